@@ -0,0 +1,94 @@
+// Command finbus-sim publishes the positions of a simulated bus fleet to an MQTT broker, in the
+// topics and HFP payloads of the Digitransit feed
+package main
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/simulator"
+	"flag"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	cfg := config.Default().Simulator
+	flag.IntVar(&cfg.Vehicles, "vehicles", cfg.Vehicles, "number of simulated vehicles, required")
+	flag.StringVar(&cfg.RoutesFile, "routes", cfg.RoutesFile, "YAML route polylines or GTFS shapes.txt, a built in route if empty")
+	flag.DurationVar(&cfg.Interval, "interval", cfg.Interval, "interval between position reports of every vehicle")
+	flag.Float64Var(&cfg.Speed, "speed", cfg.Speed, "average vehicle speed in km/h")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed of the simulation")
+	broker := flag.String("broker", "tcp://localhost:1883", "MQTT broker URL")
+	clientID := flag.String("client-id", "finbus-sim", "MQTT client ID")
+	username := flag.String("username", "", "MQTT username")
+	password := flag.String("password", "", "MQTT password")
+	qos := flag.Int("qos", 0, "MQTT publish quality of service: 0, 1 or 2")
+	duration := flag.Duration("duration", 0, "how long to simulate, until interrupted if 0")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if *qos < 0 || *qos > 2 {
+		fatal(logger, "Invalid flags", fmt.Errorf("qos %d must be 0, 1 or 2", *qos))
+	}
+	if cfg.Vehicles <= 0 {
+		fatal(logger, "Invalid flags", fmt.Errorf("-vehicles must be positive"))
+	}
+
+	routes := simulator.DefaultRoutes()
+	if cfg.RoutesFile != "" {
+		var err error
+		if routes, err = simulator.LoadRoutes(cfg.RoutesFile); err != nil {
+			fatal(logger, "Error loading routes", err)
+		}
+	}
+	sim, err := simulator.New(cfg, routes, time.Now())
+	if err != nil {
+		fatal(logger, "Error creating simulator", err)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*broker).
+		SetClientID(*clientID).
+		SetUsername(*username).
+		SetPassword(*password).
+		SetAutoReconnect(true)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		fatal(logger, "Error connecting to MQTT broker", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	logger.Info("Simulating vehicles", "vehicles", cfg.Vehicles, "routes", len(routes), "broker", *broker)
+	published := 0
+	sim.Run(ctx, cfg.Interval, func(position simulator.Position) {
+		payload, err := position.Payload()
+		if err != nil {
+			logger.Error("Error encoding position", "vehicle_id", position.Data.VehicleID, "error", err)
+			return
+		}
+		token := client.Publish(position.Topic(), byte(*qos), false, payload)
+		if token.Wait() && token.Error() != nil {
+			logger.Error("Error publishing position", "vehicle_id", position.Data.VehicleID, "error", token.Error())
+			return
+		}
+		published++
+	})
+	logger.Info("Simulation stopped", "published", published)
+}
+
+// fatal logs the error and exits
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
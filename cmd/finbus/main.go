@@ -1,57 +1,67 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"finbus/internal/app"
 	"finbus/internal/config"
-	"finbus/internal/database/influxdb"
-	"finbus/internal/models"
-	"finbus/internal/services"
-	"finbus/internal/transport/mqtt"
-	"finbus/internal/transport/rest"
-	"finbus/internal/transport/ws"
-	"fmt"
-	"github.com/gorilla/mux"
-	"log"
+	"finbus/internal/logging"
+	"finbus/internal/tracing"
+	"flag"
+	"log/slog"
 	"net/http"
+	"os"
+
+	// Embed the time zone database for the agency time zones of GTFS feeds, as the runtime image
+	// has none
+	_ "time/tzdata"
 )
 
 func main() {
-	// Creates a channel to receive bus data
-	dataChannel := make(chan models.BusData)
-
-	// InfluxDB client setup
-	influxdbClient, err := influxdb.NewBusDataManager()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Error connecting to InfluxDB: %v", err)
+		fatal(slog.Default(), "Error loading configuration", err)
 	}
-	defer influxdbClient.GetClient().Close()
-	fmt.Println("Connected to InfluxDB")
 
-	// Initialize the Bus Data Service
-	mqttBroker := config.GetEnv("MQTT_BROKER", "mqtts://mqtt.digitransit.fi:8883")
-
-	// Initialize MQTT client and connect to the broker
-	mqttClient, err := mqtt.NewBusDataSubscriber(mqttBroker, dataChannel)
-	busDataService := services.NewBusDataService(influxdbClient, dataChannel, mqttClient)
-	busHandler := rest.NewBusHandler(busDataService)
-
-	webSocketHandler := ws.NewWebSocketHandler(busDataService)
+	logger, err := logging.New(cfg.Log, os.Stderr)
+	if err != nil {
+		fatal(slog.Default(), "Error creating logger", err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("Loaded configuration", "config", cfg.String())
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Error creating MQTT client: %v", err)
+		fatal(logger, "Error setting up tracing", err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("Error shutting down tracing", "error", err)
+		}
+	}()
 
-	// Setup HTTP server and routes, passing the bus data service to the REST handler
-	router := mux.NewRouter()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = fmt.Fprintf(w, "Successfully started finbus service\n")
-	})
+	finbus, err := app.New(cfg, app.Options{}, logger)
+	if err != nil {
+		fatal(logger, "Error creating finbus service", err)
+	}
+	defer finbus.Close()
 
-	router.HandleFunc("/api/get-busses", busHandler.HandleQueryBusesNear).Methods("GET")
-	router.HandleFunc("/api/stops/get-busses/", busHandler.HandleGetBusesFromStops).Methods("POST")
-	router.HandleFunc("/ws/bus-updates", webSocketHandler.HandleBusUpdatesWS)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := finbus.Start(ctx); err != nil {
+		fatal(logger, "Error starting ingestion", err)
+	}
 
 	// Start the HTTP server
-	httpPort := config.GetEnv("HTTP_PORT", "8080")
-	log.Printf("Websocket server listening on port %s", httpPort)
-	log.Fatal(http.ListenAndServe(":"+httpPort, router))
+	logger.Info("Websocket server listening", "port", cfg.HTTP.Port)
+	fatal(logger, "HTTP server stopped", http.ListenAndServe(":"+cfg.HTTP.Port, finbus.Router))
+}
+
+// fatal logs the error and exits
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/ingest"
+	"finbus/internal/logging"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/services"
+	"finbus/internal/simulator"
+	"finbus/internal/tracing"
+	"finbus/internal/transport/gtfsrt"
+	"finbus/internal/transport/mqtt"
+	"finbus/internal/transport/rest"
+	"finbus/internal/transport/sse"
+	"finbus/internal/transport/ws"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+)
+
+// ingestQueueSize is the number of received bus updates buffered before sources block
+const ingestQueueSize = 1024
+
+// App is the finbus service: the ingestion sources feeding the bus data service, and the router
+// serving its HTTP, WebSocket and SSE APIs
+type App struct {
+	Router     *mux.Router
+	Storage    influxdb.BusDataManager
+	Subscriber mqtt.BusDataSubscriber
+	Service    services.BusDataService
+	// Schedule is the GTFS static feed enriching bus updates, nil if none is configured
+	Schedule schedule.Store
+	Alerts   services.AlertService
+	Arrivals services.ArrivalService
+
+	sources []ingest.Source
+	// segments records the segment times for the arrivals, nil without a schedule
+	segments  *services.SegmentRecorder
+	headways  services.HeadwayService
+	geofences services.GeofenceService
+	// cancel stops what Start started, nil until started
+	cancel context.CancelFunc
+}
+
+// Options replaces dependencies the app otherwise creates from the configuration
+type Options struct {
+	// Storage stores the bus data, InfluxDB if nil
+	Storage influxdb.BusDataManager
+}
+
+// New connects to the storage and the MQTT broker and builds the router. Ingestion begins once
+// the app is started.
+func New(cfg config.Config, options Options, logger *slog.Logger) (*App, error) {
+	// Creates a channel to receive bus data, buffering bursts while data is written
+	dataChannel := make(chan models.BusMessage, ingestQueueSize)
+
+	storage := options.Storage
+	if storage == nil {
+		influxdbClient, err := influxdb.NewBusDataManager(cfg.InfluxDB, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Connected to InfluxDB", "url", cfg.InfluxDB.URL)
+		storage = influxdbClient
+	}
+
+	// Initialize MQTT client and connect to the broker
+	mqttClient, err := mqtt.NewBusDataSubscriber(cfg.MQTT, dataChannel, logger)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	sources := []ingest.Source{mqttClient}
+
+	// Optionally poll a GTFS-RT feed for operators that do not publish over MQTT
+	if cfg.GTFSRT.URL != "" {
+		poller, err := gtfsrt.NewPoller(gtfsrt.PollerConfig{
+			URL:      cfg.GTFSRT.URL,
+			Interval: cfg.GTFSRT.Interval,
+			FeedID:   cfg.GTFSRT.FeedID,
+			Mode:     cfg.GTFSRT.Mode,
+			Logger:   logger,
+		}, dataChannel)
+		if err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error creating GTFS-RT poller: %v", err)
+		}
+		sources = append(sources, poller)
+	}
+
+	// Optionally replay recorded MQTT traffic, alongside the messages received from the broker
+	if cfg.Replay.File != "" {
+		replay, err := mqtt.NewReplaySource(cfg.Replay, dataChannel, logger)
+		if err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error creating replay: %v", err)
+		}
+		sources = append(sources, replay)
+	}
+
+	// Optionally simulate a fleet, for load tests and demos without the real feed
+	if cfg.Simulator.Vehicles > 0 {
+		fleet, err := simulator.NewSource(cfg.Simulator, dataChannel, logger)
+		if err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error creating simulator: %v", err)
+		}
+		sources = append(sources, fleet)
+	}
+
+	// Optionally enrich bus updates with GTFS static data and their delay by the schedule, record
+	// the travel times between stops to predict arrivals, and measure the headways along the
+	// shapes to detect bunching and gaps
+	var busDataOptions services.BusDataOptions
+	var scheduleStore schedule.Store
+	var segmentRecorder *services.SegmentRecorder
+	if cfg.GTFS.Path != "" {
+		scheduleStore, err = schedule.NewStore(cfg.GTFS, logger)
+		if err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("error loading GTFS feed: %v", err)
+		}
+	}
+	headwayService := services.NewHeadwayService(scheduleStore, storage, services.HeadwayOptions{
+		BunchingThreshold: cfg.Headway.BunchingThreshold,
+		GapThreshold:      cfg.Headway.GapThreshold,
+		Routes:            cfg.Headway.Routes,
+	}, logger)
+	// Raise the geofence events of every bus update
+	geofenceService, err := services.NewGeofenceService(storage, services.GeofenceOptions{
+		File:      cfg.Geofence.File,
+		DwellTime: cfg.Geofence.DwellTime,
+	}, logger)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("error loading geofences: %v", err)
+	}
+	// Watch the vehicles and the feed for the alert rules, delivering the alerts to the webhook
+	var notifier services.AlertNotifier
+	if cfg.Alert.Webhook.URL != "" {
+		notifier = services.NewWebhookNotifier(services.WebhookOptions{
+			URL:          cfg.Alert.Webhook.URL,
+			Secret:       string(cfg.Alert.Webhook.Secret),
+			Timeout:      cfg.Alert.Webhook.Timeout,
+			MaxAttempts:  cfg.Alert.Webhook.MaxAttempts,
+			RetryBackoff: cfg.Alert.Webhook.RetryBackoff,
+		}, logger)
+	}
+	alertService, err := services.NewAlertService(services.AlertOptions{
+		Rules:          cfg.Alert.Rules,
+		Interval:       cfg.Alert.Interval,
+		RepeatInterval: cfg.Alert.RepeatInterval,
+		Notifier:       notifier,
+		// Polled and replayed vehicles arrive without subscribed MQTT topics
+		ContinuousIngestion: cfg.GTFSRT.URL != "" || cfg.Replay.File != "",
+	}, logger)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("error creating alert rules: %v", err)
+	}
+	busDataOptions.Observers = append(busDataOptions.Observers, geofenceService, alertService)
+	if scheduleStore != nil {
+		busDataOptions.Enricher = services.NewScheduleEnricher(scheduleStore, nil)
+		segmentRecorder = services.NewSegmentRecorder(storage, logger)
+		busDataOptions.Observers = append(busDataOptions.Observers, segmentRecorder, headwayService)
+	}
+
+	busDataService := services.NewBusDataService(storage, dataChannel, mqttClient, busDataOptions, logger)
+	// Receive the vehicles of the monitored routes, in the geofences and of the routes the alert
+	// rules watch even when no client subscribes to them
+	headwayService.Watch(busDataService)
+	geofenceService.Watch(busDataService)
+	alertService.Watch(busDataService)
+	arrivalService := services.NewArrivalService(busDataService, scheduleStore, storage, services.ArrivalOptions{}, logger)
+	busHandler := rest.NewBusHandler(busDataService, logger)
+
+	webSocketHandler := ws.NewWebSocketHandler(busDataService, ws.Options{
+		PingInterval:      cfg.WebSocket.PingInterval,
+		PongWait:          cfg.WebSocket.PongWait,
+		WriteTimeout:      cfg.WebSocket.WriteTimeout,
+		IdleTimeout:       cfg.WebSocket.IdleTimeout,
+		EnableCompression: cfg.WebSocket.Compression,
+		Arrivals:          arrivalService,
+		Headways:          headwayService,
+		Geofences:         geofenceService,
+	}, logger)
+
+	streamHandler := sse.NewStreamHandler(busDataService, sse.Options{
+		HeartbeatInterval: cfg.SSE.HeartbeatInterval,
+		Headways:          headwayService,
+		Geofences:         geofenceService,
+	}, logger)
+
+	stopHandler := rest.NewStopHandler(services.NewStopService(scheduleStore), arrivalService, logger)
+	analyticsHandler := rest.NewAnalyticsHandler(services.NewDelayService(storage), logger)
+	headwayHandler := rest.NewHeadwayHandler(headwayService, logger)
+	geofenceHandler := rest.NewGeofenceHandler(geofenceService, logger)
+	alertHandler := rest.NewAlertHandler(alertService, logger)
+
+	healthService := services.NewHealthService(storage, busDataService, services.HealthOptions{
+		MaxIngestionLag:     cfg.Health.MaxIngestionLag,
+		ContinuousIngestion: cfg.GTFSRT.URL != "",
+	})
+	healthHandler := rest.NewHealthHandler(healthService, logger)
+
+	// Setup HTTP routes, passing the bus data service to the REST handler
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware, logging.Middleware(logger))
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Successfully started finbus service\n")
+	})
+
+	router.HandleFunc("/healthz", healthHandler.HandleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", healthHandler.HandleReadyz).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.HandleFunc("/api/get-busses",
+		metrics.InstrumentHandler("/api/get-busses", busHandler.HandleQueryBusesNear)).Methods("GET")
+	router.HandleFunc("/api/stops/get-busses/",
+		metrics.InstrumentHandler("/api/stops/get-busses/", busHandler.HandleGetBusesFromStops)).Methods("POST")
+	router.HandleFunc("/api/v1/stops",
+		metrics.InstrumentHandler("/api/v1/stops", stopHandler.HandleStops)).Methods("GET")
+	router.HandleFunc("/api/v1/stops/{id}/arrivals",
+		metrics.InstrumentHandler("/api/v1/stops/{id}/arrivals", stopHandler.HandleArrivals)).Methods("GET")
+	router.HandleFunc("/api/v1/analytics/delays/{by}",
+		metrics.InstrumentHandler("/api/v1/analytics/delays/{by}", analyticsHandler.HandleDelays)).Methods("GET")
+	router.HandleFunc("/api/v1/routes/{id}/headways",
+		metrics.InstrumentHandler("/api/v1/routes/{id}/headways", headwayHandler.HandleHeadways)).Methods("GET")
+	router.HandleFunc("/api/v1/headways/events",
+		metrics.InstrumentHandler("/api/v1/headways/events", headwayHandler.HandleEvents)).Methods("GET")
+	router.HandleFunc("/api/v1/geofences",
+		metrics.InstrumentHandler("/api/v1/geofences", geofenceHandler.HandleList)).Methods("GET")
+	router.HandleFunc("/api/v1/geofences",
+		metrics.InstrumentHandler("/api/v1/geofences", geofenceHandler.HandleCreate)).Methods("POST")
+	// The events route is registered first so it is not taken for a geofence ID
+	router.HandleFunc("/api/v1/geofences/events",
+		metrics.InstrumentHandler("/api/v1/geofences/events", geofenceHandler.HandleEvents)).Methods("GET")
+	router.HandleFunc("/api/v1/geofences/{id}",
+		metrics.InstrumentHandler("/api/v1/geofences/{id}", geofenceHandler.HandleGet)).Methods("GET")
+	router.HandleFunc("/api/v1/geofences/{id}",
+		metrics.InstrumentHandler("/api/v1/geofences/{id}", geofenceHandler.HandleUpdate)).Methods("PUT")
+	router.HandleFunc("/api/v1/geofences/{id}",
+		metrics.InstrumentHandler("/api/v1/geofences/{id}", geofenceHandler.HandleDelete)).Methods("DELETE")
+	router.HandleFunc("/api/v1/alerts",
+		metrics.InstrumentHandler("/api/v1/alerts", alertHandler.HandleAlerts)).Methods("GET")
+	router.HandleFunc("/ws/bus-updates", webSocketHandler.HandleBusUpdatesWS)
+	router.HandleFunc("/api/v1/stream", streamHandler.HandleStream).Methods("GET")
+
+	return &App{
+		Router:     router,
+		Storage:    storage,
+		Subscriber: mqttClient,
+		Service:    busDataService,
+		Schedule:   scheduleStore,
+		Alerts:     alertService,
+		Arrivals:   arrivalService,
+		sources:    sources,
+		segments:   segmentRecorder,
+		headways:   headwayService,
+		geofences:  geofenceService,
+	}, nil
+}
+
+// Start starts ingesting from every source, refreshing the GTFS feed, evaluating the alert rules,
+// storing the segment times, headway and geofence events and expiring the stops watched for
+// arrivals, until ctx is cancelled or the app is closed
+func (a *App) Start(ctx context.Context) error {
+	ctx, a.cancel = context.WithCancel(ctx)
+	a.Alerts.Start(ctx)
+	a.Arrivals.Start(ctx)
+	a.headways.Start(ctx)
+	a.geofences.Start(ctx)
+	if a.segments != nil {
+		a.segments.Start(ctx)
+	}
+	if a.Schedule != nil {
+		if err := a.Schedule.Start(ctx); err != nil {
+			return fmt.Errorf("error starting GTFS refresh: %v", err)
+		}
+	}
+	return ingest.StartAll(ctx, a.sources...)
+}
+
+// Close stops the sources and everything else Start started, stops processing bus updates,
+// closing every live subscriber, and closes the storage
+func (a *App) Close() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.Service.Close()
+	a.Storage.Close()
+}
@@ -0,0 +1,715 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete finbus configuration. It is loaded by Load from defaults, an optional
+// YAML file, environment variables and command line flags, in increasing order of precedence.
+type Config struct {
+	HTTP      HTTPConfig      `yaml:"http"`
+	InfluxDB  InfluxDBConfig  `yaml:"influxdb"`
+	MQTT      MQTTConfig      `yaml:"mqtt"`
+	GTFSRT    GTFSRTConfig    `yaml:"gtfsrt"`
+	GTFS      GTFSConfig      `yaml:"gtfs"`
+	Headway   HeadwayConfig   `yaml:"headway"`
+	Geofence  GeofenceConfig  `yaml:"geofence"`
+	Alert     AlertConfig     `yaml:"alert"`
+	Replay    ReplayConfig    `yaml:"replay"`
+	Simulator SimulatorConfig `yaml:"simulator"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	SSE       SSEConfig       `yaml:"sse"`
+	Health    HealthConfig    `yaml:"health"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+type HTTPConfig struct {
+	Port string `yaml:"port"`
+}
+
+type InfluxDBConfig struct {
+	URL    string `yaml:"url"`
+	Token  Secret `yaml:"token"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+}
+
+type MQTTConfig struct {
+	Broker string `yaml:"broker"`
+	// ClientID identifies the client to the broker, a unique ID is generated if empty
+	ClientID string `yaml:"client_id"`
+	// CleanSession discards the session on disconnect. Persistent sessions need a fixed ClientID.
+	CleanSession bool `yaml:"clean_session"`
+	// QoS is the quality of service of subscriptions, 0, 1 or 2
+	QoS int `yaml:"qos"`
+	// Username and Password authenticate the client. The files, if set, are read on every connect
+	// instead, so rotated credentials are picked up on reconnect.
+	Username     string        `yaml:"username"`
+	UsernameFile string        `yaml:"username_file"`
+	Password     Secret        `yaml:"password"`
+	PasswordFile string        `yaml:"password_file"`
+	TLS          MQTTTLSConfig `yaml:"tls"`
+	// RecordFile, if set, is a recording every received message is appended to, gzip compressed
+	RecordFile string `yaml:"record_file"`
+}
+
+// MQTTTLSConfig configures TLS for brokers with an ssl, tls or mqtts URL
+type MQTTTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted to sign the broker certificate in addition to the
+	// system roots
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile hold the PEM client certificate and key for mutual TLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName overrides the host name verified in the broker certificate
+	ServerName string `yaml:"server_name"`
+	// MinVersion is the lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"min_version"`
+}
+
+// GTFSRTConfig configures the optional GTFS-Realtime poller, which is disabled without a URL
+type GTFSRTConfig struct {
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+	FeedID   string        `yaml:"feed_id"`
+	Mode     string        `yaml:"mode"`
+}
+
+// GTFSConfig configures the GTFS static import, which is disabled without a path
+type GTFSConfig struct {
+	// Path is a GTFS zip file or a directory of GTFS text files
+	Path string `yaml:"path"`
+	// RefreshInterval is how often the feed is reloaded if it was modified, never if 0
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// HeadwayConfig configures the detection of bunched vehicles and gaps between them on the routes of
+// the GTFS feed. A threshold of 0 disables its detection.
+type HeadwayConfig struct {
+	// BunchingThreshold is the headway below which a vehicle is bunched with the vehicle ahead
+	BunchingThreshold time.Duration `yaml:"bunching_threshold"`
+	// GapThreshold is the headway above which there is a gap in front of a vehicle
+	GapThreshold time.Duration `yaml:"gap_threshold"`
+	// Routes are the routes whose vehicles are received for their headways even when no client
+	// subscribes to them
+	Routes []string `yaml:"routes"`
+}
+
+// GeofenceConfig configures the geofences and their events
+type GeofenceConfig struct {
+	// File persists the geofences as a GeoJSON feature collection, kept only in memory if empty
+	File string `yaml:"file"`
+	// DwellTime is how long a vehicle stays in a geofence before a dwell event, never if 0
+	DwellTime time.Duration `yaml:"dwell_time"`
+}
+
+// AlertConfig configures the alert rules and the webhook their alerts are delivered to. Nothing
+// is evaluated without rules.
+type AlertConfig struct {
+	// Interval is how often the rules are evaluated
+	Interval time.Duration `yaml:"interval"`
+	// RepeatInterval is how often an alert still firing is delivered again, never if 0
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	Webhook        WebhookConfig `yaml:"webhook"`
+	// Rules can only be set in the YAML file
+	Rules []AlertRule `yaml:"rules"`
+}
+
+// WebhookConfig configures the delivery of alerts, which are only logged without a URL
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the deliveries with HMAC-SHA256, unsigned if empty
+	Secret  Secret        `yaml:"secret"`
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxAttempts bounds the attempts to deliver an alert, retried with exponential backoff
+	// starting at RetryBackoff
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// Alert rule types
+const (
+	// AlertVehicleStationary fires when a vehicle has not moved for the rule's duration
+	AlertVehicleStationary = "vehicle_stationary"
+	// AlertRouteWithoutVehicles fires when none of a route's vehicles has been seen for the
+	// rule's duration during its service hours
+	AlertRouteWithoutVehicles = "route_without_vehicles"
+	// AlertFeedSilent fires when no bus updates have been received for the rule's duration
+	AlertFeedSilent = "feed_silent"
+)
+
+// AlertRule is a condition raising an alert once it has held for a duration
+type AlertRule struct {
+	Name string `yaml:"name"`
+	// Type is vehicle_stationary, route_without_vehicles or feed_silent
+	Type string `yaml:"type"`
+	// For is how long the condition holds before the alert fires
+	For time.Duration `yaml:"for"`
+	// Routes are the routes watched by route_without_vehicles, and limit vehicle_stationary to
+	// vehicles on them, every route if empty
+	Routes []string `yaml:"routes"`
+	// ServiceHours limits route_without_vehicles to a daily window such as 05:00-01:30, all day
+	// if empty
+	ServiceHours string `yaml:"service_hours"`
+	// Timezone is the IANA time zone of the service hours, UTC if empty
+	Timezone string `yaml:"timezone"`
+	// Radius is the distance in meters a vehicle moves within while stationary, 50 if 0
+	Radius float64 `yaml:"radius"`
+}
+
+// ReplayConfig configures the optional replay of a recording, which is disabled without a file
+type ReplayConfig struct {
+	File string `yaml:"file"`
+	// Speed is how many times faster than recorded messages are replayed, 0 replays them as fast
+	// as possible
+	Speed float64 `yaml:"speed"`
+	// Loop starts the replay over at the end of the recording
+	Loop bool `yaml:"loop"`
+}
+
+// SimulatorConfig configures the synthetic fleet, which is disabled without vehicles
+type SimulatorConfig struct {
+	Vehicles int `yaml:"vehicles"`
+	// RoutesFile is a YAML file of route polylines or a GTFS shapes.txt, a built in route if empty
+	RoutesFile string `yaml:"routes_file"`
+	// Interval is how often every vehicle reports its position
+	Interval time.Duration `yaml:"interval"`
+	// Speed is the average vehicle speed in km/h
+	Speed float64 `yaml:"speed"`
+	// Seed makes the simulation repeatable
+	Seed int64 `yaml:"seed"`
+}
+
+type WebSocketConfig struct {
+	PingInterval time.Duration `yaml:"ping_interval"`
+	PongWait     time.Duration `yaml:"pong_wait"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	Compression  bool          `yaml:"compression"`
+}
+
+type SSEConfig struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+}
+
+type HealthConfig struct {
+	MaxIngestionLag time.Duration `yaml:"max_ingestion_lag"`
+}
+
+// LogConfig configures the structured logger
+type LogConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+	// SampleEvery logs only one in every SampleEvery debug records with the same message
+	SampleEvery int `yaml:"sample_every"`
+}
+
+// TracingConfig configures OpenTelemetry tracing, which is disabled with the none exporter
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `yaml:"exporter"`
+	// File is where the stdout exporter writes spans, standard output if empty
+	File string `yaml:"file"`
+	// OTLPEndpoint is the URL of the OTLP/HTTP collector used by the otlp exporter
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	// SampleRatio is the fraction of new traces that are sampled
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Secret is a configuration value that is redacted when printed
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+// Default returns the configuration used for settings that are not configured
+func Default() Config {
+	return Config{
+		HTTP: HTTPConfig{Port: "8080"},
+		InfluxDB: InfluxDBConfig{
+			URL:    "http://influxdb:8086",
+			Org:    "abax",
+			Bucket: "finbus",
+		},
+		MQTT: MQTTConfig{
+			Broker:       "mqtts://mqtt.digitransit.fi:8883",
+			CleanSession: true,
+		},
+		GTFSRT: GTFSRTConfig{
+			Interval: 15 * time.Second,
+			FeedID:   "gtfsrt",
+			Mode:     "bus",
+		},
+		GTFS:     GTFSConfig{RefreshInterval: time.Hour},
+		Headway:  HeadwayConfig{BunchingThreshold: 2 * time.Minute, GapThreshold: 20 * time.Minute},
+		Geofence: GeofenceConfig{DwellTime: 5 * time.Minute},
+		Alert: AlertConfig{
+			Interval: 30 * time.Second,
+			Webhook:  WebhookConfig{Timeout: 10 * time.Second, MaxAttempts: 5, RetryBackoff: time.Second},
+		},
+		Replay: ReplayConfig{Speed: 1},
+		Simulator: SimulatorConfig{
+			Interval: time.Second,
+			Speed:    25,
+			Seed:     1,
+		},
+		WebSocket: WebSocketConfig{
+			PingInterval: 30 * time.Second,
+			PongWait:     60 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  5 * time.Minute,
+		},
+		SSE:    SSEConfig{HeartbeatInterval: 15 * time.Second},
+		Health: HealthConfig{MaxIngestionLag: 2 * time.Minute},
+		Log:    LogConfig{Level: "info", Format: "text", SampleEvery: 100},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "http://localhost:4318",
+			SampleRatio:  1,
+		},
+	}
+}
+
+// setting maps a configuration field to its environment variable and command line flag
+type setting struct {
+	name  string
+	env   string
+	usage string
+	value interface{}
+}
+
+// settings lists every setting of the configuration with a pointer to its field
+func (c *Config) settings() []setting {
+	return []setting{
+		{"http.port", "HTTP_PORT", "HTTP listen port", &c.HTTP.Port},
+		{"influxdb.url", "INFLUXDB_URL", "InfluxDB URL", &c.InfluxDB.URL},
+		{"influxdb.token", "INFLUXDB_TOKEN", "InfluxDB API token", &c.InfluxDB.Token},
+		{"influxdb.org", "INFLUXDB_ORG", "InfluxDB organization", &c.InfluxDB.Org},
+		{"influxdb.bucket", "INFLUXDB_BUCKET", "InfluxDB bucket", &c.InfluxDB.Bucket},
+		{"mqtt.broker", "MQTT_BROKER", "MQTT broker URL", &c.MQTT.Broker},
+		{"mqtt.client-id", "MQTT_CLIENT_ID", "MQTT client ID, generated if empty", &c.MQTT.ClientID},
+		{"mqtt.clean-session", "MQTT_CLEAN_SESSION", "discard the MQTT session on disconnect", &c.MQTT.CleanSession},
+		{"mqtt.qos", "MQTT_QOS", "MQTT subscription quality of service: 0, 1 or 2", &c.MQTT.QoS},
+		{"mqtt.username", "MQTT_USERNAME", "MQTT username", &c.MQTT.Username},
+		{"mqtt.username-file", "MQTT_USERNAME_FILE", "file containing the MQTT username", &c.MQTT.UsernameFile},
+		{"mqtt.password", "MQTT_PASSWORD", "MQTT password", &c.MQTT.Password},
+		{"mqtt.password-file", "MQTT_PASSWORD_FILE", "file containing the MQTT password", &c.MQTT.PasswordFile},
+		{"mqtt.tls.ca-file", "MQTT_TLS_CA_FILE", "PEM bundle of CAs trusted for the MQTT broker", &c.MQTT.TLS.CAFile},
+		{"mqtt.tls.cert-file", "MQTT_TLS_CERT_FILE", "PEM client certificate for the MQTT broker", &c.MQTT.TLS.CertFile},
+		{"mqtt.tls.key-file", "MQTT_TLS_KEY_FILE", "PEM client key for the MQTT broker", &c.MQTT.TLS.KeyFile},
+		{"mqtt.tls.server-name", "MQTT_TLS_SERVER_NAME", "host name verified in the MQTT broker certificate", &c.MQTT.TLS.ServerName},
+		{"mqtt.tls.min-version", "MQTT_TLS_MIN_VERSION", "lowest accepted TLS version for MQTT: 1.0, 1.1, 1.2 or 1.3", &c.MQTT.TLS.MinVersion},
+		{"mqtt.record-file", "MQTT_RECORD_FILE", "file received MQTT messages are recorded to, not recorded if empty", &c.MQTT.RecordFile},
+		{"gtfsrt.url", "GTFSRT_URL", "GTFS-RT feed URL, polling is disabled if empty", &c.GTFSRT.URL},
+		{"gtfsrt.interval", "GTFSRT_INTERVAL", "GTFS-RT polling interval", &c.GTFSRT.Interval},
+		{"gtfsrt.feed-id", "GTFSRT_FEED_ID", "feed ID given to GTFS-RT vehicles", &c.GTFSRT.FeedID},
+		{"gtfsrt.mode", "GTFSRT_MODE", "transport mode given to GTFS-RT vehicles", &c.GTFSRT.Mode},
+		{"gtfs.path", "GTFS_PATH", "GTFS static zip file or directory, no GTFS data if empty", &c.GTFS.Path},
+		{"gtfs.refresh-interval", "GTFS_REFRESH_INTERVAL", "how often the GTFS feed is reloaded if modified, never if 0", &c.GTFS.RefreshInterval},
+		{"headway.bunching-threshold", "HEADWAY_BUNCHING_THRESHOLD", "headway below which vehicles are bunched, disabled if 0", &c.Headway.BunchingThreshold},
+		{"headway.gap-threshold", "HEADWAY_GAP_THRESHOLD", "headway above which there is a gap between vehicles, disabled if 0", &c.Headway.GapThreshold},
+		{"headway.routes", "HEADWAY_ROUTES", "comma-separated routes measured even without subscribed clients", &c.Headway.Routes},
+		{"geofence.file", "GEOFENCE_FILE", "GeoJSON file persisting the geofences, in memory only if empty", &c.Geofence.File},
+		{"geofence.dwell-time", "GEOFENCE_DWELL_TIME", "time in a geofence before a dwell event, never if 0", &c.Geofence.DwellTime},
+		{"alert.interval", "ALERT_INTERVAL", "how often the alert rules are evaluated", &c.Alert.Interval},
+		{"alert.repeat-interval", "ALERT_REPEAT_INTERVAL", "how often a firing alert is delivered again, never if 0", &c.Alert.RepeatInterval},
+		{"alert.webhook.url", "ALERT_WEBHOOK_URL", "URL alerts are posted to, only logged if empty", &c.Alert.Webhook.URL},
+		{"alert.webhook.secret", "ALERT_WEBHOOK_SECRET", "secret signing alert webhooks, unsigned if empty", &c.Alert.Webhook.Secret},
+		{"alert.webhook.timeout", "ALERT_WEBHOOK_TIMEOUT", "timeout of an alert webhook request", &c.Alert.Webhook.Timeout},
+		{"alert.webhook.max-attempts", "ALERT_WEBHOOK_MAX_ATTEMPTS", "attempts to deliver an alert webhook", &c.Alert.Webhook.MaxAttempts},
+		{"alert.webhook.retry-backoff", "ALERT_WEBHOOK_RETRY_BACKOFF", "delay before the first alert webhook retry, doubled on each retry", &c.Alert.Webhook.RetryBackoff},
+		{"replay.file", "REPLAY_FILE", "recording to replay, no replay if empty", &c.Replay.File},
+		{"replay.speed", "REPLAY_SPEED", "replay speed relative to the recording, 0 for as fast as possible", &c.Replay.Speed},
+		{"replay.loop", "REPLAY_LOOP", "start the replay over at the end of the recording", &c.Replay.Loop},
+		{"simulator.vehicles", "SIM_VEHICLES", "number of simulated vehicles, no simulation if 0", &c.Simulator.Vehicles},
+		{"simulator.routes-file", "SIM_ROUTES_FILE", "YAML route polylines or GTFS shapes.txt driven by simulated vehicles", &c.Simulator.RoutesFile},
+		{"simulator.interval", "SIM_INTERVAL", "interval between simulated position reports", &c.Simulator.Interval},
+		{"simulator.speed", "SIM_SPEED", "average simulated vehicle speed in km/h", &c.Simulator.Speed},
+		{"simulator.seed", "SIM_SEED", "random seed of the simulation", &c.Simulator.Seed},
+		{"websocket.ping-interval", "WS_PING_INTERVAL", "WebSocket ping interval", &c.WebSocket.PingInterval},
+		{"websocket.pong-wait", "WS_PONG_WAIT", "WebSocket dead connection timeout", &c.WebSocket.PongWait},
+		{"websocket.write-timeout", "WS_WRITE_TIMEOUT", "WebSocket write timeout", &c.WebSocket.WriteTimeout},
+		{"websocket.idle-timeout", "WS_IDLE_TIMEOUT", "timeout for WebSocket sessions without subscriptions", &c.WebSocket.IdleTimeout},
+		{"websocket.compression", "WS_COMPRESSION", "enable WebSocket permessage-deflate", &c.WebSocket.Compression},
+		{"sse.heartbeat-interval", "SSE_HEARTBEAT_INTERVAL", "SSE heartbeat interval", &c.SSE.HeartbeatInterval},
+		{"health.max-ingestion-lag", "HEALTH_MAX_INGESTION_LAG", "longest time without bus updates before not ready", &c.Health.MaxIngestionLag},
+		{"log.level", "LOG_LEVEL", "minimum log level: debug, info, warn or error", &c.Log.Level},
+		{"log.format", "LOG_FORMAT", "log format: text or json", &c.Log.Format},
+		{"log.sample-every", "LOG_SAMPLE_EVERY", "log one in every n debug records with the same message", &c.Log.SampleEvery},
+		{"tracing.exporter", "TRACING_EXPORTER", "trace exporter: none, stdout or otlp", &c.Tracing.Exporter},
+		{"tracing.file", "TRACING_FILE", "file the stdout trace exporter writes to, standard output if empty", &c.Tracing.File},
+		{"tracing.otlp-endpoint", "TRACING_OTLP_ENDPOINT", "OTLP/HTTP collector URL", &c.Tracing.OTLPEndpoint},
+		{"tracing.sample-ratio", "TRACING_SAMPLE_RATIO", "fraction of traces sampled", &c.Tracing.SampleRatio},
+	}
+}
+
+// Load builds the configuration from defaults, the YAML file given by the -config flag or the
+// FINBUS_CONFIG environment variable, environment variables and command line flags, with later
+// sources taking precedence. The result is validated, and all problems are reported at once.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+
+	flags := flag.NewFlagSet("finbus", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("FINBUS_CONFIG"), "path to a YAML configuration file")
+	flagValues := make(map[string]string)
+	for _, s := range cfg.settings() {
+		name := strings.ReplaceAll(s.name, ".", "-")
+		flags.Func(name, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config file: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing config file %s: %v", *configFile, err)
+		}
+	}
+
+	var problems []string
+	for _, s := range cfg.settings() {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := setValue(s.value, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", s.env, err))
+			}
+		}
+	}
+	for _, s := range cfg.settings() {
+		name := strings.ReplaceAll(s.name, ".", "-")
+		if value, ok := flagValues[name]; ok {
+			if err := setValue(s.value, value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", name, err))
+			}
+		}
+	}
+
+	problems = append(problems, cfg.Validate()...)
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// setValue parses a string into the configuration field pointed to by target
+func setValue(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *Secret:
+		*target = Secret(value)
+	case *time.Duration:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*target = duration
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*target = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*target = n
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*target = f
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*target = b
+	case *[]string:
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", target)
+	}
+	return nil
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate returns the problems with the configuration, if any
+func (c Config) Validate() []string {
+	var problems []string
+	port, err := strconv.Atoi(c.HTTP.Port)
+	if err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("http.port: %q is not a valid port", c.HTTP.Port))
+	}
+
+	problems = append(problems, validateURL("influxdb.url", c.InfluxDB.URL, "http", "https")...)
+	if c.InfluxDB.Token == "" {
+		problems = append(problems, "influxdb.token: is required")
+	}
+	if c.InfluxDB.Org == "" {
+		problems = append(problems, "influxdb.org: is required")
+	}
+	if c.InfluxDB.Bucket == "" {
+		problems = append(problems, "influxdb.bucket: is required")
+	}
+
+	problems = append(problems, validateURL("mqtt.broker", c.MQTT.Broker, "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss")...)
+	if !c.MQTT.CleanSession && c.MQTT.ClientID == "" {
+		problems = append(problems, "mqtt.client_id: is required for persistent sessions")
+	}
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+		problems = append(problems, fmt.Sprintf("mqtt.qos: %d must be 0, 1 or 2", c.MQTT.QoS))
+	}
+	if c.MQTT.Username != "" && c.MQTT.UsernameFile != "" {
+		problems = append(problems, "mqtt.username_file: cannot be combined with mqtt.username")
+	}
+	if c.MQTT.Password != "" && c.MQTT.PasswordFile != "" {
+		problems = append(problems, "mqtt.password_file: cannot be combined with mqtt.password")
+	}
+	if (c.MQTT.TLS.CertFile == "") != (c.MQTT.TLS.KeyFile == "") {
+		problems = append(problems, "mqtt.tls: cert_file and key_file must be set together")
+	}
+	switch c.MQTT.TLS.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		problems = append(problems, fmt.Sprintf("mqtt.tls.min_version: %q must be one of 1.0, 1.1, 1.2, 1.3", c.MQTT.TLS.MinVersion))
+	}
+
+	if c.GTFSRT.URL != "" {
+		problems = append(problems, validateURL("gtfsrt.url", c.GTFSRT.URL, "http", "https")...)
+		if c.GTFSRT.Interval <= 0 {
+			problems = append(problems, "gtfsrt.interval: must be positive")
+		}
+	}
+
+	if c.GTFS.RefreshInterval < 0 {
+		problems = append(problems, "gtfs.refresh_interval: must not be negative")
+	}
+	if c.Headway.BunchingThreshold < 0 {
+		problems = append(problems, "headway.bunching_threshold: must not be negative")
+	}
+	if c.Headway.GapThreshold < 0 {
+		problems = append(problems, "headway.gap_threshold: must not be negative")
+	}
+	if c.Headway.BunchingThreshold > 0 && c.Headway.GapThreshold > 0 && c.Headway.GapThreshold <= c.Headway.BunchingThreshold {
+		problems = append(problems, "headway.gap_threshold: must be above headway.bunching_threshold")
+	}
+	if c.Geofence.DwellTime < 0 {
+		problems = append(problems, "geofence.dwell_time: must not be negative")
+	}
+	problems = append(problems, c.Alert.validate()...)
+	if c.Replay.Speed < 0 {
+		problems = append(problems, "replay.speed: must not be negative")
+	}
+
+	if c.Simulator.Vehicles < 0 {
+		problems = append(problems, "simulator.vehicles: must not be negative")
+	}
+	if c.Simulator.Vehicles > 0 {
+		if c.Simulator.Interval <= 0 {
+			problems = append(problems, "simulator.interval: must be positive")
+		}
+		if c.Simulator.Speed <= 0 {
+			problems = append(problems, "simulator.speed: must be positive")
+		}
+	}
+
+	if c.WebSocket.PingInterval <= 0 {
+		problems = append(problems, "websocket.ping_interval: must be positive")
+	}
+	if c.WebSocket.PongWait <= c.WebSocket.PingInterval {
+		problems = append(problems, "websocket.pong_wait: must be longer than websocket.ping_interval")
+	}
+	if c.WebSocket.WriteTimeout <= 0 {
+		problems = append(problems, "websocket.write_timeout: must be positive")
+	}
+	if c.WebSocket.IdleTimeout < 0 {
+		problems = append(problems, "websocket.idle_timeout: must not be negative")
+	}
+	if c.SSE.HeartbeatInterval <= 0 {
+		problems = append(problems, "sse.heartbeat_interval: must be positive")
+	}
+	if c.Health.MaxIngestionLag < 0 {
+		problems = append(problems, "health.max_ingestion_lag: must not be negative")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log.level: %q must be one of debug, info, warn, error", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Sprintf("log.format: %q must be text or json", c.Log.Format))
+	}
+	if c.Log.SampleEvery < 1 {
+		problems = append(problems, "log.sample_every: must be at least 1")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		problems = append(problems, validateURL("tracing.otlp_endpoint", c.Tracing.OTLPEndpoint, "http", "https")...)
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter: %q must be one of none, stdout, otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio: must be between 0 and 1")
+	}
+	return problems
+}
+
+// validate returns the problems with the alert configuration and its rules
+func (c AlertConfig) validate() []string {
+	var problems []string
+	if c.Interval <= 0 {
+		problems = append(problems, "alert.interval: must be positive")
+	}
+	if c.RepeatInterval < 0 {
+		problems = append(problems, "alert.repeat_interval: must not be negative")
+	}
+	if c.Webhook.URL != "" {
+		problems = append(problems, validateURL("alert.webhook.url", c.Webhook.URL, "http", "https")...)
+	}
+	if c.Webhook.Timeout <= 0 {
+		problems = append(problems, "alert.webhook.timeout: must be positive")
+	}
+	if c.Webhook.MaxAttempts < 1 {
+		problems = append(problems, "alert.webhook.max_attempts: must be at least 1")
+	}
+	if c.Webhook.RetryBackoff < 0 {
+		problems = append(problems, "alert.webhook.retry_backoff: must not be negative")
+	}
+
+	names := make(map[string]bool, len(c.Rules))
+	for i, rule := range c.Rules {
+		name := fmt.Sprintf("alert.rules[%d]", i)
+		switch {
+		case rule.Name == "":
+			problems = append(problems, name+".name: is required")
+		case names[rule.Name]:
+			problems = append(problems, fmt.Sprintf("%s.name: %q is used by another rule", name, rule.Name))
+		}
+		names[rule.Name] = true
+		switch rule.Type {
+		case AlertVehicleStationary, AlertFeedSilent:
+		case AlertRouteWithoutVehicles:
+			if len(rule.Routes) == 0 {
+				problems = append(problems, name+".routes: is required for route_without_vehicles")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s.type: %q must be one of %s, %s, %s", name, rule.Type,
+				AlertVehicleStationary, AlertRouteWithoutVehicles, AlertFeedSilent))
+		}
+		if rule.For < 0 {
+			problems = append(problems, name+".for: must not be negative")
+		}
+		if rule.Radius < 0 {
+			problems = append(problems, name+".radius: must not be negative")
+		}
+		if rule.ServiceHours != "" {
+			if _, _, err := ParseServiceHours(rule.ServiceHours); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.service_hours: %v", name, err))
+			}
+		}
+		if _, err := time.LoadLocation(rule.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.timezone: %q is not a known time zone", name, rule.Timezone))
+		}
+	}
+	return problems
+}
+
+// ParseServiceHours parses a daily window such as 05:00-01:30 into the minutes after midnight it
+// starts and ends at. A window ending before it starts continues past midnight.
+func ParseServiceHours(value string) (start, end int, err error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q must be a window such as 05:00-23:30", value)
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("%q must not start and end at the same time", value)
+	}
+	return start, end, nil
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 05:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateURL(name, value string, schemes ...string) []string {
+	if value == "" {
+		return []string{name + ": is required"}
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return []string{fmt.Sprintf("%s: %q is not a valid URL", name, value)}
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s: scheme must be one of %s", name, strings.Join(schemes, ", "))}
+}
+
+// String returns the configuration as YAML with secrets redacted, for logging
+func (c Config) String() string {
+	redacted := c
+	redacted.InfluxDB.Token = Secret(c.InfluxDB.Token.String())
+	redacted.MQTT.Password = Secret(c.MQTT.Password.String())
+	redacted.Alert.Webhook.Secret = Secret(c.Alert.Webhook.Secret.String())
+	data, err := yaml.Marshal(redacted)
+	if err != nil {
+		return fmt.Sprintf("%+v", redacted)
+	}
+	return string(data)
+}
@@ -1,10 +1,9 @@
 package config
 
 import (
-	"fmt"
-	"log"
+	"finbus/internal/geo"
+	"log/slog"
 	"os"
-	"strconv"
 	"strings"
 )
 
@@ -13,24 +12,23 @@ func GetEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
 	}
-	log.Printf("Environment variable %s not set. Using fallback value %s\n", key, fallback)
+	slog.Debug("Environment variable not set, using fallback value", "key", key, "fallback", fallback)
 	return fallback
 }
 
 // GetGeohash Converts a latitude and longitude to a custom geohash format.
 func GetGeohash(lat, lon float64) (string, error) {
-
-	latInt, _ := splitFloat(lat)
-	lonInt, _ := splitFloat(lon)
-
-	geohashHead := fmt.Sprintf("%d;%d", latInt, lonInt)
-
-	return fmt.Sprintf("/gtfsrt/vp/+/+/+/+/+/+/+/+/+/+/+/%s/+/+/+/+/#", geohashHead), nil
+	return BuildTopic("", "", "", geo.GeohashHead(lat, lon)), nil
 }
 
-// Splits a float into its integer and fractional parts as strings.
-func splitFloat(num float64) (int, string) {
-	parts := strings.Split(fmt.Sprintf("%.6f", num), ".") // Ensure 6 decimal places
-	intPart, _ := strconv.Atoi(parts[0])
-	return intPart, parts[1]
+// BuildTopic builds a vehicle position topic filter matching the given route, next stop, vehicle
+// and geohash head. Empty values match any value on their topic level.
+func BuildTopic(routeID, nextStop, vehicleID, geohashHead string) string {
+	levels := []string{"", "gtfsrt", "vp", "+", "+", "+", "+", routeID, "+", "+", "+", nextStop, "+", vehicleID, geohashHead}
+	for i := 3; i < len(levels); i++ {
+		if levels[i] == "" {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/") + "/+/+/+/+/#"
 }
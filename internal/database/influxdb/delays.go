@@ -0,0 +1,113 @@
+package influxdb
+
+import (
+	"context"
+	"finbus/internal/models"
+	"finbus/internal/tracing"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// delayGroupColumns are the columns the delays are grouped by for each grouping
+var delayGroupColumns = map[models.DelayGrouping][]string{
+	models.DelayByRoute:     {"route_id"},
+	models.DelayByDirection: {"route_id", "direction_id"},
+	models.DelayByStop:      {"next_stop"},
+}
+
+// QueryDelayStats returns the distribution of the delays reported within the query range, per
+// route, direction or next stop. The direction is a field, so it is pivoted into a column along
+// with the delay before grouping.
+func (c *busDataManager) QueryDelayStats(ctx context.Context, delayQuery models.DelayQuery) (_ []models.DelayStats, err error) {
+	columns, ok := delayGroupColumns[delayQuery.GroupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown delay grouping %q", delayQuery.GroupBy)
+	}
+	fields := `r._field == "delay"`
+	if delayQuery.GroupBy == models.DelayByDirection {
+		fields = `(r._field == "delay" or r._field == "direction_id")`
+	}
+	route := ""
+	if delayQuery.RouteID != "" {
+		route = " and r.route_id == " + fluxString(delayQuery.RouteID)
+	}
+	groupColumns := fluxStrings(columns)
+
+	query := fmt.Sprintf(`data = from(bucket:"%s")
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == "busTelemetry" and %s%s)
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => exists r.delay)
+	|> map(fn: (r) => ({r with _value: float(v: r.delay)}))
+	|> group(columns: %s)
+
+mean = data |> mean() |> set(key: "_field", value: "mean")
+p50 = data |> quantile(q: 0.5, method: "estimate_tdigest") |> set(key: "_field", value: "p50")
+p90 = data |> quantile(q: 0.9, method: "estimate_tdigest") |> set(key: "_field", value: "p90")
+count = data |> count() |> toFloat() |> set(key: "_field", value: "count")
+onTime = data
+	|> map(fn: (r) => ({r with _value: if r._value >= %d.0 and r._value <= %d.0 then 100.0 else 0.0}))
+	|> mean()
+	|> set(key: "_field", value: "on_time_percent")
+
+union(tables: [mean, p50, p90, count, onTime])
+	|> pivot(rowKey: %s, columnKey: ["_field"], valueColumn: "_value")
+	|> group()`,
+		c.bucket, delayQuery.Start.UTC().Format(time.RFC3339Nano), delayQuery.End.UTC().Format(time.RFC3339Nano),
+		fields, route, groupColumns, -models.OnTimeMaxEarly, models.OnTimeMaxLate, groupColumns)
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	stats := []models.DelayStats{}
+	for result.Next() {
+		record := result.Record()
+		value := func(key string) float64 {
+			v, _ := record.ValueByKey(key).(float64)
+			return v
+		}
+		label := func(key string) string {
+			v, _ := record.ValueByKey(key).(string)
+			return v
+		}
+		stat := models.DelayStats{
+			Count:         int(value("count")),
+			Mean:          value("mean"),
+			P50:           value("p50"),
+			P90:           value("p90"),
+			OnTimePercent: value("on_time_percent"),
+		}
+		switch delayQuery.GroupBy {
+		case models.DelayByRoute:
+			stat.RouteID = label("route_id")
+		case models.DelayByDirection:
+			stat.RouteID, stat.DirectionID = label("route_id"), label("direction_id")
+		case models.DelayByStop:
+			stat.StopID = label("next_stop")
+		}
+		stats = append(stats, stat)
+	}
+	return stats, result.Err()
+}
+
+// fluxString quotes a string literal for a Flux query, escaping interpolation
+func fluxString(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`).Replace(s)
+	return `"` + s + `"`
+}
+
+// fluxStrings returns a Flux array of string literals
+func fluxStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fluxString(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
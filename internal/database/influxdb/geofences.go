@@ -0,0 +1,106 @@
+package influxdb
+
+import (
+	"context"
+	"finbus/internal/models"
+	"finbus/internal/tracing"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// geofenceMeasurement holds the geofence enter, exit and dwell events
+const geofenceMeasurement = "geofenceEvent"
+
+// WriteGeofenceEvent writes a geofence enter, exit or dwell event
+func (c *busDataManager) WriteGeofenceEvent(ctx context.Context, event models.GeofenceEvent) (err error) {
+	ctx, span := c.startSpan(ctx, "influxdb.write", "")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	point := influxdb2.NewPoint(geofenceMeasurement,
+		map[string]string{
+			"type":        event.Type,
+			"geofence_id": event.GeofenceID,
+			"vehicle_id":  event.VehicleID,
+			"route_id":    event.RouteID,
+		},
+		map[string]interface{}{
+			"geofence_name": event.GeofenceName,
+			"direction_id":  event.DirectionID,
+			"next_stop":     event.NextStop,
+			"latitude":      event.Latitude,
+			"longitude":     event.Longitude,
+			"duration":      event.Duration,
+		},
+		event.At)
+	if err := c.client.WriteAPIBlocking(c.org, c.bucket).WritePoint(ctx, point); err != nil {
+		return fmt.Errorf("error writing geofence event: %v", err)
+	}
+	return nil
+}
+
+// QueryGeofenceEvents returns the geofence events raised within the query range, latest first
+func (c *busDataManager) QueryGeofenceEvents(ctx context.Context, eventQuery models.GeofenceEventQuery) (_ []models.GeofenceEvent, err error) {
+	filters := ""
+	if eventQuery.GeofenceID != "" {
+		filters += " and r.geofence_id == " + fluxString(eventQuery.GeofenceID)
+	}
+	if eventQuery.VehicleID != "" {
+		filters += " and r.vehicle_id == " + fluxString(eventQuery.VehicleID)
+	}
+	if eventQuery.Type != "" {
+		filters += " and r.type == " + fluxString(eventQuery.Type)
+	}
+	limit := ""
+	if eventQuery.Limit > 0 {
+		limit = fmt.Sprintf("\n\t|> limit(n: %d)", eventQuery.Limit)
+	}
+	query := fmt.Sprintf(`from(bucket:"%s")
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == "%s"%s)
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> group()
+	|> sort(columns: ["_time"], desc: true)%s`,
+		c.bucket, eventQuery.Start.UTC().Format(time.RFC3339Nano), eventQuery.End.UTC().Format(time.RFC3339Nano),
+		geofenceMeasurement, filters, limit)
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.GeofenceEvent{}
+	for result.Next() {
+		record := result.Record()
+		value := func(key string) float64 {
+			v, _ := record.ValueByKey(key).(float64)
+			return v
+		}
+		label := func(key string) string {
+			v, _ := record.ValueByKey(key).(string)
+			return v
+		}
+		events = append(events, models.GeofenceEvent{
+			Type:         label("type"),
+			GeofenceID:   label("geofence_id"),
+			GeofenceName: label("geofence_name"),
+			VehicleID:    label("vehicle_id"),
+			RouteID:      label("route_id"),
+			DirectionID:  label("direction_id"),
+			NextStop:     label("next_stop"),
+			Latitude:     value("latitude"),
+			Longitude:    value("longitude"),
+			Duration:     value("duration"),
+			At:           record.Time(),
+		})
+	}
+	return events, result.Err()
+}
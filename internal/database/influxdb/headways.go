@@ -0,0 +1,103 @@
+package influxdb
+
+import (
+	"context"
+	"finbus/internal/models"
+	"finbus/internal/tracing"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// headwayMeasurement holds the bunching and gap events
+const headwayMeasurement = "headwayEvent"
+
+// WriteHeadwayEvent writes a bunching or gap event
+func (c *busDataManager) WriteHeadwayEvent(ctx context.Context, event models.HeadwayEvent) (err error) {
+	ctx, span := c.startSpan(ctx, "influxdb.write", "")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	point := influxdb2.NewPoint(headwayMeasurement,
+		map[string]string{
+			"type":         event.Type,
+			"route_id":     event.RouteID,
+			"direction_id": event.DirectionID,
+			"vehicle_id":   event.VehicleID,
+			"leader_id":    event.LeaderID,
+			"next_stop":    event.NextStop,
+		},
+		map[string]interface{}{
+			"headway":   event.Headway,
+			"distance":  event.Distance,
+			"latitude":  event.Latitude,
+			"longitude": event.Longitude,
+		},
+		event.At)
+	if err := c.client.WriteAPIBlocking(c.org, c.bucket).WritePoint(ctx, point); err != nil {
+		return fmt.Errorf("error writing headway event: %v", err)
+	}
+	return nil
+}
+
+// QueryHeadwayEvents returns the headway events raised within the query range, latest first
+func (c *busDataManager) QueryHeadwayEvents(ctx context.Context, eventQuery models.HeadwayEventQuery) (_ []models.HeadwayEvent, err error) {
+	filters := ""
+	if eventQuery.RouteID != "" {
+		filters += " and r.route_id == " + fluxString(eventQuery.RouteID)
+	}
+	if eventQuery.Type != "" {
+		filters += " and r.type == " + fluxString(eventQuery.Type)
+	}
+	limit := ""
+	if eventQuery.Limit > 0 {
+		limit = fmt.Sprintf("\n\t|> limit(n: %d)", eventQuery.Limit)
+	}
+	query := fmt.Sprintf(`from(bucket:"%s")
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == "%s"%s)
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> group()
+	|> sort(columns: ["_time"], desc: true)%s`,
+		c.bucket, eventQuery.Start.UTC().Format(time.RFC3339Nano), eventQuery.End.UTC().Format(time.RFC3339Nano),
+		headwayMeasurement, filters, limit)
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.HeadwayEvent{}
+	for result.Next() {
+		record := result.Record()
+		value := func(key string) float64 {
+			v, _ := record.ValueByKey(key).(float64)
+			return v
+		}
+		label := func(key string) string {
+			v, _ := record.ValueByKey(key).(string)
+			return v
+		}
+		events = append(events, models.HeadwayEvent{
+			Type:        label("type"),
+			RouteID:     label("route_id"),
+			DirectionID: label("direction_id"),
+			VehicleID:   label("vehicle_id"),
+			LeaderID:    label("leader_id"),
+			NextStop:    label("next_stop"),
+			Headway:     value("headway"),
+			Distance:    value("distance"),
+			Latitude:    value("latitude"),
+			Longitude:   value("longitude"),
+			At:          record.Time(),
+		})
+	}
+	return events, result.Err()
+}
@@ -3,56 +3,92 @@ package influxdb
 import (
 	"context"
 	"finbus/internal/config"
+	"finbus/internal/metrics"
 	"finbus/internal/models"
+	"finbus/internal/tracing"
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"log"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+	"log/slog"
 	"time"
-)
 
-var (
-	influxURL    = config.GetEnv("INFLUXDB_URL", "http://influxdb:8086")
-	influxToken  = config.GetEnv("INFLUXDB_TOKEN", "3gQf-0IZ9vuoXy3mr_ZyPZUtr3mvSHifynt0cmc3c8KFq2yDwzjPLzo2RzuM8OJOoAFsNk3mA-mPtlk7NFAcjQ==")
-	influxOrg    = config.GetEnv("INFLUXDB_ORG", "abax")
-	influxBucket = config.GetEnv("INFLUXDB_BUCKET", "finbus")
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type BusDataManager interface {
-	GetClient() influxdb2.Client
-	WriteToInfluxDB(data models.BusData) error
-	QueryData(vehicleID string) ([]models.BusData, error)
-	FindBusesNear(geohash string) ([]models.BusData, error)
-	FindBusesFromStops(stops []models.BusData) (models.BusData, error)
+	Close()
+	Ready(ctx context.Context) error
+	WriteToInfluxDB(ctx context.Context, data models.BusData) error
+	QueryData(ctx context.Context, vehicleID string) ([]models.BusData, error)
+	FindBusesNear(ctx context.Context, geohash string) ([]models.BusData, error)
+	FindBusesFromStops(ctx context.Context, stops []models.BusData) (models.BusData, error)
+	// WriteSegmentTime writes an observed travel time between two stops
+	WriteSegmentTime(ctx context.Context, segment models.SegmentTime) error
+	// QuerySegmentTimes returns the travel times observed within the window, per segment
+	QuerySegmentTimes(ctx context.Context, window time.Duration) ([]models.SegmentStats, error)
+	// QueryDelayStats returns the distribution of the delays reported within the query range
+	QueryDelayStats(ctx context.Context, query models.DelayQuery) ([]models.DelayStats, error)
+	// WriteHeadwayEvent writes a bunching or gap event
+	WriteHeadwayEvent(ctx context.Context, event models.HeadwayEvent) error
+	// QueryHeadwayEvents returns the headway events raised within the query range, latest first
+	QueryHeadwayEvents(ctx context.Context, query models.HeadwayEventQuery) ([]models.HeadwayEvent, error)
+	// WriteGeofenceEvent writes a geofence enter, exit or dwell event
+	WriteGeofenceEvent(ctx context.Context, event models.GeofenceEvent) error
+	// QueryGeofenceEvents returns the geofence events raised within the query range, latest first
+	QueryGeofenceEvents(ctx context.Context, query models.GeofenceEventQuery) ([]models.GeofenceEvent, error)
 }
 
 type busDataManager struct {
 	client influxdb2.Client
 	org    string
 	bucket string
+	logger *slog.Logger
 }
 
 // NewBusDataManager creates a new InfluxDBClient and connects to InfluxDB
-func NewBusDataManager() (BusDataManager, error) {
-	client := influxdb2.NewClientWithOptions(influxURL, influxToken, influxdb2.DefaultOptions().SetLogLevel(3))
+func NewBusDataManager(cfg config.InfluxDBConfig, logger *slog.Logger) (BusDataManager, error) {
+	client := influxdb2.NewClientWithOptions(cfg.URL, string(cfg.Token), influxdb2.DefaultOptions().SetLogLevel(3))
 	_, err := client.Ready(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to InfluxDB: %v", err)
 	}
 	return &busDataManager{
 		client: client,
-		org:    influxOrg,
-		bucket: influxBucket,
+		org:    cfg.Org,
+		bucket: cfg.Bucket,
+		logger: logger.With("component", "influxdb"),
 	}, nil
 }
 
-// GetClient returns the InfluxDB client
-func (c *busDataManager) GetClient() influxdb2.Client {
-	return c.client
+// Close closes the InfluxDB client
+func (c *busDataManager) Close() {
+	c.client.Close()
+}
+
+// Ready checks that InfluxDB is up and ready to serve requests
+func (c *busDataManager) Ready(ctx context.Context) error {
+	_, err := c.client.Ready(ctx)
+	return err
+}
+
+// startSpan starts a client span for an InfluxDB operation, with the Flux query if there is one
+func (c *busDataManager) startSpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system", "influxdb"),
+		attribute.String("db.namespace", c.bucket),
+	}
+	if query != "" {
+		attributes = append(attributes, attribute.String("db.query.text", query))
+	}
+	return tracing.Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
 }
 
-// WriteToInfluxDB writes bus telemetry data to InfluxDB
-func (c *busDataManager) WriteToInfluxDB(data models.BusData) error {
-	fmt.Printf("Writing data to InfluxDB: %v\n", data)
+// WriteToInfluxDB writes bus telemetry data to InfluxDB. The write is traced in ctx.
+func (c *busDataManager) WriteToInfluxDB(ctx context.Context, data models.BusData) error {
+	ctx, span := c.startSpan(ctx, "influxdb.write", "")
+	defer span.End()
+
 	tags := map[string]string{
 		"vehicle_id":     data.VehicleID,
 		"mode":           data.Mode,
@@ -76,70 +112,104 @@ func (c *busDataManager) WriteToInfluxDB(data models.BusData) error {
 		"short_name":   data.ShortName,
 		"color":        data.Color,
 	}
+	if data.Latitude != 0 || data.Longitude != 0 {
+		fields["latitude"] = data.Latitude
+		fields["longitude"] = data.Longitude
+	}
+	if data.NextStopName != "" {
+		fields["next_stop_name"] = data.NextStopName
+	}
+	if data.RouteLongName != "" {
+		fields["route_long_name"] = data.RouteLongName
+	}
+	if data.ShapeID != "" {
+		fields["shape_id"] = data.ShapeID
+	}
+	if data.Delay != nil {
+		fields["delay"] = *data.Delay
+	}
 
-	writeAPI := c.client.WriteAPIBlocking(influxOrg, influxBucket)
+	writeAPI := c.client.WriteAPIBlocking(c.org, c.bucket)
 	point := influxdb2.NewPoint("busTelemetry",
 		tags,
 		fields,
 		time.Now())
 
-	if err := writeAPI.WritePoint(context.Background(), point); err != nil {
-		log.Printf("Error writing to InfluxDB: %v", err)
+	start := time.Now()
+	err := writeAPI.WritePoint(ctx, point)
+	metrics.InfluxDBWriteDuration.Observe(time.Since(start).Seconds())
+	tracing.RecordError(span, err)
+	if err != nil {
+		metrics.InfluxDBWriteErrors.Inc()
+		c.logger.ErrorContext(ctx, "Error writing to InfluxDB", "vehicle_id", data.VehicleID, "error", err)
 	} else {
-		log.Println("Data successfully written to InfluxDB")
+		c.logger.DebugContext(ctx, "Bus data written to InfluxDB", "vehicle_id", data.VehicleID, "route_id", data.RouteID)
 	}
 	return nil
 }
 
-func (c *busDataManager) FindBusesFromStops(stops []models.BusData) (models.BusData, error) {
+func (c *busDataManager) FindBusesFromStops(ctx context.Context, stops []models.BusData) (models.BusData, error) {
 	var busData models.BusData
 	for _, stop := range stops {
 		query := fmt.Sprintf(`from(bucket:"%s")
 	|> range(start: -1h)
-	|> filter(fn: (r) => r._measurement == "busTelemetry" and r.next_stop == "%s")`, influxBucket, stop.NextStop)
+	|> filter(fn: (r) => r._measurement == "busTelemetry" and r.next_stop == "%s")`, c.bucket, stop.NextStop)
 
-		queryAPI := c.client.QueryAPI(influxOrg)
-
-		result, err := queryAPI.Query(context.Background(), query)
-		if err != nil {
+		if err := c.findBusFromStop(ctx, query, &busData); err != nil {
 			return busData, err
 		}
+	}
+	return busData, nil
 
-		for result.Next() {
-			if result.Record().Measurement() == "busTelemetry" {
-				busData = models.BusData{
-					VehicleID: result.Record().ValueByKey("vehicle_id").(string),
-				}
-			}
-		}
+}
 
-		if result.Err() != nil {
-			return busData, result.Err()
-		}
+// findBusFromStop runs the query of a stop, storing the last bus found in busData
+func (c *busDataManager) findBusFromStop(ctx context.Context, query string, busData *models.BusData) (err error) {
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	queryAPI := c.client.QueryAPI(c.org)
+
+	result, err := queryAPI.Query(ctx, query)
+	if err != nil {
+		return err
 	}
-	return busData, nil
 
+	for result.Next() {
+		if vehicleID := tag(result.Record(), "vehicle_id"); result.Record().Measurement() == "busTelemetry" && vehicleID != "" {
+			*busData = models.BusData{VehicleID: vehicleID}
+		}
+	}
+	return result.Err()
 }
 
 // QueryData queries bus telemetry data from InfluxDB
-func (c *busDataManager) QueryData(vehicleID string) ([]models.BusData, error) {
+func (c *busDataManager) QueryData(ctx context.Context, vehicleID string) (_ []models.BusData, err error) {
 	query := fmt.Sprintf(`from(bucket:"%s")
     |> range(start: -1h)
-    |> filter(fn: (r) => r._measurement == "busTelemetry" and r.next_stop == "%s")`, influxBucket, vehicleID)
+    |> filter(fn: (r) => r._measurement == "busTelemetry" and r.next_stop == "%s")`, c.bucket, vehicleID)
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
 
-	queryAPI := c.client.QueryAPI(influxOrg)
+	queryAPI := c.client.QueryAPI(c.org)
 
-	result, err := queryAPI.Query(context.Background(), query)
+	result, err := queryAPI.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
 	var busDataList []models.BusData
 	for result.Next() {
-		if result.Record().Measurement() == "busTelemetry" {
+		if vehicleID := tag(result.Record(), "vehicle_id"); result.Record().Measurement() == "busTelemetry" && vehicleID != "" {
 			busData := models.BusData{
-				VehicleID: result.Record().ValueByKey("vehicle_id").(string),
-				RouteID:   result.Record().ValueByKey("route_id").(string),
+				VehicleID: vehicleID,
+				RouteID:   tag(result.Record(), "route_id"),
 			}
 			busDataList = append(busDataList, busData)
 		}
@@ -153,35 +223,51 @@ func (c *busDataManager) QueryData(vehicleID string) ([]models.BusData, error) {
 }
 
 // FindBusesNear queries buses near a specific location
-func (c *busDataManager) FindBusesNear(geohash string) ([]models.BusData, error) {
+func (c *busDataManager) FindBusesNear(ctx context.Context, geohash string) (_ []models.BusData, err error) {
 	fluxQuery := fmt.Sprintf(`from(bucket:"%s")
 	|> range(start: -1h)
-	|> filter(fn: (r) => r._measurement == "busTelemetry" and r.geoHash_head == "%s")`, influxBucket, geohash)
+	|> filter(fn: (r) => r._measurement == "busTelemetry" and r.geoHash_head == "%s")`, c.bucket, geohash)
+	ctx, span := c.startSpan(ctx, "influxdb.query", fluxQuery)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
 
-	queryAPI := c.client.QueryAPI(influxOrg)
-	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	queryAPI := c.client.QueryAPI(c.org)
+	result, err := queryAPI.Query(ctx, fluxQuery)
 	if err != nil {
-		log.Printf("Error executing query: %v", err)
+		c.logger.ErrorContext(ctx, "Error executing query", "geohash", geohash, "error", err)
 		return nil, err
 	}
 
 	var buses []models.BusData
 	for result.Next() {
+		record := result.Record()
+		if tag(record, "vehicle_id") == "" {
+			continue
+		}
 		bus := models.BusData{
-			VehicleID:        result.Record().ValueByKey("vehicle_id").(string),
-			RouteID:          result.Record().ValueByKey("route_id").(string),
-			GeohashFirstDeg:  result.Record().ValueByKey("geoHash_first").(string),
-			GeohashSecondDeg: result.Record().ValueByKey("geoHash_second").(string),
-			GeohashThirdDeg:  result.Record().ValueByKey("geoHash_third").(string),
+			VehicleID:        tag(record, "vehicle_id"),
+			RouteID:          tag(record, "route_id"),
+			GeohashFirstDeg:  tag(record, "geoHash_first"),
+			GeohashSecondDeg: tag(record, "geoHash_second"),
+			GeohashThirdDeg:  tag(record, "geoHash_third"),
 		}
 		buses = append(buses, bus)
 	}
 	if result.Err() != nil {
-		log.Printf("Error processing query results: %v", result.Err())
+		c.logger.ErrorContext(ctx, "Error processing query results", "geohash", geohash, "error", result.Err())
 		return nil, result.Err()
 	}
 
 	return buses, nil
 }
 
+// tag returns the tag of the record, or an empty string if the record does not have it. Line
+// protocol leaves out empty tags, so for example positions without a route have no route_id.
+func tag(record *query.FluxRecord, key string) string {
+	value, _ := record.ValueByKey(key).(string)
+	return value
+}
+
 var _ BusDataManager = (*busDataManager)(nil)
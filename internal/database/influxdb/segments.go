@@ -0,0 +1,76 @@
+package influxdb
+
+import (
+	"context"
+	"finbus/internal/models"
+	"finbus/internal/tracing"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// segmentMeasurement holds the observed travel times between consecutive stops
+const segmentMeasurement = "segmentTravelTime"
+
+// WriteSegmentTime writes an observed travel time between two stops
+func (c *busDataManager) WriteSegmentTime(ctx context.Context, segment models.SegmentTime) (err error) {
+	ctx, span := c.startSpan(ctx, "influxdb.write", "")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	point := influxdb2.NewPoint(segmentMeasurement,
+		map[string]string{
+			"route_id":   segment.RouteID,
+			"vehicle_id": segment.VehicleID,
+			"from_stop":  segment.FromStop,
+			"to_stop":    segment.ToStop,
+		},
+		map[string]interface{}{"seconds": segment.Seconds},
+		segment.ObservedAt)
+	if err := c.client.WriteAPIBlocking(c.org, c.bucket).WritePoint(ctx, point); err != nil {
+		return fmt.Errorf("error writing segment time: %v", err)
+	}
+	return nil
+}
+
+// QuerySegmentTimes returns the mean travel time and number of observations of every segment
+// observed within the window
+func (c *busDataManager) QuerySegmentTimes(ctx context.Context, window time.Duration) (_ []models.SegmentStats, err error) {
+	query := fmt.Sprintf(`from(bucket:"%s")
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "%s" and r._field == "seconds")
+	|> group(columns: ["from_stop", "to_stop"])
+	|> reduce(fn: (r, accumulator) => ({sum: accumulator.sum + r._value, count: accumulator.count + 1}),
+		identity: {sum: 0.0, count: 0})`, c.bucket, window, segmentMeasurement)
+	ctx, span := c.startSpan(ctx, "influxdb.query", query)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result, err := c.client.QueryAPI(c.org).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var segments []models.SegmentStats
+	for result.Next() {
+		record := result.Record()
+		fromStop, _ := record.ValueByKey("from_stop").(string)
+		toStop, _ := record.ValueByKey("to_stop").(string)
+		sum, _ := record.ValueByKey("sum").(float64)
+		count, _ := record.ValueByKey("count").(int64)
+		if count == 0 {
+			continue
+		}
+		segments = append(segments, models.SegmentStats{
+			FromStop:    fromStop,
+			ToStop:      toStop,
+			MeanSeconds: sum / float64(count),
+			Count:       int(count),
+		})
+	}
+	return segments, result.Err()
+}
@@ -0,0 +1,274 @@
+package memory
+
+import (
+	"context"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/models"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retention is how far back the queries look, like the range of the InfluxDB queries
+const retention = time.Hour
+
+// Storage is an in-memory stand-in for InfluxDB. Its queries match the stored bus data like the
+// Flux queries of the InfluxDB BusDataManager, so the app can run without a database.
+type Storage struct {
+	mu       sync.Mutex
+	records  []record
+	segments []models.SegmentTime
+	headways []models.HeadwayEvent
+	fences   []models.GeofenceEvent
+}
+
+// record is a bus update as written at a point in time
+type record struct {
+	data models.BusData
+	time time.Time
+}
+
+// NewStorage creates an empty in-memory storage
+func NewStorage() *Storage {
+	return &Storage{}
+}
+
+// Close does nothing, there is no connection to close
+func (s *Storage) Close() {}
+
+// Ready always succeeds
+func (s *Storage) Ready(ctx context.Context) error {
+	return nil
+}
+
+// WriteToInfluxDB stores the bus data
+func (s *Storage) WriteToInfluxDB(ctx context.Context, data models.BusData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record{data: data, time: time.Now()})
+	return nil
+}
+
+// Written returns every stored bus update in the order written
+func (s *Storage) Written() []models.BusData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := make([]models.BusData, len(s.records))
+	for i, r := range s.records {
+		written[i] = r.data
+	}
+	return written
+}
+
+// recent returns the bus data written within the retention that matches
+func (s *Storage) recent(matches func(models.BusData) bool) []models.BusData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := time.Now().Add(-retention)
+	var found []models.BusData
+	for _, r := range s.records {
+		if r.time.After(since) && matches(r.data) {
+			found = append(found, r.data)
+		}
+	}
+	return found
+}
+
+// FindBusesFromStops returns the last bus heading to the last stop any bus was found for
+func (s *Storage) FindBusesFromStops(ctx context.Context, stops []models.BusData) (models.BusData, error) {
+	var busData models.BusData
+	for _, stop := range stops {
+		found := s.recent(func(data models.BusData) bool { return data.NextStop == stop.NextStop })
+		if len(found) > 0 {
+			busData = models.BusData{VehicleID: found[len(found)-1].VehicleID}
+		}
+	}
+	return busData, nil
+}
+
+// QueryData returns the vehicle and route of the buses whose next stop is the ID, like the InfluxDB query
+func (s *Storage) QueryData(ctx context.Context, vehicleID string) ([]models.BusData, error) {
+	var busDataList []models.BusData
+	for _, data := range s.recent(func(data models.BusData) bool { return data.NextStop == vehicleID }) {
+		busDataList = append(busDataList, models.BusData{VehicleID: data.VehicleID, RouteID: data.RouteID})
+	}
+	return busDataList, nil
+}
+
+// FindBusesNear returns the buses stored with the geohash head
+func (s *Storage) FindBusesNear(ctx context.Context, geohash string) ([]models.BusData, error) {
+	var buses []models.BusData
+	for _, data := range s.recent(func(data models.BusData) bool { return data.GeohashHead == geohash }) {
+		buses = append(buses, models.BusData{
+			VehicleID:        data.VehicleID,
+			RouteID:          data.RouteID,
+			GeohashFirstDeg:  data.GeohashFirstDeg,
+			GeohashSecondDeg: data.GeohashSecondDeg,
+			GeohashThirdDeg:  data.GeohashThirdDeg,
+		})
+	}
+	return buses, nil
+}
+
+// WriteSegmentTime stores an observed travel time between two stops
+func (s *Storage) WriteSegmentTime(ctx context.Context, segment models.SegmentTime) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments = append(s.segments, segment)
+	return nil
+}
+
+// SegmentTimes returns every stored segment time in the order written
+func (s *Storage) SegmentTimes() []models.SegmentTime {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.SegmentTime(nil), s.segments...)
+}
+
+// QuerySegmentTimes returns the mean travel time and number of observations of every segment
+// observed within the window, ordered by segment
+func (s *Storage) QuerySegmentTimes(ctx context.Context, window time.Duration) ([]models.SegmentStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := time.Now().Add(-window)
+	stats := make(map[[2]string]*models.SegmentStats)
+	var keys [][2]string
+	for _, segment := range s.segments {
+		if !segment.ObservedAt.After(since) {
+			continue
+		}
+		key := [2]string{segment.FromStop, segment.ToStop}
+		if stats[key] == nil {
+			stats[key] = &models.SegmentStats{FromStop: segment.FromStop, ToStop: segment.ToStop}
+			keys = append(keys, key)
+		}
+		stats[key].MeanSeconds += segment.Seconds
+		stats[key].Count++
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	segments := make([]models.SegmentStats, 0, len(keys))
+	for _, key := range keys {
+		segment := *stats[key]
+		segment.MeanSeconds /= float64(segment.Count)
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// QueryDelayStats returns the distribution of the delays written within the query range, per
+// route, direction or next stop. The percentiles are exact, where InfluxDB
+// estimates them.
+func (s *Storage) QueryDelayStats(ctx context.Context, query models.DelayQuery) ([]models.DelayStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := make(map[models.DelayStats][]float64)
+	for _, r := range s.records {
+		data := r.data
+		if data.Delay == nil || r.time.Before(query.Start) || !r.time.Before(query.End) ||
+			query.RouteID != "" && data.RouteID != query.RouteID {
+			continue
+		}
+		var key models.DelayStats
+		switch query.GroupBy {
+		case models.DelayByRoute:
+			key.RouteID = data.RouteID
+		case models.DelayByDirection:
+			key.RouteID, key.DirectionID = data.RouteID, data.DirectionID
+		case models.DelayByStop:
+			key.StopID = data.NextStop
+		default:
+			return nil, fmt.Errorf("unknown delay grouping %q", query.GroupBy)
+		}
+		groups[key] = append(groups[key], float64(*data.Delay))
+	}
+
+	stats := make([]models.DelayStats, 0, len(groups))
+	for key, delays := range groups {
+		sort.Float64s(delays)
+		onTime := 0
+		for _, delay := range delays {
+			key.Mean += delay
+			if delay >= -models.OnTimeMaxEarly && delay <= models.OnTimeMaxLate {
+				onTime++
+			}
+		}
+		key.Count = len(delays)
+		key.Mean /= float64(len(delays))
+		key.P50, key.P90 = quantile(delays, 0.5), quantile(delays, 0.9)
+		key.OnTimePercent = 100 * float64(onTime) / float64(len(delays))
+		stats = append(stats, key)
+	}
+	return stats, nil
+}
+
+// WriteHeadwayEvent stores a bunching or gap event
+func (s *Storage) WriteHeadwayEvent(ctx context.Context, event models.HeadwayEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headways = append(s.headways, event)
+	return nil
+}
+
+// QueryHeadwayEvents returns the headway events raised within the query range, latest first
+func (s *Storage) QueryHeadwayEvents(ctx context.Context, query models.HeadwayEventQuery) ([]models.HeadwayEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []models.HeadwayEvent{}
+	for i := len(s.headways) - 1; i >= 0; i-- {
+		event := s.headways[i]
+		if event.At.Before(query.Start) || !event.At.Before(query.End) ||
+			query.RouteID != "" && event.RouteID != query.RouteID || query.Type != "" && event.Type != query.Type {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[:query.Limit]
+	}
+	return events, nil
+}
+
+// WriteGeofenceEvent stores a geofence enter, exit or dwell event
+func (s *Storage) WriteGeofenceEvent(ctx context.Context, event models.GeofenceEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fences = append(s.fences, event)
+	return nil
+}
+
+// QueryGeofenceEvents returns the geofence events raised within the query range, latest first
+func (s *Storage) QueryGeofenceEvents(ctx context.Context, query models.GeofenceEventQuery) ([]models.GeofenceEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []models.GeofenceEvent{}
+	for i := len(s.fences) - 1; i >= 0; i-- {
+		event := s.fences[i]
+		if event.At.Before(query.Start) || !event.At.Before(query.End) ||
+			query.GeofenceID != "" && event.GeofenceID != query.GeofenceID ||
+			query.VehicleID != "" && event.VehicleID != query.VehicleID || query.Type != "" && event.Type != query.Type {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[:query.Limit]
+	}
+	return events, nil
+}
+
+// quantile returns the q quantile of the sorted values, interpolating between the closest ranks
+func quantile(sorted []float64, q float64) float64 {
+	position := q * float64(len(sorted)-1)
+	lower := int(position)
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (position-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+var _ influxdb.BusDataManager = (*Storage)(nil)
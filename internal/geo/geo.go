@@ -0,0 +1,32 @@
+// Package geo has the geometry shared by the schedule, simulator and analytics: distances,
+// bearings, positions along paths and the regions containing a position on the surface of the
+// Earth
+package geo
+
+import "math"
+
+// EarthRadius is the mean radius of the Earth in meters
+const EarthRadius = 6371000
+
+// Distance returns the great-circle distance between two coordinates in meters
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := radians(lat1), radians(lat2)
+	dPhi := phi2 - phi1
+	dLambda := radians(lon2 - lon1)
+	h := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Bearing returns the initial bearing from the first coordinate to the second in degrees
+// clockwise from north
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := radians(lat1), radians(lat2)
+	dLambda := radians(lon2 - lon1)
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
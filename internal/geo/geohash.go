@@ -0,0 +1,96 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GeohashHead returns the integer geohash head ("60;24") of a latitude and longitude
+func GeohashHead(lat, lon float64) string {
+	latInt, _ := splitFloat(lat)
+	lonInt, _ := splitFloat(lon)
+	return fmt.Sprintf("%d;%d", latInt, lonInt)
+}
+
+// SplitGeohash splits a latitude and longitude into the geohash topic levels used by the
+// Digitransit feed: the integer head ("60;24") followed by one level per decimal digit pair.
+func SplitGeohash(lat, lon float64) (head, firstDeg, secondDeg, thirdDeg string) {
+	_, latFrac := splitFloat(lat)
+	_, lonFrac := splitFloat(lon)
+
+	head = GeohashHead(lat, lon)
+	firstDeg = latFrac[0:1] + lonFrac[0:1]
+	secondDeg = latFrac[1:2] + lonFrac[1:2]
+	thirdDeg = latFrac[2:3] + lonFrac[2:3]
+	return head, firstDeg, secondDeg, thirdDeg
+}
+
+// GeohashPosition returns the center of the cell of the geohash topic levels, the inverse of
+// SplitGeohash. ok is false if the head is not a valid geohash head. Missing decimal levels give
+// a larger cell.
+func GeohashPosition(head string, decimals ...string) (lat, lon float64, ok bool) {
+	latHead, lonHead, found := strings.Cut(head, ";")
+	latInt, latErr := strconv.Atoi(latHead)
+	lonInt, lonErr := strconv.Atoi(lonHead)
+	if !found || latErr != nil || lonErr != nil {
+		return 0, 0, false
+	}
+
+	lat, lon = float64(latInt), float64(lonInt)
+	scale := 1.0
+	for _, level := range decimals {
+		if len(level) != 2 || level[0] < '0' || level[0] > '9' || level[1] < '0' || level[1] > '9' {
+			break
+		}
+		scale /= 10
+		lat += float64(level[0]-'0') * scale
+		lon += float64(level[1]-'0') * scale
+	}
+	return lat + scale/2, lon + scale/2, true
+}
+
+// GeohashCells returns a position in every geohash head cell overlapping the bounds. Heads
+// truncate the coordinates towards zero, so the cells next to the equator and the prime meridian
+// are two degrees wide.
+func GeohashCells(b Bounds) []Point {
+	if b.MinLat > b.MaxLat || b.MinLon > b.MaxLon {
+		return nil
+	}
+	var cells []Point
+	for _, lat := range headValues(b.MinLat, b.MaxLat) {
+		for _, lon := range headValues(b.MinLon, b.MaxLon) {
+			cells = append(cells, Point{Lat: lat, Lon: lon})
+		}
+	}
+	return cells
+}
+
+// headValues returns a value from min to max in every integer part of a head they span. Every
+// head spans at least a degree, so it contains min, max or a value halfway between two integers.
+func headValues(min, max float64) []float64 {
+	var values []float64
+	seen := make(map[int]bool)
+	add := func(value float64) {
+		if head, _ := splitFloat(value); !seen[head] {
+			seen[head] = true
+			values = append(values, value)
+		}
+	}
+	add(min)
+	for half := math.Floor(min) + 0.5; half < max; half++ {
+		if half > min {
+			add(half)
+		}
+	}
+	add(max)
+	return values
+}
+
+// Splits a float into its integer and fractional parts as strings.
+func splitFloat(num float64) (int, string) {
+	parts := strings.Split(fmt.Sprintf("%.6f", num), ".") // Ensure 6 decimal places
+	intPart, _ := strconv.Atoi(parts[0])
+	return intPart, parts[1]
+}
@@ -0,0 +1,66 @@
+package geo
+
+import "math"
+
+// Point is a coordinate in degrees
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// Path is a polyline with the distances along it precomputed
+type Path struct {
+	points []Point
+	// along is the distance in meters from the start of the path to each point
+	along []float64
+}
+
+// NewPath creates a path through the points in order
+func NewPath(points []Point) *Path {
+	path := &Path{points: points, along: make([]float64, len(points))}
+	for i := 1; i < len(points); i++ {
+		path.along[i] = path.along[i-1] + Distance(points[i-1].Lat, points[i-1].Lon, points[i].Lat, points[i].Lon)
+	}
+	return path
+}
+
+// Length returns the length of the path in meters
+func (p *Path) Length() float64 {
+	if len(p.along) == 0 {
+		return 0
+	}
+	return p.along[len(p.along)-1]
+}
+
+// Project returns the distance along the path of the point of the path nearest to the coordinate,
+// and the distance from the coordinate to that point, both in meters. The segments are treated as
+// flat, which holds for the short segments of routes. ok is false for an empty path.
+func (p *Path) Project(lat, lon float64) (along, offset float64, ok bool) {
+	if len(p.points) == 0 {
+		return 0, 0, false
+	}
+	if len(p.points) == 1 {
+		return 0, Distance(p.points[0].Lat, p.points[0].Lon, lat, lon), true
+	}
+
+	// Local coordinates in meters around the coordinate
+	scale := math.Cos(radians(lat))
+	local := func(point Point) (x, y float64) {
+		return radians(point.Lon-lon) * scale * EarthRadius, radians(point.Lat-lat) * EarthRadius
+	}
+	offset = math.Inf(1)
+	for i := 1; i < len(p.points); i++ {
+		ax, ay := local(p.points[i-1])
+		bx, by := local(p.points[i])
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if length := dx*dx + dy*dy; length > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+		}
+		if d := math.Hypot(ax+t*dx, ay+t*dy); d < offset {
+			offset = d
+			along = p.along[i-1] + t*(p.along[i]-p.along[i-1])
+		}
+	}
+	return along, offset, true
+}
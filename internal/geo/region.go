@@ -0,0 +1,169 @@
+package geo
+
+import "math"
+
+// Bounds is a latitude and longitude bounding box in degrees
+type Bounds struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// Contains reports whether the coordinate is within the box
+func (b Bounds) Contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// Region is an area of the surface of the Earth
+type Region interface {
+	// Contains reports whether the coordinate is inside the region
+	Contains(lat, lon float64) bool
+	// Bounds returns the bounding box of the region
+	Bounds() Bounds
+}
+
+// Polygon is one or more areas, each an outer ring with optional holes. Rings are closed
+// implicitly, so the last point need not repeat the first.
+type Polygon struct {
+	// areas are the rings of each area, the outer ring first
+	areas  [][][]Point
+	bounds Bounds
+}
+
+// NewPolygon creates a polygon of the areas, each given as its outer ring followed by its holes
+func NewPolygon(areas ...[][]Point) *Polygon {
+	bounds := Bounds{MinLat: math.Inf(1), MinLon: math.Inf(1), MaxLat: math.Inf(-1), MaxLon: math.Inf(-1)}
+	for _, rings := range areas {
+		if len(rings) == 0 {
+			continue
+		}
+		for _, point := range rings[0] {
+			bounds.MinLat, bounds.MaxLat = math.Min(bounds.MinLat, point.Lat), math.Max(bounds.MaxLat, point.Lat)
+			bounds.MinLon, bounds.MaxLon = math.Min(bounds.MinLon, point.Lon), math.Max(bounds.MaxLon, point.Lon)
+		}
+	}
+	return &Polygon{areas: areas, bounds: bounds}
+}
+
+// Contains reports whether the coordinate is inside an outer ring of the polygon and outside its
+// holes. Points on an edge may fall on either side.
+func (p *Polygon) Contains(lat, lon float64) bool {
+	if !p.bounds.Contains(lat, lon) {
+		return false
+	}
+	for _, rings := range p.areas {
+		if len(rings) == 0 || !ringContains(rings[0], lat, lon) {
+			continue
+		}
+		inHole := false
+		for _, hole := range rings[1:] {
+			if ringContains(hole, lat, lon) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds returns the bounding box of the outer rings
+func (p *Polygon) Bounds() Bounds {
+	return p.bounds
+}
+
+// ringContains casts a ray from the coordinate towards the east and counts the edges of the ring
+// it crosses, which is odd for coordinates inside the ring
+func ringContains(ring []Point, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lon < a.Lon+(lat-a.Lat)*(b.Lon-a.Lon)/(b.Lat-a.Lat) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Circle is the area within a radius in meters of a center
+type Circle struct {
+	Center Point
+	Radius float64
+}
+
+// Contains reports whether the coordinate is within the radius of the center
+func (c Circle) Contains(lat, lon float64) bool {
+	return Distance(c.Center.Lat, c.Center.Lon, lat, lon) <= c.Radius
+}
+
+// Bounds returns the bounding box of the circle, widened towards the poles
+func (c Circle) Bounds() Bounds {
+	dLat := c.Radius / EarthRadius * 180 / math.Pi
+	dLon := 180.0
+	if cos := math.Cos(radians(math.Max(math.Abs(c.Center.Lat-dLat), math.Abs(c.Center.Lat+dLat)))); cos > 0 {
+		dLon = math.Min(dLat/cos, 180)
+	}
+	return Bounds{MinLat: c.Center.Lat - dLat, MinLon: c.Center.Lon - dLon, MaxLat: c.Center.Lat + dLat, MaxLon: c.Center.Lon + dLon}
+}
+
+// Index finds the regions containing a coordinate without testing every region. Regions are
+// bucketed in a grid by their bounding boxes, so only the regions overlapping the cell of the
+// coordinate are tested. An index is not modified once built and is safe for concurrent use.
+type Index struct {
+	cellSize float64
+	cells    map[[2]int][]int
+	ids      []string
+	regions  []Region
+}
+
+// NewIndex indexes the regions by their IDs in a grid of cells of cellSize degrees. Regions
+// spanning more than maxCells cells are tested for every coordinate instead.
+func NewIndex(regions map[string]Region, cellSize float64) *Index {
+	const maxCells = 10000
+	index := &Index{cellSize: cellSize, cells: make(map[[2]int][]int)}
+	for id, region := range regions {
+		i := len(index.regions)
+		index.ids = append(index.ids, id)
+		index.regions = append(index.regions, region)
+
+		bounds := region.Bounds()
+		minLat, minLon := index.cell(bounds.MinLat, bounds.MinLon)
+		maxLat, maxLon := index.cell(bounds.MaxLat, bounds.MaxLon)
+		if (maxLat-minLat+1)*(maxLon-minLon+1) > maxCells {
+			index.cells[everywhere] = append(index.cells[everywhere], i)
+			continue
+		}
+		for lat := minLat; lat <= maxLat; lat++ {
+			for lon := minLon; lon <= maxLon; lon++ {
+				index.cells[[2]int{lat, lon}] = append(index.cells[[2]int{lat, lon}], i)
+			}
+		}
+	}
+	return index
+}
+
+// everywhere is the pseudo cell of the regions tested for every coordinate
+var everywhere = [2]int{math.MaxInt, math.MaxInt}
+
+func (x *Index) cell(lat, lon float64) (int, int) {
+	return int(math.Floor(lat / x.cellSize)), int(math.Floor(lon / x.cellSize))
+}
+
+// Containing returns the IDs of the regions containing the coordinate
+func (x *Index) Containing(lat, lon float64) []string {
+	var ids []string
+	latCell, lonCell := x.cell(lat, lon)
+	for _, cell := range [][2]int{{latCell, lonCell}, everywhere} {
+		for _, i := range x.cells[cell] {
+			if x.regions[i].Contains(lat, lon) {
+				ids = append(ids, x.ids[i])
+			}
+		}
+	}
+	return ids
+}
+
+// Len returns the number of indexed regions
+func (x *Index) Len() int {
+	return len(x.regions)
+}
@@ -0,0 +1,26 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+)
+
+// Source is a producer of bus data for the ingestion pipeline. Sources are constructed with the
+// channel they feed, so several sources can share the channel consumed by the BusDataService.
+type Source interface {
+	// Name returns a short identifier for the source, used in logs
+	Name() string
+	// Start begins producing bus data. It returns once the source is running, and the source
+	// stops when ctx is cancelled.
+	Start(ctx context.Context) error
+}
+
+// StartAll starts every source in order and returns the first error encountered
+func StartAll(ctx context.Context, sources ...Source) error {
+	for _, source := range sources {
+		if err := source.Start(ctx); err != nil {
+			return fmt.Errorf("error starting %s source: %v", source.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "finbus"
+
+var (
+	// MQTTMessagesReceived counts MQTT messages received per event type
+	MQTTMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_received_total",
+		Help:      "MQTT messages received, by event type.",
+	}, []string{"event_type"})
+
+	// MQTTMessagesParsed counts MQTT messages successfully parsed into bus data per event type
+	MQTTMessagesParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_parsed_total",
+		Help:      "MQTT messages parsed into bus data, by event type.",
+	}, []string{"event_type"})
+
+	// MQTTMessagesFailed counts MQTT messages that could not be parsed per event type
+	MQTTMessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_failed_total",
+		Help:      "MQTT messages that could not be parsed, by event type.",
+	}, []string{"event_type"})
+
+	// QueueDepth is the number of items waiting in each internal queue. The queues registered with
+	// SampleQueueDepth are sampled when the metrics are collected.
+	QueueDepth = register(&sampledGaugeVec{
+		GaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_depth",
+			Help:      "Items waiting in internal queues, by queue.",
+		}, []string{"queue"}),
+		samplers: make(map[string]func() int),
+	})
+
+	// InfluxDBWriteDuration observes the latency of InfluxDB writes
+	InfluxDBWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "influxdb",
+		Name:      "write_duration_seconds",
+		Help:      "Latency of InfluxDB writes.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// InfluxDBWriteErrors counts failed InfluxDB writes
+	InfluxDBWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "influxdb",
+		Name:      "write_errors_total",
+		Help:      "Failed InfluxDB writes.",
+	})
+
+	// HTTPRequestDuration observes the latency of REST requests per route, method and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of REST requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// WebSocketSessions is the number of open WebSocket sessions
+	WebSocketSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "sessions_active",
+		Help:      "Open WebSocket sessions.",
+	})
+
+	// SSEStreams is the number of open Server-Sent Events streams
+	SSEStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "sse",
+		Name:      "streams_active",
+		Help:      "Open Server-Sent Events streams.",
+	})
+
+	// UpdatesDropped counts live updates dropped because a client was not keeping up
+	UpdatesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_dropped_total",
+		Help:      "Live updates dropped because a client was not keeping up.",
+	})
+
+	// StorageWritesDropped counts the storage writes dropped because their queue was full
+	StorageWritesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_writes_dropped_total",
+		Help:      "Storage writes dropped because their queue was full, by queue.",
+	}, []string{"queue"})
+
+	// TrackedVehicles is the number of vehicles in the latest-state cache
+	TrackedVehicles = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tracked_vehicles",
+		Help:      "Vehicles whose latest state is cached.",
+	})
+
+	// HeadwayEvents counts the bunching and gap events raised per type
+	HeadwayEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "headway_events_total",
+		Help:      "Bunching and gap events raised, by type.",
+	}, []string{"type"})
+
+	// GeofenceEvents counts the geofence enter, exit and dwell events raised per type
+	GeofenceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geofence_events_total",
+		Help:      "Geofence enter, exit and dwell events raised, by type.",
+	}, []string{"type"})
+
+	// AlertsFiring is the number of alerts firing
+	AlertsFiring = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "alerts_firing",
+		Help:      "Alerts firing.",
+	})
+
+	// AlertNotifications counts the alert webhook deliveries per result: delivered, failed or
+	// dropped
+	AlertNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alert_notifications_total",
+		Help:      "Alert webhook deliveries, by result.",
+	}, []string{"result"})
+)
+
+// sampledGaugeVec is a gauge vector whose samplers set the gauge of their label value whenever it
+// is collected, so the gauge stays current even when nothing updates it
+type sampledGaugeVec struct {
+	*prometheus.GaugeVec
+	mu       sync.Mutex
+	samplers map[string]func() int
+}
+
+func (g *sampledGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	for label, sample := range g.samplers {
+		g.WithLabelValues(label).Set(float64(sample()))
+	}
+	g.mu.Unlock()
+	g.GaugeVec.Collect(ch)
+}
+
+func register[C prometheus.Collector](collector C) C {
+	prometheus.MustRegister(collector)
+	return collector
+}
+
+// SampleQueueDepth reports the length of the queue in QueueDepth whenever the metrics are
+// collected, replacing the previous sampler of the queue. This keeps the depth of a queue current
+// while its consumer is stalled.
+func SampleQueueDepth(queue string, length func() int) {
+	QueueDepth.mu.Lock()
+	defer QueueDepth.mu.Unlock()
+	QueueDepth.samplers[queue] = length
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentHandler records the latency of requests to the route in HTTPRequestDuration. The
+// route is the path template, so paths with parameters share a series.
+func InstrumentHandler(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		HTTPRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).
+			Observe(time.Since(start).Seconds())
+	}
+}
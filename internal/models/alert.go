@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Alert statuses
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is raised by an alert rule whose condition has held for the rule's duration, and resolved
+// once the condition no longer holds
+type Alert struct {
+	// ID identifies the alert by its rule and subject, so it is the same for every notification
+	// of one occurrence and the next
+	ID     string `json:"id"`
+	Rule   string `json:"rule"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// VehicleID and RouteID are the subject of the alert, empty for alerts about the whole feed
+	VehicleID string `json:"vehicle_id,omitempty"`
+	RouteID   string `json:"route_id,omitempty"`
+	Message   string `json:"message"`
+	// StartedAt is when the condition began to hold
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// Arrival is a predicted arrival of a live vehicle at a stop
+type Arrival struct {
+	StopID       string `json:"stop_id"`
+	VehicleID    string `json:"vehicle_id"`
+	RouteID      string `json:"route_id"`
+	ShortName    string `json:"short_name"`
+	TripID       string `json:"trip_id"`
+	TripHeadsign string `json:"trip_headsign"`
+	// ScheduledAt is the scheduled arrival time of the trip at the stop
+	ScheduledAt time.Time `json:"scheduled_at"`
+	// PredictedAt is the predicted arrival time, and InSeconds the seconds until it
+	PredictedAt time.Time `json:"predicted_at"`
+	InSeconds   int       `json:"in_seconds"`
+	// Delay is how many seconds after the scheduled time the vehicle is predicted to arrive,
+	// negative if early
+	Delay int `json:"delay"`
+	// StopsAway is the number of stops the vehicle passes before the stop
+	StopsAway int `json:"stops_away"`
+	// Source is "observed" if recently observed travel times went into the prediction,
+	// "reported" if it carries the delay reported by the feed over the schedule, and "schedule" if
+	// it only relies on the scheduled travel times
+	Source    string  `json:"source"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Prediction sources of arrivals
+const (
+	ArrivalSourceObserved = "observed"
+	ArrivalSourceReported = "reported"
+	ArrivalSourceSchedule = "schedule"
+)
+
+// SegmentTime is the observed travel time of a vehicle from passing a stop to passing the next
+type SegmentTime struct {
+	RouteID   string
+	VehicleID string
+	FromStop  string
+	ToStop    string
+	Seconds   float64
+	// ObservedAt is when the vehicle passed the second stop
+	ObservedAt time.Time
+}
+
+// SegmentStats are the travel times observed between two consecutive stops
+type SegmentStats struct {
+	FromStop    string
+	ToStop      string
+	MeanSeconds float64
+	Count       int
+}
@@ -20,4 +20,16 @@ type BusData struct {
 	GeohashThirdDeg  string
 	ShortName        string
 	Color            string
+	Latitude         float64
+	Longitude        float64
+
+	// NextStopName, RouteLongName and ShapeID are added from the GTFS static feed, if one is loaded
+	NextStopName  string
+	RouteLongName string
+	ShapeID       string
+
+	// Delay is how many seconds the vehicle runs behind its schedule, negative if ahead, when its
+	// feed reports it or the GTFS static feed gives it. DelayEstimated is set in the latter case.
+	Delay          *int
+	DelayEstimated bool
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"finbus/internal/geo"
+	"slices"
+)
+
+// BusFilter selects the live bus updates a subscriber receives. A bus matches when it is in the
+// area and matches at least one value of every non-empty list.
+type BusFilter struct {
+	Area     *ClientCoords `json:"area,omitempty"`
+	Routes   []string      `json:"routes,omitempty"`
+	Stops    []string      `json:"stops,omitempty"`
+	Vehicles []string      `json:"vehicles,omitempty"`
+}
+
+// Matches reports whether a bus matches the filter. Empty filters match nothing.
+func (f BusFilter) Matches(busData BusData) bool {
+	if f.IsEmpty() {
+		return false
+	}
+	if f.Area != nil && geo.GeohashHead(f.Area.Latitude, f.Area.Longitude) != busData.GeohashHead {
+		return false
+	}
+	if len(f.Routes) > 0 && !slices.Contains(f.Routes, busData.RouteID) {
+		return false
+	}
+	if len(f.Stops) > 0 && !slices.Contains(f.Stops, busData.NextStop) {
+		return false
+	}
+	if len(f.Vehicles) > 0 && !slices.Contains(f.Vehicles, busData.VehicleID) {
+		return false
+	}
+	return true
+}
+
+// IsEmpty reports whether the filter has no criteria at all
+func (f BusFilter) IsEmpty() bool {
+	return f.Area == nil && len(f.Routes) == 0 && len(f.Stops) == 0 && len(f.Vehicles) == 0
+}
@@ -0,0 +1,18 @@
+package models
+
+import "context"
+
+// BusMessage is bus data as received from a source, with the context it was received in, which
+// carries the trace of the message so its processing can be traced
+type BusMessage struct {
+	Ctx  context.Context
+	Data BusData
+}
+
+// Context returns the context the bus data was received in, or the background context if none
+func (m BusMessage) Context() context.Context {
+	if m.Ctx == nil {
+		return context.Background()
+	}
+	return m.Ctx
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// A vehicle is on time when it runs at most OnTimeMaxEarly seconds ahead of its schedule and at
+// most OnTimeMaxLate seconds behind it
+const (
+	OnTimeMaxEarly = 60
+	OnTimeMaxLate  = 180
+)
+
+// DelayGrouping is what delay statistics are computed per
+type DelayGrouping string
+
+const (
+	DelayByRoute     DelayGrouping = "route"
+	DelayByDirection DelayGrouping = "direction"
+	DelayByStop      DelayGrouping = "stop"
+)
+
+// DelayQuery selects the delays reported between Start and End, optionally of a single route
+type DelayQuery struct {
+	GroupBy DelayGrouping
+	Start   time.Time
+	End     time.Time
+	RouteID string
+}
+
+// DelayStats is the distribution of the delays reported by the vehicles of a route, direction or
+// stop, in seconds behind the schedule. Only the fields of the grouping are set, so StopID is
+// the next stop of the vehicles reporting the delays.
+type DelayStats struct {
+	RouteID     string  `json:"route_id,omitempty"`
+	DirectionID string  `json:"direction_id,omitempty"`
+	StopID      string  `json:"stop_id,omitempty"`
+	Count       int     `json:"count"`
+	Mean        float64 `json:"mean"`
+	P50         float64 `json:"p50"`
+	P90         float64 `json:"p90"`
+	// OnTimePercent is the share of the delays within the on-time window, from 0 to 100
+	OnTimePercent float64 `json:"on_time_percent"`
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"encoding/json"
+	"finbus/internal/geo"
+	"time"
+)
+
+// Geofence event types
+const (
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+	GeofenceDwell = "dwell"
+)
+
+// Geofence is a named area, such as a depot, a terminal or a construction zone, as a GeoJSON
+// Feature. The geometry is a Polygon, a MultiPolygon, or a Point with a radius, which is a circle.
+type Geofence struct {
+	// Type is always "Feature"
+	Type       string             `json:"type"`
+	ID         string             `json:"id"`
+	Geometry   GeofenceGeometry   `json:"geometry"`
+	Properties GeofenceProperties `json:"properties"`
+}
+
+// GeofenceGeometry is a GeoJSON geometry with coordinates in longitude, latitude order
+type GeofenceGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// GeofenceProperties are the properties of a geofence feature
+type GeofenceProperties struct {
+	Name string `json:"name"`
+	// Kind is a free-form category, such as depot, terminal or construction
+	Kind string `json:"kind,omitempty"`
+	// Radius is the radius in meters of a circle around a Point geometry
+	Radius    float64   `json:"radius,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GeofenceCollection is a GeoJSON FeatureCollection of geofences
+type GeofenceCollection struct {
+	// Type is always "FeatureCollection"
+	Type     string     `json:"type"`
+	Features []Geofence `json:"features"`
+}
+
+// GeofenceEvent is raised when a vehicle enters or exits a geofence, or has dwelled in it
+type GeofenceEvent struct {
+	// Type is GeofenceEnter, GeofenceExit or GeofenceDwell
+	Type         string  `json:"type"`
+	GeofenceID   string  `json:"geofence_id"`
+	GeofenceName string  `json:"geofence_name"`
+	VehicleID    string  `json:"vehicle_id"`
+	RouteID      string  `json:"route_id"`
+	DirectionID  string  `json:"direction_id"`
+	NextStop     string  `json:"next_stop"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	// Duration is how many seconds the vehicle was in the geofence, in exit and dwell events
+	Duration float64   `json:"duration,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Matches reports whether the subscription filter matches the vehicle of the event
+func (e GeofenceEvent) Matches(filter BusFilter) bool {
+	return filter.Matches(BusData{
+		RouteID:     e.RouteID,
+		VehicleID:   e.VehicleID,
+		NextStop:    e.NextStop,
+		GeohashHead: geo.GeohashHead(e.Latitude, e.Longitude),
+	})
+}
+
+// GeofenceEventQuery selects the geofence events raised between Start and End, optionally of a
+// single geofence, vehicle or type, the latest Limit of them if Limit is positive
+type GeofenceEventQuery struct {
+	Start      time.Time
+	End        time.Time
+	GeofenceID string
+	VehicleID  string
+	Type       string
+	Limit      int
+}
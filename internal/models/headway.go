@@ -0,0 +1,65 @@
+package models
+
+import (
+	"finbus/internal/geo"
+	"time"
+)
+
+// Headway statuses and the types of the events raised when a vehicle enters them
+const (
+	HeadwayNormal   = "normal"
+	HeadwayBunching = "bunching"
+	HeadwayGap      = "gap"
+)
+
+// Headway is the current headway of a vehicle to the vehicle ahead of it on the same route,
+// direction and shape
+type Headway struct {
+	RouteID     string `json:"route_id"`
+	DirectionID string `json:"direction_id"`
+	VehicleID   string `json:"vehicle_id"`
+	LeaderID    string `json:"leader_id"`
+	// Headway is how many seconds ago the vehicle ahead was where the vehicle is now
+	Headway float64 `json:"headway"`
+	// Distance is how many meters ahead along the shape the vehicle ahead is
+	Distance  float64   `json:"distance"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HeadwayEvent is raised when a vehicle becomes bunched with the vehicle ahead or falls too far
+// behind it
+type HeadwayEvent struct {
+	// Type is HeadwayBunching or HeadwayGap
+	Type        string    `json:"type"`
+	RouteID     string    `json:"route_id"`
+	DirectionID string    `json:"direction_id"`
+	VehicleID   string    `json:"vehicle_id"`
+	LeaderID    string    `json:"leader_id"`
+	NextStop    string    `json:"next_stop"`
+	Headway     float64   `json:"headway"`
+	Distance    float64   `json:"distance"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	At          time.Time `json:"at"`
+}
+
+// Matches reports whether the subscription filter matches the vehicle of the event
+func (e HeadwayEvent) Matches(filter BusFilter) bool {
+	return filter.Matches(BusData{
+		RouteID:     e.RouteID,
+		VehicleID:   e.VehicleID,
+		NextStop:    e.NextStop,
+		GeohashHead: geo.GeohashHead(e.Latitude, e.Longitude),
+	})
+}
+
+// HeadwayEventQuery selects the headway events raised between Start and End, optionally of a
+// single route or type, the latest Limit of them if Limit is positive
+type HeadwayEventQuery struct {
+	Start   time.Time
+	End     time.Time
+	RouteID string
+	Type    string
+	Limit   int
+}
@@ -0,0 +1,22 @@
+package models
+
+// Stop is a stop of the GTFS static feed with the routes serving it
+type Stop struct {
+	ID        string            `json:"id"`
+	Code      string            `json:"code,omitempty"`
+	Name      string            `json:"name"`
+	Names     map[string]string `json:"names,omitempty"`
+	Latitude  float64           `json:"latitude"`
+	Longitude float64           `json:"longitude"`
+	// Distance is the distance in meters from the searched location, if there is one
+	Distance *float64    `json:"distance,omitempty"`
+	Routes   []StopRoute `json:"routes"`
+}
+
+// StopRoute is a route serving a stop
+type StopRoute struct {
+	ID        string `json:"id"`
+	ShortName string `json:"short_name"`
+	LongName  string `json:"long_name"`
+	Color     string `json:"color,omitempty"`
+}
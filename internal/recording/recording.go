@@ -0,0 +1,187 @@
+// Package recording reads and writes recordings of raw MQTT traffic. A recording is NDJSON, one
+// Message per line, gzip compressed when written by a Writer.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxLineSize is the longest recorded message line that can be read
+const maxLineSize = 1 << 20
+
+// Message is a raw MQTT message as it was received
+type Message struct {
+	Topic      string    `json:"topic"`
+	Payload    []byte    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Writer appends messages to a gzip compressed recording. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	gzip    *gzip.Writer
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// Create opens the recording file for appending, creating it if needed. Every Writer adds a gzip
+// member to the file, which readers decompress as one stream.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording %s: %v", path, err)
+	}
+	gzipWriter := gzip.NewWriter(file)
+	buffer := bufio.NewWriter(gzipWriter)
+	return &Writer{
+		file:    file,
+		gzip:    gzipWriter,
+		buffer:  buffer,
+		encoder: json.NewEncoder(buffer),
+	}, nil
+}
+
+// Write appends the message to the recording
+func (w *Writer) Write(message Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.encoder.Encode(message); err != nil {
+		return fmt.Errorf("error writing recording: %v", err)
+	}
+	return nil
+}
+
+// Flush writes the buffered messages to the file, so they can be read even if the recording is
+// not closed
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buffer.Flush(); err != nil {
+		return fmt.Errorf("error flushing recording: %v", err)
+	}
+	if err := w.gzip.Flush(); err != nil {
+		return fmt.Errorf("error flushing recording: %v", err)
+	}
+	return nil
+}
+
+// Close flushes the recording and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.buffer.Flush()
+	if closeErr := w.gzip.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error closing recording: %v", err)
+	}
+	return nil
+}
+
+// Reader reads the messages of a recording in order
+type Reader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	line    int
+}
+
+// Open opens a recording file, which may be gzip compressed or plain NDJSON
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording %s: %v", path, err)
+	}
+	reader, err := NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	reader.closer = file
+	return reader, nil
+}
+
+// NewReader reads a recording from r, decompressing it if it is gzip compressed
+func NewReader(r io.Reader) (*Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading recording: %v", err)
+	}
+
+	var source io.Reader = buffered
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("error reading recording: %v", err)
+		}
+		source = gzipReader
+	}
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(nil, maxLineSize)
+	return &Reader{scanner: scanner}, nil
+}
+
+// Next returns the next message, or io.EOF at the end of the recording. A recording that was not
+// closed, for example because the recorder was killed, ends with io.ErrUnexpectedEOF after the
+// last flushed message.
+func (r *Reader) Next() (Message, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if len(bytes.TrimSpace(r.scanner.Bytes())) == 0 {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal(r.scanner.Bytes(), &message); err != nil {
+			return Message{}, fmt.Errorf("error parsing recording line %d: %v", r.line, err)
+		}
+		return message, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Message{}, err
+		}
+		return Message{}, fmt.Errorf("error reading recording: %v", err)
+	}
+	return Message{}, io.EOF
+}
+
+// Close closes the recording file, if the reader opened one
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// ReadAll reads every message of a recording. On error, the messages read before it are returned
+// with it.
+func ReadAll(r io.Reader) ([]Message, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for {
+		message, err := reader.Next()
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+}
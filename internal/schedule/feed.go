@@ -0,0 +1,166 @@
+// Package schedule imports GTFS static data, the stops, routes, trips, stop times and shapes of
+// the scheduled service, and indexes it in memory
+package schedule
+
+import (
+	"sort"
+	"time"
+)
+
+// Stop is a stop or station of stops.txt
+type Stop struct {
+	ID            string
+	Code          string
+	Name          string
+	Lat           float64
+	Lon           float64
+	ParentStation string
+	// Names are the translations of the name by language, such as the Swedish name under "sv"
+	Names map[string]string
+}
+
+// Route is a route of routes.txt
+type Route struct {
+	ID        string
+	AgencyID  string
+	ShortName string
+	LongName  string
+	Type      int
+	Color     string
+	TextColor string
+}
+
+// Trip is a trip of trips.txt
+type Trip struct {
+	ID          string
+	RouteID     string
+	ServiceID   string
+	Headsign    string
+	DirectionID string
+	ShapeID     string
+}
+
+// StopTime is a scheduled stop of a trip in stop_times.txt. Times are seconds since the start of
+// the service day, exceeding 24 hours for trips running past midnight.
+type StopTime struct {
+	StopID        string
+	Sequence      int
+	Arrival       int
+	Departure     int
+	ShapeDistance float64
+}
+
+// ShapePoint is a point of a shape in shapes.txt
+type ShapePoint struct {
+	Lat      float64
+	Lon      float64
+	Sequence int
+	Distance float64
+}
+
+// Feed is a loaded GTFS feed indexed by ID. It is not modified once loaded.
+type Feed struct {
+	Stops  map[string]*Stop
+	Routes map[string]*Route
+	Trips  map[string]*Trip
+	// StopTimes are the stop times of every trip, ordered by sequence
+	StopTimes map[string][]StopTime
+	// Shapes are the points of every shape, ordered by sequence
+	Shapes map[string][]ShapePoint
+	// LoadedAt is when the feed was loaded
+	LoadedAt time.Time
+	// Location is the time zone of the agencies, in which stop times are given
+	Location *time.Location
+
+	// stopRoutes are the IDs of the routes with trips stopping at each stop
+	stopRoutes map[string][]string
+	// searchIndex has the normalized names of every stop, ordered by stop ID
+	searchIndex []searchEntry
+}
+
+// newFeed returns an empty feed
+func newFeed() *Feed {
+	return &Feed{
+		Stops:      make(map[string]*Stop),
+		Routes:     make(map[string]*Route),
+		Trips:      make(map[string]*Trip),
+		StopTimes:  make(map[string][]StopTime),
+		Shapes:     make(map[string][]ShapePoint),
+		stopRoutes: make(map[string][]string),
+		LoadedAt:   time.Now(),
+		Location:   time.Local,
+	}
+}
+
+// index orders the stop times and shape points and indexes the routes serving every stop
+func (f *Feed) index() {
+	routes := make(map[string]map[string]bool)
+	for tripID, stopTimes := range f.StopTimes {
+		sort.Slice(stopTimes, func(i, j int) bool { return stopTimes[i].Sequence < stopTimes[j].Sequence })
+		trip, ok := f.Trips[tripID]
+		if !ok {
+			continue
+		}
+		for _, stopTime := range stopTimes {
+			if routes[stopTime.StopID] == nil {
+				routes[stopTime.StopID] = make(map[string]bool)
+			}
+			routes[stopTime.StopID][trip.RouteID] = true
+		}
+	}
+	for _, points := range f.Shapes {
+		sort.Slice(points, func(i, j int) bool { return points[i].Sequence < points[j].Sequence })
+	}
+	for stopID, routeIDs := range routes {
+		for routeID := range routeIDs {
+			f.stopRoutes[stopID] = append(f.stopRoutes[stopID], routeID)
+		}
+		sort.Strings(f.stopRoutes[stopID])
+	}
+	f.indexNames()
+}
+
+// RoutesAtStop returns the routes with trips stopping at the stop, ordered by ID
+func (f *Feed) RoutesAtStop(stopID string) []*Route {
+	var routes []*Route
+	for _, routeID := range f.stopRoutes[stopID] {
+		if route, ok := f.Routes[routeID]; ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// ServiceDay returns the start of the service day on which a stop time of seconds since the start
+// of the service day is nearest to now. Trips running past midnight are given the previous day.
+func (f *Feed) ServiceDay(now time.Time, seconds int) time.Time {
+	local := now.In(f.Location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, f.Location)
+	best := today
+	for _, days := range []int{-1, 1} {
+		day := today.AddDate(0, 0, days)
+		if absDuration(now.Sub(day.Add(time.Duration(seconds)*time.Second))) < absDuration(now.Sub(best.Add(time.Duration(seconds)*time.Second))) {
+			best = day
+		}
+	}
+	return best
+}
+
+// StopIndex returns the index of the first stop time of the trip at the stop from index from
+// onwards, or -1 if the trip does not stop there
+func (f *Feed) StopIndex(tripID, stopID string, from int) int {
+	stopTimes := f.StopTimes[tripID]
+	for i := max(from, 0); i < len(stopTimes); i++ {
+		if stopTimes[i].StopID == stopID {
+			return i
+		}
+	}
+	return -1
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,251 @@
+package schedule
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load reads a GTFS feed from a zip file or a directory of GTFS text files. stops.txt, routes.txt
+// and trips.txt are required, agency.txt, stop_times.txt, shapes.txt and translations.txt are
+// loaded if present.
+func Load(path string) (*Feed, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GTFS feed: %v", err)
+	}
+	if info.IsDir() {
+		return Read(os.DirFS(path))
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GTFS feed: %v", err)
+	}
+	defer archive.Close()
+	return Read(archive)
+}
+
+// Read reads a GTFS feed from the text files of fsys
+func Read(fsys fs.FS) (*Feed, error) {
+	feed := newFeed()
+	// nameTranslations are the stop name translations given by the translated name rather than
+	// by stop ID, by name and language
+	nameTranslations := make(map[string]map[string]string)
+	tables := []struct {
+		name     string
+		required bool
+		columns  []string
+		read     func(row row) error
+	}{
+		{"agency.txt", false, nil, func(r row) error {
+			// Every agency of a feed has the same time zone
+			if name := r.get("agency_timezone"); name != "" {
+				location, err := time.LoadLocation(name)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid agency_timezone %q", r.line, name)
+				}
+				feed.Location = location
+			}
+			return nil
+		}},
+		{"stops.txt", true, []string{"stop_id"}, func(r row) error {
+			lat, lon := r.float("stop_lat"), r.float("stop_lon")
+			feed.Stops[r.get("stop_id")] = &Stop{
+				ID:            r.get("stop_id"),
+				Code:          r.get("stop_code"),
+				Name:          r.get("stop_name"),
+				Lat:           lat,
+				Lon:           lon,
+				ParentStation: r.get("parent_station"),
+			}
+			return r.err
+		}},
+		{"routes.txt", true, []string{"route_id"}, func(r row) error {
+			feed.Routes[r.get("route_id")] = &Route{
+				ID:        r.get("route_id"),
+				AgencyID:  r.get("agency_id"),
+				ShortName: r.get("route_short_name"),
+				LongName:  r.get("route_long_name"),
+				Type:      r.int("route_type"),
+				Color:     strings.ToUpper(r.get("route_color")),
+				TextColor: strings.ToUpper(r.get("route_text_color")),
+			}
+			return r.err
+		}},
+		{"trips.txt", true, []string{"trip_id", "route_id"}, func(r row) error {
+			feed.Trips[r.get("trip_id")] = &Trip{
+				ID:          r.get("trip_id"),
+				RouteID:     r.get("route_id"),
+				ServiceID:   r.get("service_id"),
+				Headsign:    r.get("trip_headsign"),
+				DirectionID: r.get("direction_id"),
+				ShapeID:     r.get("shape_id"),
+			}
+			return nil
+		}},
+		{"stop_times.txt", false, []string{"trip_id", "stop_id", "stop_sequence"}, func(r row) error {
+			tripID := r.get("trip_id")
+			feed.StopTimes[tripID] = append(feed.StopTimes[tripID], StopTime{
+				StopID:        r.get("stop_id"),
+				Sequence:      r.int("stop_sequence"),
+				Arrival:       r.time("arrival_time"),
+				Departure:     r.time("departure_time"),
+				ShapeDistance: r.float("shape_dist_traveled"),
+			})
+			return r.err
+		}},
+		{"shapes.txt", false, []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"}, func(r row) error {
+			shapeID := r.get("shape_id")
+			feed.Shapes[shapeID] = append(feed.Shapes[shapeID], ShapePoint{
+				Lat:      r.float("shape_pt_lat"),
+				Lon:      r.float("shape_pt_lon"),
+				Sequence: r.int("shape_pt_sequence"),
+				Distance: r.float("shape_dist_traveled"),
+			})
+			return r.err
+		}},
+		{"translations.txt", false, []string{"table_name", "field_name", "language", "translation"}, func(r row) error {
+			if r.get("table_name") != "stops" || r.get("field_name") != "stop_name" {
+				return nil
+			}
+			language, translation := r.get("language"), r.get("translation")
+			if recordID := r.get("record_id"); recordID != "" {
+				if stop, ok := feed.Stops[recordID]; ok {
+					stop.translate(language, translation)
+				}
+			} else if name := r.get("field_value"); name != "" {
+				if nameTranslations[name] == nil {
+					nameTranslations[name] = make(map[string]string)
+				}
+				nameTranslations[name][language] = translation
+			}
+			return nil
+		}},
+	}
+
+	for _, table := range tables {
+		err := readTable(fsys, table.name, table.columns, table.read)
+		if errors.Is(err, fs.ErrNotExist) && !table.required {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, stop := range feed.Stops {
+		for language, translation := range nameTranslations[stop.Name] {
+			stop.translate(language, translation)
+		}
+	}
+	feed.index()
+	return feed, nil
+}
+
+// row is a record of a GTFS table, with its values looked up by column name. Parsing errors are
+// kept in err.
+type row struct {
+	columns map[string]int
+	record  []string
+	line    int
+	err     error
+}
+
+func (r *row) get(column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.record) {
+		return ""
+	}
+	return strings.TrimSpace(r.record[i])
+}
+
+func (r *row) float(column string) float64 {
+	value := r.get(column)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("line %d: invalid %s %q", r.line, column, value)
+	}
+	return f
+}
+
+func (r *row) int(column string) int {
+	value := r.get(column)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("line %d: invalid %s %q", r.line, column, value)
+	}
+	return n
+}
+
+// time parses an HH:MM:SS time into seconds since the start of the service day
+func (r *row) time(column string) int {
+	value := r.get(column)
+	if value == "" {
+		return 0
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) == 3 {
+		hours, hErr := strconv.Atoi(parts[0])
+		minutes, mErr := strconv.Atoi(parts[1])
+		seconds, sErr := strconv.Atoi(parts[2])
+		if hErr == nil && mErr == nil && sErr == nil {
+			return hours*3600 + minutes*60 + seconds
+		}
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("line %d: invalid %s %q", r.line, column, value)
+	}
+	return 0
+}
+
+// readTable reads every record of a GTFS table, which must have the required columns
+func readTable(fsys fs.FS, name string, required []string, read func(row row) error) error {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", name, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		columns[strings.TrimPrefix(strings.TrimSpace(column), "\ufeff")] = i
+	}
+	for _, column := range required {
+		if _, ok := columns[column]; !ok {
+			return fmt.Errorf("error reading %s: missing column %s", name, column)
+		}
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		if err := read(row{columns: columns, record: record, line: line}); err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+	}
+}
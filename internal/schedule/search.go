@@ -0,0 +1,189 @@
+package schedule
+
+import (
+	"finbus/internal/geo"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchEntry is a stop with its names and code normalized for searching
+type searchEntry struct {
+	stop  *Stop
+	code  string
+	names []string
+}
+
+// StopDistance is a stop and its distance in meters from a searched location
+type StopDistance struct {
+	Stop     *Stop
+	Distance float64
+}
+
+// folding replaces the accented letters of Finnish and Swedish names, so that "itakeskus" finds
+// Itäkeskus
+var folding = strings.NewReplacer("å", "a", "ä", "a", "á", "a", "à", "a", "ö", "o", "ø", "o", "ó", "o",
+	"é", "e", "è", "e", "ü", "u")
+
+// normalize lowercases and folds a name and separates its words with single spaces
+func normalize(name string) string {
+	words := strings.FieldsFunc(folding.Replace(strings.ToLower(name)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// translate adds a translation of the stop name
+func (s *Stop) translate(language, name string) {
+	if language == "" || name == "" {
+		return
+	}
+	if s.Names == nil {
+		s.Names = make(map[string]string)
+	}
+	s.Names[language] = name
+}
+
+// indexNames normalizes the names of every stop for searching
+func (f *Feed) indexNames() {
+	f.searchIndex = make([]searchEntry, 0, len(f.Stops))
+	for _, stop := range f.Stops {
+		entry := searchEntry{stop: stop, code: normalize(stop.Code), names: []string{normalize(stop.Name)}}
+		for _, name := range stop.Names {
+			if normalized := normalize(name); normalized != entry.names[0] {
+				entry.names = append(entry.names, normalized)
+			}
+		}
+		f.searchIndex = append(f.searchIndex, entry)
+	}
+	sort.Slice(f.searchIndex, func(i, j int) bool { return f.searchIndex[i].stop.ID < f.searchIndex[j].stop.ID })
+}
+
+// SearchStops returns the stops whose code or name, in any language, matches the query, at most
+// limit of them if limit is positive. Exact matches come first, then names starting with the
+// query, names with a word starting with it, names containing it, and names with a word nearly
+// starting with it, allowing a typo in every four letters.
+func (f *Feed) SearchStops(query string, limit int) []*Stop {
+	query = normalize(query)
+	if query == "" {
+		return nil
+	}
+	type match struct {
+		stop  *Stop
+		score int
+	}
+	var matches []match
+	for _, entry := range f.searchIndex {
+		best := -1
+		if entry.code == query {
+			best = 0
+		}
+		for _, name := range entry.names {
+			if score := matchScore(query, name); score >= 0 && (best < 0 || score < best) {
+				best = score
+			}
+		}
+		if best >= 0 {
+			matches = append(matches, match{entry.stop, best})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.score != b.score {
+			return a.score < b.score
+		}
+		if len(a.stop.Name) != len(b.stop.Name) {
+			return len(a.stop.Name) < len(b.stop.Name)
+		}
+		return a.stop.Name < b.stop.Name
+	})
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	stops := make([]*Stop, len(matches))
+	for i, m := range matches {
+		stops[i] = m.stop
+	}
+	return stops
+}
+
+// matchScore ranks how well a normalized name matches a normalized query, lower is better, or
+// returns -1 if it does not match
+func matchScore(query, name string) int {
+	switch {
+	case name == query:
+		return 0
+	case strings.HasPrefix(name, query):
+		return 1
+	case strings.Contains(" "+name, " "+query):
+		return 2
+	case strings.Contains(name, query):
+		return 3
+	}
+
+	q, n := []rune(query), []rune(name)
+	maxEdits := min(len(q)/4, 2)
+	if maxEdits == 0 {
+		return -1
+	}
+	for start := range n {
+		if start > 0 && n[start-1] != ' ' {
+			continue
+		}
+		for length := len(q) - 1; length <= len(q)+1; length++ {
+			end := min(start+length, len(n))
+			if editDistance(q, n[start:end]) <= maxEdits {
+				return 4
+			}
+		}
+	}
+	return -1
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// StopsNear returns the stops within radius meters of a location ordered by distance, at most
+// limit of them if limit is positive
+func (f *Feed) StopsNear(lat, lon, radius float64, limit int) []StopDistance {
+	// Skip the stops outside the bounding box of the radius before computing distances
+	latDelta := radius / geo.EarthRadius * 180 / math.Pi
+	lonDelta := latDelta / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+
+	var near []StopDistance
+	for _, entry := range f.searchIndex {
+		stop := entry.stop
+		if math.Abs(stop.Lat-lat) > latDelta || math.Abs(stop.Lon-lon) > lonDelta {
+			continue
+		}
+		if distance := geo.Distance(lat, lon, stop.Lat, stop.Lon); distance <= radius {
+			near = append(near, StopDistance{Stop: stop, Distance: distance})
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool { return near[i].Distance < near[j].Distance })
+
+	if limit > 0 && len(near) > limit {
+		near = near[:limit]
+	}
+	return near
+}
@@ -0,0 +1,155 @@
+package schedule
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds the current GTFS feed, reloading it when the file changes
+type Store interface {
+	// Feed returns the current feed
+	Feed() *Feed
+	// Enrich adds the stop name, route long name and color, headsign and shape ID of the
+	// scheduled data to live bus data
+	Enrich(data models.BusData) models.BusData
+	// Start refreshes the feed every refresh interval until ctx is cancelled
+	Start(ctx context.Context) error
+}
+
+type store struct {
+	cfg    config.GTFSConfig
+	feed   atomic.Pointer[Feed]
+	logger *slog.Logger
+	// modified is when the loaded feed files were last modified
+	modified time.Time
+}
+
+// NewStore loads the GTFS feed of cfg.Path
+func NewStore(cfg config.GTFSConfig, logger *slog.Logger) (Store, error) {
+	s := &store{cfg: cfg, logger: logger.With("component", "gtfs", "path", cfg.Path)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStaticStore returns a store holding a feed that is never reloaded
+func NewStaticStore(feed *Feed) Store {
+	s := &store{logger: slog.Default()}
+	s.feed.Store(feed)
+	return s
+}
+
+// Feed returns the current feed
+func (s *store) Feed() *Feed {
+	return s.feed.Load()
+}
+
+// Start refreshes the feed every refresh interval until ctx is cancelled. The feed is only
+// reloaded if its files were modified, and the previous feed is kept if it cannot be loaded.
+func (s *store) Start(ctx context.Context) error {
+	if s.cfg.RefreshInterval <= 0 || s.cfg.Path == "" {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(s.cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.reload(); err != nil {
+					s.logger.Error("Error refreshing GTFS feed, keeping the previous one", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// reload loads the feed if its files were modified since it was last loaded
+func (s *store) reload() error {
+	modified, err := lastModified(s.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("error opening GTFS feed: %v", err)
+	}
+	if s.feed.Load() != nil && !modified.After(s.modified) {
+		return nil
+	}
+
+	start := time.Now()
+	feed, err := Load(s.cfg.Path)
+	if err != nil {
+		return err
+	}
+	s.feed.Store(feed)
+	s.modified = modified
+	s.logger.Info("Loaded GTFS feed", "stops", len(feed.Stops), "routes", len(feed.Routes), "trips", len(feed.Trips),
+		"shapes", len(feed.Shapes), "duration", time.Since(start))
+	return nil
+}
+
+// lastModified returns when the feed file, or the latest file of a feed directory, was modified
+func lastModified(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !info.IsDir() {
+		return info.ModTime(), nil
+	}
+	latest := info.ModTime()
+	err = filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entryInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if entryInfo.ModTime().After(latest) {
+			latest = entryInfo.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// Enrich adds the scheduled data of the stop, route and trip of the bus data. Values already set
+// by the feed the data was received from are kept.
+func (s *store) Enrich(data models.BusData) models.BusData {
+	feed := s.Feed()
+	if feed == nil {
+		return data
+	}
+	if stop, ok := feed.Stops[data.NextStop]; ok {
+		data.NextStopName = stop.Name
+	}
+	if route, ok := feed.Routes[data.RouteID]; ok {
+		data.RouteLongName = route.LongName
+		if data.ShortName == "" {
+			data.ShortName = route.ShortName
+		}
+		if data.Color == "" {
+			data.Color = route.Color
+		}
+	}
+	if trip, ok := feed.Trips[data.TripID]; ok {
+		data.ShapeID = trip.ShapeID
+		if data.TripHeadsign == "" {
+			data.TripHeadsign = trip.Headsign
+		}
+	}
+	return data
+}
+
+var _ Store = (*store)(nil)
@@ -0,0 +1,393 @@
+package services
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/geo"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultStationaryRadius is the distance in meters a stationary vehicle moves within, absorbing
+// GPS noise
+const defaultStationaryRadius = 50
+
+type AlertService interface {
+	// Observer tracks the vehicles, routes and feed the rules watch
+	Observer
+	// Start evaluates the rules every interval, and starts the notifier, until ctx is cancelled,
+	// then releases the watched routes
+	Start(ctx context.Context)
+	// Watch receives the vehicles of the routes the rules watch through busData, whether or not
+	// clients subscribe to them, and tells from it whether bus updates are expected
+	Watch(busData BusDataService)
+	// Evaluate evaluates the rules, notifying the alerts that began firing or were resolved
+	Evaluate()
+	// Alerts returns the firing alerts, oldest first
+	Alerts() []models.Alert
+}
+
+// AlertNotifier delivers alert notifications
+type AlertNotifier interface {
+	// Start delivers the notified alerts until ctx is cancelled
+	Start(ctx context.Context)
+	// Notify queues the alert for delivery
+	Notify(alert models.Alert)
+}
+
+// AlertOptions configures the alert rules and their notifications
+type AlertOptions struct {
+	Rules []config.AlertRule
+	// Interval is how often the rules are evaluated once started
+	Interval time.Duration
+	// RepeatInterval is how often an alert still firing is notified again, never if 0
+	RepeatInterval time.Duration
+	// Notifier delivers the alerts, which are only logged if nil
+	Notifier AlertNotifier
+	// ContinuousIngestion expects bus updates even without subscribed MQTT topics, as polled and
+	// replayed sources deliver every vehicle regardless of subscriptions
+	ContinuousIngestion bool
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+// alertRule is a validated rule with its service hours resolved
+type alertRule struct {
+	config.AlertRule
+	routes   map[string]bool
+	hours    bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+// inService returns when the current service hours of the rule began, false outside them
+func (r *alertRule) inService(now time.Time) (time.Time, bool) {
+	if !r.hours {
+		return time.Time{}, true
+	}
+	local := now.In(r.location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local
+	switch {
+	case r.start < r.end && (minute < r.start || minute >= r.end):
+		return time.Time{}, false
+	case r.start > r.end && minute < r.start && minute >= r.end:
+		return time.Time{}, false
+	case r.start > r.end && minute < r.end:
+		// The service hours began the day before
+		day = local.AddDate(0, 0, -1)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), r.start/60, r.start%60, 0, 0, r.location), true
+}
+
+// anchor is where a vehicle has stayed within a rule's radius of since
+type anchor struct {
+	lat, lon float64
+	since    time.Time
+}
+
+// watchedVehicle is a vehicle tracked for the stationary rules, with an anchor per rule
+type watchedVehicle struct {
+	routeID string
+	seen    time.Time
+	anchors map[int]*anchor
+}
+
+// firingAlert is an alert that has not been resolved yet
+type firingAlert struct {
+	alert    models.Alert
+	notified time.Time
+}
+
+type alertService struct {
+	rules   []*alertRule
+	options AlertOptions
+	logger  *slog.Logger
+	watch   *ingestWatch
+
+	mu         sync.Mutex
+	busData    BusDataService
+	started    time.Time
+	lastUpdate time.Time
+	// lastIdle is when bus updates were last not expected, so silence is only counted after it
+	lastIdle time.Time
+	vehicles map[string]*watchedVehicle
+	routes   map[string]time.Time
+	firing   map[string]*firingAlert
+}
+
+// NewAlertService creates a new AlertService evaluating the rules
+func NewAlertService(options AlertOptions, logger *slog.Logger) (AlertService, error) {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	logger = logger.With("component", "alerts")
+	s := &alertService{
+		options:  options,
+		logger:   logger,
+		watch:    newIngestWatch(logger),
+		started:  options.Now(),
+		vehicles: make(map[string]*watchedVehicle),
+		routes:   make(map[string]time.Time),
+		firing:   make(map[string]*firingAlert),
+	}
+	for _, rule := range options.Rules {
+		compiled := &alertRule{AlertRule: rule, routes: make(map[string]bool, len(rule.Routes))}
+		for _, route := range rule.Routes {
+			compiled.routes[route] = true
+		}
+		if compiled.Radius == 0 {
+			compiled.Radius = defaultStationaryRadius
+		}
+		location, err := time.LoadLocation(rule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("error loading time zone of alert rule %q: %v", rule.Name, err)
+		}
+		compiled.location = location
+		if rule.ServiceHours != "" {
+			compiled.start, compiled.end, err = config.ParseServiceHours(rule.ServiceHours)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing service hours of alert rule %q: %v", rule.Name, err)
+			}
+			compiled.hours = true
+		}
+		s.rules = append(s.rules, compiled)
+	}
+
+	filters := make(map[string]models.BusFilter)
+	for _, rule := range s.rules {
+		if len(rule.Routes) > 0 {
+			filters[rule.Name] = models.BusFilter{Routes: rule.Routes}
+		}
+	}
+	s.watch.set(filters)
+	return s, nil
+}
+
+// Start evaluates the rules every interval, and starts the notifier, until ctx is cancelled, then
+// releases the watched routes
+func (s *alertService) Start(ctx context.Context) {
+	if s.options.Notifier != nil {
+		s.options.Notifier.Start(ctx)
+	}
+	if len(s.rules) == 0 {
+		return
+	}
+	s.logger.Info("Evaluating alert rules", "rules", len(s.rules), "interval", s.options.Interval)
+	go func() {
+		ticker := time.NewTicker(s.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.watch.close()
+				return
+			case <-ticker.C:
+				s.Evaluate()
+			}
+		}
+	}()
+}
+
+// Watch receives the vehicles of the routes the rules watch through busData, and expects bus
+// updates while it has MQTT topics subscribed
+func (s *alertService) Watch(busData BusDataService) {
+	s.mu.Lock()
+	s.busData = busData
+	s.mu.Unlock()
+	if len(s.rules) > 0 {
+		s.watch.attach(busData)
+	}
+}
+
+// expectsUpdates reports whether bus updates are expected, either from a continuous source or for
+// the subscribed MQTT topics, as only subscribed topics are received. The lock must be held.
+func (s *alertService) expectsUpdates() bool {
+	return s.options.ContinuousIngestion || (s.busData != nil && s.busData.IngestionStatus().ActiveTopics > 0)
+}
+
+// Observe records the update of the feed, the vehicle's route and whether the vehicle moved out
+// of the radius of each stationary rule
+func (s *alertService) Observe(data models.BusData) {
+	if len(s.rules) == 0 {
+		return
+	}
+	now := s.options.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpdate = now
+	if data.RouteID != "" {
+		s.routes[data.RouteID] = now
+	}
+	lat, lon, ok := vehiclePosition(data)
+	if data.VehicleID == "" || !ok {
+		return
+	}
+	vehicle, ok := s.vehicles[data.VehicleID]
+	if !ok {
+		vehicle = &watchedVehicle{anchors: make(map[int]*anchor)}
+		s.vehicles[data.VehicleID] = vehicle
+	}
+	vehicle.routeID = data.RouteID
+	vehicle.seen = now
+	for i, rule := range s.rules {
+		if rule.Type != config.AlertVehicleStationary {
+			continue
+		}
+		at, ok := vehicle.anchors[i]
+		if !ok || geo.Distance(at.lat, at.lon, lat, lon) > rule.Radius {
+			vehicle.anchors[i] = &anchor{lat: lat, lon: lon, since: now}
+		}
+	}
+}
+
+// Evaluate evaluates the rules. Alerts are notified when they begin firing, again every repeat
+// interval while they keep firing, and once more when resolved.
+func (s *alertService) Evaluate() {
+	now := s.options.Now()
+	s.mu.Lock()
+	for id, vehicle := range s.vehicles {
+		if now.Sub(vehicle.seen) > vehicleTTL {
+			delete(s.vehicles, id)
+		}
+	}
+	if !s.expectsUpdates() {
+		s.lastIdle = now
+	}
+	conditions := make(map[string]models.Alert)
+	for i, rule := range s.rules {
+		for _, alert := range s.evaluate(i, rule, now) {
+			conditions[alert.ID] = alert
+		}
+	}
+
+	var notifications []models.Alert
+	for id, alert := range conditions {
+		firing, ok := s.firing[id]
+		switch {
+		case !ok:
+			firing = &firingAlert{notified: now}
+			s.firing[id] = firing
+			notifications = append(notifications, alert)
+		case s.options.RepeatInterval > 0 && now.Sub(firing.notified) >= s.options.RepeatInterval:
+			firing.notified = now
+			notifications = append(notifications, alert)
+		}
+		firing.alert = alert
+	}
+	for id, firing := range s.firing {
+		if _, ok := conditions[id]; ok {
+			continue
+		}
+		resolved := firing.alert
+		resolved.Status = models.AlertResolved
+		resolved.ResolvedAt = &now
+		notifications = append(notifications, resolved)
+		delete(s.firing, id)
+	}
+	metrics.AlertsFiring.Set(float64(len(s.firing)))
+	s.mu.Unlock()
+
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].ID < notifications[j].ID })
+	for _, alert := range notifications {
+		if alert.Status == models.AlertFiring {
+			s.logger.Warn("Alert firing", "id", alert.ID, "rule", alert.Rule, "message", alert.Message)
+		} else {
+			s.logger.Info("Alert resolved", "id", alert.ID, "rule", alert.Rule)
+		}
+		if s.options.Notifier != nil {
+			s.options.Notifier.Notify(alert)
+		}
+	}
+}
+
+// evaluate returns the alerts of the rule whose condition has held for the rule's duration. Routes
+// and the feed are only silent while bus updates are expected. The lock must be held.
+func (s *alertService) evaluate(i int, rule *alertRule, now time.Time) []models.Alert {
+	alert := func(subject string, since time.Time, message string) models.Alert {
+		id := rule.Name
+		if subject != "" {
+			id += "/" + subject
+		}
+		return models.Alert{
+			ID:        id,
+			Rule:      rule.Name,
+			Type:      rule.Type,
+			Status:    models.AlertFiring,
+			Message:   message,
+			StartedAt: since,
+		}
+	}
+
+	var alerts []models.Alert
+	switch rule.Type {
+	case config.AlertVehicleStationary:
+		for id, vehicle := range s.vehicles {
+			at, ok := vehicle.anchors[i]
+			if !ok || (len(rule.routes) > 0 && !rule.routes[vehicle.routeID]) || now.Sub(at.since) < rule.For {
+				continue
+			}
+			a := alert(id, at.since, fmt.Sprintf("Vehicle %s on route %s has been stationary for %s",
+				id, vehicle.routeID, now.Sub(at.since).Round(time.Second)))
+			a.VehicleID = id
+			a.RouteID = vehicle.routeID
+			alerts = append(alerts, a)
+		}
+	case config.AlertRouteWithoutVehicles:
+		began, ok := rule.inService(now)
+		if !ok {
+			return nil
+		}
+		for _, route := range rule.Routes {
+			since := latest(s.started, began, s.routes[route], s.lastIdle)
+			if now.Sub(since) < rule.For {
+				continue
+			}
+			a := alert(route, since, fmt.Sprintf("No vehicles on route %s for %s", route, now.Sub(since).Round(time.Second)))
+			a.RouteID = route
+			alerts = append(alerts, a)
+		}
+	case config.AlertFeedSilent:
+		since := latest(s.started, s.lastUpdate, s.lastIdle)
+		if now.Sub(since) >= rule.For {
+			alerts = append(alerts, alert("", since, fmt.Sprintf("No bus updates received for %s", now.Sub(since).Round(time.Second))))
+		}
+	}
+	return alerts
+}
+
+// latest returns the latest of the times
+func latest(times ...time.Time) time.Time {
+	var last time.Time
+	for _, t := range times {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// Alerts returns the firing alerts, oldest first
+func (s *alertService) Alerts() []models.Alert {
+	s.mu.Lock()
+	alerts := make([]models.Alert, 0, len(s.firing))
+	for _, firing := range s.firing {
+		alerts = append(alerts, firing.alert)
+	}
+	s.mu.Unlock()
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].StartedAt.Equal(alerts[j].StartedAt) {
+			return alerts[i].StartedAt.Before(alerts[j].StartedAt)
+		}
+		return alerts[i].ID < alerts[j].ID
+	})
+	return alerts
+}
+
+var _ AlertService = (*alertService)(nil)
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhookQueueSize is the number of alerts buffered for delivery before new ones are dropped
+const webhookQueueSize = 256
+
+// Headers of webhook deliveries
+const (
+	// WebhookDeliveryHeader identifies a delivery, and is the same on every attempt of it
+	WebhookDeliveryHeader = "X-Finbus-Delivery"
+	// WebhookTimestampHeader is the Unix time of the attempt
+	WebhookTimestampHeader = "X-Finbus-Timestamp"
+	// WebhookSignatureHeader is the SignWebhook signature of the attempt
+	WebhookSignatureHeader = "X-Finbus-Signature"
+)
+
+// WebhookOptions configures the delivery of alerts to a webhook
+type WebhookOptions struct {
+	URL string
+	// Secret signs the deliveries, which are unsigned if empty
+	Secret  string
+	Timeout time.Duration
+	// MaxAttempts bounds the attempts to deliver an alert. Failed attempts are retried after
+	// RetryBackoff, doubled on every retry.
+	MaxAttempts  int
+	RetryBackoff time.Duration
+}
+
+// webhookDelivery is an alert queued for delivery
+type webhookDelivery struct {
+	id    string
+	alert models.Alert
+	body  []byte
+}
+
+type webhookNotifier struct {
+	options WebhookOptions
+	client  *http.Client
+	queue   chan webhookDelivery
+	logger  *slog.Logger
+}
+
+// NewWebhookNotifier creates a new AlertNotifier posting every alert as JSON to the webhook URL.
+// Alerts are delivered one at a time in the order notified, so a resolution never arrives before
+// the alert.
+func NewWebhookNotifier(options WebhookOptions, logger *slog.Logger) AlertNotifier {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	return &webhookNotifier{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+		queue:   make(chan webhookDelivery, webhookQueueSize),
+		logger:  logger.With("component", "webhook"),
+	}
+}
+
+// SignWebhook returns the signature of a delivery attempt: sha256= followed by the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify queues the alert for delivery, dropping it if the queue is full
+func (n *webhookNotifier) Notify(alert models.Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		n.logger.Error("Error encoding alert", "id", alert.ID, "error", err)
+		return
+	}
+	select {
+	case n.queue <- webhookDelivery{id: newID(), alert: alert, body: body}:
+		metrics.QueueDepth.WithLabelValues("alert_webhook").Set(float64(len(n.queue)))
+	default:
+		metrics.AlertNotifications.WithLabelValues("dropped").Inc()
+		n.logger.Error("Alert webhook queue full, dropping alert", "id", alert.ID, "status", alert.Status)
+	}
+}
+
+// Start delivers the queued alerts until ctx is cancelled
+func (n *webhookNotifier) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case delivery := <-n.queue:
+				metrics.QueueDepth.WithLabelValues("alert_webhook").Set(float64(len(n.queue)))
+				n.deliver(ctx, delivery)
+			}
+		}
+	}()
+}
+
+// deliver posts the delivery until it succeeds, fails permanently or runs out of attempts
+func (n *webhookNotifier) deliver(ctx context.Context, delivery webhookDelivery) {
+	backoff := n.options.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, delivery)
+		if err == nil {
+			metrics.AlertNotifications.WithLabelValues("delivered").Inc()
+			n.logger.Debug("Delivered alert", "id", delivery.alert.ID, "status", delivery.alert.Status, "attempt", attempt)
+			return
+		}
+		if !retry || attempt >= n.options.MaxAttempts || ctx.Err() != nil {
+			metrics.AlertNotifications.WithLabelValues("failed").Inc()
+			n.logger.Error("Error delivering alert", "id", delivery.alert.ID, "status", delivery.alert.Status,
+				"attempts", attempt, "error", err)
+			return
+		}
+		n.logger.Warn("Error delivering alert, retrying", "id", delivery.alert.ID, "attempt", attempt,
+			"backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt, reporting whether a failure is worth retrying. Network
+// errors, timeouts, rate limiting and server errors are.
+func (n *webhookNotifier) post(ctx context.Context, delivery webhookDelivery) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.options.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "finbus")
+	req.Header.Set(WebhookDeliveryHeader, delivery.id)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if n.options.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(n.options.Secret, timestamp, delivery.body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+}
+
+var _ AlertNotifier = (*webhookNotifier)(nil)
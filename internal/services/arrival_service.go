@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentWindow is how far back observed segment times are used for predictions
+	segmentWindow = time.Hour
+	// segmentRefresh is how often the observed segment times are loaded from storage
+	segmentRefresh = time.Minute
+	// minSegmentObservations is the number of observations needed to prefer the observed travel
+	// time of a segment over the scheduled one
+	minSegmentObservations = 2
+	// watchTTL is how long the vehicles serving a stop stay subscribed after its arrivals were
+	// last requested
+	watchTTL = 10 * time.Minute
+	// watchWarmup is how long after the vehicles serving a stop are first subscribed its arrivals
+	// are pending, as the vehicles are only known once they report their position
+	watchWarmup = 5 * time.Second
+)
+
+// ErrUnknownStop is returned for stops that are not in the GTFS feed
+var ErrUnknownStop = errors.New("unknown stop")
+
+type ArrivalService interface {
+	// Arrivals returns the predicted arrivals of live vehicles at the stop, soonest first, at
+	// most limit of them if limit is positive
+	Arrivals(ctx context.Context, stopID string, limit int) ([]models.Arrival, error)
+	// Filter returns the filter matching the vehicles of the routes serving the stop, whose
+	// updates change its arrivals
+	Filter(stopID string) (models.BusFilter, error)
+	// Pending reports whether the vehicles serving the stop were subscribed too recently for all
+	// of them to be known, so its arrivals are incomplete
+	Pending(stopID string) bool
+	// Start releases the vehicles of the stops whose arrivals were not requested for a while,
+	// until ctx is cancelled, then releases every vehicle
+	Start(ctx context.Context)
+}
+
+// ArrivalOptions configures the arrival predictions
+type ArrivalOptions struct {
+	// WatchTTL is how long the vehicles serving a stop stay subscribed after its arrivals were
+	// last requested, watchTTL if 0
+	WatchTTL time.Duration
+	// WatchWarmup is how long the arrivals of a stop are pending after its vehicles are first
+	// subscribed, watchWarmup if 0
+	WatchWarmup time.Duration
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+type arrivalService struct {
+	busData  BusDataService
+	schedule schedule.Store
+	storage  influxdb.BusDataManager
+	options  ArrivalOptions
+	logger   *slog.Logger
+
+	// segments are the observed segment times by from and to stop, loaded at segmentsLoaded
+	segmentsMu     sync.Mutex
+	segments       map[[2]string]models.SegmentStats
+	segmentsLoaded time.Time
+
+	// watcher keeps the vehicles of the stops in watched subscribed until their expiry, so the
+	// vehicles are known to the next request. Nothing is watched once stopped.
+	watchMu sync.Mutex
+	watcher *Subscriber
+	watched map[string]watchedStop
+	stopped bool
+}
+
+// watchedStop is a stop whose vehicles are subscribed since the time until the expiry
+type watchedStop struct {
+	since  time.Time
+	expiry time.Time
+}
+
+// NewArrivalService creates a new ArrivalService predicting arrivals at the stops of the GTFS
+// feed, which may be nil if none is configured, from the vehicles of the bus data service and the
+// segment times in storage
+func NewArrivalService(busData BusDataService, store schedule.Store, storage influxdb.BusDataManager, options ArrivalOptions, logger *slog.Logger) ArrivalService {
+	if options.WatchTTL <= 0 {
+		options.WatchTTL = watchTTL
+	}
+	if options.WatchWarmup <= 0 {
+		options.WatchWarmup = watchWarmup
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	return &arrivalService{
+		busData:  busData,
+		schedule: store,
+		storage:  storage,
+		options:  options,
+		logger:   logger.With("component", "arrivals"),
+		watched:  make(map[string]watchedStop),
+	}
+}
+
+// Filter returns the filter matching the vehicles of the routes serving the stop
+func (s *arrivalService) Filter(stopID string) (models.BusFilter, error) {
+	if s.schedule == nil {
+		return models.BusFilter{}, ErrNoSchedule
+	}
+	feed := s.schedule.Feed()
+	if _, ok := feed.Stops[stopID]; !ok {
+		return models.BusFilter{}, ErrUnknownStop
+	}
+	var filter models.BusFilter
+	for _, route := range feed.RoutesAtStop(stopID) {
+		filter.Routes = append(filter.Routes, route.ID)
+	}
+	return filter, nil
+}
+
+// Arrivals predicts when the live vehicles of the routes serving the stop arrive at it. The
+// vehicles are subscribed to for a while, so the first requests for a stop may not know them yet,
+// which Pending reports.
+func (s *arrivalService) Arrivals(ctx context.Context, stopID string, limit int) ([]models.Arrival, error) {
+	filter, err := s.Filter(stopID)
+	if err != nil {
+		return nil, err
+	}
+	arrivals := []models.Arrival{}
+	if filter.IsEmpty() {
+		return arrivals, nil
+	}
+	s.watch(stopID, filter)
+
+	vehicles, _, err := s.busData.Snapshot(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	feed := s.schedule.Feed()
+	segments := s.segmentTimes(ctx)
+	now := s.options.Now()
+	for _, vehicle := range vehicles {
+		if arrival, ok := predictArrival(feed, segments, vehicle, stopID, now); ok {
+			arrivals = append(arrivals, arrival)
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].PredictedAt.Before(arrivals[j].PredictedAt) })
+	if limit > 0 && len(arrivals) > limit {
+		arrivals = arrivals[:limit]
+	}
+	return arrivals, nil
+}
+
+// Start releases the stops that expired every half of the watch TTL until ctx is cancelled, then
+// closes the watcher
+func (s *arrivalService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.options.WatchTTL / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.stop()
+				return
+			case <-ticker.C:
+				s.expire(time.Now())
+			}
+		}
+	}()
+}
+
+// watch subscribes to the vehicles serving the stop until the watch TTL after the last request
+func (s *arrivalService) watch(stopID string, filter models.BusFilter) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.watcher == nil {
+		s.watcher = s.busData.NewSubscriber()
+		// The updates are only needed in the vehicle cache
+		go func(updates <-chan Update) {
+			for range updates {
+			}
+		}(s.watcher.Updates)
+	}
+
+	now := time.Now()
+	watched, ok := s.watched[stopID]
+	if !ok {
+		if err := s.busData.Subscribe(s.watcher, stopID, filter); err != nil {
+			s.logger.Warn("Error subscribing to the vehicles serving a stop", "stop_id", stopID, "error", err)
+			return
+		}
+		watched.since = now
+	}
+	watched.expiry = now.Add(s.options.WatchTTL)
+	s.watched[stopID] = watched
+}
+
+// Pending reports whether the vehicles serving the stop were first subscribed less than the watch
+// warmup ago
+func (s *arrivalService) Pending(stopID string) bool {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	watched, ok := s.watched[stopID]
+	return ok && time.Since(watched.since) < s.options.WatchWarmup
+}
+
+// expire releases the vehicles of the stops whose watch expired
+func (s *arrivalService) expire(now time.Time) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for stopID, watched := range s.watched {
+		if now.After(watched.expiry) {
+			delete(s.watched, stopID)
+			_ = s.busData.Unsubscribe(s.watcher, stopID)
+		}
+	}
+}
+
+// stop closes the watcher, releasing the vehicles of every stop
+func (s *arrivalService) stop() {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.stopped = true
+	if s.watcher != nil {
+		s.busData.CloseSubscriber(s.watcher)
+		s.watcher = nil
+	}
+	s.watched = make(map[string]watchedStop)
+}
+
+// segmentTimes returns the recently observed segment times, reloading them from storage at most
+// once per segmentRefresh. The previous times are kept if they cannot be loaded.
+func (s *arrivalService) segmentTimes(ctx context.Context) map[[2]string]models.SegmentStats {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+	if s.segments != nil && time.Since(s.segmentsLoaded) < segmentRefresh {
+		return s.segments
+	}
+
+	stats, err := s.storage.QuerySegmentTimes(ctx, segmentWindow)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Error loading segment times", "error", err)
+		if s.segments == nil {
+			return map[[2]string]models.SegmentStats{}
+		}
+		return s.segments
+	}
+	s.segments = make(map[[2]string]models.SegmentStats, len(stats))
+	for _, segment := range stats {
+		s.segments[[2]string{segment.FromStop, segment.ToStop}] = segment
+	}
+	s.segmentsLoaded = time.Now()
+	return s.segments
+}
+
+// tripPosition is where a vehicle is on its trip by the schedule
+type tripPosition struct {
+	// next is the index of the next stop in the stop times of the trip, and left the fraction of
+	// the way from the previous stop the vehicle has left
+	next int
+	left float64
+	// serviceDay is the start of the service day of the trip, and scheduled the seconds since
+	// then the vehicle was scheduled at its position
+	serviceDay time.Time
+	scheduled  float64
+}
+
+// scheduledAt returns when the vehicle was scheduled at its position
+func (p tripPosition) scheduledAt() time.Time {
+	return p.serviceDay.Add(time.Duration(p.scheduled * float64(time.Second)))
+}
+
+// scheduledPosition places the vehicle between the previous stop and its next stop by its
+// distances to them, which gives the scheduled time at its position. A vehicle heading to the
+// first stop is scheduled at its departure. ok is false if the trip is not in the feed or does
+// not have the next stop.
+func scheduledPosition(feed *schedule.Feed, vehicle models.BusData, now time.Time) (tripPosition, bool) {
+	stopTimes := feed.StopTimes[vehicle.TripID]
+	next := feed.StopIndex(vehicle.TripID, vehicle.NextStop, 0)
+	if next < 0 {
+		return tripPosition{}, false
+	}
+	position := tripPosition{next: next, left: 1, scheduled: float64(stopTimes[0].Departure)}
+	if next > 0 {
+		from, to := stopTimes[next-1], stopTimes[next]
+		position.left = segmentLeft(feed, from.StopID, to.StopID, vehicle)
+		position.scheduled = float64(from.Departure) + (1-position.left)*float64(to.Arrival-from.Departure)
+	}
+	position.serviceDay = feed.ServiceDay(now, int(position.scheduled))
+	return position, true
+}
+
+// scheduleDelay returns the seconds the vehicle is behind the schedule at its position. A
+// vehicle heading to the first stop departs on schedule at the earliest, so it is only late once
+// its departure has passed. ok is false if the trip is not in the feed or does not have the next
+// stop.
+func scheduleDelay(feed *schedule.Feed, vehicle models.BusData, now time.Time) (int, bool) {
+	position, ok := scheduledPosition(feed, vehicle, now)
+	if !ok {
+		return 0, false
+	}
+	delay := now.Sub(position.scheduledAt())
+	if position.next == 0 {
+		delay = max(delay, 0)
+	}
+	return int(delay.Round(time.Second).Seconds()), true
+}
+
+// predictArrival predicts when the vehicle arrives at the stop on its current trip. ok is false
+// if the trip is not in the feed or does not reach the stop anymore.
+//
+// The vehicle is scheduled at its position, which gives its delay. The remaining time is the rest
+// of the current segment and every segment up to the stop, each taking its recently observed mean
+// travel time if there are enough observations and its scheduled time otherwise, which carries
+// the current delay over. Without enough observations on the way, a vehicle whose feed reports
+// its delay is predicted to keep that delay instead.
+func predictArrival(feed *schedule.Feed, segments map[[2]string]models.SegmentStats, vehicle models.BusData, stopID string, now time.Time) (models.Arrival, bool) {
+	position, ok := scheduledPosition(feed, vehicle, now)
+	if !ok {
+		return models.Arrival{}, false
+	}
+	stopTimes := feed.StopTimes[vehicle.TripID]
+	next, serviceDay := position.next, position.serviceDay
+	target := feed.StopIndex(vehicle.TripID, stopID, next)
+	if target < 0 {
+		return models.Arrival{}, false
+	}
+
+	// segmentTime is the time from departing stop time i to departing stop time i+1, of which
+	// the fraction left of the travel remains
+	observed := false
+	segmentTime := func(i int, left float64) float64 {
+		segment, ok := segments[[2]string{stopTimes[i].StopID, stopTimes[i+1].StopID}]
+		if ok && segment.Count >= minSegmentObservations {
+			observed = true
+			return left * segment.MeanSeconds
+		}
+		from, to := stopTimes[i], stopTimes[i+1]
+		return left*float64(to.Arrival-from.Departure) + float64(to.Departure-to.Arrival)
+	}
+
+	remaining := 0.0
+	if next == 0 {
+		// A vehicle heading to the first stop departs on schedule at the earliest
+		remaining = max(position.scheduledAt().Sub(now).Seconds(), 0)
+	} else {
+		remaining = segmentTime(next-1, position.left)
+	}
+	for i := next; i < target; i++ {
+		remaining += segmentTime(i, 1)
+	}
+	// Segments are timed between departures, and the vehicle arrives before its dwell time
+	remaining = max(remaining-float64(stopTimes[target].Departure-stopTimes[target].Arrival), 0)
+
+	scheduledAt := serviceDay.Add(time.Duration(stopTimes[target].Arrival) * time.Second)
+	source := models.ArrivalSourceSchedule
+	switch {
+	case observed:
+		source = models.ArrivalSourceObserved
+	case vehicle.Delay != nil && !vehicle.DelayEstimated:
+		source = models.ArrivalSourceReported
+		reportedAt := scheduledAt.Add(time.Duration(*vehicle.Delay) * time.Second)
+		remaining = max(reportedAt.Sub(now).Seconds(), 0)
+	}
+	predictedAt := now.Add(time.Duration(remaining * float64(time.Second))).Truncate(time.Second)
+	arrival := models.Arrival{
+		StopID:       stopID,
+		VehicleID:    vehicle.VehicleID,
+		RouteID:      vehicle.RouteID,
+		ShortName:    vehicle.ShortName,
+		TripID:       vehicle.TripID,
+		TripHeadsign: vehicle.TripHeadsign,
+		ScheduledAt:  scheduledAt,
+		PredictedAt:  predictedAt,
+		InSeconds:    int(math.Round(remaining)),
+		Delay:        int(predictedAt.Sub(scheduledAt).Round(time.Second).Seconds()),
+		StopsAway:    target - next,
+		Source:       source,
+	}
+	arrival.Latitude, arrival.Longitude, _ = vehiclePosition(vehicle)
+	return arrival, true
+}
+
+// segmentLeft returns the fraction of the way from the previous stop to the next stop the
+// vehicle has left, by its distances to the stops. A vehicle without a known position is assumed
+// to have just left the previous stop.
+func segmentLeft(feed *schedule.Feed, fromStopID, toStopID string, vehicle models.BusData) float64 {
+	from, to := feed.Stops[fromStopID], feed.Stops[toStopID]
+	lat, lon, ok := vehiclePosition(vehicle)
+	if from == nil || to == nil || !ok {
+		return 1
+	}
+	travelled := geo.Distance(from.Lat, from.Lon, lat, lon)
+	left := geo.Distance(lat, lon, to.Lat, to.Lon)
+	if travelled+left == 0 {
+		return 1
+	}
+	return left / (travelled + left)
+}
+
+// vehiclePosition returns the coordinates of the vehicle, or the center of its geohash cell if
+// its feed does not give coordinates
+func vehiclePosition(vehicle models.BusData) (lat, lon float64, ok bool) {
+	if vehicle.Latitude != 0 || vehicle.Longitude != 0 {
+		return vehicle.Latitude, vehicle.Longitude, true
+	}
+	return geo.GeohashPosition(vehicle.GeohashHead, vehicle.GeohashFirstDeg, vehicle.GeohashSecondDeg, vehicle.GeohashThirdDeg)
+}
+
+var _ ArrivalService = (*arrivalService)(nil)
@@ -1,76 +1,348 @@
 package services
 
 import (
+	"context"
 	"finbus/internal/config"
 	"finbus/internal/database/influxdb"
+	"finbus/internal/geo"
+	"finbus/internal/metrics"
 	"finbus/internal/models"
+	"finbus/internal/tracing"
 	"finbus/internal/transport/mqtt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"fmt"
 )
 
 type BusDataService interface {
-	QueryBusesNear(lat, lon float64) ([]models.BusData, error)
-	WriteBusData(data models.BusData) error
-	SubscribeToBusUpdates(coords models.ClientCoords) (chan models.BusData, error)
-	GetBusQueryFromStops(stops []models.BusData) (models.BusData, error)
+	QueryBusesNear(ctx context.Context, lat, lon float64) ([]models.BusData, error)
+	WriteBusData(ctx context.Context, data models.BusData) error
+	Snapshot(ctx context.Context, filter models.BusFilter) (vehicles []models.BusData, lastSeq uint64, err error)
+	Replay(filter models.BusFilter, seq uint64) (updates []Update, lastSeq uint64, ok bool)
+	NewSubscriber() *Subscriber
+	Subscribe(sub *Subscriber, id string, filter models.BusFilter) error
+	Unsubscribe(sub *Subscriber, id string) error
+	CloseSubscriber(sub *Subscriber)
+	GetBusQueryFromStops(ctx context.Context, stops []models.BusData) (models.BusData, error)
+	IngestionStatus() IngestionStatus
+	// Close stops processing bus updates and closes every subscriber
+	Close()
+}
+
+// IngestionStatus describes the state of the ingestion pipeline
+type IngestionStatus struct {
+	// LastMessageAt is when the last bus update was processed, zero if none has been
+	LastMessageAt time.Time
+	// ActiveTopics is the number of MQTT topics subscribed to for live subscriptions
+	ActiveTopics int
+	// TrackedVehicles is the number of vehicles in the latest-state cache
+	TrackedVehicles int
+	// Broker is the state of the connection to the MQTT broker
+	Broker mqtt.ConnectionState
+}
+
+// Enricher adds data to bus updates before they are stored and published
+type Enricher interface {
+	Enrich(data models.BusData) models.BusData
+}
+
+// Observer is notified of every processed bus update, after it is stored and before it is
+// published to subscribers. Observers are called from the processing goroutine one at a time.
+type Observer interface {
+	Observe(data models.BusData)
+}
+
+// BusDataOptions configures the processing of bus updates
+type BusDataOptions struct {
+	// Enricher adds data to every bus update, such as scheduled data, if not nil
+	Enricher Enricher
+	// Observers are notified of every bus update
+	Observers []Observer
 }
 
 type busDataService struct {
 	influxDBManager influxdb.BusDataManager
+	options         BusDataOptions
 	mqttBroker      mqtt.BusDataSubscriber
-	dataChannel     chan models.BusData
+	dataChannel     chan models.BusMessage
+	hub             *hub
+	vehicles        *vehicleCache
+	logger          *slog.Logger
+
+	// topicsMu guards topics, the number of subscriptions needing each MQTT topic
+	topicsMu sync.Mutex
+	topics   map[string]int
+
+	// lastMessageAt is the Unix time in nanoseconds of the last processed bus update
+	lastMessageAt atomic.Int64
+
+	// stop is closed to stop processing, and stopped once processing has stopped
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
 }
 
 // NewBusDataService creates a new BusDataService
-func NewBusDataService(dbManager influxdb.BusDataManager, dataChannel chan models.BusData, mqttSub mqtt.BusDataSubscriber) BusDataService {
+func NewBusDataService(dbManager influxdb.BusDataManager, dataChannel chan models.BusMessage, mqttSub mqtt.BusDataSubscriber, options BusDataOptions, logger *slog.Logger) BusDataService {
+	vehicles := newVehicleCache(vehicleTTL)
 	service := &busDataService{
 		influxDBManager: dbManager,
+		options:         options,
 		dataChannel:     dataChannel,
 		mqttBroker:      mqttSub,
+		hub:             newHub(replayBufferSize, vehicles),
+		vehicles:        vehicles,
+		topics:          make(map[string]int),
+		logger:          logger.With("component", "bus_data_service"),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
 	}
+	metrics.SampleQueueDepth("ingest", func() int { return len(dataChannel) })
 	go service.processData()
 	return service
 }
 
+// processData processes the received bus updates until the service is closed or the data
+// channel is closed
 func (s *busDataService) processData() {
-	for busData := range s.dataChannel {
-		if err := s.WriteBusData(busData); err != nil {
-			fmt.Printf("Error processing data: %v\n", err)
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case message, ok := <-s.dataChannel:
+			if !ok {
+				return
+			}
+			s.process(message)
 		}
 	}
 }
 
+// Close stops processing bus updates, waiting for the update being processed, and closes every
+// subscriber so their sessions end
+func (s *busDataService) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.stopped
+	s.hub.close()
+}
+
+// process stores a bus update and publishes it to subscribers, tracing it in the context it was
+// received in
+func (s *busDataService) process(message models.BusMessage) {
+	ctx, span := tracing.Tracer().Start(message.Context(), "bus_data.process")
+	defer span.End()
+
+	busData := message.Data
+	if s.options.Enricher != nil {
+		busData = s.options.Enricher.Enrich(busData)
+	}
+	err := s.WriteBusData(ctx, busData)
+	tracing.RecordError(span, err)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Error processing data", "vehicle_id", busData.VehicleID, "error", err)
+	}
+
+	for _, observer := range s.options.Observers {
+		observer.Observe(busData)
+	}
+	s.hub.publish(busData)
+	metrics.TrackedVehicles.Set(float64(s.vehicles.size()))
+	s.lastMessageAt.Store(time.Now().UnixNano())
+}
+
 // QueryBusesNear queries the buses near the specified coordinates
-func (s *busDataService) QueryBusesNear(lat, lon float64) ([]models.BusData, error) {
+func (s *busDataService) QueryBusesNear(ctx context.Context, lat, lon float64) ([]models.BusData, error) {
 	geohash, err := config.GetGeohash(lat, lon)
 	if err != nil {
 		return nil, err
 	}
-	return s.influxDBManager.FindBusesNear(geohash)
+	return s.influxDBManager.FindBusesNear(ctx, geohash)
 }
 
 // WriteBusData writes bus telemetry data to the database
-func (s *busDataService) WriteBusData(data models.BusData) error {
-	return s.influxDBManager.WriteToInfluxDB(data)
+func (s *busDataService) WriteBusData(ctx context.Context, data models.BusData) error {
+	return s.influxDBManager.WriteToInfluxDB(ctx, data)
 }
 
-func (s *busDataService) SubscribeToBusUpdates(coords models.ClientCoords) (chan models.BusData, error) {
-	geohashPosition, err := config.GetGeohash(coords.Latitude, coords.Longitude)
-	if err != nil {
-		return nil, err
+// Snapshot returns the latest known state of every vehicle matching the filter, and the sequence
+// number of the latest live update it includes. Until vehicles have been received, area
+// snapshots fall back to the buses recently stored near the area.
+func (s *busDataService) Snapshot(ctx context.Context, filter models.BusFilter) ([]models.BusData, uint64, error) {
+	vehicles, lastSeq := s.hub.snapshot(filter)
+	if s.vehicles.size() > 0 || filter.Area == nil {
+		return vehicles, lastSeq, nil
 	}
 
-	err = s.mqttBroker.SubscribeToTopic(geohashPosition)
+	stored, err := s.QueryBusesNear(ctx, filter.Area.Latitude, filter.Area.Longitude)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	// Stored buses without a geohash head are in the area they were queried by
+	head := geo.GeohashHead(filter.Area.Latitude, filter.Area.Longitude)
+	seen := make(map[string]bool)
+	var buses []models.BusData
+	for _, busData := range stored {
+		if seen[busData.VehicleID] {
+			continue
+		}
+		seen[busData.VehicleID] = true
+		if busData.GeohashHead == "" {
+			busData.GeohashHead = head
+		}
+		if filter.Matches(busData) {
+			buses = append(buses, busData)
+		}
+	}
+	return buses, lastSeq, nil
+}
+
+// Replay returns the buffered updates matching the filter that were published after seq, so a
+// reconnecting client can catch up. Live updates up to lastSeq are included in the replay. ok is
+// false if the updates after seq are no longer buffered and the client needs a snapshot instead.
+func (s *busDataService) Replay(filter models.BusFilter, seq uint64) ([]Update, uint64, bool) {
+	return s.hub.since(filter, seq)
+}
+
+// NewSubscriber registers a new live update subscriber without any subscriptions
+func (s *busDataService) NewSubscriber() *Subscriber {
+	return s.hub.add()
+}
+
+// Subscribe adds or replaces the subscription with the given ID, subscribing to the MQTT topics
+// it needs before releasing the topics of the subscription it replaces
+func (s *busDataService) Subscribe(sub *Subscriber, id string, filter models.BusFilter) error {
+	if filter.IsEmpty() {
+		return fmt.Errorf("subscription needs an area, route, stop or vehicle filter")
 	}
+	topics := filterTopics(filter)
+	if err := s.acquireTopics(topics); err != nil {
+		return err
+	}
+
+	sub.mu.Lock()
+	if sub.closed {
+		sub.mu.Unlock()
+		s.releaseTopics(topics)
+		return fmt.Errorf("subscriber is closed")
+	}
+	previous, replaced := sub.filters[id]
+	sub.filters[id] = filter
+	sub.mu.Unlock()
+
+	if replaced {
+		s.releaseTopics(filterTopics(previous))
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription with the given ID, or every subscription if id is empty
+func (s *busDataService) Unsubscribe(sub *Subscriber, id string) error {
+	sub.mu.Lock()
+	var removed []models.BusFilter
+	if id == "" {
+		for _, filter := range sub.filters {
+			removed = append(removed, filter)
+		}
+		clear(sub.filters)
+	} else if filter, ok := sub.filters[id]; ok {
+		removed = append(removed, filter)
+		delete(sub.filters, id)
+	}
+	sub.mu.Unlock()
 
-	return s.dataChannel, nil
+	if id != "" && len(removed) == 0 {
+		return fmt.Errorf("unknown subscription %q", id)
+	}
+	for _, filter := range removed {
+		s.releaseTopics(filterTopics(filter))
+	}
+	return nil
+}
+
+// CloseSubscriber removes all subscriptions of the subscriber and closes its update channel
+func (s *busDataService) CloseSubscriber(sub *Subscriber) {
+	_ = s.Unsubscribe(sub, "")
+	s.hub.remove(sub)
+}
+
+// acquireTopics subscribes to the MQTT topics that are not subscribed to yet
+func (s *busDataService) acquireTopics(topics []string) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	for i, topic := range topics {
+		if s.topics[topic] == 0 {
+			if err := s.mqttBroker.SubscribeToTopic(topic); err != nil {
+				s.releaseTopicsLocked(topics[:i])
+				return err
+			}
+		}
+		s.topics[topic]++
+	}
+	return nil
+}
+
+// releaseTopics unsubscribes from the MQTT topics no subscription needs anymore
+func (s *busDataService) releaseTopics(topics []string) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	s.releaseTopicsLocked(topics)
+}
+
+func (s *busDataService) releaseTopicsLocked(topics []string) {
+	for _, topic := range topics {
+		s.topics[topic]--
+		if s.topics[topic] > 0 {
+			continue
+		}
+		delete(s.topics, topic)
+		if err := s.mqttBroker.UnsubscribeFromTopic(topic); err != nil {
+			s.logger.Error("Error unsubscribing from topic", "topic", topic, "error", err)
+		}
+	}
+}
+
+// filterTopics returns the MQTT topics covering every bus the filter can match
+func filterTopics(filter models.BusFilter) []string {
+	head := ""
+	if filter.Area != nil {
+		head = geo.GeohashHead(filter.Area.Latitude, filter.Area.Longitude)
+	}
+	orAny := func(values []string) []string {
+		if len(values) == 0 {
+			return []string{""}
+		}
+		return values
+	}
+
+	var topics []string
+	for _, route := range orAny(filter.Routes) {
+		for _, stop := range orAny(filter.Stops) {
+			for _, vehicle := range orAny(filter.Vehicles) {
+				topics = append(topics, config.BuildTopic(route, stop, vehicle, head))
+			}
+		}
+	}
+	return topics
+}
+
+// IngestionStatus returns the current state of the ingestion pipeline
+func (s *busDataService) IngestionStatus() IngestionStatus {
+	status := IngestionStatus{TrackedVehicles: s.vehicles.size(), Broker: s.mqttBroker.ConnectionState()}
+	if lastMessageAt := s.lastMessageAt.Load(); lastMessageAt != 0 {
+		status.LastMessageAt = time.Unix(0, lastMessageAt)
+	}
+	s.topicsMu.Lock()
+	status.ActiveTopics = len(s.topics)
+	s.topicsMu.Unlock()
+	return status
 }
 
-func (s *busDataService) GetBusQueryFromStops(stops []models.BusData) (models.BusData, error) {
-	return s.influxDBManager.FindBusesFromStops(stops)
+func (s *busDataService) GetBusQueryFromStops(ctx context.Context, stops []models.BusData) (models.BusData, error) {
+	return s.influxDBManager.FindBusesFromStops(ctx, stops)
 }
 
 var _ BusDataService = (*busDataService)(nil)
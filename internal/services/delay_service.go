@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"sort"
+	"time"
+)
+
+// ErrInvalidRange is returned for delay queries whose range does not end after it starts
+var ErrInvalidRange = errors.New("the end of the range must be after its start")
+
+type DelayService interface {
+	// DelayStats returns the distribution of the delays reported within the query range per
+	// route, direction or stop, ordered by route, direction and stop
+	DelayStats(ctx context.Context, query models.DelayQuery) ([]models.DelayStats, error)
+}
+
+type delayService struct {
+	storage influxdb.BusDataManager
+}
+
+// NewDelayService creates a new DelayService computing delay statistics in storage
+func NewDelayService(storage influxdb.BusDataManager) DelayService {
+	return &delayService{storage: storage}
+}
+
+// DelayStats returns the distribution of the delays reported within the query range
+func (s *delayService) DelayStats(ctx context.Context, query models.DelayQuery) ([]models.DelayStats, error) {
+	if !query.End.After(query.Start) {
+		return nil, ErrInvalidRange
+	}
+	stats, err := s.storage.QueryDelayStats(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.RouteID != b.RouteID {
+			return a.RouteID < b.RouteID
+		}
+		if a.DirectionID != b.DirectionID {
+			return a.DirectionID < b.DirectionID
+		}
+		return a.StopID < b.StopID
+	})
+	return stats, nil
+}
+
+// scheduleEnricher adds the scheduled data of the GTFS feed to bus updates, with the delay by the
+// schedule for feeds that do not report it, such as the GTFS-Realtime vehicle positions
+type scheduleEnricher struct {
+	store schedule.Store
+	now   func() time.Time
+}
+
+// NewScheduleEnricher creates an Enricher adding the scheduled data of the store to bus updates,
+// and their delay at now by the schedule if they have none. now is time.Now if nil.
+func NewScheduleEnricher(store schedule.Store, now func() time.Time) Enricher {
+	if now == nil {
+		now = time.Now
+	}
+	return &scheduleEnricher{store: store, now: now}
+}
+
+// Enrich adds the scheduled data, and the estimated delay if the bus update has none
+func (e *scheduleEnricher) Enrich(data models.BusData) models.BusData {
+	data = e.store.Enrich(data)
+	if data.Delay != nil {
+		return data
+	}
+	if feed := e.store.Feed(); feed != nil {
+		if delay, ok := scheduleDelay(feed, data, e.now()); ok {
+			data.Delay, data.DelayEstimated = &delay, true
+		}
+	}
+	return data
+}
+
+var _ DelayService = (*delayService)(nil)
+var _ Enricher = (*scheduleEnricher)(nil)
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"sync"
+)
+
+// listenerBuffer is the number of events buffered per listener before events are dropped
+const listenerBuffer = 64
+
+// Listener receives the new events of a service on Events
+type Listener[E any] struct {
+	Events chan E
+}
+
+// eventListeners delivers the events of a service to its registered listeners
+type eventListeners[E any] struct {
+	mu        sync.Mutex
+	listeners map[*Listener[E]]struct{}
+}
+
+func newEventListeners[E any]() *eventListeners[E] {
+	return &eventListeners[E]{listeners: make(map[*Listener[E]]struct{})}
+}
+
+// Listen registers a listener receiving every new event
+func (l *eventListeners[E]) Listen() *Listener[E] {
+	listener := &Listener[E]{Events: make(chan E, listenerBuffer)}
+	l.mu.Lock()
+	l.listeners[listener] = struct{}{}
+	l.mu.Unlock()
+	return listener
+}
+
+// CloseListener unregisters the listener and closes its event channel
+func (l *eventListeners[E]) CloseListener(listener *Listener[E]) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.listeners[listener]; ok {
+		delete(l.listeners, listener)
+		close(listener.Events)
+	}
+}
+
+// publish delivers the event to every listener, dropping it for listeners that are not keeping up
+func (l *eventListeners[E]) publish(event E) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for listener := range l.listeners {
+		select {
+		case listener.Events <- event:
+		default:
+		}
+	}
+}
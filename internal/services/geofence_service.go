@@ -0,0 +1,385 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/geo"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// geofenceCellSize is the size in degrees of the grid cells geofences are indexed by, about a
+	// kilometer
+	geofenceCellSize = 0.01
+	// maxGeofenceHeads bounds the geohash heads whose vehicles are received for a geofence
+	maxGeofenceHeads = 64
+)
+
+var (
+	// ErrUnknownGeofence is returned for geofences that do not exist
+	ErrUnknownGeofence = errors.New("unknown geofence")
+	// ErrGeofenceExists is returned when creating a geofence with the ID of an existing one
+	ErrGeofenceExists = errors.New("geofence already exists")
+)
+
+type GeofenceService interface {
+	// Observer raises the events of every updated vehicle entering, exiting or dwelling in a
+	// geofence
+	Observer
+	// Geofences returns every geofence ordered by ID
+	Geofences(ctx context.Context) ([]models.Geofence, error)
+	// Geofence returns the geofence with the ID
+	Geofence(ctx context.Context, id string) (models.Geofence, error)
+	// CreateGeofence adds a geofence, generating its ID if it has none
+	CreateGeofence(ctx context.Context, geofence models.Geofence) (models.Geofence, error)
+	// UpdateGeofence replaces the geofence with the ID
+	UpdateGeofence(ctx context.Context, id string, geofence models.Geofence) (models.Geofence, error)
+	// DeleteGeofence removes the geofence with the ID
+	DeleteGeofence(ctx context.Context, id string) error
+	// Events returns the stored geofence events of the query
+	Events(ctx context.Context, query models.GeofenceEventQuery) ([]models.GeofenceEvent, error)
+	// Start stores the raised geofence events until ctx is cancelled, then releases the areas of
+	// the geofences
+	Start(ctx context.Context)
+	// Watch receives the vehicles in the areas of the geofences through busData, whether or not
+	// clients subscribe to them
+	Watch(busData BusDataService)
+	// Listen registers a listener receiving every new geofence event
+	Listen() *GeofenceListener
+	// CloseListener unregisters the listener and closes its event channel
+	CloseListener(listener *GeofenceListener)
+}
+
+// GeofenceOptions configures the persistence of geofences and their events
+type GeofenceOptions struct {
+	// File persists the geofences, which are kept only in memory if empty
+	File string
+	// DwellTime is how long a vehicle stays in a geofence before a dwell event, never if 0
+	DwellTime time.Duration
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+// GeofenceListener receives the new geofence events on Events
+type GeofenceListener = Listener[models.GeofenceEvent]
+
+// geofenceIndex is an immutable index of the geofences, replaced whenever they change so
+// vehicle updates never wait for changes to the geofences
+type geofenceIndex struct {
+	index *geo.Index
+	names map[string]string
+}
+
+// visit is a vehicle's stay in a geofence
+type visit struct {
+	since   time.Time
+	dwelled bool
+}
+
+// fencedVehicle is a vehicle inside at least one geofence
+type fencedVehicle struct {
+	visits map[string]*visit
+	seen   time.Time
+}
+
+type geofenceService struct {
+	storage influxdb.BusDataManager
+	writer  *storageWriter
+	options GeofenceOptions
+	logger  *slog.Logger
+
+	// mu serializes changes to the geofences and their file
+	mu        sync.Mutex
+	geofences map[string]models.Geofence
+	index     atomic.Pointer[geofenceIndex]
+
+	vehiclesMu sync.Mutex
+	vehicles   map[string]*fencedVehicle
+	lastPruned time.Time
+
+	watch *ingestWatch
+	*eventListeners[models.GeofenceEvent]
+}
+
+// NewGeofenceService creates a new GeofenceService storing events in storage, with the geofences
+// persisted in the options file if it exists
+func NewGeofenceService(storage influxdb.BusDataManager, options GeofenceOptions, logger *slog.Logger) (GeofenceService, error) {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	logger = logger.With("component", "geofences")
+	s := &geofenceService{
+		storage:        storage,
+		writer:         newStorageWriter("geofence_events", logger),
+		options:        options,
+		logger:         logger,
+		geofences:      make(map[string]models.Geofence),
+		vehicles:       make(map[string]*fencedVehicle),
+		lastPruned:     options.Now(),
+		watch:          newIngestWatch(logger),
+		eventListeners: newEventListeners[models.GeofenceEvent](),
+	}
+	if options.File != "" {
+		geofences, err := loadGeofences(options.File)
+		if err != nil {
+			return nil, err
+		}
+		for _, geofence := range geofences {
+			if _, err := geofenceRegion(geofence); err != nil {
+				return nil, fmt.Errorf("error loading geofence %q: %v", geofence.ID, err)
+			}
+			s.geofences[geofence.ID] = geofence
+		}
+		s.logger.Info("Loaded geofences", "file", options.File, "geofences", len(s.geofences))
+	}
+	s.reindex()
+	return s, nil
+}
+
+// reindex replaces the index with one of the current geofences, which are all valid, and watches
+// the geohash heads they overlap. The lock must be held, except while constructing.
+func (s *geofenceService) reindex() {
+	regions := make(map[string]geo.Region, len(s.geofences))
+	names := make(map[string]string, len(s.geofences))
+	heads := make(map[string]models.BusFilter)
+	for id, geofence := range s.geofences {
+		regions[id], _ = geofenceRegion(geofence)
+		names[id] = geofence.Properties.Name
+
+		cells := geo.GeohashCells(regions[id].Bounds())
+		if len(cells) > maxGeofenceHeads {
+			s.logger.Warn("Geofence too large to receive its vehicles without subscribed clients", "geofence_id", id)
+			continue
+		}
+		for _, cell := range cells {
+			heads[geo.GeohashHead(cell.Lat, cell.Lon)] = models.BusFilter{Area: &models.ClientCoords{Latitude: cell.Lat, Longitude: cell.Lon}}
+		}
+	}
+	s.index.Store(&geofenceIndex{index: geo.NewIndex(regions, geofenceCellSize), names: names})
+	s.watch.set(heads)
+}
+
+// Observe compares the geofences containing the vehicle with those it was in before, raising an
+// enter event for every geofence it entered and an exit event for every geofence it left. A
+// dwell event is raised once a vehicle has stayed in a geofence for the dwell time. Vehicles
+// that stop sending updates are forgotten without exit events.
+func (s *geofenceService) Observe(data models.BusData) {
+	lat, lon, ok := vehiclePosition(data)
+	if data.VehicleID == "" || !ok {
+		return
+	}
+	index := s.index.Load()
+	inside := index.index.Containing(lat, lon)
+	sort.Strings(inside)
+	now := s.options.Now()
+
+	event := func(eventType, geofenceID string, since time.Time) models.GeofenceEvent {
+		event := models.GeofenceEvent{
+			Type:         eventType,
+			GeofenceID:   geofenceID,
+			GeofenceName: index.names[geofenceID],
+			VehicleID:    data.VehicleID,
+			RouteID:      data.RouteID,
+			DirectionID:  data.DirectionID,
+			NextStop:     data.NextStop,
+			Latitude:     lat,
+			Longitude:    lon,
+			At:           now,
+		}
+		if eventType != models.GeofenceEnter {
+			event.Duration = now.Sub(since).Seconds()
+		}
+		return event
+	}
+
+	var events []models.GeofenceEvent
+	s.vehiclesMu.Lock()
+	vehicle, ok := s.vehicles[data.VehicleID]
+	if !ok {
+		vehicle = &fencedVehicle{visits: make(map[string]*visit)}
+	}
+	vehicle.seen = now
+	left := make([]string, 0, len(vehicle.visits))
+	for id := range vehicle.visits {
+		if !contains(inside, id) {
+			left = append(left, id)
+		}
+	}
+	sort.Strings(left)
+	for _, id := range left {
+		// Leaving a deleted geofence raises no event
+		if _, exists := index.names[id]; exists {
+			events = append(events, event(models.GeofenceExit, id, vehicle.visits[id].since))
+		}
+		delete(vehicle.visits, id)
+	}
+	for _, id := range inside {
+		stay, ok := vehicle.visits[id]
+		if !ok {
+			vehicle.visits[id] = &visit{since: now}
+			events = append(events, event(models.GeofenceEnter, id, now))
+			continue
+		}
+		if s.options.DwellTime > 0 && !stay.dwelled && now.Sub(stay.since) >= s.options.DwellTime {
+			stay.dwelled = true
+			events = append(events, event(models.GeofenceDwell, id, stay.since))
+		}
+	}
+	if len(vehicle.visits) > 0 {
+		s.vehicles[data.VehicleID] = vehicle
+	} else {
+		delete(s.vehicles, data.VehicleID)
+	}
+	pruneVehicles(s.vehicles, func(vehicle *fencedVehicle) time.Time { return vehicle.seen }, nil, &s.lastPruned, now)
+	s.vehiclesMu.Unlock()
+
+	for _, event := range events {
+		metrics.GeofenceEvents.WithLabelValues(event.Type).Inc()
+		s.writer.write(func(ctx context.Context) error { return s.storage.WriteGeofenceEvent(ctx, event) },
+			"Error storing geofence event", "vehicle_id", event.VehicleID, "geofence_id", event.GeofenceID, "type", event.Type)
+		s.publish(event)
+	}
+}
+
+// Start stores the raised geofence events until ctx is cancelled, then releases the areas of the
+// geofences
+func (s *geofenceService) Start(ctx context.Context) {
+	s.writer.Start(ctx)
+	go func() {
+		<-ctx.Done()
+		s.watch.close()
+	}()
+}
+
+// Watch receives the vehicles in the areas of the geofences through busData
+func (s *geofenceService) Watch(busData BusDataService) {
+	s.watch.attach(busData)
+}
+
+// contains reports whether the sorted IDs contain the ID
+func contains(sorted []string, id string) bool {
+	i := sort.SearchStrings(sorted, id)
+	return i < len(sorted) && sorted[i] == id
+}
+
+// Geofences returns every geofence ordered by ID
+func (s *geofenceService) Geofences(_ context.Context) ([]models.Geofence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedGeofences(s.geofences), nil
+}
+
+// Geofence returns the geofence with the ID
+func (s *geofenceService) Geofence(_ context.Context, id string) (models.Geofence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	geofence, ok := s.geofences[id]
+	if !ok {
+		return models.Geofence{}, ErrUnknownGeofence
+	}
+	return geofence, nil
+}
+
+// CreateGeofence adds a geofence, generating its ID if it has none
+func (s *geofenceService) CreateGeofence(_ context.Context, geofence models.Geofence) (models.Geofence, error) {
+	if geofence.ID == "" {
+		geofence.ID = newID()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.geofences[geofence.ID]; ok {
+		return models.Geofence{}, ErrGeofenceExists
+	}
+	return s.put(geofence)
+}
+
+// UpdateGeofence replaces the geofence with the ID. Vehicles that are no longer inside it exit
+// it on their next update.
+func (s *geofenceService) UpdateGeofence(_ context.Context, id string, geofence models.Geofence) (models.Geofence, error) {
+	if geofence.ID != "" && geofence.ID != id {
+		return models.Geofence{}, invalidGeofence("id does not match the geofence")
+	}
+	geofence.ID = id
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.geofences[id]; !ok {
+		return models.Geofence{}, ErrUnknownGeofence
+	}
+	return s.put(geofence)
+}
+
+// put validates and stores the geofence, persisting the geofences. The lock must be held.
+func (s *geofenceService) put(geofence models.Geofence) (models.Geofence, error) {
+	if geofence.Type == "" {
+		geofence.Type = "Feature"
+	}
+	if _, err := geofenceRegion(geofence); err != nil {
+		return models.Geofence{}, err
+	}
+	geofence.Properties.UpdatedAt = s.options.Now().UTC()
+
+	previous, existed := s.geofences[geofence.ID]
+	s.geofences[geofence.ID] = geofence
+	if err := s.persist(); err != nil {
+		if existed {
+			s.geofences[geofence.ID] = previous
+		} else {
+			delete(s.geofences, geofence.ID)
+		}
+		return models.Geofence{}, err
+	}
+	s.reindex()
+	return geofence, nil
+}
+
+// DeleteGeofence removes the geofence with the ID. Vehicles inside it raise no exit events.
+func (s *geofenceService) DeleteGeofence(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	geofence, ok := s.geofences[id]
+	if !ok {
+		return ErrUnknownGeofence
+	}
+	delete(s.geofences, id)
+	if err := s.persist(); err != nil {
+		s.geofences[id] = geofence
+		return err
+	}
+	s.reindex()
+	return nil
+}
+
+// persist saves the geofences to the file, if there is one. The lock must be held.
+func (s *geofenceService) persist() error {
+	if s.options.File == "" {
+		return nil
+	}
+	return saveGeofences(s.options.File, s.geofences)
+}
+
+// newID returns a random ID
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Events returns the stored geofence events of the query
+func (s *geofenceService) Events(ctx context.Context, query models.GeofenceEventQuery) ([]models.GeofenceEvent, error) {
+	if !query.End.After(query.Start) {
+		return nil, ErrInvalidRange
+	}
+	return s.storage.QueryGeofenceEvents(ctx, query)
+}
+
+var _ GeofenceService = (*geofenceService)(nil)
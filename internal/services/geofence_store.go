@@ -0,0 +1,179 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// ErrInvalidGeofence is wrapped by the errors describing why a geofence is invalid
+var ErrInvalidGeofence = errors.New("invalid geofence")
+
+// geofenceIDPattern restricts geofence IDs to characters that need no escaping in paths
+var geofenceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// invalidGeofence returns an ErrInvalidGeofence describing the problem
+func invalidGeofence(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidGeofence, fmt.Sprintf(format, args...))
+}
+
+// geofenceRegion validates the geofence and returns the region of its geometry
+func geofenceRegion(geofence models.Geofence) (geo.Region, error) {
+	if geofence.Type != "Feature" {
+		return nil, invalidGeofence("type must be Feature")
+	}
+	if !geofenceIDPattern.MatchString(geofence.ID) {
+		return nil, invalidGeofence("id must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+	if geofence.Properties.Name == "" {
+		return nil, invalidGeofence("properties.name is required")
+	}
+	radius := geofence.Properties.Radius
+	if radius < 0 || math.IsNaN(radius) {
+		return nil, invalidGeofence("properties.radius must not be negative")
+	}
+
+	geometry := geofence.Geometry
+	if radius > 0 && geometry.Type != "Point" {
+		return nil, invalidGeofence("properties.radius is only allowed with a Point geometry")
+	}
+	switch geometry.Type {
+	case "Point":
+		var position []float64
+		if err := json.Unmarshal(geometry.Coordinates, &position); err != nil {
+			return nil, invalidGeofence("geometry.coordinates must be a position")
+		}
+		center, err := geofencePoint(position)
+		if err != nil {
+			return nil, err
+		}
+		if radius == 0 {
+			return nil, invalidGeofence("properties.radius is required with a Point geometry")
+		}
+		return geo.Circle{Center: center, Radius: radius}, nil
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &rings); err != nil {
+			return nil, invalidGeofence("geometry.coordinates must be an array of linear rings")
+		}
+		area, err := geofenceArea(rings)
+		if err != nil {
+			return nil, err
+		}
+		return geo.NewPolygon(area), nil
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil || len(polygons) == 0 {
+			return nil, invalidGeofence("geometry.coordinates must be an array of polygons")
+		}
+		areas := make([][][]geo.Point, len(polygons))
+		for i, rings := range polygons {
+			area, err := geofenceArea(rings)
+			if err != nil {
+				return nil, err
+			}
+			areas[i] = area
+		}
+		return geo.NewPolygon(areas...), nil
+	default:
+		return nil, invalidGeofence("geometry.type must be Polygon, MultiPolygon or Point")
+	}
+}
+
+// geofenceArea converts the linear rings of a polygon, the outer ring first. The closing
+// position repeating the first is optional.
+func geofenceArea(rings [][][]float64) ([][]geo.Point, error) {
+	if len(rings) == 0 {
+		return nil, invalidGeofence("a polygon must have an outer ring")
+	}
+	area := make([][]geo.Point, len(rings))
+	for i, ring := range rings {
+		points := make([]geo.Point, 0, len(ring))
+		for _, position := range ring {
+			point, err := geofencePoint(position)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+		}
+		if n := len(points); n > 1 && points[0] == points[n-1] {
+			points = points[:n-1]
+		}
+		if len(points) < 3 {
+			return nil, invalidGeofence("a linear ring must have at least 3 distinct positions")
+		}
+		area[i] = points
+	}
+	return area, nil
+}
+
+// geofencePoint converts a GeoJSON longitude, latitude position
+func geofencePoint(position []float64) (geo.Point, error) {
+	if len(position) < 2 {
+		return geo.Point{}, invalidGeofence("a position must have a longitude and a latitude")
+	}
+	lon, lat := position[0], position[1]
+	if !(lat >= -90 && lat <= 90) || !(lon >= -180 && lon <= 180) {
+		return geo.Point{}, invalidGeofence("position [%g, %g] is out of range", lon, lat)
+	}
+	return geo.Point{Lat: lat, Lon: lon}, nil
+}
+
+// loadGeofences reads the geofences persisted in the file, none if it does not exist yet
+func loadGeofences(file string) ([]models.Geofence, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading geofences: %v", err)
+	}
+	var collection models.GeofenceCollection
+	if err := json.Unmarshal(content, &collection); err != nil {
+		return nil, fmt.Errorf("error decoding geofences in %s: %v", file, err)
+	}
+	return collection.Features, nil
+}
+
+// saveGeofences persists the geofences by ID in the file as a feature collection. The file is
+// replaced by renaming, so it is never left half written.
+func saveGeofences(file string, geofences map[string]models.Geofence) error {
+	collection := models.GeofenceCollection{Type: "FeatureCollection", Features: sortedGeofences(geofences)}
+	content, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error saving geofences: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return fmt.Errorf("error saving geofences: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error saving geofences: %v", err)
+	}
+	if err := os.Rename(temp.Name(), file); err != nil {
+		return fmt.Errorf("error saving geofences: %v", err)
+	}
+	return nil
+}
+
+// sortedGeofences returns the geofences ordered by ID
+func sortedGeofences(geofences map[string]models.Geofence) []models.Geofence {
+	sorted := make([]models.Geofence, 0, len(geofences))
+	for _, geofence := range geofences {
+		sorted = append(sorted, geofence)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
@@ -0,0 +1,372 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/geo"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// headwayHistory is how long the progress of a vehicle along its shape is kept, which bounds
+	// the headways that can be measured behind it
+	headwayHistory = time.Hour
+	// minProgress is how many meters a vehicle moves along its shape before its progress is
+	// recorded again
+	minProgress = 10.0
+	// maxShapeOffset is how many meters a vehicle can be off its shape and still be placed on it
+	maxShapeOffset = 200.0
+	// terminalDistance is how many meters from the ends of their shape vehicles are laying over at
+	// a terminal, where their headways are not measured
+	terminalDistance = 200.0
+)
+
+// ErrUnknownRoute is returned for routes that are not in the GTFS feed
+var ErrUnknownRoute = errors.New("unknown route")
+
+type HeadwayService interface {
+	// Observer measures the headway of every updated vehicle to the vehicle ahead of it
+	Observer
+	// Headways returns the current headways of the vehicles of the route, by direction and from
+	// the front
+	Headways(ctx context.Context, routeID string) ([]models.Headway, error)
+	// Events returns the stored bunching and gap events of the query
+	Events(ctx context.Context, query models.HeadwayEventQuery) ([]models.HeadwayEvent, error)
+	// Start stores the raised bunching and gap events until ctx is cancelled, then releases the
+	// monitored routes
+	Start(ctx context.Context)
+	// Watch receives the vehicles of the monitored routes through busData, whether or not clients
+	// subscribe to them
+	Watch(busData BusDataService)
+	// Listen registers a listener receiving every new bunching and gap event
+	Listen() *HeadwayListener
+	// CloseListener unregisters the listener and closes its event channel
+	CloseListener(listener *HeadwayListener)
+}
+
+// HeadwayOptions configures the bunching and gap detection. A threshold of 0 disables its
+// detection.
+type HeadwayOptions struct {
+	BunchingThreshold time.Duration
+	GapThreshold      time.Duration
+	// Routes are the monitored routes, whose vehicles are received even when no client subscribes
+	// to them. The headways of other routes are only measured while clients subscribe to them.
+	Routes []string
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+// HeadwayListener receives the new bunching and gap events on Events
+type HeadwayListener = Listener[models.HeadwayEvent]
+
+// headwayKey groups the vehicles whose positions along a shape are compared
+type headwayKey struct {
+	routeID, directionID, shapeID string
+}
+
+// progress is the distance along its shape a vehicle had reached at a point in time
+type progress struct {
+	at    time.Time
+	along float64
+}
+
+// trackedVehicle is the progress of a vehicle along the shape of its current trip
+type trackedVehicle struct {
+	key    headwayKey
+	tripID string
+	// history is the progress of the vehicle, oldest and so shortest first
+	history []progress
+	length  float64
+	seen    time.Time
+	// headway is the last headway measured to the vehicle ahead, nil without one
+	headway *models.Headway
+}
+
+type headwayService struct {
+	schedule schedule.Store
+	storage  influxdb.BusDataManager
+	writer   *storageWriter
+	options  HeadwayOptions
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	vehicles map[string]*trackedVehicle
+	// groups are the vehicles by the key they are compared by, and so each vehicle's group
+	groups     map[headwayKey]map[string]*trackedVehicle
+	lastPruned time.Time
+	// paths are the shapes of feed measured along their length, built when first needed
+	feed  *schedule.Feed
+	paths map[string]*geo.Path
+
+	watch *ingestWatch
+	*eventListeners[models.HeadwayEvent]
+}
+
+// NewHeadwayService creates a new HeadwayService measuring headways along the shapes of the GTFS
+// feed, which may be nil if none is configured, and storing events in storage
+func NewHeadwayService(store schedule.Store, storage influxdb.BusDataManager, options HeadwayOptions, logger *slog.Logger) HeadwayService {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	logger = logger.With("component", "headways")
+	watch := newIngestWatch(logger)
+	if len(options.Routes) > 0 {
+		watch.set(map[string]models.BusFilter{"routes": {Routes: options.Routes}})
+	}
+	return &headwayService{
+		schedule:       store,
+		storage:        storage,
+		writer:         newStorageWriter("headway_events", logger),
+		options:        options,
+		logger:         logger,
+		vehicles:       make(map[string]*trackedVehicle),
+		groups:         make(map[headwayKey]map[string]*trackedVehicle),
+		lastPruned:     options.Now(),
+		watch:          watch,
+		eventListeners: newEventListeners[models.HeadwayEvent](),
+	}
+}
+
+// Observe places the vehicle along the shape of its trip and measures its headway to the vehicle
+// ahead of it on the same route, direction and shape: how long ago that vehicle was where this
+// one is now. A bunching or gap event is raised when the headway crosses a threshold.
+func (s *headwayService) Observe(data models.BusData) {
+	if s.schedule == nil || data.VehicleID == "" {
+		return
+	}
+	feed := s.schedule.Feed()
+	shapeID := data.ShapeID
+	if trip := feed.Trips[data.TripID]; shapeID == "" && trip != nil {
+		shapeID = trip.ShapeID
+	}
+	lat, lon, ok := vehiclePosition(data)
+	if shapeID == "" || !ok {
+		return
+	}
+
+	now := s.options.Now()
+	s.mu.Lock()
+	path := s.path(feed, shapeID)
+	along, offset, ok := path.Project(lat, lon)
+	if !ok || offset > maxShapeOffset {
+		s.mu.Unlock()
+		return
+	}
+	key := headwayKey{routeID: data.RouteID, directionID: data.DirectionID, shapeID: shapeID}
+	vehicle := s.track(data, key, along, path.Length(), now)
+	event, raised := s.measure(data.VehicleID, vehicle, now)
+	pruneVehicles(s.vehicles, func(vehicle *trackedVehicle) time.Time { return vehicle.seen }, s.forget, &s.lastPruned, now)
+	s.mu.Unlock()
+
+	if !raised {
+		return
+	}
+	event.NextStop, event.Latitude, event.Longitude = data.NextStop, lat, lon
+	metrics.HeadwayEvents.WithLabelValues(event.Type).Inc()
+	s.writer.write(func(ctx context.Context) error { return s.storage.WriteHeadwayEvent(ctx, event) },
+		"Error storing headway event", "vehicle_id", data.VehicleID, "type", event.Type)
+	s.publish(event)
+}
+
+// Start stores the raised bunching and gap events until ctx is cancelled, then releases the
+// monitored routes
+func (s *headwayService) Start(ctx context.Context) {
+	s.writer.Start(ctx)
+	go func() {
+		<-ctx.Done()
+		s.watch.close()
+	}()
+}
+
+// Watch receives the vehicles of the monitored routes through busData. Nothing is measured
+// without a GTFS feed, so nothing is received then.
+func (s *headwayService) Watch(busData BusDataService) {
+	if s.schedule == nil {
+		return
+	}
+	s.watch.attach(busData)
+}
+
+// path returns the shape measured along its length, rebuilding the paths when the feed was
+// reloaded. The lock must be held.
+func (s *headwayService) path(feed *schedule.Feed, shapeID string) *geo.Path {
+	if s.feed != feed {
+		s.feed, s.paths = feed, make(map[string]*geo.Path)
+	}
+	path, ok := s.paths[shapeID]
+	if !ok {
+		shape := feed.Shapes[shapeID]
+		points := make([]geo.Point, len(shape))
+		for i, point := range shape {
+			points[i] = geo.Point{Lat: point.Lat, Lon: point.Lon}
+		}
+		path = geo.NewPath(points)
+		s.paths[shapeID] = path
+	}
+	return path
+}
+
+// track records the progress of the vehicle, starting over when it starts a new trip. Moving
+// back along the shape is position noise and is not recorded. The lock must be held.
+func (s *headwayService) track(data models.BusData, key headwayKey, along, length float64, now time.Time) *trackedVehicle {
+	vehicle, ok := s.vehicles[data.VehicleID]
+	if !ok || vehicle.key != key || vehicle.tripID != data.TripID {
+		if ok {
+			s.forget(data.VehicleID, vehicle)
+		}
+		vehicle = &trackedVehicle{key: key, tripID: data.TripID, length: length}
+		s.vehicles[data.VehicleID] = vehicle
+		group, ok := s.groups[key]
+		if !ok {
+			group = make(map[string]*trackedVehicle)
+			s.groups[key] = group
+		}
+		group[data.VehicleID] = vehicle
+	}
+	vehicle.seen = now
+	if n := len(vehicle.history); n == 0 || along-vehicle.history[n-1].along >= minProgress {
+		vehicle.history = append(vehicle.history, progress{at: now, along: along})
+	}
+	expired := 0
+	for expired < len(vehicle.history)-1 && now.Sub(vehicle.history[expired].at) > headwayHistory {
+		expired++
+	}
+	vehicle.history = vehicle.history[expired:]
+	return vehicle
+}
+
+// forget stops tracking the vehicle. The lock must be held.
+func (s *headwayService) forget(vehicleID string, vehicle *trackedVehicle) {
+	delete(s.vehicles, vehicleID)
+	group := s.groups[vehicle.key]
+	delete(group, vehicleID)
+	if len(group) == 0 {
+		delete(s.groups, vehicle.key)
+	}
+}
+
+// measure updates the headway of the vehicle to the nearest vehicle ahead of it in its group,
+// returning an event if the vehicle became bunched or fell behind. The lock must be held.
+func (s *headwayService) measure(vehicleID string, vehicle *trackedVehicle, now time.Time) (models.HeadwayEvent, bool) {
+	along := vehicle.history[len(vehicle.history)-1].along
+	previous := vehicle.headway
+	vehicle.headway = nil
+	if along < terminalDistance || along > vehicle.length-terminalDistance {
+		return models.HeadwayEvent{}, false
+	}
+
+	var leaderID string
+	var leader *trackedVehicle
+	for id, other := range s.groups[vehicle.key] {
+		if other == vehicle || now.Sub(other.seen) > vehicleTTL {
+			continue
+		}
+		otherAlong := other.history[len(other.history)-1].along
+		if otherAlong <= along || otherAlong > other.length-terminalDistance {
+			continue
+		}
+		if leader == nil || otherAlong < leader.history[len(leader.history)-1].along {
+			leaderID, leader = id, other
+		}
+	}
+	if leader == nil {
+		return models.HeadwayEvent{}, false
+	}
+
+	headway := &models.Headway{
+		RouteID:     vehicle.key.routeID,
+		DirectionID: vehicle.key.directionID,
+		VehicleID:   vehicleID,
+		LeaderID:    leaderID,
+		Headway:     now.Sub(passedAt(leader.history, along)).Seconds(),
+		Distance:    leader.history[len(leader.history)-1].along - along,
+		Status:      models.HeadwayNormal,
+		UpdatedAt:   now,
+	}
+	switch {
+	case s.options.BunchingThreshold > 0 && headway.Headway < s.options.BunchingThreshold.Seconds():
+		headway.Status = models.HeadwayBunching
+	case s.options.GapThreshold > 0 && headway.Headway > s.options.GapThreshold.Seconds():
+		headway.Status = models.HeadwayGap
+	}
+	vehicle.headway = headway
+
+	if headway.Status == models.HeadwayNormal || previous != nil && previous.Status == headway.Status && previous.LeaderID == leaderID {
+		return models.HeadwayEvent{}, false
+	}
+	return models.HeadwayEvent{
+		Type:        headway.Status,
+		RouteID:     headway.RouteID,
+		DirectionID: headway.DirectionID,
+		VehicleID:   vehicleID,
+		LeaderID:    leaderID,
+		Headway:     headway.Headway,
+		Distance:    headway.Distance,
+		At:          now,
+	}, true
+}
+
+// passedAt returns when the history first reached the distance along the shape, interpolating
+// between the recorded progress. A history starting beyond the distance gives its start, so
+// headways are at most the history long.
+func passedAt(history []progress, along float64) time.Time {
+	i := sort.Search(len(history), func(i int) bool { return history[i].along >= along })
+	if i == 0 {
+		return history[0].at
+	}
+	if i == len(history) {
+		return history[i-1].at
+	}
+	before, after := history[i-1], history[i]
+	fraction := (along - before.along) / (after.along - before.along)
+	return before.at.Add(time.Duration(fraction * float64(after.at.Sub(before.at))))
+}
+
+// Headways returns the current headways of the vehicles of the route, by direction and from the
+// front. Vehicles without a vehicle ahead are left out.
+func (s *headwayService) Headways(_ context.Context, routeID string) ([]models.Headway, error) {
+	if s.schedule == nil {
+		return nil, ErrNoSchedule
+	}
+	if _, ok := s.schedule.Feed().Routes[routeID]; !ok {
+		return nil, ErrUnknownRoute
+	}
+
+	now := s.options.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	headways := []models.Headway{}
+	for _, vehicle := range s.vehicles {
+		if vehicle.key.routeID == routeID && vehicle.headway != nil && now.Sub(vehicle.seen) <= vehicleTTL {
+			headways = append(headways, *vehicle.headway)
+		}
+	}
+	position := func(headway models.Headway) float64 {
+		history := s.vehicles[headway.VehicleID].history
+		return history[len(history)-1].along
+	}
+	sort.Slice(headways, func(i, j int) bool {
+		if headways[i].DirectionID != headways[j].DirectionID {
+			return headways[i].DirectionID < headways[j].DirectionID
+		}
+		return position(headways[i]) > position(headways[j])
+	})
+	return headways, nil
+}
+
+// Events returns the stored bunching and gap events of the query
+func (s *headwayService) Events(ctx context.Context, query models.HeadwayEventQuery) ([]models.HeadwayEvent, error) {
+	if !query.End.After(query.Start) {
+		return nil, ErrInvalidRange
+	}
+	return s.storage.QueryHeadwayEvents(ctx, query)
+}
+
+var _ HeadwayService = (*headwayService)(nil)
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/transport/mqtt"
+	"fmt"
+	"time"
+)
+
+// readinessTimeout bounds the dependency checks of a readiness probe
+const readinessTimeout = 2 * time.Second
+
+// DependencyStatus is the result of checking a single dependency
+type DependencyStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type HealthService interface {
+	Readiness(ctx context.Context) (ready bool, checks []DependencyStatus)
+	Uptime() time.Duration
+}
+
+// HealthOptions configures the readiness checks
+type HealthOptions struct {
+	// MaxIngestionLag is the longest time without bus updates while data is expected
+	MaxIngestionLag time.Duration
+	// ContinuousIngestion expects data even without live subscriptions, as polled sources deliver
+	// every vehicle regardless of subscriptions
+	ContinuousIngestion bool
+}
+
+type healthService struct {
+	influxDBManager influxdb.BusDataManager
+	busDataService  BusDataService
+	options         HealthOptions
+	startedAt       time.Time
+}
+
+// NewHealthService creates a new HealthService checking the given dependencies
+func NewHealthService(dbManager influxdb.BusDataManager, busDataService BusDataService, options HealthOptions) HealthService {
+	return &healthService{
+		influxDBManager: dbManager,
+		busDataService:  busDataService,
+		options:         options,
+		startedAt:       time.Now(),
+	}
+}
+
+// Uptime returns how long the service has been running
+func (h *healthService) Uptime() time.Duration {
+	return time.Since(h.startedAt)
+}
+
+// Readiness checks every dependency, and reports ready only if all of them are healthy
+func (h *healthService) Readiness(ctx context.Context) (bool, []DependencyStatus) {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	status := h.busDataService.IngestionStatus()
+	checks := []DependencyStatus{
+		h.checkInfluxDB(ctx),
+		checkMQTT(status.Broker),
+		checkSubscriptions(status),
+		h.checkIngestion(status),
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Healthy
+	}
+	return ready, checks
+}
+
+func (h *healthService) checkInfluxDB(ctx context.Context) DependencyStatus {
+	if err := h.influxDBManager.Ready(ctx); err != nil {
+		return DependencyStatus{Name: "influxdb", Healthy: false, Detail: err.Error()}
+	}
+	return DependencyStatus{Name: "influxdb", Healthy: true}
+}
+
+func checkMQTT(state mqtt.ConnectionState) DependencyStatus {
+	if !state.Connected {
+		detail := "not connected to broker"
+		if state.LastError != "" {
+			detail = fmt.Sprintf("%s since %s: %s", detail, state.Since.Format(time.RFC3339), state.LastError)
+		}
+		return DependencyStatus{Name: "mqtt", Healthy: false, Detail: detail}
+	}
+	return DependencyStatus{Name: "mqtt", Healthy: true, Detail: fmt.Sprintf("%d reconnects", state.Reconnects)}
+}
+
+// checkSubscriptions checks that the broker acknowledged every MQTT topic subscribed to while
+// connected to it. While disconnected, which the mqtt check reports, the topics wait for the
+// subscriber to restore them on reconnect.
+func checkSubscriptions(status IngestionStatus) DependencyStatus {
+	check := DependencyStatus{
+		Name:    "subscriptions",
+		Healthy: true,
+		Detail: fmt.Sprintf("%d MQTT topics subscribed for clients, %d of %d acknowledged by the broker",
+			status.ActiveTopics, status.Broker.Acknowledged, status.Broker.Subscriptions),
+	}
+	if status.Broker.Connected && status.Broker.Acknowledged < max(status.Broker.Subscriptions, status.ActiveTopics) {
+		check.Healthy = false
+	}
+	return check
+}
+
+// checkIngestion checks that bus updates keep arriving while they are expected, that is while
+// topics are subscribed or a polled source is configured
+func (h *healthService) checkIngestion(status IngestionStatus) DependencyStatus {
+	check := DependencyStatus{Name: "ingestion", Healthy: true}
+	since := status.LastMessageAt
+	if since.IsZero() {
+		check.Detail = "no bus updates received yet"
+		since = h.startedAt
+	} else {
+		check.Detail = fmt.Sprintf("last bus update %s ago, %d vehicles tracked",
+			time.Since(since).Round(time.Second), status.TrackedVehicles)
+	}
+
+	expected := status.ActiveTopics > 0 || h.options.ContinuousIngestion
+	if expected && h.options.MaxIngestionLag > 0 && time.Since(since) > h.options.MaxIngestionLag {
+		check.Healthy = false
+		check.Detail = fmt.Sprintf("no bus updates for more than %s", h.options.MaxIngestionLag)
+	}
+	return check
+}
+
+var _ HealthService = (*healthService)(nil)
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriberBuffer is the number of updates buffered per subscriber before updates are dropped
+const subscriberBuffer = 64
+
+// Update is a bus update with the sequence number assigned to it by the hub
+type Update struct {
+	Seq  uint64
+	Data models.BusData
+}
+
+// Subscriber receives the live bus updates matching any of its filters on Updates
+type Subscriber struct {
+	Updates chan Update
+
+	mu      sync.RWMutex
+	filters map[string]models.BusFilter
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of updates dropped because the subscriber was not keeping up
+func (s *Subscriber) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Filters returns a copy of the subscriber's filters keyed by subscription ID
+func (s *Subscriber) Filters() map[string]models.BusFilter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filters := make(map[string]models.BusFilter, len(s.filters))
+	for id, filter := range s.filters {
+		filters[id] = filter
+	}
+	return filters
+}
+
+// matches reports whether any of the subscriber's filters matches the bus
+func (s *Subscriber) matches(busData models.BusData) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, filter := range s.filters {
+		if filter.Matches(busData) {
+			return true
+		}
+	}
+	return false
+}
+
+// hub fans out bus updates to every subscriber with a matching filter, numbering every update
+// with a monotonic sequence number and keeping the most recent updates for replay. The latest
+// state of every vehicle is updated with the sequence number, so snapshots match a sequence number.
+type hub struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+	seq         atomic.Uint64
+	replay      *replayBuffer
+	vehicles    *vehicleCache
+	// closed is set once the hub is closed, after which subscribers are added closed
+	closed bool
+}
+
+func newHub(replaySize int, vehicles *vehicleCache) *hub {
+	return &hub{subscribers: make(map[*Subscriber]struct{}), replay: newReplayBuffer(replaySize), vehicles: vehicles}
+}
+
+// since returns the buffered updates matching the filter published after seq, and the sequence
+// number of the latest update at that moment. Updates published later are delivered to
+// subscribers with higher sequence numbers, so subscribers can skip live updates up to lastSeq.
+func (h *hub) since(filter models.BusFilter, seq uint64) (updates []Update, lastSeq uint64, ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	lastSeq = h.seq.Load()
+	updates, ok = h.replay.since(filter, seq, lastSeq)
+	return updates, lastSeq, ok
+}
+
+// snapshot returns the latest state of every vehicle matching the filter, and the sequence
+// number of the latest update it includes
+func (h *hub) snapshot(filter models.BusFilter) ([]models.BusData, uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.vehicles.matching(filter), h.seq.Load()
+}
+
+// add registers a new subscriber without any filters
+func (h *hub) add() *Subscriber {
+	sub := &Subscriber{
+		Updates: make(chan Update, subscriberBuffer),
+		filters: make(map[string]models.BusFilter),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		sub.closed = true
+		close(sub.Updates)
+		return sub
+	}
+	h.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// close unregisters every subscriber, closing their update channels
+func (h *hub) close() {
+	h.mu.Lock()
+	subscribers := h.subscribers
+	h.subscribers = make(map[*Subscriber]struct{})
+	h.closed = true
+	h.mu.Unlock()
+	for sub := range subscribers {
+		close(sub.Updates)
+		sub.mu.Lock()
+		sub.closed = true
+		sub.mu.Unlock()
+	}
+}
+
+// remove unregisters a subscriber and closes its update channel
+func (h *hub) remove(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.Updates)
+	}
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+}
+
+// publish records the latest state of the bus and delivers it to every matching subscriber,
+// dropping it for subscribers that are not keeping up so a slow client cannot stall ingestion
+func (h *hub) publish(busData models.BusData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update := Update{Seq: h.seq.Add(1), Data: busData}
+	h.vehicles.update(busData)
+	h.replay.add(update)
+	for sub := range h.subscribers {
+		if !sub.matches(busData) {
+			continue
+		}
+		select {
+		case sub.Updates <- update:
+		default:
+			sub.dropped.Add(1)
+			metrics.UpdatesDropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"finbus/internal/models"
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+// ingestWatch keeps the bus updates matching its filters ingested for a service, whether or not
+// clients subscribe to them, since only subscribed MQTT topics are received. The filters are
+// subscribed to once the watch is attached to the bus data service, and nothing is subscribed
+// to once it is closed.
+type ingestWatch struct {
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	busData BusDataService
+	watcher *Subscriber
+	filters map[string]models.BusFilter
+	closed  bool
+}
+
+func newIngestWatch(logger *slog.Logger) *ingestWatch {
+	return &ingestWatch{logger: logger, filters: make(map[string]models.BusFilter)}
+}
+
+// attach subscribes to the filters through the bus data service
+func (w *ingestWatch) attach(busData BusDataService) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.watcher != nil {
+		return
+	}
+	w.busData = busData
+	w.watcher = busData.NewSubscriber()
+	// The updates are only needed by the observers
+	go func(updates <-chan Update) {
+		for range updates {
+		}
+	}(w.watcher.Updates)
+	for id, filter := range w.filters {
+		w.subscribe(id, filter)
+	}
+}
+
+// set replaces the filters by ID, subscribing to the added and changed filters and releasing the
+// removed ones
+func (w *ingestWatch) set(filters map[string]models.BusFilter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id := range w.filters {
+		if _, ok := filters[id]; !ok && w.watcher != nil {
+			_ = w.busData.Unsubscribe(w.watcher, id)
+		}
+	}
+	for id, filter := range filters {
+		if previous, ok := w.filters[id]; (!ok || !reflect.DeepEqual(previous, filter)) && w.watcher != nil {
+			w.subscribe(id, filter)
+		}
+	}
+	w.filters = filters
+}
+
+// subscribe adds or replaces the subscription of the filter. The lock must be held.
+func (w *ingestWatch) subscribe(id string, filter models.BusFilter) {
+	if err := w.busData.Subscribe(w.watcher, id, filter); err != nil {
+		w.logger.Warn("Error subscribing to watched vehicles", "id", id, "error", err)
+	}
+}
+
+// close releases every filter
+func (w *ingestWatch) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.watcher != nil {
+		w.busData.CloseSubscriber(w.watcher)
+		w.watcher = nil
+	}
+}
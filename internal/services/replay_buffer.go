@@ -0,0 +1,52 @@
+package services
+
+import "finbus/internal/models"
+
+// replayBufferSize is the number of most recent updates kept for resuming clients
+const replayBufferSize = 10000
+
+// replayBuffer is a bounded ring buffer of the most recent updates in sequence order
+type replayBuffer struct {
+	updates []Update
+	start   int
+	count   int
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{updates: make([]Update, size)}
+}
+
+// add appends an update, overwriting the oldest update once the buffer is full
+func (b *replayBuffer) add(update Update) {
+	if len(b.updates) == 0 {
+		return
+	}
+	b.updates[(b.start+b.count)%len(b.updates)] = update
+	if b.count < len(b.updates) {
+		b.count++
+	} else {
+		b.start = (b.start + 1) % len(b.updates)
+	}
+}
+
+// since returns the buffered updates matching the filter with a sequence number above seq.
+// ok is false if updates after seq have already been overwritten, or seq is from the future,
+// as happens when a client resumes against a restarted server.
+func (b *replayBuffer) since(filter models.BusFilter, seq, lastSeq uint64) (updates []Update, ok bool) {
+	if seq > lastSeq {
+		return nil, false
+	}
+	if seq == lastSeq {
+		return nil, true
+	}
+	if b.count == 0 || b.updates[b.start].Seq > seq+1 {
+		return nil, false
+	}
+	for i := 0; i < b.count; i++ {
+		update := b.updates[(b.start+i)%len(b.updates)]
+		if update.Seq > seq && filter.Matches(update.Data) {
+			updates = append(updates, update)
+		}
+	}
+	return updates, true
+}
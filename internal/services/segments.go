@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/models"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxSegmentTime is the longest travel time between consecutive stops that is recorded. Longer
+// times are breaks or lost updates rather than travel.
+const maxSegmentTime = 30 * time.Minute
+
+// passing is the last stop a vehicle was seen passing on its current trip
+type passing struct {
+	tripID string
+	// stop is the last stop passed and at when, empty until a stop is seen passed
+	stop string
+	at   time.Time
+	// next is the stop the vehicle is heading to
+	next string
+	seen time.Time
+}
+
+// SegmentRecorder observes vehicles passing stops and stores the travel times between
+// consecutive stops, from which arrivals are predicted. A vehicle passes its next stop when its
+// next stop changes, so a segment is the time from one such change to the next on the same trip.
+// The segment times are stored once the recorder is started.
+type SegmentRecorder struct {
+	storage influxdb.BusDataManager
+	writer  *storageWriter
+	logger  *slog.Logger
+
+	mu         sync.Mutex
+	vehicles   map[string]passing
+	lastPruned time.Time
+}
+
+// NewSegmentRecorder creates a SegmentRecorder storing segment times in storage
+func NewSegmentRecorder(storage influxdb.BusDataManager, logger *slog.Logger) *SegmentRecorder {
+	logger = logger.With("component", "segments")
+	return &SegmentRecorder{
+		storage:    storage,
+		writer:     newStorageWriter("segments", logger),
+		logger:     logger,
+		vehicles:   make(map[string]passing),
+		lastPruned: time.Now(),
+	}
+}
+
+// Start stores the recorded segment times until ctx is cancelled
+func (r *SegmentRecorder) Start(ctx context.Context) {
+	r.writer.Start(ctx)
+}
+
+// Observe records the vehicle passing its previous next stop, storing the travel time from the
+// stop it passed before
+func (r *SegmentRecorder) Observe(data models.BusData) {
+	if data.VehicleID == "" || data.TripID == "" || data.NextStop == "" {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	previous, ok := r.vehicles[data.VehicleID]
+	current := passing{tripID: data.TripID, next: data.NextStop, seen: now}
+	if ok && previous.tripID == data.TripID {
+		current.stop, current.at = previous.stop, previous.at
+		if data.NextStop != previous.next {
+			current.stop, current.at = previous.next, now
+		}
+	}
+	r.vehicles[data.VehicleID] = current
+	pruneVehicles(r.vehicles, func(vehicle passing) time.Time { return vehicle.seen }, nil, &r.lastPruned, now)
+	r.mu.Unlock()
+
+	if !ok || previous.tripID != data.TripID || previous.stop == "" || current.stop == previous.stop {
+		return
+	}
+	seconds := now.Sub(previous.at)
+	if seconds <= 0 || seconds > maxSegmentTime {
+		return
+	}
+	segment := models.SegmentTime{
+		RouteID:    data.RouteID,
+		VehicleID:  data.VehicleID,
+		FromStop:   previous.stop,
+		ToStop:     current.stop,
+		Seconds:    seconds.Seconds(),
+		ObservedAt: now,
+	}
+	r.writer.write(func(ctx context.Context) error { return r.storage.WriteSegmentTime(ctx, segment) },
+		"Error storing segment time", "vehicle_id", data.VehicleID, "from_stop", previous.stop, "to_stop", current.stop)
+}
+
+var _ Observer = (*SegmentRecorder)(nil)
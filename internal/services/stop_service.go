@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+)
+
+// ErrNoSchedule is returned by schedule-based queries when no GTFS static feed is configured
+var ErrNoSchedule = errors.New("no GTFS static feed is configured")
+
+type StopService interface {
+	// SearchStops returns the stops whose code or name matches the query, best matches first
+	SearchStops(ctx context.Context, query string, limit int) ([]models.Stop, error)
+	// StopsNear returns the stops within radius meters of a location, nearest first
+	StopsNear(ctx context.Context, lat, lon, radius float64, limit int) ([]models.Stop, error)
+}
+
+type stopService struct {
+	schedule schedule.Store
+}
+
+// NewStopService creates a new StopService searching the stops of the GTFS feed, which may be nil
+// if none is configured
+func NewStopService(store schedule.Store) StopService {
+	return &stopService{schedule: store}
+}
+
+// SearchStops returns the stops whose code or name matches the query, best matches first
+func (s *stopService) SearchStops(_ context.Context, query string, limit int) ([]models.Stop, error) {
+	if s.schedule == nil {
+		return nil, ErrNoSchedule
+	}
+
+	feed := s.schedule.Feed()
+	found := feed.SearchStops(query, limit)
+	stops := make([]models.Stop, 0, len(found))
+	for _, stop := range found {
+		stops = append(stops, toStop(feed, stop))
+	}
+	return stops, nil
+}
+
+// StopsNear returns the stops within radius meters of a location, nearest first
+func (s *stopService) StopsNear(_ context.Context, lat, lon, radius float64, limit int) ([]models.Stop, error) {
+	if s.schedule == nil {
+		return nil, ErrNoSchedule
+	}
+
+	feed := s.schedule.Feed()
+	near := feed.StopsNear(lat, lon, radius, limit)
+	stops := make([]models.Stop, 0, len(near))
+	for _, n := range near {
+		stop := toStop(feed, n.Stop)
+		distance := n.Distance
+		stop.Distance = &distance
+		stops = append(stops, stop)
+	}
+	return stops, nil
+}
+
+// toStop converts a stop of the feed, with the routes serving it, to its API representation
+func toStop(feed *schedule.Feed, stop *schedule.Stop) models.Stop {
+	result := models.Stop{
+		ID:        stop.ID,
+		Code:      stop.Code,
+		Name:      stop.Name,
+		Names:     stop.Names,
+		Latitude:  stop.Lat,
+		Longitude: stop.Lon,
+		Routes:    []models.StopRoute{},
+	}
+	for _, route := range feed.RoutesAtStop(stop.ID) {
+		result.Routes = append(result.Routes, models.StopRoute{
+			ID:        route.ID,
+			ShortName: route.ShortName,
+			LongName:  route.LongName,
+			Color:     route.Color,
+		})
+	}
+	return result
+}
+
+var _ StopService = (*stopService)(nil)
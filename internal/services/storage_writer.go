@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"finbus/internal/metrics"
+	"log/slog"
+	"time"
+)
+
+const (
+	// storageQueueSize is the number of writes buffered by a storage writer before new ones are
+	// dropped
+	storageQueueSize = 1024
+	// storageWriteTimeout bounds every write of a storage writer
+	storageWriteTimeout = 10 * time.Second
+)
+
+// storageWrite is a write queued in a storage writer, with the message and attributes logged if
+// it fails
+type storageWrite struct {
+	write   func(ctx context.Context) error
+	message string
+	attrs   []any
+}
+
+// storageWriter writes to storage from its own goroutine, one write at a time in the order
+// queued, so observers never hold up the processing of bus updates waiting for storage
+type storageWriter struct {
+	queue  string
+	writes chan storageWrite
+	logger *slog.Logger
+}
+
+// newStorageWriter creates a storage writer, reporting the depth of its queue by the queue name
+func newStorageWriter(queue string, logger *slog.Logger) *storageWriter {
+	return &storageWriter{
+		queue:  queue,
+		writes: make(chan storageWrite, storageQueueSize),
+		logger: logger,
+	}
+}
+
+// write queues the write, dropping it if the queue is full. message and attrs are logged if the
+// write fails or is dropped.
+func (w *storageWriter) write(write func(ctx context.Context) error, message string, attrs ...any) {
+	select {
+	case w.writes <- storageWrite{write: write, message: message, attrs: attrs}:
+		metrics.QueueDepth.WithLabelValues(w.queue).Set(float64(len(w.writes)))
+	default:
+		metrics.StorageWritesDropped.WithLabelValues(w.queue).Inc()
+		w.logger.Error(message+", queue full", attrs...)
+	}
+}
+
+// Start runs the queued writes until ctx is cancelled
+func (w *storageWriter) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case write := <-w.writes:
+				metrics.QueueDepth.WithLabelValues(w.queue).Set(float64(len(w.writes)))
+				w.run(ctx, write)
+			}
+		}
+	}()
+}
+
+// run runs a write, giving up after the write timeout
+func (w *storageWriter) run(ctx context.Context, write storageWrite) {
+	ctx, cancel := context.WithTimeout(ctx, storageWriteTimeout)
+	defer cancel()
+	if err := write.write(ctx); err != nil {
+		w.logger.ErrorContext(ctx, write.message, append(write.attrs, "error", err)...)
+	}
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"finbus/internal/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// vehicleTTL is how long a vehicle stays in the latest-state cache without updates
+const vehicleTTL = 5 * time.Minute
+
+// pruneVehicles forgets the vehicles without updates for longer than the vehicle TTL, at most once
+// per TTL since lastPruned. forget removes a vehicle, deleting it from vehicles if nil.
+func pruneVehicles[V any](vehicles map[string]V, seen func(V) time.Time, forget func(id string, vehicle V), lastPruned *time.Time, now time.Time) {
+	if now.Sub(*lastPruned) < vehicleTTL {
+		return
+	}
+	for id, vehicle := range vehicles {
+		if now.Sub(seen(vehicle)) <= vehicleTTL {
+			continue
+		}
+		if forget != nil {
+			forget(id, vehicle)
+		} else {
+			delete(vehicles, id)
+		}
+	}
+	*lastPruned = now
+}
+
+type cachedVehicle struct {
+	data models.BusData
+	seen time.Time
+}
+
+// vehicleCache keeps the latest known state of every vehicle
+type vehicleCache struct {
+	mu         sync.RWMutex
+	ttl        time.Duration
+	vehicles   map[string]cachedVehicle
+	lastPruned time.Time
+}
+
+func newVehicleCache(ttl time.Duration) *vehicleCache {
+	return &vehicleCache{ttl: ttl, vehicles: make(map[string]cachedVehicle), lastPruned: time.Now()}
+}
+
+// update stores the latest state of a vehicle, pruning expired vehicles at most once per TTL
+func (c *vehicleCache) update(busData models.BusData) {
+	if busData.VehicleID == "" {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vehicles[busData.VehicleID] = cachedVehicle{data: busData, seen: now}
+
+	if now.Sub(c.lastPruned) < c.ttl {
+		return
+	}
+	for id, vehicle := range c.vehicles {
+		if now.Sub(vehicle.seen) > c.ttl {
+			delete(c.vehicles, id)
+		}
+	}
+	c.lastPruned = now
+}
+
+// matching returns the vehicles matching the filter, ordered by vehicle ID
+func (c *vehicleCache) matching(filter models.BusFilter) []models.BusData {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var buses []models.BusData
+	for _, vehicle := range c.vehicles {
+		if now.Sub(vehicle.seen) <= c.ttl && filter.Matches(vehicle.data) {
+			buses = append(buses, vehicle.data)
+		}
+	}
+	sort.Slice(buses, func(i, j int) bool {
+		return buses[i].VehicleID < buses[j].VehicleID
+	})
+	return buses
+}
+
+// size returns the number of vehicles in the cache, including expired ones not yet pruned
+func (c *vehicleCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.vehicles)
+}
@@ -0,0 +1,160 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Point is a WGS84 coordinate
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// UnmarshalYAML reads a point written as [lat, lon]
+func (p *Point) UnmarshalYAML(node *yaml.Node) error {
+	var pair []float64
+	if err := node.Decode(&pair); err != nil || len(pair) != 2 {
+		return fmt.Errorf("line %d: a point must be [lat, lon]", node.Line)
+	}
+	p.Lat, p.Lon = pair[0], pair[1]
+	return nil
+}
+
+// Stop is a stop along a route
+type Stop struct {
+	ID  string  `yaml:"id"`
+	Lat float64 `yaml:"lat"`
+	Lon float64 `yaml:"lon"`
+}
+
+// Route is a line driven back and forth along its polyline
+type Route struct {
+	ID        string `yaml:"id"`
+	ShortName string `yaml:"short_name"`
+	// Headsigns are the destinations driving along the points and back
+	Headsigns [2]string `yaml:"headsigns"`
+	Color     string    `yaml:"color"`
+	Points    []Point   `yaml:"points"`
+	// Stops are served in the order of the points, stops are generated every stopSpacing if empty
+	Stops []Stop `yaml:"stops"`
+}
+
+// routesFile is the YAML format of route polylines
+type routesFile struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// LoadRoutes reads the routes of a YAML file of route polylines, or of a GTFS shapes.txt
+func LoadRoutes(path string) ([]Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening routes %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var routes []Route
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".txt", ".csv":
+		routes, err = ReadShapes(file)
+	default:
+		var parsed routesFile
+		if err = yaml.NewDecoder(file).Decode(&parsed); err == nil {
+			routes = parsed.Routes
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading routes %s: %v", path, err)
+	}
+	for _, route := range routes {
+		if len(route.Points) < 2 {
+			return nil, fmt.Errorf("error reading routes %s: route %s needs at least 2 points", path, route.ID)
+		}
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("error reading routes %s: no routes", path)
+	}
+	return routes, nil
+}
+
+// ReadShapes reads a GTFS shapes.txt, making every shape a route named after the shape ID
+func ReadShapes(r io.Reader) ([]Route, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+	for _, name := range []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	type shapePoint struct {
+		Point
+		sequence int
+	}
+	shapes := make(map[string][]shapePoint)
+	var order []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lat, latErr := strconv.ParseFloat(record[columns["shape_pt_lat"]], 64)
+		lon, lonErr := strconv.ParseFloat(record[columns["shape_pt_lon"]], 64)
+		sequence, sequenceErr := strconv.Atoi(record[columns["shape_pt_sequence"]])
+		if latErr != nil || lonErr != nil || sequenceErr != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: invalid shape point", line)
+		}
+		id := record[columns["shape_id"]]
+		if _, ok := shapes[id]; !ok {
+			order = append(order, id)
+		}
+		shapes[id] = append(shapes[id], shapePoint{Point{lat, lon}, sequence})
+	}
+
+	routes := make([]Route, 0, len(order))
+	for _, id := range order {
+		points := shapes[id]
+		sort.SliceStable(points, func(i, j int) bool { return points[i].sequence < points[j].sequence })
+		route := Route{ID: id, ShortName: id, Headsigns: [2]string{id + " A", id + " B"}}
+		for _, point := range points {
+			route.Points = append(route.Points, point.Point)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// DefaultRoutes returns the route used without a routes file, bus 550 between Westendinasema and
+// Itäkeskus in Helsinki
+func DefaultRoutes() []Route {
+	return []Route{{
+		ID:        "2550",
+		ShortName: "550",
+		Headsigns: [2]string{"Itäkeskus(M)", "Westendinasema"},
+		Color:     "007AC9",
+		Points: []Point{
+			{60.16388, 24.80549}, {60.17563, 24.81362}, {60.18426, 24.82747}, {60.18819, 24.83320},
+			{60.20308, 24.87653}, {60.20712, 24.89770}, {60.21051, 24.92126}, {60.20993, 24.95037},
+			{60.21150, 24.97810}, {60.21471, 25.01430}, {60.21340, 25.05130}, {60.21060, 25.08090},
+		},
+	}}
+}
@@ -0,0 +1,365 @@
+// Package simulator simulates a fleet of buses driving along route polylines and reporting their
+// positions like the Digitransit feed, for load tests and demos without the real feed
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/transport/mqtt"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// stopSpacing is the distance in meters between the stops generated for routes without stops
+	stopSpacing = 400
+	// firstVehicle is the number of the first simulated vehicle
+	firstVehicle = 1001
+	// operator is the operator number of simulated vehicles
+	operator = 99
+)
+
+// Feed levels of the topics of simulated vehicles
+const (
+	FeedID     = "SIM"
+	AgencyID   = "SIM"
+	AgencyName = "Simulated"
+	Mode       = "BUS"
+)
+
+// Position is a position report of a simulated vehicle
+type Position struct {
+	Data models.BusData
+	At   time.Time
+	// Speed is in meters per second and Acceleration in meters per second squared
+	Speed        float64
+	Acceleration float64
+	// Heading is in degrees clockwise from north
+	Heading int
+	// Odometer is the distance driven in meters
+	Odometer int
+}
+
+// Topic returns the vehicle position topic the position is published to
+func (p Position) Topic() string {
+	return mqtt.FormatTopic(p.Data)
+}
+
+// hfpPayload is a vehicle position message of the Digitransit high-frequency positioning feed
+type hfpPayload struct {
+	VP hfpVehiclePosition `json:"VP"`
+}
+
+type hfpVehiclePosition struct {
+	Desi  string  `json:"desi"`
+	Dir   string  `json:"dir"`
+	Oper  int     `json:"oper"`
+	Veh   int     `json:"veh"`
+	Tst   string  `json:"tst"`
+	Tsi   int64   `json:"tsi"`
+	Spd   float64 `json:"spd"`
+	Hdg   int     `json:"hdg"`
+	Lat   float64 `json:"lat"`
+	Long  float64 `json:"long"`
+	Acc   float64 `json:"acc"`
+	Dl    int     `json:"dl"`
+	Odo   int     `json:"odo"`
+	Drst  int     `json:"drst"`
+	Oday  string  `json:"oday"`
+	Start string  `json:"start"`
+	Loc   string  `json:"loc"`
+	Stop  string  `json:"stop"`
+	Route string  `json:"route"`
+	Occu  int     `json:"occu"`
+}
+
+// Payload returns the HFP JSON message of the position. HFP reports the schedule deviation as dl,
+// positive when the vehicle is ahead of its schedule.
+func (p Position) Payload() ([]byte, error) {
+	vehicle, _ := strconv.Atoi(p.Data.VehicleID)
+	dl := 0
+	if p.Data.Delay != nil {
+		dl = -*p.Data.Delay
+	}
+	return json.Marshal(hfpPayload{VP: hfpVehiclePosition{
+		Desi:  p.Data.ShortName,
+		Dir:   p.Data.DirectionID,
+		Oper:  operator,
+		Veh:   vehicle,
+		Tst:   p.At.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Tsi:   p.At.Unix(),
+		Spd:   math.Round(p.Speed*100) / 100,
+		Hdg:   p.Heading,
+		Lat:   p.Data.Latitude,
+		Long:  p.Data.Longitude,
+		Acc:   math.Round(p.Acceleration*100) / 100,
+		Dl:    dl,
+		Odo:   p.Odometer,
+		Oday:  p.At.Format("2006-01-02"),
+		Start: p.Data.StartTime,
+		Loc:   "GPS",
+		Stop:  p.Data.NextStop,
+		Route: p.Data.RouteID,
+	}})
+}
+
+// route is a route with the distances along it precomputed
+type route struct {
+	Route
+	// distances are the distances of the points from the first one
+	distances []float64
+	stops     []stop
+}
+
+// stop is a stop at a distance along a route
+type stop struct {
+	id       string
+	distance float64
+}
+
+func (r *route) length() float64 {
+	return r.distances[len(r.distances)-1]
+}
+
+// vehicle is the state of a simulated vehicle. Direction 0 drives along the points of the route
+// and direction 1 back.
+type vehicle struct {
+	id        string
+	route     *route
+	distance  float64
+	direction int
+	// pace is how much faster than average the vehicle drives
+	pace     float64
+	speed    float64
+	odometer float64
+	// tripStart is the scheduled start of the current trip, which is scheduled at the average
+	// speed, and tripDriven the distance driven on it
+	tripStart  time.Time
+	tripDriven float64
+}
+
+// Simulator moves a fleet of vehicles along their routes. It is not safe for concurrent use.
+type Simulator struct {
+	vehicles []*vehicle
+	speed    float64
+	rng      *rand.Rand
+}
+
+// New creates a simulator with the configured number of vehicles spread over the routes, starting
+// their trips at start
+func New(cfg config.SimulatorConfig, routes []Route, start time.Time) (*Simulator, error) {
+	if cfg.Vehicles <= 0 {
+		return nil, fmt.Errorf("simulator needs at least one vehicle")
+	}
+	if cfg.Speed <= 0 {
+		return nil, fmt.Errorf("simulator speed must be positive")
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("simulator needs at least one route")
+	}
+
+	prepared := make([]*route, len(routes))
+	for i, r := range routes {
+		if len(r.Points) < 2 {
+			return nil, fmt.Errorf("route %s needs at least 2 points", r.ID)
+		}
+		prepared[i] = newRoute(r)
+	}
+
+	s := &Simulator{speed: cfg.Speed / 3.6, rng: rand.New(rand.NewSource(cfg.Seed))}
+	for i := 0; i < cfg.Vehicles; i++ {
+		r := prepared[i%len(prepared)]
+		v := &vehicle{
+			id:        strconv.Itoa(firstVehicle + i),
+			route:     r,
+			distance:  s.rng.Float64() * r.length(),
+			direction: s.rng.Intn(2),
+			pace:      0.8 + 0.4*s.rng.Float64(),
+		}
+		v.tripDriven = v.distance
+		if v.direction == 1 {
+			v.tripDriven = r.length() - v.distance
+		}
+		// Vehicles start up to two minutes off the schedule of their trip
+		scheduled := time.Duration(v.tripDriven/s.speed*float64(time.Second)) + time.Duration(s.rng.Intn(240)-120)*time.Second
+		v.tripStart = start.Add(-scheduled).Truncate(time.Minute)
+		v.speed = s.speed * v.pace
+		s.vehicles = append(s.vehicles, v)
+	}
+	return s, nil
+}
+
+// newRoute precomputes the distances along the route and places its stops
+func newRoute(r Route) *route {
+	prepared := &route{Route: r, distances: make([]float64, len(r.Points))}
+	for i := 1; i < len(r.Points); i++ {
+		prepared.distances[i] = prepared.distances[i-1] + distance(r.Points[i-1], r.Points[i])
+	}
+
+	if len(r.Stops) == 0 {
+		for i := 0; float64(i)*stopSpacing <= prepared.length(); i++ {
+			prepared.stops = append(prepared.stops, stop{id: fmt.Sprintf("%s%02d", r.ID, i+1), distance: float64(i) * stopSpacing})
+		}
+		return prepared
+	}
+	// Stops are placed at the nearest point of the route
+	for _, s := range r.Stops {
+		nearest := 0
+		for i, point := range r.Points {
+			if distance(point, Point{s.Lat, s.Lon}) < distance(r.Points[nearest], Point{s.Lat, s.Lon}) {
+				nearest = i
+			}
+		}
+		prepared.stops = append(prepared.stops, stop{id: s.ID, distance: prepared.distances[nearest]})
+	}
+	return prepared
+}
+
+// Step moves every vehicle for the elapsed time and returns their positions at now. Vehicles turn
+// around at the ends of their routes, starting a new trip.
+func (s *Simulator) Step(now time.Time, elapsed time.Duration) []Position {
+	positions := make([]Position, 0, len(s.vehicles))
+	for _, v := range s.vehicles {
+		previousSpeed := v.speed
+		v.speed = s.speed * v.pace * (0.9 + 0.2*s.rng.Float64())
+		moved := v.speed * elapsed.Seconds()
+		v.odometer += moved
+		v.tripDriven += moved
+
+		length := v.route.length()
+		if v.direction == 0 {
+			v.distance += moved
+		} else {
+			v.distance -= moved
+		}
+		if v.distance >= length || v.distance <= 0 {
+			v.distance = math.Max(0, math.Min(length, v.distance))
+			v.direction = 1 - v.direction
+			v.tripStart = now.Truncate(time.Minute)
+			v.tripDriven = 0
+		}
+
+		acceleration := 0.0
+		if elapsed > 0 {
+			acceleration = (v.speed - previousSpeed) / elapsed.Seconds()
+		}
+		positions = append(positions, s.position(v, now, acceleration))
+	}
+	return positions
+}
+
+// position returns the position report of the vehicle
+func (s *Simulator) position(v *vehicle, now time.Time, acceleration float64) Position {
+	point, heading := v.route.locate(v.distance)
+	if v.direction == 1 {
+		heading = math.Mod(heading+180, 360)
+	}
+	lat := math.Round(point.Lat*1e6) / 1e6
+	lon := math.Round(point.Lon*1e6) / 1e6
+	head, firstDeg, secondDeg, thirdDeg := geo.SplitGeohash(lat, lon)
+	// The vehicle is behind its schedule by how much longer it took to drive its trip so far than
+	// the schedule at the average speed
+	delay := int(math.Round(now.Sub(v.tripStart).Seconds() - v.tripDriven/s.speed))
+
+	return Position{
+		Data: models.BusData{
+			FeedFormat:       "gtfsrt",
+			Type:             "vp",
+			FeedID:           FeedID,
+			AgencyID:         AgencyID,
+			AgencyName:       AgencyName,
+			Mode:             Mode,
+			RouteID:          v.route.ID,
+			DirectionID:      strconv.Itoa(v.direction + 1),
+			TripHeadsign:     v.route.Headsigns[v.direction],
+			TripID:           fmt.Sprintf("%s_%s_Sim_%d_%s", v.route.ID, v.tripStart.Format("20060102"), v.direction+1, v.tripStart.Format("1504")),
+			NextStop:         v.route.nextStop(v.distance, v.direction),
+			StartTime:        v.tripStart.Format("15:04"),
+			VehicleID:        v.id,
+			GeohashHead:      head,
+			GeohashFirstDeg:  firstDeg,
+			GeohashSecondDeg: secondDeg,
+			GeohashThirdDeg:  thirdDeg,
+			ShortName:        v.route.ShortName,
+			Color:            v.route.Color,
+			Latitude:         lat,
+			Longitude:        lon,
+			Delay:            &delay,
+		},
+		At:           now,
+		Speed:        v.speed,
+		Acceleration: acceleration,
+		Heading:      int(math.Round(heading)) % 360,
+		Odometer:     int(v.odometer),
+	}
+}
+
+// locate returns the point at the distance along the route and the heading of the route there
+func (r *route) locate(d float64) (Point, float64) {
+	i := 1
+	for i < len(r.distances)-1 && r.distances[i] < d {
+		i++
+	}
+	from, to := r.Points[i-1], r.Points[i]
+	fraction := 0.0
+	if segment := r.distances[i] - r.distances[i-1]; segment > 0 {
+		fraction = math.Max(0, math.Min(1, (d-r.distances[i-1])/segment))
+	}
+	return Point{
+		Lat: from.Lat + (to.Lat-from.Lat)*fraction,
+		Lon: from.Lon + (to.Lon-from.Lon)*fraction,
+	}, bearing(from, to)
+}
+
+// nextStop returns the next stop ahead in the direction of travel, or the terminus
+func (r *route) nextStop(d float64, direction int) string {
+	if direction == 0 {
+		for _, s := range r.stops {
+			if s.distance > d {
+				return s.id
+			}
+		}
+		return r.stops[len(r.stops)-1].id
+	}
+	for i := len(r.stops) - 1; i >= 0; i-- {
+		if r.stops[i].distance < d {
+			return r.stops[i].id
+		}
+	}
+	return r.stops[0].id
+}
+
+// distance returns the great-circle distance between two points in meters
+func distance(a, b Point) float64 {
+	return geo.Distance(a.Lat, a.Lon, b.Lat, b.Lon)
+}
+
+// bearing returns the initial bearing from a to b in degrees clockwise from north
+func bearing(a, b Point) float64 {
+	return geo.Bearing(a.Lat, a.Lon, b.Lat, b.Lon)
+}
+
+// Run steps the simulation every interval until ctx is cancelled, passing every position to
+// publish
+func (s *Simulator) Run(ctx context.Context, interval time.Duration, publish func(Position)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, position := range s.Step(now, now.Sub(last)) {
+				publish(position)
+			}
+			last = now
+		}
+	}
+}
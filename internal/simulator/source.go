@@ -0,0 +1,59 @@
+package simulator
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"log/slog"
+	"time"
+)
+
+// Source is an ingest.Source sending the positions of a simulated fleet straight to the data
+// channel, without going through an MQTT broker
+type Source struct {
+	simulator   *Simulator
+	interval    time.Duration
+	dataChannel chan models.BusMessage
+	logger      *slog.Logger
+	vehicles    int
+}
+
+// NewSource creates a source simulating the configured fleet on the routes of cfg.RoutesFile, or
+// on the default routes without one
+func NewSource(cfg config.SimulatorConfig, dataChannel chan models.BusMessage, logger *slog.Logger) (*Source, error) {
+	routes := DefaultRoutes()
+	if cfg.RoutesFile != "" {
+		var err error
+		if routes, err = LoadRoutes(cfg.RoutesFile); err != nil {
+			return nil, err
+		}
+	}
+	simulator, err := New(cfg, routes, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &Source{
+		simulator:   simulator,
+		interval:    cfg.Interval,
+		dataChannel: dataChannel,
+		logger:      logger.With("component", "simulator"),
+		vehicles:    cfg.Vehicles,
+	}, nil
+}
+
+// Name returns the name of the source
+func (s *Source) Name() string {
+	return "simulator"
+}
+
+// Start simulates the fleet in the background until ctx is cancelled
+func (s *Source) Start(ctx context.Context) error {
+	s.logger.Info("Simulating vehicles", "vehicles", s.vehicles, "interval", s.interval)
+	go s.simulator.Run(ctx, s.interval, func(position Position) {
+		select {
+		case s.dataChannel <- models.BusMessage{Data: position.Data}:
+		case <-ctx.Done():
+		}
+	})
+	return nil
+}
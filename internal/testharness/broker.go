@@ -0,0 +1,71 @@
+package testharness
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// Broker is an embedded MQTT broker that can be stopped before the end of the test
+type Broker struct {
+	*mochi.Server
+	stopOnce sync.Once
+}
+
+// BrokerOptions configures an embedded broker
+type BrokerOptions struct {
+	// TLSConfig makes the broker serve TLS if set
+	TLSConfig *tls.Config
+	// Hook, with its HookConfig, authenticates clients, allowing every client if nil
+	Hook       mochi.Hook
+	HookConfig any
+}
+
+// StartBroker starts an MQTT broker on the address, stopped when the test ends
+func StartBroker(t testing.TB, address string, options BrokerOptions) *Broker {
+	t.Helper()
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	hook := options.Hook
+	if hook == nil {
+		hook = new(auth.AllowHook)
+	}
+	if err := server.AddHook(hook, options.HookConfig); err != nil {
+		t.Fatalf("Error adding broker hook: %v", err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: address, TLSConfig: options.TLSConfig})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatalf("Error listening on %s: %v", address, err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Error starting broker: %v", err)
+	}
+	broker := &Broker{Server: server}
+	t.Cleanup(broker.Stop)
+	return broker
+}
+
+// Stop stops the broker, disconnecting its clients
+func (b *Broker) Stop() {
+	b.stopOnce.Do(func() { _ = b.Close() })
+}
+
+// FreeAddress returns a local address that is free to listen on
+func FreeAddress(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -0,0 +1,145 @@
+// Package testharness runs finbus end to end in process: the real app and router, fed by an
+// embedded MQTT broker and storing bus data in memory, so tests need no external services.
+package testharness
+
+import (
+	"context"
+	"finbus/internal/app"
+	"finbus/internal/config"
+	"finbus/internal/database/memory"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/recording"
+	"finbus/internal/transport/mqtt"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitTimeout is how long the harness waits for published messages to be processed
+const waitTimeout = 5 * time.Second
+
+// Harness is a running finbus app with its broker and storage
+type Harness struct {
+	Broker  *Broker
+	Storage *memory.Storage
+	App     *app.App
+	Server  *httptest.Server
+}
+
+// Options configures the harness
+type Options struct {
+	// Configure adjusts the configuration before the app is created. The broker address is set
+	// already.
+	Configure func(cfg *config.Config)
+	// Logger is used by the app, slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// Start starts a broker, the app connected to it and an HTTP server serving the app's router.
+// Everything is stopped when the test ends.
+func Start(t testing.TB, options Options) *Harness {
+	t.Helper()
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	address := FreeAddress(t)
+	broker := StartBroker(t, address, BrokerOptions{})
+
+	cfg := config.Default()
+	cfg.MQTT.Broker = "tcp://" + address
+	if options.Configure != nil {
+		options.Configure(&cfg)
+	}
+
+	storage := memory.NewStorage()
+	finbus, err := app.New(cfg, app.Options{Storage: storage}, options.Logger)
+	if err != nil {
+		t.Fatalf("Error creating app: %v", err)
+	}
+	t.Cleanup(finbus.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := finbus.Start(ctx); err != nil {
+		t.Fatalf("Error starting app: %v", err)
+	}
+
+	server := httptest.NewServer(finbus.Router)
+	t.Cleanup(server.Close)
+
+	return &Harness{Broker: broker, Storage: storage, App: finbus, Server: server}
+}
+
+// URL returns the URL of the path on the HTTP server
+func (h *Harness) URL(path string) string {
+	return h.Server.URL + path
+}
+
+// WebSocketURL returns the WebSocket URL of the path on the HTTP server
+func (h *Harness) WebSocketURL(path string) string {
+	return "ws" + strings.TrimPrefix(h.Server.URL, "http") + path
+}
+
+// Publish publishes a message to the broker
+func (h *Harness) Publish(t testing.TB, topic string, payload []byte) {
+	t.Helper()
+	if err := h.Broker.Publish(topic, payload, false, 0); err != nil {
+		t.Fatalf("Error publishing to %s: %v", topic, err)
+	}
+}
+
+// PublishPosition publishes a position of the vehicle on trip T<vehicleID> of the route, heading
+// to stop D in direction 1
+func (h *Harness) PublishPosition(t testing.TB, vehicleID, routeID string, lat, lon float64) {
+	t.Helper()
+	h.PublishBusData(t, models.BusData{VehicleID: vehicleID, RouteID: routeID, Latitude: lat, Longitude: lon})
+}
+
+// PublishBusData publishes the bus data as a Digitransit vehicle position topic without a payload.
+// The geohash levels are those of its position, and the other topic fields left empty get the
+// defaults of PublishPosition.
+func (h *Harness) PublishBusData(t testing.TB, data models.BusData) {
+	t.Helper()
+	for field, fallback := range map[*string]string{
+		&data.FeedFormat: "gtfsrt", &data.Type: "vp", &data.FeedID: "HSL", &data.AgencyID: "HSL",
+		&data.AgencyName: "HSL", &data.Mode: "bus", &data.DirectionID: "1", &data.TripHeadsign: "D",
+		&data.TripID: "T" + data.VehicleID, &data.NextStop: "D", &data.StartTime: "08:00",
+		&data.ShortName: data.RouteID, &data.Color: "00b9e4",
+	} {
+		if *field == "" {
+			*field = fallback
+		}
+	}
+	data.GeohashHead, data.GeohashFirstDeg, data.GeohashSecondDeg, data.GeohashThirdDeg = geo.SplitGeohash(data.Latitude, data.Longitude)
+	h.Publish(t, mqtt.FormatTopic(data), nil)
+}
+
+// PublishFixtures publishes the recorded messages of the fixture file in order, without waiting
+// between them, and returns them
+func (h *Harness) PublishFixtures(t testing.TB, name string) []recording.Message {
+	t.Helper()
+	recorded, err := LoadFixtures(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range recorded {
+		h.Publish(t, message.Topic, message.Payload)
+	}
+	return recorded
+}
+
+// WaitForWrites waits until at least n bus updates have been stored
+func (h *Harness) WaitForWrites(t testing.TB, n int) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for len(h.Storage.Written()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d stored bus updates, got %d", n, len(h.Storage.Written()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,252 @@
+package gtfsrt
+
+import (
+	"context"
+	"finbus/internal/geo"
+	"finbus/internal/ingest"
+	"finbus/internal/models"
+	"finbus/internal/tracing"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultInterval = 15 * time.Second
+
+// PollerConfig configures a GTFS-Realtime feed poller
+type PollerConfig struct {
+	// URL of the GTFS-RT feed returning a FeedMessage, e.g. a VehiclePositions endpoint
+	URL string
+	// Interval between polls, defaults to 15 seconds
+	Interval time.Duration
+	// FeedID and Mode are copied into every BusData, as GTFS-RT does not carry them
+	FeedID string
+	Mode   string
+	// Client is the HTTP client used for polling, defaults to http.DefaultClient
+	Client *http.Client
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Poller is an ingest.Source that polls a GTFS-Realtime feed over HTTP and sends the vehicles
+// in it to a channel
+type Poller struct {
+	config       PollerConfig
+	dataChannel  chan models.BusMessage
+	etag         string
+	lastModified string
+}
+
+// NewPoller creates a new Poller for the feed described by the config
+func NewPoller(config PollerConfig, dataChannel chan models.BusMessage) (*Poller, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("GTFS-RT feed URL is required")
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.FeedID == "" {
+		config.FeedID = "gtfsrt"
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	config.Logger = config.Logger.With("component", "gtfsrt", "url", config.URL)
+	return &Poller{config: config, dataChannel: dataChannel}, nil
+}
+
+// Name returns the name of the source
+func (p *Poller) Name() string {
+	return "gtfsrt"
+}
+
+// Start polls the feed once and keeps polling it in the background until ctx is cancelled
+func (p *Poller) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(p.config.Interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Poll(ctx); err != nil {
+				p.config.Logger.Error("Error polling GTFS-RT feed", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Poll fetches the feed once and sends its vehicles to the data channel. The feed is skipped when
+// the server reports it unchanged since the previous poll.
+func (p *Poller) Poll(ctx context.Context) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "gtfsrt.poll",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", p.config.URL)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	req.Header.Set("Accept", "application/x-protobuf, application/octet-stream")
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	}
+
+	resp, err := p.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		p.config.Logger.Debug("GTFS-RT feed not modified")
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var feed gtfs.FeedMessage
+	if err := proto.Unmarshal(body, &feed); err != nil {
+		return fmt.Errorf("error decoding feed: %v", err)
+	}
+
+	p.etag = resp.Header.Get("ETag")
+	p.lastModified = resp.Header.Get("Last-Modified")
+
+	buses := ParseFeed(&feed, p.config.FeedID, p.config.Mode)
+	p.config.Logger.Debug("Polled GTFS-RT feed", "vehicles", len(buses))
+	for _, busData := range buses {
+		select {
+		case p.dataChannel <- models.BusMessage{Ctx: ctx, Data: busData}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ParseFeed converts the vehicle positions in a GTFS-RT feed to BusData. Trip updates in the same
+// feed are used to fill in the next stop of vehicles that do not report one, and the delay. Trip
+// updates without a trip ID cannot be matched to a vehicle and are ignored.
+func ParseFeed(feed *gtfs.FeedMessage, feedID, mode string) []models.BusData {
+	nextStops := make(map[string]string)
+	delays := make(map[string]int)
+	for _, entity := range feed.GetEntity() {
+		update := entity.GetTripUpdate()
+		tripID := update.GetTrip().GetTripId()
+		if update == nil || tripID == "" {
+			continue
+		}
+		if delay, ok := tripDelay(update); ok {
+			delays[tripID] = delay
+		}
+		if len(update.GetStopTimeUpdate()) > 0 {
+			nextStops[tripID] = update.GetStopTimeUpdate()[0].GetStopId()
+		}
+	}
+
+	var buses []models.BusData
+	for _, entity := range feed.GetEntity() {
+		vehicle := entity.GetVehicle()
+		if vehicle == nil || vehicle.GetPosition() == nil {
+			continue
+		}
+		busData := parseVehiclePosition(vehicle, feedID, mode)
+		if busData.NextStop == "" {
+			busData.NextStop = nextStops[busData.TripID]
+		}
+		if delay, ok := delays[busData.TripID]; ok {
+			busData.Delay = &delay
+		}
+		buses = append(buses, busData)
+	}
+	return buses
+}
+
+// tripDelay returns the delay of the trip update in seconds behind the schedule: the delay of the
+// trip, or else the arrival or departure delay of the next stop time update
+func tripDelay(update *gtfs.TripUpdate) (int, bool) {
+	if update.Delay != nil {
+		return int(update.GetDelay()), true
+	}
+	if len(update.GetStopTimeUpdate()) == 0 {
+		return 0, false
+	}
+	next := update.GetStopTimeUpdate()[0]
+	for _, event := range []*gtfs.TripUpdate_StopTimeEvent{next.GetArrival(), next.GetDeparture()} {
+		if event != nil && event.Delay != nil {
+			return int(event.GetDelay()), true
+		}
+	}
+	return 0, false
+}
+
+// parseVehiclePosition converts a single GTFS-RT VehiclePosition to BusData
+func parseVehiclePosition(vehicle *gtfs.VehiclePosition, feedID, mode string) models.BusData {
+	trip := vehicle.GetTrip()
+	position := vehicle.GetPosition()
+	lat, lon := float64(position.GetLatitude()), float64(position.GetLongitude())
+	head, firstDeg, secondDeg, thirdDeg := geo.SplitGeohash(lat, lon)
+
+	vehicleID := vehicle.GetVehicle().GetId()
+	if vehicleID == "" {
+		vehicleID = vehicle.GetVehicle().GetLabel()
+	}
+	directionID := ""
+	if trip.DirectionId != nil {
+		directionID = strconv.Itoa(int(trip.GetDirectionId()))
+	}
+
+	return models.BusData{
+		FeedFormat:       "gtfsrt",
+		Type:             "vp",
+		FeedID:           feedID,
+		Mode:             mode,
+		RouteID:          trip.GetRouteId(),
+		DirectionID:      directionID,
+		TripID:           trip.GetTripId(),
+		NextStop:         vehicle.GetStopId(),
+		StartTime:        trip.GetStartTime(),
+		VehicleID:        vehicleID,
+		GeohashHead:      head,
+		GeohashFirstDeg:  firstDeg,
+		GeohashSecondDeg: secondDeg,
+		GeohashThirdDeg:  thirdDeg,
+		Latitude:         lat,
+		Longitude:        lon,
+	}
+}
+
+var _ ingest.Source = (*Poller)(nil)
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ConnectionState describes the connection to the MQTT broker
+type ConnectionState struct {
+	Connected bool
+	// Since is when the connection was last established or lost
+	Since time.Time
+	// Reconnects counts the connections established after the first one
+	Reconnects int
+	// LastError is why the connection was last lost
+	LastError string
+	// Subscriptions is the number of topics subscribed to, or to subscribe to on reconnect
+	Subscriptions int
+	// Acknowledged is the number of those subscriptions the broker acknowledged on the current
+	// connection
+	Acknowledged int
+}
+
+// ConnectionState returns the state of the connection to the broker
+func (m *busDataSubscriber) ConnectionState() ConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.state
+	state.Connected = m.client.IsConnectionOpen()
+	state.Subscriptions = len(m.topics)
+	for _, acknowledged := range m.topics {
+		if acknowledged {
+			state.Acknowledged++
+		}
+	}
+	return state
+}
+
+// onConnect records the connection and restores the registered subscriptions, which the broker
+// has dropped unless it resumed a persistent session
+func (m *busDataSubscriber) onConnect(client mqtt.Client) {
+	m.mu.Lock()
+	if !m.state.Since.IsZero() {
+		m.state.Reconnects++
+	}
+	m.state.Since = time.Now()
+	topics := make(map[string]byte, len(m.topics))
+	for topic := range m.topics {
+		topics[topic] = m.qos
+	}
+	m.mu.Unlock()
+
+	m.logger.Info("Connected to MQTT broker", "subscriptions", len(topics))
+	if len(topics) == 0 {
+		return
+	}
+	if token := client.SubscribeMultiple(topics, m.mqttMessageHandler); token.Wait() && token.Error() != nil {
+		m.logger.Error("Error restoring subscriptions", "topics", sortedTopics(topics), "error", token.Error())
+		return
+	}
+	m.mu.Lock()
+	for topic := range topics {
+		if _, ok := m.topics[topic]; ok {
+			m.topics[topic] = true
+		}
+	}
+	m.mu.Unlock()
+	m.logger.Info("Restored subscriptions", "topics", sortedTopics(topics))
+}
+
+// onConnectionLost records the lost connection. The client reconnects automatically.
+func (m *busDataSubscriber) onConnectionLost(_ mqtt.Client, err error) {
+	m.mu.Lock()
+	m.state.Since = time.Now()
+	m.state.LastError = err.Error()
+	for topic := range m.topics {
+		m.topics[topic] = false
+	}
+	m.mu.Unlock()
+	m.logger.Warn("Connection to MQTT broker lost, reconnecting", "error", err)
+}
+
+func sortedTopics(topics map[string]byte) []string {
+	sorted := make([]string, 0, len(topics))
+	for topic := range topics {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// generateClientID returns a client ID unique to this process, such as finbus-host-1a2b3c4d
+func generateClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return "finbus-" + hostname + "-" + hex.EncodeToString(b)
+}
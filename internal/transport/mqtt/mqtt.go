@@ -1,53 +1,218 @@
 package mqtt
 
 import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/ingest"
+	"finbus/internal/metrics"
 	"finbus/internal/models"
+	"finbus/internal/recording"
+	"finbus/internal/tracing"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
 	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type BusDataSubscriber interface {
+	ingest.Source
 	SubscribeToTopic(topic string) error
+	UnsubscribeFromTopic(topic string) error
 	mqttMessageHandler(client mqtt.Client, msg mqtt.Message)
 	ListenToAllTopics()
+	IsConnected() bool
+	ConnectionState() ConnectionState
 }
 
+// recordFlushInterval is how often recorded messages are flushed to the recording file
+const recordFlushInterval = time.Second
+
 // busDataSubscriber is an MQTT client that subscribes to a specific topic and sends the data to a channel
 type busDataSubscriber struct {
 	client      mqtt.Client
-	dataChannel chan models.BusData
+	dataChannel chan models.BusMessage
+	logger      *slog.Logger
+	qos         byte
+	// recorder records every received message, if a recording is configured
+	recorder *recording.Writer
+
+	// mu guards topics, the registry of subscribed topics restored on every reconnect, and state.
+	// A topic is true once the broker acknowledged its subscription on the current connection.
+	mu     sync.Mutex
+	topics map[string]bool
+	state  ConnectionState
 }
 
-// NewBusDataSubscriber creates a new busDataSubscriber and connects to the MQTT broker
-func NewBusDataSubscriber(mqttBroker string, dataChannel chan models.BusData) (BusDataSubscriber, error) {
-	opts := mqtt.NewClientOptions().AddBroker(mqttBroker).SetClientID("go_mqtt_client").SetAutoReconnect(true)
+// NewBusDataSubscriber creates a new busDataSubscriber and connects to the MQTT broker. Without a
+// configured client ID a unique one is generated, so replicas do not take over each other's
+// connection.
+func NewBusDataSubscriber(cfg config.MQTTConfig, dataChannel chan models.BusMessage, logger *slog.Logger) (BusDataSubscriber, error) {
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = generateClientID()
+	}
+	m := &busDataSubscriber{
+		dataChannel: dataChannel,
+		logger:      logger.With("component", "mqtt", "broker", cfg.Broker, "client_id", clientID),
+		qos:         byte(cfg.QoS),
+		topics:      make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetCleanSession(cfg.CleanSession).
+		SetAutoReconnect(true).
+		SetConnectRetry(false)
+	opts.OnConnect = m.onConnect
+	opts.OnConnectionLost = m.onConnectionLost
 
-	opts.OnConnect = func(c mqtt.Client) {
-		fmt.Println("Connected to MQTT broker")
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
 	}
 
-	opts.OnConnectionLost = func(c mqtt.Client, err error) {
-		fmt.Printf("Connection lost: %v. Reconnecting...\n", err)
+	// Credentials are read again on every reconnect, keeping the last ones if the files cannot be read
+	username, password, err := credentials(cfg)
+	if err != nil {
+		return nil, err
 	}
+	opts.SetCredentialsProvider(func() (string, string) {
+		if u, p, err := credentials(cfg); err != nil {
+			m.logger.Error("Error reading MQTT credentials, using the previous ones", "error", err)
+		} else {
+			username, password = u, p
+		}
+		return username, password
+	})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	if cfg.RecordFile != "" {
+		if m.recorder, err = recording.Create(cfg.RecordFile); err != nil {
+			return nil, err
+		}
+		m.logger.Info("Recording MQTT messages", "file", cfg.RecordFile)
+	}
+
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		if m.recorder != nil {
+			_ = m.recorder.Close()
+		}
 		return nil, fmt.Errorf("error connecting to MQTT broker: %v", token.Error())
 	}
+	return m, nil
+}
 
-	return &busDataSubscriber{client: client, dataChannel: dataChannel}, nil
+// Name returns the name of the source
+func (m *busDataSubscriber) Name() string {
+	return "mqtt"
 }
 
-// mqttMessageHandler handles incoming MQTT messages and sends the data to the data channel
+// Start keeps the broker connection open until ctx is cancelled. Topics are subscribed to on
+// demand through SubscribeToTopic and ListenToAllTopics. The recording, if any, is flushed
+// periodically and closed after disconnecting.
+func (m *busDataSubscriber) Start(ctx context.Context) error {
+	if !m.client.IsConnected() {
+		return fmt.Errorf("MQTT client is not connected")
+	}
+	go func() {
+		var flush <-chan time.Time
+		if m.recorder != nil {
+			ticker := time.NewTicker(recordFlushInterval)
+			defer ticker.Stop()
+			flush = ticker.C
+		}
+		for {
+			select {
+			case <-flush:
+				if err := m.recorder.Flush(); err != nil {
+					m.logger.Error("Error flushing recording", "error", err)
+				}
+			case <-ctx.Done():
+				m.client.Disconnect(250)
+				if m.recorder != nil {
+					if err := m.recorder.Close(); err != nil {
+						m.logger.Error("Error closing recording", "error", err)
+					}
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// mqttMessageHandler handles incoming MQTT messages, recording them if a recording is configured,
+// and sends the data to the data channel
 func (m *busDataSubscriber) mqttMessageHandler(_ mqtt.Client, msg mqtt.Message) {
-	busData := parseTopic(msg.Topic())
-	m.dataChannel <- busData
+	if m.recorder != nil {
+		message := recording.Message{Topic: msg.Topic(), Payload: msg.Payload(), ReceivedAt: time.Now()}
+		if err := m.recorder.Write(message); err != nil {
+			m.logger.Error("Error recording MQTT message", "topic", msg.Topic(), "error", err)
+		}
+	}
+	handleMessage(context.Background(), msg.Topic(), m.dataChannel, m.logger)
+}
+
+// handleMessage parses the topic of a received or replayed message and sends the data to the data
+// channel, unless ctx is cancelled first. The message is traced in a new trace.
+func handleMessage(ctx context.Context, topic string, dataChannel chan<- models.BusMessage, logger *slog.Logger) {
+	eventType := topicEventType(topic)
+	messageCtx, span := tracing.Tracer().Start(context.WithoutCancel(ctx), "mqtt.message",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("mqtt.event_type", eventType),
+		))
+	defer span.End()
+
+	metrics.MQTTMessagesReceived.WithLabelValues(eventType).Inc()
+	_, parseSpan := tracing.Tracer().Start(messageCtx, "mqtt.parse")
+	busData, err := parseTopic(topic)
+	tracing.RecordError(parseSpan, err)
+	parseSpan.End()
+	if err != nil {
+		tracing.RecordError(span, err)
+		metrics.MQTTMessagesFailed.WithLabelValues(eventType).Inc()
+		logger.DebugContext(messageCtx, "Error parsing MQTT message", "topic", topic, "error", err)
+		return
+	}
+	metrics.MQTTMessagesParsed.WithLabelValues(eventType).Inc()
+	logger.DebugContext(messageCtx, "Received MQTT message", "topic", topic)
+	select {
+	case dataChannel <- models.BusMessage{Ctx: messageCtx, Data: busData}:
+	case <-ctx.Done():
+	}
+}
+
+// topicFields is the number of levels in a vehicle position topic, including the leading empty level
+const topicFields = 20
+
+// topicEventType returns the event type level of the topic, such as vp for vehicle positions
+func topicEventType(topic string) string {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) < 3 || parts[2] == "" {
+		return "unknown"
+	}
+	return parts[2]
 }
 
 // parseTopic parses the MQTT topic and returns a BusData struct
-func parseTopic(topic string) models.BusData {
+func parseTopic(topic string) (models.BusData, error) {
 	parts := strings.Split(topic, "/")
+	if len(parts) < topicFields {
+		return models.BusData{}, fmt.Errorf("topic %s has %d levels, expected %d", topic, len(parts), topicFields)
+	}
 	return models.BusData{
 		FeedFormat:       parts[1],
 		Type:             parts[2],
@@ -68,22 +233,72 @@ func parseTopic(topic string) models.BusData {
 		GeohashThirdDeg:  parts[17],
 		ShortName:        parts[18],
 		Color:            parts[19],
-	}
+	}, nil
+}
+
+// FormatTopic returns the vehicle position topic of the bus data, as published by the Digitransit
+// feed and parsed back by the subscriber
+func FormatTopic(data models.BusData) string {
+	levels := []string{"", data.FeedFormat, data.Type, data.FeedID, data.AgencyID, data.AgencyName, data.Mode,
+		data.RouteID, data.DirectionID, data.TripHeadsign, data.TripID, data.NextStop, data.StartTime, data.VehicleID,
+		data.GeohashHead, data.GeohashFirstDeg, data.GeohashSecondDeg, data.GeohashThirdDeg, data.ShortName, data.Color, ""}
+	return strings.Join(levels, "/")
 }
 
-// SubscribeToTopic subscribes to a specific MQTT topic
+// SubscribeToTopic subscribes to a specific MQTT topic. The topic is registered so it is
+// subscribed to again after a reconnect. While the client is reconnecting, the subscription is
+// only registered and made once the connection is restored.
 func (m *busDataSubscriber) SubscribeToTopic(topic string) error {
-	if token := m.client.Subscribe(topic, 0, m.mqttMessageHandler); token.Wait() && token.Error() != nil {
+	m.mu.Lock()
+	if _, ok := m.topics[topic]; !ok {
+		m.topics[topic] = false
+	}
+	m.mu.Unlock()
+
+	if !m.client.IsConnectionOpen() {
+		m.logger.Info("Not connected, subscribing to topic on reconnect", "topic", topic)
+		return nil
+	}
+	if token := m.client.Subscribe(topic, m.qos, m.mqttMessageHandler); token.Wait() && token.Error() != nil {
+		m.mu.Lock()
+		delete(m.topics, topic)
+		m.mu.Unlock()
 		return fmt.Errorf("error subscribing to topic %s: %v", topic, token.Error())
 	}
-	fmt.Printf("Subscribed to topic: %s\n", topic)
+	m.mu.Lock()
+	if _, ok := m.topics[topic]; ok {
+		m.topics[topic] = true
+	}
+	m.mu.Unlock()
+	m.logger.Info("Subscribed to topic", "topic", topic)
+	return nil
+}
+
+// UnsubscribeFromTopic unsubscribes from a previously subscribed MQTT topic
+func (m *busDataSubscriber) UnsubscribeFromTopic(topic string) error {
+	m.mu.Lock()
+	delete(m.topics, topic)
+	m.mu.Unlock()
+
+	if !m.client.IsConnectionOpen() {
+		return nil
+	}
+	if token := m.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error unsubscribing from topic %s: %v", topic, token.Error())
+	}
+	m.logger.Info("Unsubscribed from topic", "topic", topic)
 	return nil
 }
 
+// IsConnected reports whether the client is currently connected to the broker
+func (m *busDataSubscriber) IsConnected() bool {
+	return m.client.IsConnectionOpen()
+}
+
 // ListenToAllTopics subscribes to all topics
 func (m *busDataSubscriber) ListenToAllTopics() {
-	if token := m.client.Subscribe("#", 0, m.mqttMessageHandler); token.Wait() && token.Error() != nil {
-		fmt.Printf("Error subscribing to all topics: %v\n", token.Error())
+	if err := m.SubscribeToTopic("#"); err != nil {
+		m.logger.Error("Error subscribing to all topics", "error", err)
 	}
 }
 
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/config"
+	"finbus/internal/ingest"
+	"finbus/internal/models"
+	"finbus/internal/recording"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// ReplaySource is a source replaying a recording of MQTT traffic
+type ReplaySource interface {
+	ingest.Source
+	// Done returns a channel closed when the replay has finished
+	Done() <-chan struct{}
+}
+
+// replaySource feeds a recording of MQTT traffic into the data channel, parsing the messages like
+// the subscriber does
+type replaySource struct {
+	cfg         config.ReplayConfig
+	dataChannel chan models.BusMessage
+	logger      *slog.Logger
+	// done is closed when the replay has finished
+	done chan struct{}
+}
+
+// NewReplaySource creates a source replaying the recording configured in cfg. Messages are sent
+// with the recorded intervals between them divided by the speed, or as fast as the data channel
+// takes them with speed 0.
+func NewReplaySource(cfg config.ReplayConfig, dataChannel chan models.BusMessage, logger *slog.Logger) (ReplaySource, error) {
+	if cfg.Speed < 0 {
+		return nil, fmt.Errorf("replay speed must not be negative")
+	}
+	reader, err := recording.Open(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	_ = reader.Close()
+	return &replaySource{
+		cfg:         cfg,
+		dataChannel: dataChannel,
+		logger:      logger.With("component", "replay", "file", cfg.File),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// Name returns the name of the source
+func (r *replaySource) Name() string {
+	return "replay"
+}
+
+// Start begins the replay, which stops at the end of the recording unless it loops, or when ctx
+// is cancelled
+func (r *replaySource) Start(ctx context.Context) error {
+	reader, err := recording.Open(r.cfg.File)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Replaying recording", "speed", r.cfg.Speed, "loop", r.cfg.Loop)
+	go r.run(ctx, reader)
+	return nil
+}
+
+// Done returns a channel closed when the replay has finished, at the end of the recording or when
+// the replay is stopped
+func (r *replaySource) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *replaySource) run(ctx context.Context, reader *recording.Reader) {
+	defer close(r.done)
+	for {
+		count, err := r.replay(ctx, reader)
+		_ = reader.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			r.logger.Warn("Recording ends unexpectedly, it was not closed", "messages", count)
+		} else if err != nil {
+			r.logger.Error("Error replaying recording", "messages", count, "error", err)
+			return
+		}
+		r.logger.Info("Replayed recording", "messages", count)
+		if !r.cfg.Loop {
+			return
+		}
+		if reader, err = recording.Open(r.cfg.File); err != nil {
+			r.logger.Error("Error reopening recording", "error", err)
+			return
+		}
+	}
+}
+
+// replay sends every message of the recording and returns how many were sent
+func (r *replaySource) replay(ctx context.Context, reader *recording.Reader) (int, error) {
+	var first time.Time
+	start := time.Now()
+	count := 0
+	for {
+		message, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if r.cfg.Speed > 0 {
+			if first.IsZero() {
+				first = message.ReceivedAt
+			}
+			due := start.Add(time.Duration(float64(message.ReceivedAt.Sub(first)) / r.cfg.Speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return count, ctx.Err()
+				}
+			}
+		}
+
+		handleMessage(ctx, message.Topic, r.dataChannel, r.logger)
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		count++
+	}
+}
+
+var _ ReplaySource = (*replaySource)(nil)
@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"finbus/internal/config"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration of the broker connection. It returns nil if nothing is
+// configured, leaving the defaults of the client for TLS brokers.
+func newTLSConfig(cfg config.MQTTTLSConfig) (*tls.Config, error) {
+	if cfg == (config.MQTTTLSConfig{}) {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, MinVersion: tls.VersionTLS12}
+
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		// The CAs are trusted in addition to the system roots, where the platform has them
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// credentials returns the username and password configured for the broker, reading them from
+// their files if set
+func credentials(cfg config.MQTTConfig) (string, string, error) {
+	username, password := cfg.Username, string(cfg.Password)
+	if cfg.UsernameFile != "" {
+		data, err := os.ReadFile(cfg.UsernameFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading username file: %v", err)
+		}
+		username = strings.TrimSpace(string(data))
+	}
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading password file: %v", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	return username, password, nil
+}
@@ -0,0 +1,43 @@
+package rest
+
+import (
+	"encoding/json"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"log/slog"
+	"net/http"
+)
+
+type AlertHandler interface {
+	HandleAlerts(w http.ResponseWriter, r *http.Request)
+}
+
+type alertHandler struct {
+	service services.AlertService
+	logger  *slog.Logger
+}
+
+// alertsResponse lists the firing alerts
+type alertsResponse struct {
+	Alerts []models.Alert `json:"alerts"`
+}
+
+// NewAlertHandler creates a new AlertHandler
+func NewAlertHandler(service services.AlertService, logger *slog.Logger) AlertHandler {
+	return &alertHandler{service: service, logger: logger.With("component", "rest")}
+}
+
+// HandleAlerts returns the firing alerts, oldest first. rule limits them to the alerts of a rule.
+func (h *alertHandler) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	rule := r.URL.Query().Get("rule")
+	alerts := make([]models.Alert, 0)
+	for _, alert := range h.service.Alerts() {
+		if rule == "" || alert.Rule == rule {
+			alerts = append(alerts, alert)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(alertsResponse{Alerts: alerts})
+}
+
+var _ AlertHandler = (*alertHandler)(nil)
@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"finbus/internal/logging"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultDelayRange is how far back delay statistics look without a start
+const defaultDelayRange = 24 * time.Hour
+
+// delayGroupings maps the grouping path segments to their groupings
+var delayGroupings = map[string]models.DelayGrouping{
+	"routes":     models.DelayByRoute,
+	"directions": models.DelayByDirection,
+	"stops":      models.DelayByStop,
+}
+
+type AnalyticsHandler interface {
+	HandleDelays(w http.ResponseWriter, r *http.Request)
+}
+
+type analyticsHandler struct {
+	service services.DelayService
+	logger  *slog.Logger
+}
+
+// delaysResponse lists the delay statistics of a range
+type delaysResponse struct {
+	Start time.Time           `json:"start"`
+	End   time.Time           `json:"end"`
+	Stats []models.DelayStats `json:"stats"`
+}
+
+// NewAnalyticsHandler creates a new AnalyticsHandler
+func NewAnalyticsHandler(service services.DelayService, logger *slog.Logger) AnalyticsHandler {
+	return &analyticsHandler{service: service, logger: logger.With("component", "rest")}
+}
+
+// HandleDelays returns the delay statistics per route, direction or stop, as given by the by path
+// variable, between start and end. Both are RFC 3339 times or durations relative to now, such as
+// -24h, and default to the last 24 hours. route limits the statistics to a single route.
+func (h *analyticsHandler) HandleDelays(w http.ResponseWriter, r *http.Request) {
+	groupBy, ok := delayGroupings[mux.Vars(r)["by"]]
+	if !ok {
+		http.Error(w, "Unknown grouping, expected routes, directions or stops", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	query := r.URL.Query()
+	start, ok := timeParam(w, query.Get("start"), "start", now, now.Add(-defaultDelayRange))
+	if !ok {
+		return
+	}
+	end, ok := timeParam(w, query.Get("end"), "end", now, now)
+	if !ok {
+		return
+	}
+
+	stats, err := h.service.DelayStats(r.Context(), models.DelayQuery{
+		GroupBy: groupBy,
+		Start:   start,
+		End:     end,
+		RouteID: query.Get("route"),
+	})
+	if errors.Is(err, services.ErrInvalidRange) {
+		http.Error(w, "The end must be after the start", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error querying delays", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(delaysResponse{Start: start, End: end, Stats: stats})
+}
+
+// timeParam parses an RFC 3339 time or a duration relative to now, responding with a bad request
+// if it is invalid. It returns the default if the parameter is empty.
+func timeParam(w http.ResponseWriter, value, name string, now, defaultValue time.Time) (time.Time, bool) {
+	if value == "" {
+		return defaultValue, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), true
+	}
+	http.Error(w, "Invalid "+name+" value, expected an RFC 3339 time or a duration such as -24h", http.StatusBadRequest)
+	return time.Time{}, false
+}
+
+var _ AnalyticsHandler = (*analyticsHandler)(nil)
@@ -0,0 +1,181 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"finbus/internal/logging"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxGeofenceSize bounds the size of geofence request bodies
+const maxGeofenceSize = 1 << 20
+
+// geofenceEventTypes are the event types accepted by the type parameter
+var geofenceEventTypes = map[string]bool{
+	models.GeofenceEnter: true,
+	models.GeofenceExit:  true,
+	models.GeofenceDwell: true,
+}
+
+type GeofenceHandler interface {
+	HandleList(w http.ResponseWriter, r *http.Request)
+	HandleGet(w http.ResponseWriter, r *http.Request)
+	HandleCreate(w http.ResponseWriter, r *http.Request)
+	HandleUpdate(w http.ResponseWriter, r *http.Request)
+	HandleDelete(w http.ResponseWriter, r *http.Request)
+	HandleEvents(w http.ResponseWriter, r *http.Request)
+}
+
+type geofenceHandler struct {
+	service services.GeofenceService
+	logger  *slog.Logger
+}
+
+// geofenceEventsResponse lists the geofence events of a range
+type geofenceEventsResponse struct {
+	Start  time.Time              `json:"start"`
+	End    time.Time              `json:"end"`
+	Events []models.GeofenceEvent `json:"events"`
+}
+
+// NewGeofenceHandler creates a new GeofenceHandler
+func NewGeofenceHandler(service services.GeofenceService, logger *slog.Logger) GeofenceHandler {
+	return &geofenceHandler{service: service, logger: logger.With("component", "rest")}
+}
+
+// HandleList returns every geofence as a GeoJSON FeatureCollection
+func (h *geofenceHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	geofences, err := h.service.Geofences(r.Context())
+	if err != nil {
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error listing geofences", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	_ = json.NewEncoder(w).Encode(models.GeofenceCollection{Type: "FeatureCollection", Features: geofences})
+}
+
+// HandleGet returns the geofence as a GeoJSON Feature
+func (h *geofenceHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	geofence, err := h.service.Geofence(r.Context(), mux.Vars(r)["id"])
+	h.respond(w, r, http.StatusOK, geofence, err)
+}
+
+// HandleCreate adds the GeoJSON Feature in the body as a geofence, generating its ID if it has
+// none
+func (h *geofenceHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	geofence, ok := decodeGeofence(w, r)
+	if !ok {
+		return
+	}
+	geofence, err := h.service.CreateGeofence(r.Context(), geofence)
+	if err == nil {
+		w.Header().Set("Location", "/api/v1/geofences/"+geofence.ID)
+	}
+	h.respond(w, r, http.StatusCreated, geofence, err)
+}
+
+// HandleUpdate replaces the geofence with the GeoJSON Feature in the body
+func (h *geofenceHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	geofence, ok := decodeGeofence(w, r)
+	if !ok {
+		return
+	}
+	geofence, err := h.service.UpdateGeofence(r.Context(), mux.Vars(r)["id"], geofence)
+	h.respond(w, r, http.StatusOK, geofence, err)
+}
+
+// HandleDelete removes the geofence
+func (h *geofenceHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteGeofence(r.Context(), mux.Vars(r)["id"]); err != nil {
+		h.respond(w, r, 0, models.Geofence{}, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeGeofence decodes the GeoJSON Feature in the request body, responding with a bad request
+// if it is malformed
+func decodeGeofence(w http.ResponseWriter, r *http.Request) (models.Geofence, bool) {
+	var geofence models.Geofence
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGeofenceSize)).Decode(&geofence); err != nil {
+		http.Error(w, "Invalid request body, expected a GeoJSON Feature", http.StatusBadRequest)
+		return geofence, false
+	}
+	return geofence, true
+}
+
+// respond writes the geofence with the status, or the response matching the error
+func (h *geofenceHandler) respond(w http.ResponseWriter, r *http.Request, status int, geofence models.Geofence, err error) {
+	switch {
+	case errors.Is(err, services.ErrUnknownGeofence):
+		http.Error(w, "Unknown geofence", http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrGeofenceExists):
+		http.Error(w, "A geofence with the ID already exists", http.StatusConflict)
+		return
+	case errors.Is(err, services.ErrInvalidGeofence):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error handling geofence", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(geofence)
+}
+
+// HandleEvents returns the geofence events raised between start and end, latest first. Both are
+// RFC 3339 times or durations relative to now and default to the last 24 hours. geofence,
+// vehicle and type limit the events to a single geofence, vehicle or type, and limit bounds
+// their number.
+func (h *geofenceHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := r.URL.Query()
+	start, ok := timeParam(w, query.Get("start"), "start", now, now.Add(-defaultEventRange))
+	if !ok {
+		return
+	}
+	end, ok := timeParam(w, query.Get("end"), "end", now, now)
+	if !ok {
+		return
+	}
+	limit, ok := intParam(w, query.Get("limit"), "limit", defaultEventLimit, maxEventLimit)
+	if !ok {
+		return
+	}
+	eventType := query.Get("type")
+	if eventType != "" && !geofenceEventTypes[eventType] {
+		http.Error(w, "Invalid type value, expected enter, exit or dwell", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.service.Events(r.Context(), models.GeofenceEventQuery{
+		Start:      start,
+		End:        end,
+		GeofenceID: query.Get("geofence"),
+		VehicleID:  query.Get("vehicle"),
+		Type:       eventType,
+		Limit:      limit,
+	})
+	if errors.Is(err, services.ErrInvalidRange) {
+		http.Error(w, "The end must be after the start", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error querying geofence events", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(geofenceEventsResponse{Start: start, End: end, Events: events})
+}
+
+var _ GeofenceHandler = (*geofenceHandler)(nil)
@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"finbus/internal/logging"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultEventRange is how far back headway events are listed without a start
+	defaultEventRange = 24 * time.Hour
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+type HeadwayHandler interface {
+	HandleHeadways(w http.ResponseWriter, r *http.Request)
+	HandleEvents(w http.ResponseWriter, r *http.Request)
+}
+
+type headwayHandler struct {
+	service services.HeadwayService
+	logger  *slog.Logger
+}
+
+// headwaysResponse lists the current headways of a route
+type headwaysResponse struct {
+	RouteID  string           `json:"route_id"`
+	Headways []models.Headway `json:"headways"`
+}
+
+// eventsResponse lists the headway events of a range
+type eventsResponse struct {
+	Start  time.Time             `json:"start"`
+	End    time.Time             `json:"end"`
+	Events []models.HeadwayEvent `json:"events"`
+}
+
+// NewHeadwayHandler creates a new HeadwayHandler
+func NewHeadwayHandler(service services.HeadwayService, logger *slog.Logger) HeadwayHandler {
+	return &headwayHandler{service: service, logger: logger.With("component", "rest")}
+}
+
+// HandleHeadways returns the current headways of the vehicles of the route, by direction and from
+// the front. Routes that are neither monitored nor subscribed to by a client have no vehicles to
+// measure.
+func (h *headwayHandler) HandleHeadways(w http.ResponseWriter, r *http.Request) {
+	routeID := mux.Vars(r)["id"]
+	headways, err := h.service.Headways(r.Context(), routeID)
+	switch {
+	case errors.Is(err, services.ErrNoSchedule):
+		http.Error(w, "Headways are not available without GTFS static data", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, services.ErrUnknownRoute):
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	case err != nil:
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error listing headways", "route_id", routeID, "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(headwaysResponse{RouteID: routeID, Headways: headways})
+}
+
+// HandleEvents returns the bunching and gap events raised between start and end, latest first.
+// Both are RFC 3339 times or durations relative to now and default to the last 24 hours. route
+// and type limit the events to a single route or type, and limit bounds their number.
+func (h *headwayHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := r.URL.Query()
+	start, ok := timeParam(w, query.Get("start"), "start", now, now.Add(-defaultEventRange))
+	if !ok {
+		return
+	}
+	end, ok := timeParam(w, query.Get("end"), "end", now, now)
+	if !ok {
+		return
+	}
+	limit, ok := intParam(w, query.Get("limit"), "limit", defaultEventLimit, maxEventLimit)
+	if !ok {
+		return
+	}
+	eventType := query.Get("type")
+	if eventType != "" && eventType != models.HeadwayBunching && eventType != models.HeadwayGap {
+		http.Error(w, "Invalid type value, expected bunching or gap", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.service.Events(r.Context(), models.HeadwayEventQuery{
+		Start:   start,
+		End:     end,
+		RouteID: query.Get("route"),
+		Type:    eventType,
+		Limit:   limit,
+	})
+	if errors.Is(err, services.ErrInvalidRange) {
+		http.Error(w, "The end must be after the start", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error querying headway events", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(eventsResponse{Start: start, End: end, Events: events})
+}
+
+var _ HeadwayHandler = (*headwayHandler)(nil)
@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"encoding/json"
+	"finbus/internal/logging"
+	"finbus/internal/services"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type HealthHandler interface {
+	HandleHealthz(w http.ResponseWriter, r *http.Request)
+	HandleReadyz(w http.ResponseWriter, r *http.Request)
+}
+
+type healthHandler struct {
+	service services.HealthService
+	logger  *slog.Logger
+}
+
+type healthResponse struct {
+	Status string                      `json:"status"`
+	Uptime string                      `json:"uptime,omitempty"`
+	Checks []services.DependencyStatus `json:"checks,omitempty"`
+}
+
+// NewHealthHandler creates a new HealthHandler
+func NewHealthHandler(service services.HealthService, logger *slog.Logger) HealthHandler {
+	return &healthHandler{service: service, logger: logger.With("component", "health")}
+}
+
+// HandleHealthz reports that the process is alive
+func (h *healthHandler) HandleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{
+		Status: "ok",
+		Uptime: h.service.Uptime().Round(time.Second).String(),
+	})
+}
+
+// HandleReadyz reports whether every dependency is healthy, detailing each of them. It responds
+// with 503 Service Unavailable when the service should not receive traffic.
+func (h *healthHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, checks := h.service.Readiness(r.Context())
+	if !ready {
+		logging.FromContext(r.Context(), h.logger).Warn("Service is not ready", "checks", checks)
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Checks: checks})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ready", Checks: checks})
+}
+
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+var _ HealthHandler = (*healthHandler)(nil)
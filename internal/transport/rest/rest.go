@@ -2,8 +2,12 @@ package rest
 
 import (
 	"encoding/json"
+	"finbus/internal/logging"
 	"finbus/internal/models"
 	"finbus/internal/services"
+	"finbus/internal/tracing"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 )
@@ -14,11 +18,12 @@ type BusHandler interface {
 }
 type busHandler struct {
 	service services.BusDataService
+	logger  *slog.Logger
 }
 
 // NewBusHandler creates a new BusHandler
-func NewBusHandler(service services.BusDataService) BusHandler {
-	return &busHandler{service: service}
+func NewBusHandler(service services.BusDataService, logger *slog.Logger) BusHandler {
+	return &busHandler{service: service, logger: logger.With("component", "rest")}
 }
 
 // HandleQueryBusesNear processes the API request for querying buses near specific coordinates.
@@ -43,32 +48,62 @@ func (h *busHandler) HandleQueryBusesNear(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	buses, err := h.service.QueryBusesNear(lat, lon)
+	buses, err := h.service.QueryBusesNear(r.Context(), lat, lon)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error querying buses near", "lat", lat, "lon", lon, "error", err)
+		serverError(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(buses)
 }
 
+// stopRequest is a stop of the stop-based vehicle query, identified by id or stop_id, so stops
+// found through the stops API can be posted as they are. NextStop is still accepted for clients
+// posting bus data.
+type stopRequest struct {
+	ID       string `json:"id"`
+	StopID   string `json:"stop_id"`
+	NextStop string `json:"NextStop"`
+}
+
+// stopID returns the first of the stop IDs given
+func (s stopRequest) stopID() string {
+	for _, id := range []string{s.ID, s.StopID, s.NextStop} {
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
 // HandleGetBusesFromStops processes the API request for querying buses from specific stops.
 func (h *busHandler) HandleGetBusesFromStops(w http.ResponseWriter, r *http.Request) {
-	var stopsData []models.BusData
+	var stops []stopRequest
 
-	err := json.NewDecoder(r.Body).Decode(&stopsData)
+	err := json.NewDecoder(r.Body).Decode(&stops)
 	if err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if len(stopsData) == 0 {
+	if len(stops) == 0 {
 		http.Error(w, "No stops provided", http.StatusBadRequest)
 		return
 	}
+	stopsData := make([]models.BusData, 0, len(stops))
+	for _, stop := range stops {
+		id := stop.stopID()
+		if id == "" {
+			http.Error(w, "Every stop needs an id or stop_id", http.StatusBadRequest)
+			return
+		}
+		stopsData = append(stopsData, models.BusData{NextStop: id})
+	}
 
-	busData, err := h.service.GetBusQueryFromStops(stopsData)
+	busData, err := h.service.GetBusQueryFromStops(r.Context(), stopsData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error querying buses from stops", "stops", len(stopsData), "error", err)
+		serverError(w, r, err)
 		return
 	}
 
@@ -78,4 +113,14 @@ func (h *busHandler) HandleGetBusesFromStops(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// serverError responds with an internal server error, including the trace ID of the request so
+// the error can be found in the traces
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	message := err.Error()
+	if traceID := tracing.TraceID(r.Context()); traceID != "" {
+		message = fmt.Sprintf("%s (trace ID %s)", message, traceID)
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
 var _ BusHandler = (*busHandler)(nil)
@@ -0,0 +1,142 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"finbus/internal/logging"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultStopLimit and maxStopLimit bound the number of stops returned
+	defaultStopLimit = 20
+	maxStopLimit     = 100
+	// defaultStopRadius and maxStopRadius bound the radius in meters of nearby stop searches
+	defaultStopRadius = 500
+	maxStopRadius     = 5000
+)
+
+type StopHandler interface {
+	HandleStops(w http.ResponseWriter, r *http.Request)
+	HandleArrivals(w http.ResponseWriter, r *http.Request)
+}
+
+type stopHandler struct {
+	service  services.StopService
+	arrivals services.ArrivalService
+	logger   *slog.Logger
+}
+
+// arrivalsResponse lists the predicted arrivals at a stop
+type arrivalsResponse struct {
+	StopID   string           `json:"stop_id"`
+	Arrivals []models.Arrival `json:"arrivals"`
+	// Pending is set while the vehicles serving the stop are being subscribed to
+	Pending bool `json:"pending,omitempty"`
+}
+
+// NewStopHandler creates a new StopHandler
+func NewStopHandler(service services.StopService, arrivals services.ArrivalService, logger *slog.Logger) StopHandler {
+	return &stopHandler{service: service, arrivals: arrivals, logger: logger.With("component", "rest")}
+}
+
+// HandleStops searches stops by name or code with q, or near a location with lat, lon and an
+// optional radius in meters. limit bounds the number of stops returned.
+func (h *stopHandler) HandleStops(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, ok := intParam(w, query.Get("limit"), "limit", defaultStopLimit, maxStopLimit)
+	if !ok {
+		return
+	}
+
+	var stops []models.Stop
+	var err error
+	switch {
+	case query.Get("q") != "":
+		stops, err = h.service.SearchStops(r.Context(), query.Get("q"), limit)
+	case query.Get("lat") != "" && query.Get("lon") != "":
+		lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+		if latErr != nil || lat < -90 || lat > 90 {
+			http.Error(w, "Invalid latitude value", http.StatusBadRequest)
+			return
+		}
+		lon, lonErr := strconv.ParseFloat(query.Get("lon"), 64)
+		if lonErr != nil || lon < -180 || lon > 180 {
+			http.Error(w, "Invalid longitude value", http.StatusBadRequest)
+			return
+		}
+		radius, ok := intParam(w, query.Get("radius"), "radius", defaultStopRadius, maxStopRadius)
+		if !ok {
+			return
+		}
+		stops, err = h.service.StopsNear(r.Context(), lat, lon, float64(radius), limit)
+	default:
+		http.Error(w, "A search query or latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, services.ErrNoSchedule) {
+		http.Error(w, "Stops are not available without GTFS static data", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error searching stops", "error", err)
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stops)
+}
+
+// HandleArrivals returns the predicted arrivals of live vehicles at the stop, soonest first.
+// limit bounds the number of arrivals. Responds with 202 Accepted and pending set instead of an
+// empty list while the vehicles serving the stop are being subscribed to.
+func (h *stopHandler) HandleArrivals(w http.ResponseWriter, r *http.Request) {
+	stopID := mux.Vars(r)["id"]
+	limit, ok := intParam(w, r.URL.Query().Get("limit"), "limit", defaultStopLimit, maxStopLimit)
+	if !ok {
+		return
+	}
+
+	arrivals, err := h.arrivals.Arrivals(r.Context(), stopID, limit)
+	switch {
+	case errors.Is(err, services.ErrNoSchedule):
+		http.Error(w, "Arrivals are not available without GTFS static data", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, services.ErrUnknownStop):
+		http.Error(w, "Unknown stop", http.StatusNotFound)
+		return
+	case err != nil:
+		logging.FromContext(r.Context(), h.logger).ErrorContext(r.Context(), "Error predicting arrivals", "stop_id", stopID, "error", err)
+		serverError(w, r, err)
+		return
+	}
+	response := arrivalsResponse{StopID: stopID, Arrivals: arrivals}
+	w.Header().Set("Content-Type", "application/json")
+	if len(arrivals) == 0 && h.arrivals.Pending(stopID) {
+		response.Pending = true
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// intParam parses a positive integer query parameter of at most max, responding with a bad
+// request if it is invalid. It returns the default if the parameter is empty.
+func intParam(w http.ResponseWriter, value, name string, defaultValue, max int) (int, bool) {
+	if value == "" {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > max {
+		http.Error(w, "Invalid "+name+" value, expected 1 to "+strconv.Itoa(max), http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+var _ StopHandler = (*stopHandler)(nil)
@@ -0,0 +1,307 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"finbus/internal/logging"
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/tracing"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subscriptionID is the ID of the single subscription of every stream
+const subscriptionID = "stream"
+
+type StreamHandler interface {
+	HandleStream(w http.ResponseWriter, r *http.Request)
+}
+
+// Options configures Server-Sent Events streams
+type Options struct {
+	// HeartbeatInterval is how often a comment is sent to keep idle streams open through proxies
+	HeartbeatInterval time.Duration
+	// WriteTimeout bounds every write to the client
+	WriteTimeout time.Duration
+	// RetryInterval is the reconnection delay suggested to clients
+	RetryInterval time.Duration
+	// Headways raises the headway events streams can opt in to, which are rejected if nil
+	Headways services.HeadwayService
+	// Geofences raises the geofence events streams can opt in to, which are rejected if nil
+	Geofences services.GeofenceService
+}
+
+// DefaultOptions returns the options used when none are configured
+func DefaultOptions() Options {
+	return Options{
+		HeartbeatInterval: 15 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		RetryInterval:     3 * time.Second,
+	}
+}
+
+type streamHandler struct {
+	service services.BusDataService
+	options Options
+	logger  *slog.Logger
+}
+
+// NewStreamHandler creates a new StreamHandler
+func NewStreamHandler(service services.BusDataService, options Options, logger *slog.Logger) StreamHandler {
+	defaults := DefaultOptions()
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = defaults.WriteTimeout
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = defaults.RetryInterval
+	}
+	return &streamHandler{service: service, options: options, logger: logger.With("component", "sse")}
+}
+
+// HandleStream streams the live bus updates matching the query filters as Server-Sent Events.
+// Clients reconnecting with Last-Event-ID are replayed the updates they missed, while new clients
+// and clients that missed more than the replay buffer holds start with a snapshot. Streams with
+// headways=true or geofences=true are also sent the bunching and gap events or the geofence
+// events of the matching vehicles, which are not replayed.
+func (h *streamHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headways, ok := boolParam(w, r.URL.Query().Get("headways"), "headways")
+	if !ok {
+		return
+	}
+	geofences, ok := boolParam(w, r.URL.Query().Get("geofences"), "geofences")
+	if !ok {
+		return
+	}
+	if headways && h.options.Headways == nil || geofences && h.options.Geofences == nil {
+		http.Error(w, "Events are not available", http.StatusServiceUnavailable)
+		return
+	}
+	lastID, resuming, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	sub := h.service.NewSubscriber()
+	defer h.service.CloseSubscriber(sub)
+	if err := h.service.Subscribe(sub, subscriptionID, filter); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	metrics.SSEStreams.Inc()
+	defer metrics.SSEStreams.Dec()
+
+	stream := &eventStream{w: w, controller: http.NewResponseController(w), writeTimeout: h.options.WriteTimeout}
+	if err := stream.write(fmt.Sprintf("retry: %d\n\n", h.options.RetryInterval.Milliseconds())); err != nil {
+		return
+	}
+
+	// Live updates up to sentSeq are already covered by the replay or snapshot
+	logger := logging.FromContext(r.Context(), h.logger).With("remote", r.RemoteAddr)
+	sentSeq, err := h.catchUp(r.Context(), stream, logger, filter, lastID, resuming)
+	if err != nil {
+		logger.Warn("Error catching up SSE stream", "error", err)
+		return
+	}
+
+	// Without opting in the nil channels never receive
+	var headwayEvents chan models.HeadwayEvent
+	if headways {
+		listener := h.options.Headways.Listen()
+		defer h.options.Headways.CloseListener(listener)
+		headwayEvents = listener.Events
+	}
+	var geofenceEvents chan models.GeofenceEvent
+	if geofences {
+		listener := h.options.Geofences.Listen()
+		defer h.options.Geofences.CloseListener(listener)
+		geofenceEvents = listener.Events
+	}
+
+	heartbeat := time.NewTicker(h.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			err = stream.write(": heartbeat\n\n")
+		case update, ok := <-sub.Updates:
+			if !ok {
+				return
+			}
+			if update.Seq <= sentSeq {
+				continue
+			}
+			err = stream.event("update", update.Seq, update.Data)
+		case event := <-headwayEvents:
+			if event.Matches(filter) {
+				err = stream.unnumberedEvent("headway", event)
+			}
+		case event := <-geofenceEvents:
+			if event.Matches(filter) {
+				err = stream.unnumberedEvent("geofence", event)
+			}
+		}
+		if err != nil {
+			logger.Warn("Error sending SSE event", "error", err)
+			return
+		}
+	}
+}
+
+// catchUp replays the updates a resuming client missed, or sends a snapshot if they are no longer
+// buffered, returning the sequence number the client is up to date with
+func (h *streamHandler) catchUp(ctx context.Context, stream *eventStream, logger *slog.Logger, filter models.BusFilter, lastID uint64, resuming bool) (uint64, error) {
+	if resuming {
+		updates, lastSeq, ok := h.service.Replay(filter, lastID)
+		if ok {
+			for _, update := range updates {
+				if err := stream.event("update", update.Seq, update.Data); err != nil {
+					return 0, err
+				}
+			}
+			return lastSeq, nil
+		}
+	}
+
+	vehicles, seq, err := h.service.Snapshot(ctx, filter)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error loading snapshot for stream", "error", err)
+		_ = stream.unnumberedEvent("error", errorEvent{Error: "error loading snapshot", TraceID: tracing.TraceID(ctx)})
+		return 0, err
+	}
+	return seq, stream.event("snapshot", seq, vehicles)
+}
+
+// errorEvent is sent before the stream is closed because of a server error
+type errorEvent struct {
+	Error   string `json:"error"`
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// eventStream writes Server-Sent Events to a response, flushing after every write
+type eventStream struct {
+	w            http.ResponseWriter
+	controller   *http.ResponseController
+	writeTimeout time.Duration
+}
+
+// event writes a JSON encoded event with the given name and ID
+func (s *eventStream) event(name string, id uint64, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", id, name, payload))
+}
+
+// unnumberedEvent writes a JSON encoded event with the given name and no ID, for events that
+// are not replayed, so the last event ID of the client is kept
+func (s *eventStream) unnumberedEvent(name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+func (s *eventStream) write(text string) error {
+	_ = s.controller.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	if _, err := fmt.Fprint(s.w, text); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
+
+// parseFilter builds a subscription filter from the lat, lon, route, stop and vehicle query
+// parameters. List parameters can be repeated or comma separated.
+func parseFilter(query url.Values) (models.BusFilter, error) {
+	filter := models.BusFilter{
+		Routes:   listParam(query, "route"),
+		Stops:    listParam(query, "stop"),
+		Vehicles: listParam(query, "vehicle"),
+	}
+
+	latStr, lonStr := query.Get("lat"), query.Get("lon")
+	if latStr != "" || lonStr != "" {
+		lat, err := strconv.ParseFloat(latStr, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid latitude value")
+		}
+		lon, err := strconv.ParseFloat(lonStr, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid longitude value")
+		}
+		filter.Area = &models.ClientCoords{Latitude: lat, Longitude: lon}
+	}
+
+	if filter.IsEmpty() {
+		return filter, fmt.Errorf("at least one of lat and lon, route, stop or vehicle is required")
+	}
+	return filter, nil
+}
+
+// boolParam parses a boolean query parameter, responding with a bad request if it is invalid. It
+// returns false if the parameter is empty.
+func boolParam(w http.ResponseWriter, value, name string) (bool, bool) {
+	if value == "" {
+		return false, true
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		http.Error(w, "Invalid "+name+" value, expected true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return b, true
+}
+
+func listParam(query url.Values, key string) []string {
+	var values []string
+	for _, value := range query[key] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// lastEventID returns the sequence number of the last event the client received, taken from the
+// Last-Event-ID header or the last_event_id query parameter for clients that cannot set headers
+func lastEventID(r *http.Request) (id uint64, ok bool, err error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err = strconv.ParseUint(value, 10, 64)
+	return id, err == nil, err
+}
+
+var _ StreamHandler = (*streamHandler)(nil)
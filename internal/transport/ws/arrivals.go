@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"context"
+	"finbus/internal/services"
+	"fmt"
+	"time"
+)
+
+const (
+	// arrivalsInterval is the shortest interval between the arrivals messages of a subscription,
+	// sent when a vehicle serving the stop is updated
+	arrivalsInterval = time.Second
+	// arrivalsRefresh is the longest interval between arrivals messages, so the times count down
+	// even without vehicle updates
+	arrivalsRefresh = 15 * time.Second
+	// arrivalsLimit is the number of arrivals sent per message
+	arrivalsLimit = 10
+)
+
+// arrivalsSubscription is a subscription to the predicted arrivals at a stop. Its own subscriber
+// receives the updates of the vehicles serving the stop, which trigger new predictions.
+type arrivalsSubscription struct {
+	stopID string
+	sub    *services.Subscriber
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// subscribeArrivals adds or replaces the subscription with the given ID with a subscription to
+// the arrivals at the stop. It is watched once the subscription is acknowledged.
+func (s *session) subscribeArrivals(id, stopID string) (*arrivalsSubscription, error) {
+	if s.options.Arrivals == nil {
+		return nil, fmt.Errorf("arrivals are not available")
+	}
+	if s.legacy {
+		return nil, fmt.Errorf("arrivals are not available for legacy sessions")
+	}
+	filter, err := s.options.Arrivals.Filter(stopID)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &arrivalsSubscription{stopID: stopID, sub: s.service.NewSubscriber()}
+	if !filter.IsEmpty() {
+		if err := s.service.Subscribe(subscription.sub, id, filter); err != nil {
+			s.service.CloseSubscriber(subscription.sub)
+			return nil, err
+		}
+	}
+	subscription.ctx, subscription.cancel = context.WithCancel(s.ctx)
+
+	s.stopArrivals(id)
+	_ = s.service.Unsubscribe(s.sub, id)
+	s.arrivalsMu.Lock()
+	s.arrivals[id] = subscription
+	s.arrivalsMu.Unlock()
+	return subscription, nil
+}
+
+// stopArrivals ends the arrivals subscription with the given ID, or every arrivals subscription
+// if id is empty, reporting whether any subscription was ended
+func (s *session) stopArrivals(id string) bool {
+	s.arrivalsMu.Lock()
+	defer s.arrivalsMu.Unlock()
+	stopped := false
+	for subscriptionID, subscription := range s.arrivals {
+		if id == "" || subscriptionID == id {
+			subscription.cancel()
+			delete(s.arrivals, subscriptionID)
+			stopped = true
+		}
+	}
+	return stopped
+}
+
+// hasArrivals reports whether the session has any arrivals subscription
+func (s *session) hasArrivals() bool {
+	s.arrivalsMu.Lock()
+	defer s.arrivalsMu.Unlock()
+	return len(s.arrivals) > 0
+}
+
+// watchArrivals sends the predicted arrivals at the stop when the subscription starts, at most
+// every arrivalsInterval while the vehicles serving the stop are updated, and at least every
+// arrivalsRefresh, until the subscription ends
+func (s *session) watchArrivals(id string, subscription *arrivalsSubscription) {
+	defer s.service.CloseSubscriber(subscription.sub)
+	ticker := time.NewTicker(arrivalsInterval)
+	defer ticker.Stop()
+
+	changed := true
+	var sentAt time.Time
+	for {
+		if changed && time.Since(sentAt) >= arrivalsInterval || time.Since(sentAt) >= arrivalsRefresh {
+			arrivals, err := s.options.Arrivals.Arrivals(subscription.ctx, subscription.stopID, arrivalsLimit)
+			if subscription.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.logger.Error("Error predicting arrivals", "subscription", id, "stop_id", subscription.stopID, "error", err)
+				s.reply(serverMessage{Type: messageError, ID: id, Error: fmt.Sprintf("error predicting arrivals: %v", err)})
+			} else {
+				s.reply(serverMessage{Type: messageArrivals, ID: id, Stop: subscription.stopID, Arrivals: arrivals})
+			}
+			changed, sentAt = false, time.Now()
+		}
+
+		select {
+		case <-subscription.ctx.Done():
+			return
+		case _, ok := <-subscription.sub.Updates:
+			if !ok {
+				return
+			}
+			changed = true
+		case <-ticker.C:
+		}
+	}
+}
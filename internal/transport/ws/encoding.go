@@ -0,0 +1,259 @@
+package ws
+
+import (
+	"encoding/json"
+	"finbus/internal/models"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Subprotocols negotiated through Sec-WebSocket-Protocol. Sessions without a subprotocol use JSON.
+const (
+	subprotocolJSON  = "finbus.v1.json"
+	subprotocolProto = "finbus.v1.proto"
+)
+
+// encoder encodes server messages into WebSocket frames
+type encoder interface {
+	encode(message interface{}) (messageType int, data []byte, err error)
+}
+
+// newEncoder returns the encoder for a negotiated subprotocol
+func newEncoder(subprotocol string) encoder {
+	if subprotocol == subprotocolProto {
+		return protoEncoder{}
+	}
+	return jsonEncoder{}
+}
+
+// jsonEncoder encodes messages as JSON text frames
+type jsonEncoder struct{}
+
+func (jsonEncoder) encode(message interface{}) (int, []byte, error) {
+	data, err := json.Marshal(message)
+	return websocket.TextMessage, data, err
+}
+
+// protoEncoder encodes messages as binary frames following the ServerMessage schema in
+// api/finbus.proto. Bare bus data of legacy sessions is sent as an update.
+type protoEncoder struct{}
+
+// ServerMessage field numbers
+const (
+	fieldType          protowire.Number = 1
+	fieldID            protowire.Number = 2
+	fieldCommand       protowire.Number = 3
+	fieldError         protowire.Number = 4
+	fieldData          protowire.Number = 5
+	fieldVehicles      protowire.Number = 6
+	fieldChangedFields protowire.Number = 7
+	fieldSeq           protowire.Number = 8
+	fieldTraceID       protowire.Number = 9
+	fieldStop          protowire.Number = 10
+	fieldArrivals      protowire.Number = 11
+	fieldEvent         protowire.Number = 12
+	fieldGeofenceEvent protowire.Number = 13
+)
+
+func (protoEncoder) encode(message interface{}) (int, []byte, error) {
+	switch message := message.(type) {
+	case models.BusData:
+		return websocket.BinaryMessage, appendServerMessage(nil, serverMessage{Type: messageUpdate, Data: &message}), nil
+	case serverMessage:
+		return websocket.BinaryMessage, appendServerMessage(nil, message), nil
+	default:
+		return 0, nil, fmt.Errorf("cannot encode %T as protobuf", message)
+	}
+}
+
+func appendServerMessage(b []byte, message serverMessage) []byte {
+	b = appendString(b, fieldType, message.Type)
+	b = appendString(b, fieldID, message.ID)
+	b = appendString(b, fieldCommand, message.Command)
+	b = appendString(b, fieldError, message.Error)
+	b = appendString(b, fieldTraceID, message.TraceID)
+	b = appendString(b, fieldStop, message.Stop)
+	if message.Seq != 0 {
+		b = protowire.AppendTag(b, fieldSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, message.Seq)
+	}
+
+	data := message.Data
+	var changedFields []string
+	if message.Changes != nil {
+		delta, fields := busDataFromChanges(message.Changes)
+		data, changedFields = &delta, fields
+	}
+	if data != nil {
+		b = protowire.AppendTag(b, fieldData, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendBusData(nil, *data))
+	}
+	for _, busData := range message.Vehicles {
+		b = protowire.AppendTag(b, fieldVehicles, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendBusData(nil, busData))
+	}
+	for _, field := range changedFields {
+		b = protowire.AppendTag(b, fieldChangedFields, protowire.BytesType)
+		b = protowire.AppendString(b, field)
+	}
+	for _, arrival := range message.Arrivals {
+		b = protowire.AppendTag(b, fieldArrivals, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendArrival(nil, arrival))
+	}
+	switch event := message.Event.(type) {
+	case *models.HeadwayEvent:
+		b = protowire.AppendTag(b, fieldEvent, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendHeadwayEvent(nil, *event))
+	case *models.GeofenceEvent:
+		b = protowire.AppendTag(b, fieldGeofenceEvent, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendGeofenceEvent(nil, *event))
+	}
+	return b
+}
+
+// appendArrival encodes the non-zero fields of an Arrival, matching the Arrival message in
+// api/finbus.proto. Times are encoded as Unix seconds.
+func appendArrival(b []byte, arrival models.Arrival) []byte {
+	b = appendString(b, 1, arrival.StopID)
+	b = appendString(b, 2, arrival.VehicleID)
+	b = appendString(b, 3, arrival.RouteID)
+	b = appendString(b, 4, arrival.ShortName)
+	b = appendString(b, 5, arrival.TripID)
+	b = appendString(b, 6, arrival.TripHeadsign)
+	b = appendTime(b, 7, arrival.ScheduledAt)
+	b = appendTime(b, 8, arrival.PredictedAt)
+	b = appendInt(b, 9, int64(arrival.InSeconds))
+	b = appendInt(b, 10, int64(arrival.Delay))
+	b = appendInt(b, 11, int64(arrival.StopsAway))
+	b = appendString(b, 12, arrival.Source)
+	b = appendDouble(b, 13, arrival.Latitude)
+	return appendDouble(b, 14, arrival.Longitude)
+}
+
+// appendHeadwayEvent encodes the non-zero fields of a HeadwayEvent, matching the HeadwayEvent
+// message in api/finbus.proto. The time is encoded as Unix seconds.
+func appendHeadwayEvent(b []byte, event models.HeadwayEvent) []byte {
+	b = appendString(b, 1, event.Type)
+	b = appendString(b, 2, event.RouteID)
+	b = appendString(b, 3, event.DirectionID)
+	b = appendString(b, 4, event.VehicleID)
+	b = appendString(b, 5, event.LeaderID)
+	b = appendString(b, 6, event.NextStop)
+	b = appendDouble(b, 7, event.Headway)
+	b = appendDouble(b, 8, event.Distance)
+	b = appendDouble(b, 9, event.Latitude)
+	b = appendDouble(b, 10, event.Longitude)
+	return appendTime(b, 11, event.At)
+}
+
+// appendGeofenceEvent encodes the non-zero fields of a GeofenceEvent, matching the GeofenceEvent
+// message in api/finbus.proto. The time is encoded as Unix seconds.
+func appendGeofenceEvent(b []byte, event models.GeofenceEvent) []byte {
+	b = appendString(b, 1, event.Type)
+	b = appendString(b, 2, event.GeofenceID)
+	b = appendString(b, 3, event.GeofenceName)
+	b = appendString(b, 4, event.VehicleID)
+	b = appendString(b, 5, event.RouteID)
+	b = appendString(b, 6, event.DirectionID)
+	b = appendString(b, 7, event.NextStop)
+	b = appendDouble(b, 8, event.Latitude)
+	b = appendDouble(b, 9, event.Longitude)
+	b = appendDouble(b, 10, event.Duration)
+	return appendTime(b, 11, event.At)
+}
+
+// appendBusData encodes the non-zero fields of a BusData and its optional fields that are set,
+// matching the BusData message in api/finbus.proto
+func appendBusData(b []byte, busData models.BusData) []byte {
+	b = appendString(b, 1, busData.FeedFormat)
+	b = appendString(b, 2, busData.Type)
+	b = appendString(b, 3, busData.FeedID)
+	b = appendString(b, 4, busData.AgencyID)
+	b = appendString(b, 5, busData.AgencyName)
+	b = appendString(b, 6, busData.Mode)
+	b = appendString(b, 7, busData.RouteID)
+	b = appendString(b, 8, busData.DirectionID)
+	b = appendString(b, 9, busData.TripHeadsign)
+	b = appendString(b, 10, busData.TripID)
+	b = appendString(b, 11, busData.NextStop)
+	b = appendString(b, 12, busData.StartTime)
+	b = appendString(b, 13, busData.VehicleID)
+	b = appendString(b, 14, busData.GeohashHead)
+	b = appendString(b, 15, busData.GeohashFirstDeg)
+	b = appendString(b, 16, busData.GeohashSecondDeg)
+	b = appendString(b, 17, busData.GeohashThirdDeg)
+	b = appendString(b, 18, busData.ShortName)
+	b = appendString(b, 19, busData.Color)
+	b = appendDouble(b, 20, busData.Latitude)
+	b = appendDouble(b, 21, busData.Longitude)
+	b = appendString(b, 22, busData.NextStopName)
+	b = appendString(b, 23, busData.RouteLongName)
+	b = appendString(b, 24, busData.ShapeID)
+	if busData.Delay != nil {
+		b = protowire.AppendTag(b, 25, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(*busData.Delay)))
+	}
+	if busData.DelayEstimated {
+		b = protowire.AppendTag(b, 26, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	return b
+}
+
+// busDataFromChanges builds the BusData of a delta from its changed fields, which are named
+// after the Go struct fields, returning the names of the changed fields in order
+func busDataFromChanges(changes map[string]interface{}) (models.BusData, []string) {
+	var busData models.BusData
+	value := reflect.ValueOf(&busData).Elem()
+	fields := make([]string, 0, len(changes))
+	for name, change := range changes {
+		field := value.FieldByName(name)
+		if !field.IsValid() || reflect.TypeOf(change) != field.Type() {
+			continue
+		}
+		field.Set(reflect.ValueOf(change))
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return busData, fields
+}
+
+// appendDouble encodes a non-zero double field
+func appendDouble(b []byte, number protowire.Number, value float64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+// appendInt encodes a non-zero sint64 field
+func appendInt(b []byte, number protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(value))
+}
+
+// appendTime encodes a non-zero time as a sint64 field of Unix seconds
+func appendTime(b []byte, number protowire.Number, value time.Time) []byte {
+	if value.IsZero() {
+		return b
+	}
+	return appendInt(b, number, value.Unix())
+}
+
+func appendString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
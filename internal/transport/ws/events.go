@@ -0,0 +1,80 @@
+package ws
+
+import (
+	"finbus/internal/models"
+	"fmt"
+)
+
+// setHeadways starts or stops sending the session the bunching and gap events of the vehicles
+// matching any of its vehicle subscriptions
+func (s *session) setHeadways(enabled bool) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if !enabled {
+		if s.headways != nil {
+			s.options.Headways.CloseListener(s.headways)
+			s.headways = nil
+		}
+		return nil
+	}
+	if s.options.Headways == nil {
+		return fmt.Errorf("headway events are not available")
+	}
+	if s.legacy {
+		return fmt.Errorf("headway events are not available for legacy sessions")
+	}
+	if s.headways == nil {
+		s.headways = s.options.Headways.Listen()
+		go func(events chan models.HeadwayEvent) {
+			for event := range events {
+				s.forwardEvent(messageHeadway, &event, event.Matches)
+			}
+		}(s.headways.Events)
+	}
+	return nil
+}
+
+// setGeofences starts or stops sending the session the geofence events of the vehicles matching
+// any of its vehicle subscriptions
+func (s *session) setGeofences(enabled bool) error {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if !enabled {
+		if s.geofences != nil {
+			s.options.Geofences.CloseListener(s.geofences)
+			s.geofences = nil
+		}
+		return nil
+	}
+	if s.options.Geofences == nil {
+		return fmt.Errorf("geofence events are not available")
+	}
+	if s.legacy {
+		return fmt.Errorf("geofence events are not available for legacy sessions")
+	}
+	if s.geofences == nil {
+		s.geofences = s.options.Geofences.Listen()
+		go func(events chan models.GeofenceEvent) {
+			for event := range events {
+				s.forwardEvent(messageGeofence, &event, event.Matches)
+			}
+		}(s.geofences.Events)
+	}
+	return nil
+}
+
+// forwardEvent sends the event if it matches any of the session's subscriptions
+func (s *session) forwardEvent(messageType string, event interface{}, matches func(models.BusFilter) bool) {
+	for _, filter := range s.sub.Filters() {
+		if matches(filter) {
+			s.reply(serverMessage{Type: messageType, Event: event})
+			return
+		}
+	}
+}
+
+// stopEvents stops sending the session events
+func (s *session) stopEvents() {
+	_ = s.setHeadways(false)
+	_ = s.setGeofences(false)
+}
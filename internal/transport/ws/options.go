@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"finbus/internal/services"
+	"time"
+)
+
+// Options configures the keepalive and timeout behaviour of WebSocket sessions, and the services
+// of subscriptions beyond vehicle updates
+type Options struct {
+	// PingInterval is how often the server pings the client
+	PingInterval time.Duration
+	// PongWait is how long the server waits for any message or pong before treating the
+	// connection as dead. It must be longer than PingInterval.
+	PongWait time.Duration
+	// WriteTimeout bounds every write to the client
+	WriteTimeout time.Duration
+	// IdleTimeout closes sessions that have had no active subscription for this long.
+	// Zero disables the idle timeout.
+	IdleTimeout time.Duration
+	// EnableCompression negotiates permessage-deflate with clients that support it
+	EnableCompression bool
+	// Arrivals predicts the arrivals of arrivals subscriptions, which are rejected if nil
+	Arrivals services.ArrivalService
+	// Headways raises the headway events sessions can opt in to, which are rejected if nil
+	Headways services.HeadwayService
+	// Geofences raises the geofence events sessions can opt in to, which are rejected if nil
+	Geofences services.GeofenceService
+}
+
+// DefaultOptions returns the options used when none are configured
+func DefaultOptions() Options {
+	return Options{
+		PingInterval: 30 * time.Second,
+		PongWait:     60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  5 * time.Minute,
+	}
+}
+
+// withDefaults fills in unset options from DefaultOptions
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.PingInterval <= 0 {
+		o.PingInterval = defaults.PingInterval
+	}
+	if o.PongWait <= o.PingInterval {
+		o.PongWait = 2 * o.PingInterval
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = defaults.WriteTimeout
+	}
+	if o.IdleTimeout < 0 {
+		o.IdleTimeout = 0
+	}
+	return o
+}
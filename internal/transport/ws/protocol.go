@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"encoding/json"
+	"finbus/internal/models"
+)
+
+// Command types sent by clients
+const (
+	commandSubscribe      = "subscribe"
+	commandUnsubscribe    = "unsubscribe"
+	commandUpdateLocation = "update_location"
+	commandPing           = "ping"
+	commandConfigure      = "configure"
+)
+
+// Message types sent by the server
+const (
+	messageAck      = "ack"
+	messageError    = "error"
+	messagePong     = "pong"
+	messageUpdate   = "update"
+	messageSnapshot = "snapshot"
+	messageDelta    = "delta"
+	messageArrivals = "arrivals"
+	messageHeadway  = "headway"
+	messageGeofence = "geofence"
+)
+
+// clientCommand is a control message sent by a client. Subscribe commands carry a filter, or a
+// stop to subscribe to the arrivals of, and update_location commands carry the new coordinates.
+type clientCommand struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	models.BusFilter
+	Arrivals  string   `json:"arrivals,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	// Since resumes a subscription after the update with this sequence number
+	Since *uint64 `json:"since,omitempty"`
+	// MaxRate and Delta configure update delivery: at most MaxRate updates per second are sent
+	// per vehicle, and delta sessions only receive the fields that changed. Headways and
+	// Geofences opt in to the bunching and gap events and the geofence events of the subscribed
+	// vehicles.
+	MaxRate   *float64 `json:"max_rate,omitempty"`
+	Delta     *bool    `json:"delta,omitempty"`
+	Headways  *bool    `json:"headways,omitempty"`
+	Geofences *bool    `json:"geofences,omitempty"`
+}
+
+// serverMessage is a message sent to a client
+type serverMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Command string `json:"command,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// TraceID identifies the trace of the command that failed in an error message
+	TraceID string          `json:"trace_id,omitempty"`
+	Data    *models.BusData `json:"data,omitempty"`
+	// Vehicles is the state of every matching vehicle in a snapshot message
+	Vehicles []models.BusData `json:"vehicles,omitempty"`
+	// Changes are the changed fields of a vehicle in a delta message
+	Changes map[string]interface{} `json:"changes,omitempty"`
+	// Stop and Arrivals are the stop and its predicted arrivals in an arrivals message
+	Stop     string           `json:"stop,omitempty"`
+	Arrivals []models.Arrival `json:"arrivals,omitempty"`
+	// Event is the *models.HeadwayEvent of a headway message or the *models.GeofenceEvent of a
+	// geofence message
+	Event interface{} `json:"event,omitempty"`
+}
+
+// parseCommand decodes a client message. Messages without a type are legacy coordinate messages,
+// which are reported with legacy set and translated into a subscribe command for that area.
+func parseCommand(message []byte) (command clientCommand, legacy bool, err error) {
+	if err := json.Unmarshal(message, &command); err != nil {
+		return command, false, err
+	}
+	if command.Type != "" {
+		return command, false, nil
+	}
+
+	var coords models.ClientCoords
+	if err := json.Unmarshal(message, &coords); err != nil {
+		return command, false, err
+	}
+	return clientCommand{Type: commandSubscribe, BusFilter: models.BusFilter{Area: &coords}}, true, nil
+}
+
+func ackMessage(command clientCommand) serverMessage {
+	return serverMessage{Type: messageAck, ID: command.ID, Command: command.Type}
+}
+
+func errorMessage(command clientCommand, err error) serverMessage {
+	return serverMessage{Type: messageError, ID: command.ID, Command: command.Type, Error: err.Error()}
+}
@@ -0,0 +1,86 @@
+package ws
+
+import (
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"reflect"
+	"time"
+)
+
+// minUpdateInterval bounds how often a throttled session is flushed
+const minUpdateInterval = 100 * time.Millisecond
+
+// updateSettings control how bus updates are sent to a session
+type updateSettings struct {
+	// interval coalesces updates per vehicle and sends them at most once per interval,
+	// zero sends every update immediately
+	interval time.Duration
+	// delta sends only the fields that changed since the vehicle was last sent
+	delta bool
+}
+
+// updateQueue coalesces and diffs the bus updates of a session
+type updateQueue struct {
+	settings updateSettings
+	// pending holds the latest update per vehicle in arrival order until the next flush
+	pending map[string]services.Update
+	order   []string
+	// lastSent holds the last state sent per vehicle, used as the base for deltas
+	lastSent map[string]models.BusData
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{
+		pending:  make(map[string]services.Update),
+		lastSent: make(map[string]models.BusData),
+	}
+}
+
+// add queues an update, replacing any pending update of the same vehicle
+func (q *updateQueue) add(update services.Update) {
+	if _, ok := q.pending[update.Data.VehicleID]; !ok {
+		q.order = append(q.order, update.Data.VehicleID)
+	}
+	q.pending[update.Data.VehicleID] = update
+}
+
+// flush returns the pending updates in arrival order and empties the queue
+func (q *updateQueue) flush() []services.Update {
+	updates := make([]services.Update, 0, len(q.order))
+	for _, vehicleID := range q.order {
+		updates = append(updates, q.pending[vehicleID])
+	}
+	clear(q.pending)
+	q.order = q.order[:0]
+	return updates
+}
+
+// sent records the state sent to the client for a vehicle
+func (q *updateQueue) sent(busData models.BusData) {
+	if q.settings.delta {
+		q.lastSent[busData.VehicleID] = busData
+	}
+}
+
+// changes returns the fields of busData that differ from the last state sent for the vehicle,
+// keyed like the JSON encoding of BusData. ok is false if the vehicle has not been sent yet.
+func (q *updateQueue) changes(busData models.BusData) (fields map[string]interface{}, ok bool) {
+	previous, ok := q.lastSent[busData.VehicleID]
+	if !ok {
+		return nil, false
+	}
+	return diffBusData(previous, busData), true
+}
+
+// diffBusData returns the fields that differ between two states of a vehicle, always including
+// the vehicle ID so a delta can be applied
+func diffBusData(previous, current models.BusData) map[string]interface{} {
+	fields := map[string]interface{}{"VehicleID": current.VehicleID}
+	previousValue, currentValue := reflect.ValueOf(previous), reflect.ValueOf(current)
+	for i := 0; i < currentValue.NumField(); i++ {
+		if !reflect.DeepEqual(previousValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			fields[currentValue.Type().Field(i).Name] = currentValue.Field(i).Interface()
+		}
+	}
+	return fields
+}
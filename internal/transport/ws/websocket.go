@@ -1,28 +1,126 @@
 package ws
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"finbus/internal/logging"
+	"finbus/internal/metrics"
 	"finbus/internal/models"
 	"finbus/internal/services"
+	"finbus/internal/tracing"
+	"fmt"
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultSubscriptionID is used for subscriptions created without an ID
+	defaultSubscriptionID = "default"
+	// maxMessageSize limits the size of client commands
+	maxMessageSize = 4096
 )
 
 type WebSocketHandler interface {
 	HandleBusUpdatesWS(w http.ResponseWriter, r *http.Request)
+	Stats() Stats
+}
+
+// Stats are counters aggregated over all WebSocket sessions
+type Stats struct {
+	ActiveSessions  int64
+	TotalSessions   uint64
+	MessagesSent    uint64
+	MessagesDropped uint64
 }
 
 type webSocketHandler struct {
 	upgrade websocket.Upgrader
 	service services.BusDataService
+	options Options
+	logger  *slog.Logger
+
+	activeSessions  atomic.Int64
+	totalSessions   atomic.Uint64
+	messagesSent    atomic.Uint64
+	messagesDropped atomic.Uint64
+}
+
+// session is a single WebSocket connection and its live update subscriptions
+type session struct {
+	conn    *websocket.Conn
+	service services.BusDataService
+	options Options
+	sub     *services.Subscriber
+	encoder encoder
+	logger  *slog.Logger
+	// ctx is the context of the upgrade request, carrying its trace
+	ctx context.Context
+	// legacy sessions started with a bare coordinates message and receive bare BusData updates
+	legacy  bool
+	replies chan interface{}
+	// done is closed once the read loop stops, and closed once the write loop stops
+	done   chan struct{}
+	closed chan struct{}
+
+	// requested holds the update settings last requested by the client. The write loop owns
+	// queue and flushTicker, and applies the settings when it reaches them in the replies.
+	requested   updateSettings
+	queue       *updateQueue
+	flushTicker *time.Ticker
+	// markers hold the sequence numbers up to which subscriptions were caught up
+	markers []catchUpMarker
+	// catchingUp counts the commands whose catch-up has not reached the write loop yet. Live
+	// updates are held back meanwhile, so none is sent before the replay or snapshot it follows.
+	catchingUp atomic.Int32
+	held       []services.Update
+	// arrivals are the arrivals subscriptions by ID, which are not vehicle subscriptions of sub
+	arrivalsMu sync.Mutex
+	arrivals   map[string]*arrivalsSubscription
+	// headways and geofences listen to the events the client opted in to, nil if it has not
+	eventsMu  sync.Mutex
+	headways  *services.HeadwayListener
+	geofences *services.GeofenceListener
+
+	startedAt time.Time
+	sent      uint64
+}
+
+// catchUpMarker tells the write loop that live updates matching filter up to seq were already
+// sent to the client through a replay or snapshot
+type catchUpMarker struct {
+	seq    uint64
+	filter models.BusFilter
+}
+
+// catchUpDone tells the write loop that a command has queued its catch-up
+type catchUpDone struct{}
+
+// errDone is returned by the write loop once the client has gone away
+var errDone = errors.New("connection closed by client")
+
+// closeError is returned by the write loop when the server closes the session with a close code
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string {
+	return fmt.Sprintf("closing session with code %d: %s", e.code, e.reason)
 }
 
 // HandleBusUpdatesWS handles WebSocket connections for bus updates
 func (h *webSocketHandler) HandleBusUpdatesWS(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), h.logger).With("remote", r.RemoteAddr)
 	ws, err := h.upgrade.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logger.Warn("WebSocket upgrade error", "error", err)
 		return
 	}
 
@@ -30,44 +128,520 @@ func (h *webSocketHandler) HandleBusUpdatesWS(w http.ResponseWriter, r *http.Req
 	defer func(ws *websocket.Conn) {
 		err := ws.Close()
 		if err != nil {
-			log.Printf("Error closing WebSocket connection: %v", err)
+			logger.Debug("Error closing WebSocket connection", "error", err)
 		}
 	}(ws)
 
+	ws.SetReadLimit(maxMessageSize)
+	_ = ws.SetReadDeadline(time.Now().Add(h.options.PongWait))
 	_, message, err := ws.ReadMessage()
 	if err != nil {
-		log.Printf("Error reading initial message: %v", err)
+		logger.Warn("Error reading initial message", "error", err)
 		return
 	}
 
-	var coords models.ClientCoords
-	if err := json.Unmarshal(message, &coords); err != nil {
-		log.Printf("Error unmarshalling initial coordinates: %v", err)
+	command, legacy, err := parseCommand(message)
+	if err != nil {
+		logger.Warn("Error unmarshalling initial message", "error", err)
+		h.writeClose(ws, logger, &closeError{code: websocket.CloseUnsupportedData, reason: "invalid initial message"})
 		return
 	}
 
-	dataChannel, err := h.service.SubscribeToBusUpdates(coords)
+	s := &session{
+		conn:      ws,
+		service:   h.service,
+		options:   h.options,
+		sub:       h.service.NewSubscriber(),
+		encoder:   newEncoder(ws.Subprotocol()),
+		logger:    logger,
+		ctx:       r.Context(),
+		legacy:    legacy,
+		replies:   make(chan interface{}, 16),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+		queue:     newUpdateQueue(),
+		arrivals:  make(map[string]*arrivalsSubscription),
+		startedAt: time.Now(),
+	}
+	h.activeSessions.Add(1)
+	h.totalSessions.Add(1)
+	metrics.WebSocketSessions.Inc()
+	defer h.closeSession(s)
+
+	// The initial command is handled by the read loop, so its replies are written as they are
+	// queued and later commands are handled after it
+	go s.readLoop(command)
+	err = s.writeLoop()
+	close(s.closed)
+	if err != nil && !errors.Is(err, errDone) {
+		var closeErr *closeError
+		if errors.As(err, &closeErr) {
+			h.writeClose(ws, logger, closeErr)
+		} else {
+			logger.Error("Error sending data over WebSocket", "error", err)
+		}
+	}
+}
+
+// Stats returns the counters aggregated over all sessions
+func (h *webSocketHandler) Stats() Stats {
+	return Stats{
+		ActiveSessions:  h.activeSessions.Load(),
+		TotalSessions:   h.totalSessions.Load(),
+		MessagesSent:    h.messagesSent.Load(),
+		MessagesDropped: h.messagesDropped.Load(),
+	}
+}
+
+// closeSession releases the session's subscriptions and records its metrics
+func (h *webSocketHandler) closeSession(s *session) {
+	s.stopArrivals("")
+	s.stopEvents()
+	h.service.CloseSubscriber(s.sub)
+	dropped := s.sub.Dropped()
+
+	h.activeSessions.Add(-1)
+	metrics.WebSocketSessions.Dec()
+	h.messagesSent.Add(s.sent)
+	h.messagesDropped.Add(dropped)
+	s.logger.Info("WebSocket session closed", "duration", time.Since(s.startedAt).Round(time.Millisecond),
+		"sent", s.sent, "dropped", dropped)
+}
+
+// writeClose sends a close message with the error's code and reason
+func (h *webSocketHandler) writeClose(ws *websocket.Conn, logger *slog.Logger, closeErr *closeError) {
+	message := websocket.FormatCloseMessage(closeErr.code, closeErr.reason)
+	if err := ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(h.options.WriteTimeout)); err != nil {
+		logger.Debug("Error sending WebSocket close message", "error", err)
+	}
+}
+
+// readLoop handles the initial command, then reads and handles client commands until the
+// connection fails. Every message and pong from the client extends the read deadline, so a dead
+// connection fails the read after PongWait.
+func (s *session) readLoop(initial clientCommand) {
+	defer close(s.done)
+	s.handleCommand(initial)
+	extendDeadline := func() {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.options.PongWait))
+	}
+	s.conn.SetPongHandler(func(string) error {
+		extendDeadline()
+		return nil
+	})
+
+	for {
+		extendDeadline()
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.logger.Warn("Error reading WebSocket message", "error", err)
+			}
+			return
+		}
+
+		command, _, err := parseCommand(message)
+		if err != nil {
+			s.reply(serverMessage{Type: messageError, Error: fmt.Sprintf("invalid message: %v", err)})
+			continue
+		}
+		s.handleCommand(command)
+	}
+}
+
+// writeLoop is the only writer on the connection. It sends replies, bus updates and pings until
+// the read loop stops, a write fails or the session is closed for being idle. Replies such as
+// snapshots are preferred over queued updates so a snapshot is not preceded by updates it
+// already contains.
+func (s *session) writeLoop() error {
+	pingTicker := time.NewTicker(s.options.PingInterval)
+	defer pingTicker.Stop()
+	defer func() {
+		if s.flushTicker != nil {
+			s.flushTicker.Stop()
+		}
+	}()
+	idleSince := time.Now()
+
+	for {
+		select {
+		case reply := <-s.replies:
+			if err := s.writeReply(reply); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+
+		var flush <-chan time.Time
+		if s.flushTicker != nil {
+			flush = s.flushTicker.C
+		}
+
+		select {
+		case <-s.done:
+			return errDone
+		case <-pingTicker.C:
+			if len(s.sub.Filters()) > 0 || s.hasArrivals() {
+				idleSince = time.Now()
+			} else if s.options.IdleTimeout > 0 && time.Since(idleSince) >= s.options.IdleTimeout {
+				return &closeError{code: websocket.CloseNormalClosure, reason: "idle timeout"}
+			}
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.options.WriteTimeout)); err != nil {
+				return err
+			}
+		case reply := <-s.replies:
+			if err := s.writeReply(reply); err != nil {
+				return err
+			}
+		case <-flush:
+			if err := s.writeUpdates(s.queue.flush()); err != nil {
+				return err
+			}
+		case update, ok := <-s.sub.Updates:
+			if !ok {
+				return &closeError{code: websocket.CloseGoingAway, reason: "subscription closed"}
+			}
+			if s.catchingUp.Load() > 0 {
+				s.held = append(s.held, update)
+				continue
+			}
+			if err := s.writeLive(update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeLive sends a live update unless a catch-up already covered it, queueing it if updates
+// are rate limited
+func (s *session) writeLive(update services.Update) error {
+	if s.caughtUp(update) {
+		return nil
+	}
+	if s.queue.settings.interval > 0 {
+		s.queue.add(update)
+		return nil
+	}
+	return s.writeUpdates([]services.Update{update})
+}
+
+// release sends the live updates held back during catch-ups
+func (s *session) release() error {
+	held := s.held
+	s.held = nil
+	for _, update := range held {
+		if err := s.writeLive(update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReply writes a reply, recording the vehicles of snapshots as sent for delta updates.
+// Update settings are passed through the replies too, so they apply from the configure
+// acknowledgement onwards.
+func (s *session) writeReply(reply interface{}) error {
+	switch reply := reply.(type) {
+	case updateSettings:
+		return s.applySettings(reply)
+	case catchUpMarker:
+		s.markers = append(s.markers, reply)
+		return nil
+	case catchUpDone:
+		if s.catchingUp.Add(-1) > 0 {
+			return nil
+		}
+		return s.release()
+	case []services.Update:
+		return s.writeUpdates(reply)
+	case []models.BusData:
+		// Legacy snapshots are sent as individual bus updates
+		for _, busData := range reply {
+			if err := s.write(busData); err != nil {
+				return err
+			}
+			s.queue.sent(busData)
+		}
+		return nil
+	case serverMessage:
+		if reply.Type == messageSnapshot {
+			for _, busData := range reply.Vehicles {
+				s.queue.sent(busData)
+			}
+		}
+	}
+	return s.write(reply)
+}
+
+// applySettings switches the session to new update settings, first sending any updates held
+// back under the previous interval
+func (s *session) applySettings(settings updateSettings) error {
+	if err := s.writeUpdates(s.queue.flush()); err != nil {
+		return err
+	}
+	if s.flushTicker != nil {
+		s.flushTicker.Stop()
+		s.flushTicker = nil
+	}
+	if settings.interval > 0 {
+		s.flushTicker = time.NewTicker(settings.interval)
+	}
+	if !settings.delta {
+		clear(s.queue.lastSent)
+	}
+	s.queue.settings = settings
+	return nil
+}
+
+// writeUpdates writes bus updates in the session's message format. Delta sessions are sent only
+// the changed fields of vehicles they already know, and nothing if no field changed.
+func (s *session) writeUpdates(updates []services.Update) error {
+	for _, update := range updates {
+		busData := update.Data
+		var message interface{} = serverMessage{Type: messageUpdate, Seq: update.Seq, Data: &busData}
+		if s.legacy {
+			message = busData
+		} else if s.queue.settings.delta {
+			if changes, ok := s.queue.changes(busData); ok {
+				if len(changes) == 1 {
+					continue
+				}
+				message = serverMessage{Type: messageDelta, Seq: update.Seq, Changes: changes}
+			}
+		}
+
+		if err := s.write(message); err != nil {
+			return err
+		}
+		s.queue.sent(busData)
+	}
+	return nil
+}
+
+// write encodes and writes a single message with the write timeout
+func (s *session) write(message interface{}) error {
+	messageType, data, err := s.encoder.encode(message)
 	if err != nil {
-		log.Printf("Error in subscription service: %v", err)
-		return
+		return err
 	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
+	if err := s.conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	s.sent++
+	return nil
+}
 
-	for busData := range dataChannel {
-		if err := ws.WriteJSON(busData); err != nil {
-			log.Printf("Error sending data over WebSocket: %v", err)
+// handleCommand executes a client command and queues its acknowledgement or error reply.
+// Legacy sessions are not sent acknowledgements, as they only expect bus updates.
+func (s *session) handleCommand(command clientCommand) {
+	ctx, span := tracing.Tracer().Start(s.ctx, "websocket.command", trace.WithAttributes(
+		attribute.String("websocket.command", command.Type),
+		attribute.String("websocket.subscription_id", command.ID),
+	))
+	defer span.End()
+
+	// Live updates for a new or moved subscription are held back from before it is subscribed
+	// until its catch-up is queued
+	if command.Type == commandSubscribe && command.Arrivals == "" || command.Type == commandUpdateLocation {
+		s.catchingUp.Add(1)
+		defer s.reply(catchUpDone{})
+	}
+
+	var err error
+	var arrivals *arrivalsSubscription
+	switch command.Type {
+	case commandSubscribe:
+		if command.ID == "" {
+			command.ID = defaultSubscriptionID
+		}
+		if command.Arrivals != "" {
+			arrivals, err = s.subscribeArrivals(command.ID, command.Arrivals)
 			break
 		}
+		err = s.service.Subscribe(s.sub, command.ID, command.BusFilter)
+		if err == nil {
+			s.stopArrivals(command.ID)
+		}
+	case commandUnsubscribe:
+		stopped := s.stopArrivals(command.ID)
+		err = s.service.Unsubscribe(s.sub, command.ID)
+		if stopped {
+			err = nil
+		}
+	case commandUpdateLocation:
+		err = s.updateLocation(command)
+	case commandConfigure:
+		err = s.configure(command)
+	case commandPing:
+		s.reply(serverMessage{Type: messagePong, ID: command.ID})
+		return
+	default:
+		err = fmt.Errorf("unknown command type %q", command.Type)
+	}
+
+	if err != nil {
+		tracing.RecordError(span, err)
+		s.logger.WarnContext(ctx, "Error handling WebSocket command", "command", command.Type, "id", command.ID, "error", err)
+		message := errorMessage(command, err)
+		message.TraceID = tracing.TraceID(ctx)
+		s.reply(message)
+		return
+	}
+	if !s.legacy {
+		s.reply(ackMessage(command))
+	}
+	if arrivals != nil {
+		go s.watchArrivals(command.ID, arrivals)
+		return
+	}
+	if command.Type == commandSubscribe || command.Type == commandUpdateLocation {
+		s.catchUp(ctx, command.ID, command.Since)
+	}
+}
+
+// catchUp brings the client up to date with the subscription with the given ID, or all
+// subscriptions if id is empty. Subscriptions resumed with since are replayed the updates after
+// it if they are still buffered, and otherwise get a snapshot of every matching vehicle. Legacy
+// sessions receive the snapshot vehicles as individual bus updates.
+func (s *session) catchUp(ctx context.Context, id string, since *uint64) {
+	for subscriptionID, filter := range s.sub.Filters() {
+		if id != "" && subscriptionID != id {
+			continue
+		}
+
+		if since != nil {
+			if updates, lastSeq, ok := s.service.Replay(filter, *since); ok {
+				s.reply(updates)
+				s.reply(catchUpMarker{seq: lastSeq, filter: filter})
+				continue
+			}
+		}
+
+		vehicles, seq, err := s.service.Snapshot(ctx, filter)
+		if err != nil {
+			s.logger.ErrorContext(ctx, "Error loading snapshot", "subscription", subscriptionID, "error", err)
+			if !s.legacy {
+				s.reply(serverMessage{Type: messageError, ID: subscriptionID, Error: "error loading snapshot", TraceID: tracing.TraceID(ctx)})
+			}
+			continue
+		}
+		if s.legacy {
+			s.reply(vehicles)
+		} else {
+			s.reply(serverMessage{Type: messageSnapshot, ID: subscriptionID, Seq: seq, Vehicles: vehicles})
+		}
+		s.reply(catchUpMarker{seq: seq, filter: filter})
+	}
+}
+
+// caughtUp reports whether a live update is already covered by a replay or snapshot sent to the
+// client. Live updates arrive in sequence order, so markers are dropped once updates pass them.
+func (s *session) caughtUp(update services.Update) bool {
+	covered := false
+	markers := s.markers[:0]
+	for _, marker := range s.markers {
+		if update.Seq > marker.seq {
+			continue
+		}
+		markers = append(markers, marker)
+		if marker.filter.Matches(update.Data) {
+			covered = true
+		}
+	}
+	s.markers = markers
+	return covered
+}
+
+// updateLocation moves the area of the subscription with the command's ID, or of every area
+// subscription if no ID is given. A default area subscription is created if there is none.
+func (s *session) updateLocation(command clientCommand) error {
+	if command.Latitude == nil || command.Longitude == nil {
+		return fmt.Errorf("latitude and longitude are required")
+	}
+	area := &models.ClientCoords{Latitude: *command.Latitude, Longitude: *command.Longitude}
+
+	updated := false
+	for id, filter := range s.sub.Filters() {
+		if command.ID != "" && id != command.ID || command.ID == "" && filter.Area == nil {
+			continue
+		}
+		filter.Area = area
+		if err := s.service.Subscribe(s.sub, id, filter); err != nil {
+			return err
+		}
+		updated = true
+	}
+
+	if updated {
+		return nil
+	}
+	if command.ID != "" {
+		return fmt.Errorf("unknown subscription %q", command.ID)
+	}
+	return s.service.Subscribe(s.sub, defaultSubscriptionID, models.BusFilter{Area: area})
+}
+
+// configure changes how updates are delivered. Settings missing from the command are kept.
+func (s *session) configure(command clientCommand) error {
+	settings := s.requested
+	if command.MaxRate != nil {
+		switch {
+		case *command.MaxRate < 0:
+			return fmt.Errorf("max_rate must not be negative")
+		case *command.MaxRate == 0:
+			settings.interval = 0
+		default:
+			settings.interval = max(time.Duration(float64(time.Second) / *command.MaxRate), minUpdateInterval)
+		}
+	}
+	if command.Delta != nil {
+		if *command.Delta && s.legacy {
+			return fmt.Errorf("delta updates are not available for legacy sessions")
+		}
+		settings.delta = *command.Delta
+	}
+	if command.Headways != nil {
+		if err := s.setHeadways(*command.Headways); err != nil {
+			return err
+		}
+	}
+	if command.Geofences != nil {
+		if err := s.setGeofences(*command.Geofences); err != nil {
+			return err
+		}
+	}
+
+	s.requested = settings
+	s.reply(settings)
+	return nil
+}
+
+// reply queues a message for the write loop, giving up if the connection is closing
+func (s *session) reply(message interface{}) {
+	select {
+	case s.replies <- message:
+	case <-s.done:
+	case <-s.closed:
 	}
 }
 
 // NewWebSocketHandler creates a new WebSocketHandler
-func NewWebSocketHandler(service services.BusDataService) WebSocketHandler {
+func NewWebSocketHandler(service services.BusDataService, options Options, logger *slog.Logger) WebSocketHandler {
 	upgrade := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
+		Subprotocols:      []string{subprotocolProto, subprotocolJSON},
+		EnableCompression: options.EnableCompression,
+	}
+	return &webSocketHandler{
+		upgrade: upgrade,
+		service: service,
+		options: options.withDefaults(),
+		logger:  logger.With("component", "websocket"),
 	}
-	return &webSocketHandler{upgrade: upgrade, service: service}
 }
 
 var _ WebSocketHandler = (*webSocketHandler)(nil)
@@ -0,0 +1,353 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/testharness"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingNotifier records the notified alerts
+type recordingNotifier struct {
+	alerts []models.Alert
+}
+
+func (n *recordingNotifier) Start(context.Context) {}
+
+func (n *recordingNotifier) Notify(alert models.Alert) {
+	n.alerts = append(n.alerts, alert)
+}
+
+// take returns the alerts notified since the last call as status and ID
+func (n *recordingNotifier) take() []string {
+	var notified []string
+	for _, alert := range n.alerts {
+		notified = append(notified, alert.Status+" "+alert.ID)
+	}
+	n.alerts = nil
+	return notified
+}
+
+func TestAlertRules(t *testing.T) {
+	// 11:00 in Helsinki, within the service hours
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	notifier := &recordingNotifier{}
+	service, err := services.NewAlertService(services.AlertOptions{
+		Rules: []config.AlertRule{
+			{Name: "stationary", Type: config.AlertVehicleStationary, For: 10 * time.Minute, Routes: []string{"550"}},
+			{Name: "no-vehicles", Type: config.AlertRouteWithoutVehicles, For: 15 * time.Minute, Routes: []string{"550", "551"},
+				ServiceHours: "05:00-01:00", Timezone: "Europe/Helsinki"},
+			{Name: "feed-silent", Type: config.AlertFeedSilent, For: 5 * time.Minute},
+		},
+		Interval:            time.Minute,
+		Notifier:            notifier,
+		ContinuousIngestion: true,
+		Now:                 func() time.Time { return now },
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewAlertService returned error: %v", err)
+	}
+
+	step := func(after time.Duration, lat, lon float64, expected ...string) {
+		t.Helper()
+		now = start.Add(after)
+		if lat != 0 {
+			service.Observe(models.BusData{VehicleID: "1", RouteID: "550", Latitude: lat, Longitude: lon})
+		}
+		service.Evaluate()
+		if notified := notifier.take(); fmt.Sprint(notified) != fmt.Sprint(expected) {
+			t.Errorf("Expected notifications %v after %s, got %v", expected, after, notified)
+		}
+	}
+	step(0, 60.2, 24.9)
+	// Moving 20 meters is not moving
+	step(6*time.Minute, 60.2002, 24.9)
+	step(11*time.Minute, 60.2, 24.9, "firing stationary/1")
+	// Firing alerts are notified once
+	step(12*time.Minute, 60.2, 24.9)
+	step(16*time.Minute, 60.2, 24.9, "firing no-vehicles/551")
+	step(17*time.Minute, 60.21, 24.9, "resolved stationary/1")
+	step(23*time.Minute, 0, 0, "firing feed-silent")
+
+	alerts := service.Alerts()
+	if len(alerts) != 2 || alerts[0].ID != "no-vehicles/551" || alerts[1].ID != "feed-silent" {
+		t.Fatalf("Expected the route and feed alerts, got %+v", alerts)
+	}
+	if alerts[0].RouteID != "551" || !alerts[0].StartedAt.Equal(start) || !alerts[1].StartedAt.Equal(start.Add(17*time.Minute)) {
+		t.Errorf("Unexpected alerts %+v", alerts)
+	}
+
+	// 02:30 in Helsinki, outside the service hours
+	step(15*time.Hour+30*time.Minute, 0, 0, "resolved no-vehicles/551")
+	// The service hours began at 05:00 in Helsinki, so route 550 has not been seen for 15 minutes
+	// by 05:15
+	step(18*time.Hour+14*time.Minute, 0, 0)
+	step(18*time.Hour+15*time.Minute, 0, 0, "firing no-vehicles/550", "firing no-vehicles/551")
+}
+
+func TestAlertRepeatInterval(t *testing.T) {
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	notifier := &recordingNotifier{}
+	service, err := services.NewAlertService(services.AlertOptions{
+		Rules:               []config.AlertRule{{Name: "feed-silent", Type: config.AlertFeedSilent, For: time.Minute}},
+		Interval:            time.Minute,
+		RepeatInterval:      10 * time.Minute,
+		Notifier:            notifier,
+		ContinuousIngestion: true,
+		Now:                 func() time.Time { return now },
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewAlertService returned error: %v", err)
+	}
+
+	var notified []string
+	for minute := 1; minute <= 22; minute++ {
+		now = start.Add(time.Duration(minute) * time.Minute)
+		service.Evaluate()
+		for _, alert := range notifier.take() {
+			notified = append(notified, fmt.Sprintf("%d %s", minute, alert))
+		}
+	}
+	expected := []string{"1 firing feed-silent", "11 firing feed-silent", "21 firing feed-silent"}
+	if fmt.Sprint(notified) != fmt.Sprint(expected) {
+		t.Errorf("Expected notifications %v, got %v", expected, notified)
+	}
+}
+
+func TestAlertsWithoutExpectedUpdates(t *testing.T) {
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	notifier := &recordingNotifier{}
+	service, err := services.NewAlertService(services.AlertOptions{
+		Rules: []config.AlertRule{
+			{Name: "no-vehicles", Type: config.AlertRouteWithoutVehicles, For: time.Minute, Routes: []string{"550"}},
+			{Name: "feed-silent", Type: config.AlertFeedSilent, For: time.Minute},
+		},
+		Interval: time.Minute,
+		Notifier: notifier,
+		Now:      func() time.Time { return now },
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewAlertService returned error: %v", err)
+	}
+
+	// Without subscribed topics or a continuous source no bus updates are missing
+	for minute := 1; minute <= 5; minute++ {
+		now = start.Add(time.Duration(minute) * time.Minute)
+		service.Evaluate()
+	}
+	if notified := notifier.take(); len(notified) != 0 {
+		t.Fatalf("Expected no alerts without expected bus updates, got %v", notified)
+	}
+
+	// The watched route is subscribed to without any client
+	subscriber := newFakeSubscriber()
+	busData := services.NewBusDataService(&fakeBusDataManager{}, make(chan models.BusMessage), subscriber, services.BusDataOptions{}, slog.Default())
+	defer busData.Close()
+	service.Watch(busData)
+	if !subscriber.subscribed(config.BuildTopic("550", "", "", "")) {
+		t.Fatalf("Expected the route of the rule to be subscribed to, got %v", subscriber.topics)
+	}
+
+	// The silence is counted from the last evaluation without expected bus updates
+	now = start.Add(5*time.Minute + 30*time.Second)
+	service.Evaluate()
+	if notified := notifier.take(); len(notified) != 0 {
+		t.Errorf("Expected no alerts within a minute of expecting bus updates, got %v", notified)
+	}
+	now = start.Add(6 * time.Minute)
+	service.Evaluate()
+	if notified := notifier.take(); fmt.Sprint(notified) != "[firing feed-silent firing no-vehicles/550]" {
+		t.Errorf("Expected the feed and route alerts, got %v", notified)
+	}
+}
+
+// webhookReceiver records the deliveries posted to it, responding with the status chosen by
+// respond for the alert ID and attempt
+type webhookReceiver struct {
+	mu         sync.Mutex
+	deliveries []webhookAttempt
+}
+
+// webhookAttempt is an attempt to deliver an alert
+type webhookAttempt struct {
+	delivery string
+	alert    models.Alert
+	signed   bool
+}
+
+func startWebhookReceiver(t *testing.T, secret string, respond func(id string, attempt int) int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var alert models.Alert
+		if err := json.Unmarshal(body, &alert); err != nil {
+			t.Errorf("Error decoding webhook body %s: %v", body, err)
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Finbus-Timestamp") + "." + string(body)))
+		signed := hmac.Equal([]byte(r.Header.Get("X-Finbus-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+
+		receiver.mu.Lock()
+		receiver.deliveries = append(receiver.deliveries, webhookAttempt{r.Header.Get("X-Finbus-Delivery"), alert, signed})
+		attempt := 0
+		for _, delivery := range receiver.deliveries {
+			if delivery.alert.ID == alert.ID {
+				attempt++
+			}
+		}
+		receiver.mu.Unlock()
+		w.WriteHeader(respond(alert.ID, attempt))
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func (r *webhookReceiver) attempts() []webhookAttempt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookAttempt(nil), r.deliveries...)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	receiver, server := startWebhookReceiver(t, "hook-secret", func(id string, attempt int) int {
+		switch {
+		case id == "flaky" && attempt < 3:
+			return http.StatusServiceUnavailable
+		case id == "rejected":
+			return http.StatusBadRequest
+		case id == "down":
+			return http.StatusInternalServerError
+		}
+		return http.StatusNoContent
+	})
+	notifier := services.NewWebhookNotifier(services.WebhookOptions{
+		URL:          server.URL,
+		Secret:       "hook-secret",
+		Timeout:      time.Second,
+		MaxAttempts:  4,
+		RetryBackoff: time.Millisecond,
+	}, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier.Start(ctx)
+
+	for _, id := range []string{"flaky", "rejected", "down", "ok"} {
+		notifier.Notify(models.Alert{ID: id, Rule: id, Type: config.AlertFeedSilent, Status: models.AlertFiring})
+	}
+	waitFor(t, 5*time.Second, "the deliveries", func() bool { return len(receiver.attempts()) == 9 })
+
+	// Alerts are delivered in order, and retries keep the delivery ID
+	var got []string
+	deliveries := make(map[string]map[string]bool)
+	for _, attempt := range receiver.attempts() {
+		got = append(got, attempt.alert.ID)
+		if !attempt.signed {
+			t.Errorf("Expected the attempt to deliver %s to be signed", attempt.alert.ID)
+		}
+		if deliveries[attempt.alert.ID] == nil {
+			deliveries[attempt.alert.ID] = make(map[string]bool)
+		}
+		deliveries[attempt.alert.ID][attempt.delivery] = true
+	}
+	expected := []string{"flaky", "flaky", "flaky", "rejected", "down", "down", "down", "down", "ok"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected attempts %v, got %v", expected, got)
+	}
+	for id, ids := range deliveries {
+		if len(ids) != 1 {
+			t.Errorf("Expected a single delivery ID for %s, got %v", id, ids)
+		}
+	}
+	unique := make(map[string]bool)
+	for _, ids := range deliveries {
+		for id := range ids {
+			unique[id] = true
+		}
+	}
+	if len(unique) != 4 {
+		t.Errorf("Expected a delivery ID per alert, got %v", deliveries)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if attempts := len(receiver.attempts()); attempts != 9 {
+		t.Errorf("Expected no more attempts, got %d", attempts)
+	}
+}
+
+func TestAlertsAPI(t *testing.T) {
+	receiver, server := startWebhookReceiver(t, "hook-secret", func(string, int) int { return http.StatusOK })
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Alert.Interval = 20 * time.Millisecond
+		cfg.Alert.Webhook.URL = server.URL
+		cfg.Alert.Webhook.Secret = "hook-secret"
+		// The route of the rule is subscribed to without any client, so its updates are expected
+		cfg.Alert.Rules = []config.AlertRule{
+			{Name: "feed-silent", Type: config.AlertFeedSilent, For: 300 * time.Millisecond},
+			{Name: "no-vehicles", Type: config.AlertRouteWithoutVehicles, For: time.Hour, Routes: []string{"550"}},
+		}
+	}})
+
+	var response struct {
+		Alerts []models.Alert `json:"alerts"`
+	}
+	waitFor(t, 5*time.Second, "the feed silent alert", func() bool {
+		resp, err := http.Get(h.URL("/api/v1/alerts"))
+		if err != nil {
+			t.Fatalf("Error getting alerts: %v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Error decoding alerts: %v", err)
+		}
+		return len(response.Alerts) == 1
+	})
+	if alert := response.Alerts[0]; alert.ID != "feed-silent" || alert.Status != models.AlertFiring || alert.Message == "" {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+
+	h.PublishPosition(t, "1", "550", 60.2, 24.9)
+	waitFor(t, 5*time.Second, "the resolved alert", func() bool {
+		for _, attempt := range receiver.attempts() {
+			if attempt.alert.Status == models.AlertResolved {
+				return true
+			}
+		}
+		return false
+	})
+	attempts := receiver.attempts()
+	if first := attempts[0]; first.alert.Status != models.AlertFiring || !first.signed {
+		t.Errorf("Expected a signed firing alert first, got %+v", first)
+	}
+}
+
+func TestAlertsWithoutSubscriptions(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Alert.Interval = 20 * time.Millisecond
+		cfg.Alert.Rules = []config.AlertRule{{Name: "feed-silent", Type: config.AlertFeedSilent, For: 100 * time.Millisecond}}
+	}})
+
+	// Nothing is received without subscribed topics, so the feed is not silent
+	time.Sleep(300 * time.Millisecond)
+	body := getJSON[struct {
+		Alerts []models.Alert `json:"alerts"`
+	}](t, h.URL("/api/v1/alerts"), http.StatusOK)
+	if len(body.Alerts) != 0 {
+		t.Errorf("Expected no alerts without subscriptions, got %+v", body.Alerts)
+	}
+}
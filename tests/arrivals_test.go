@@ -0,0 +1,442 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/config"
+	"finbus/internal/database/memory"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/services"
+	"finbus/internal/testharness"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// arrivalsGTFS is a feed of one route along a meridian, with stops A to D about 1.1 km apart
+// and a 30 second dwell time at C. Trip T1 leaves A at 08:00 and T2 at 08:15.
+func arrivalsGTFS(timezone string, stopTimes string) map[string]string {
+	return map[string]string{
+		"agency.txt": "agency_id,agency_name,agency_url,agency_timezone\n" +
+			"HSL,HSL,https://hsl.fi," + timezone + "\n",
+		"stops.txt": "stop_id,stop_name,stop_lat,stop_lon\n" +
+			"A,Stop A,60.170,24.940\n" +
+			"B,Stop B,60.180,24.940\n" +
+			"C,Stop C,60.190,24.940\n" +
+			"D,Stop D,60.200,24.940\n" +
+			"X,Unserved,60.300,24.940\n",
+		"routes.txt": "route_id,route_short_name,route_long_name,route_type\n" +
+			"R1,1,A-D,3\n",
+		"trips.txt": "route_id,service_id,trip_id,trip_headsign\n" +
+			"R1,Ti,T1,D\n" +
+			"R1,Ti,T2,D\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" + stopTimes,
+	}
+}
+
+// tripStopTimes returns the stop times of a trip leaving A at start seconds after midnight
+func tripStopTimes(tripID string, start int) string {
+	clock := func(seconds int) string {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%[1]s,%[2]s,%[2]s,A,1\n%[1]s,%[3]s,%[3]s,B,2\n%[1]s,%[4]s,%[5]s,C,3\n%[1]s,%[6]s,%[6]s,D,4\n",
+		tripID, clock(start), clock(start+180), clock(start+360), clock(start+390), clock(start+540))
+}
+
+// startArrivalService starts an arrival service at now for the vehicles sent to the returned
+// channel, with the segment times in storage
+func startArrivalService(t *testing.T, feed *schedule.Feed, storage *memory.Storage, now time.Time) (services.ArrivalService, services.BusDataService, chan models.BusMessage) {
+	t.Helper()
+	dataChannel := make(chan models.BusMessage)
+	busData := services.NewBusDataService(&fakeBusDataManager{}, dataChannel, newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+	arrivals := services.NewArrivalService(busData, schedule.NewStaticStore(feed), storage,
+		services.ArrivalOptions{Now: func() time.Time { return now }}, slog.Default())
+	return arrivals, busData, dataChannel
+}
+
+// sendVehicles sends the vehicles to the bus data service and waits until they are known
+func sendVehicles(t *testing.T, busData services.BusDataService, dataChannel chan models.BusMessage, vehicles ...models.BusData) {
+	t.Helper()
+	for _, vehicle := range vehicles {
+		dataChannel <- models.BusMessage{Data: vehicle}
+	}
+	waitFor(t, 2*time.Second, "the vehicles to be known", func() bool {
+		known, _, _ := busData.Snapshot(context.Background(), models.BusFilter{Routes: []string{"R1"}})
+		return len(known) >= len(vehicles)
+	})
+}
+
+func TestArrivalPredictions(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, arrivalsGTFS("Europe/Helsinki", tripStopTimes("T1", 8*3600)+tripStopTimes("T2", 8*3600+900))))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	now := time.Date(2024, 5, 14, 8, 5, 0, 0, helsinki)
+	service, busData, dataChannel := startArrivalService(t, feed, memory.NewStorage(), now)
+
+	sendVehicles(t, busData, dataChannel,
+		// Halfway from B to C, scheduled there at 08:04:30 and so 30 seconds late
+		models.BusData{VehicleID: "1", RouteID: "R1", TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940},
+		// Past C already
+		models.BusData{VehicleID: "2", RouteID: "R1", TripID: "T1", NextStop: "D", Latitude: 60.195, Longitude: 24.940},
+		// Waiting for the departure of T2 at 08:15
+		models.BusData{VehicleID: "3", RouteID: "R1", TripID: "T2", NextStop: "A", Latitude: 60.170, Longitude: 24.940},
+		// On a trip missing from the feed
+		models.BusData{VehicleID: "4", RouteID: "R1", TripID: "T9", NextStop: "A", Latitude: 60.170, Longitude: 24.940},
+	)
+
+	arrivals, err := service.Arrivals(context.Background(), "C", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if len(arrivals) != 2 {
+		t.Fatalf("Expected arrivals of vehicles 1 and 3, got %+v", arrivals)
+	}
+	expected := []struct {
+		vehicleID              string
+		scheduledAt, predicted time.Time
+		delay, stopsAway       int
+	}{
+		{"1", now.Add(time.Minute), now.Add(90 * time.Second), 30, 0},
+		{"3", now.Add(16 * time.Minute), now.Add(16 * time.Minute), 0, 2},
+	}
+	for i, want := range expected {
+		got := arrivals[i]
+		if got.VehicleID != want.vehicleID || !got.ScheduledAt.Equal(want.scheduledAt) || !got.PredictedAt.Equal(want.predicted) ||
+			got.Delay != want.delay || got.StopsAway != want.stopsAway || got.Source != models.ArrivalSourceSchedule {
+			t.Errorf("Expected vehicle %s scheduled at %v, predicted at %v with delay %d and %d stops away, got %+v",
+				want.vehicleID, want.scheduledAt, want.predicted, want.delay, want.stopsAway, got)
+		}
+	}
+	if arrivals[0].InSeconds != 90 || arrivals[0].StopID != "C" || arrivals[0].TripID != "T1" {
+		t.Errorf("Unexpected arrival %+v", arrivals[0])
+	}
+
+	// The delay is carried over to the following stops
+	arrivals, err = service.Arrivals(context.Background(), "D", 1)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if len(arrivals) != 1 || arrivals[0].VehicleID != "2" {
+		t.Fatalf("Expected only the arrival of vehicle 2 with the limit, got %+v", arrivals)
+	}
+	arrivals, err = service.Arrivals(context.Background(), "D", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if len(arrivals) != 3 || arrivals[1].VehicleID != "1" || arrivals[1].Delay != 30 || !arrivals[1].PredictedAt.Equal(now.Add(270*time.Second)) {
+		t.Errorf("Expected vehicle 1 at D 30 seconds late at %v, got %+v", now.Add(270*time.Second), arrivals)
+	}
+
+	if _, err := service.Arrivals(context.Background(), "nope", 0); !errors.Is(err, services.ErrUnknownStop) {
+		t.Errorf("Expected ErrUnknownStop, got %v", err)
+	}
+	if arrivals, err := service.Arrivals(context.Background(), "X", 0); err != nil || len(arrivals) != 0 {
+		t.Errorf("Expected no arrivals at a stop without routes, got %+v, %v", arrivals, err)
+	}
+	noSchedule := services.NewArrivalService(busData, nil, memory.NewStorage(), services.ArrivalOptions{}, slog.Default())
+	if _, err := noSchedule.Arrivals(context.Background(), "C", 0); !errors.Is(err, services.ErrNoSchedule) {
+		t.Errorf("Expected ErrNoSchedule, got %v", err)
+	}
+}
+
+func TestArrivalPredictionsUseObservedSegments(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, arrivalsGTFS("Europe/Helsinki", tripStopTimes("T1", 8*3600))))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	storage := memory.NewStorage()
+	// One observation is not enough
+	_ = storage.WriteSegmentTime(context.Background(), models.SegmentTime{FromStop: "B", ToStop: "C", Seconds: 60, ObservedAt: time.Now()})
+	for _, seconds := range []float64{90, 110} {
+		_ = storage.WriteSegmentTime(context.Background(), models.SegmentTime{FromStop: "C", ToStop: "D", Seconds: seconds, ObservedAt: time.Now()})
+	}
+
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	now := time.Date(2024, 5, 14, 8, 5, 0, 0, helsinki)
+	service, busData, dataChannel := startArrivalService(t, feed, storage, now)
+	sendVehicles(t, busData, dataChannel,
+		models.BusData{VehicleID: "1", RouteID: "R1", TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940})
+
+	arrivals, err := service.Arrivals(context.Background(), "D", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	// 120 scheduled seconds to leave C, then the observed mean of 100 seconds to D
+	if len(arrivals) != 1 || arrivals[0].Source != models.ArrivalSourceObserved || arrivals[0].InSeconds != 220 || arrivals[0].Delay != -20 {
+		t.Errorf("Expected an observed arrival in 220 seconds, 20 seconds early, got %+v", arrivals)
+	}
+	arrivals, err = service.Arrivals(context.Background(), "C", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if len(arrivals) != 1 || arrivals[0].Source != models.ArrivalSourceSchedule || arrivals[0].InSeconds != 90 {
+		t.Errorf("Expected a scheduled arrival in 90 seconds, got %+v", arrivals)
+	}
+}
+
+func TestArrivalPredictionsUseReportedDelay(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, arrivalsGTFS("Europe/Helsinki", tripStopTimes("T1", 8*3600))))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	storage := memory.NewStorage()
+	for _, seconds := range []float64{90, 110} {
+		_ = storage.WriteSegmentTime(context.Background(), models.SegmentTime{FromStop: "C", ToStop: "D", Seconds: seconds, ObservedAt: time.Now()})
+	}
+
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	now := time.Date(2024, 5, 14, 8, 5, 0, 0, helsinki)
+	service, busData, dataChannel := startArrivalService(t, feed, storage, now)
+	// Halfway from B to C, where its position gives a delay of 30 seconds, but its feed reports 2 minutes
+	sendVehicles(t, busData, dataChannel,
+		models.BusData{VehicleID: "1", RouteID: "R1", TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940, Delay: intPtr(120)})
+
+	arrivals, err := service.Arrivals(context.Background(), "C", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	// Scheduled at C at 08:06
+	if len(arrivals) != 1 || arrivals[0].Source != models.ArrivalSourceReported || arrivals[0].InSeconds != 180 || arrivals[0].Delay != 120 {
+		t.Errorf("Expected an arrival in 180 seconds with the reported delay, got %+v", arrivals)
+	}
+	// Observed segment times take precedence over the reported delay
+	arrivals, err = service.Arrivals(context.Background(), "D", 0)
+	if err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if len(arrivals) != 1 || arrivals[0].Source != models.ArrivalSourceObserved || arrivals[0].InSeconds != 220 {
+		t.Errorf("Expected an observed arrival in 220 seconds, got %+v", arrivals)
+	}
+
+	// A delay estimated from the schedule is not reported by the feed
+	sendVehicles(t, busData, dataChannel,
+		models.BusData{VehicleID: "1", RouteID: "R1", TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940, Delay: intPtr(120), DelayEstimated: true})
+	waitFor(t, 2*time.Second, "the estimated delay", func() bool {
+		arrivals, _ = service.Arrivals(context.Background(), "C", 0)
+		return len(arrivals) == 1 && arrivals[0].Source == models.ArrivalSourceSchedule
+	})
+	if arrivals[0].InSeconds != 90 {
+		t.Errorf("Expected a scheduled arrival in 90 seconds, got %+v", arrivals)
+	}
+}
+
+func TestArrivalWatchExpires(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, arrivalsGTFS("Europe/Helsinki", tripStopTimes("T1", 8*3600))))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	busData := services.NewBusDataService(&fakeBusDataManager{}, make(chan models.BusMessage), newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+	service := services.NewArrivalService(busData, schedule.NewStaticStore(feed), memory.NewStorage(),
+		services.ArrivalOptions{WatchTTL: 50 * time.Millisecond}, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.Start(ctx)
+
+	// The vehicles of a stop are released once its arrivals are not requested anymore
+	if _, err := service.Arrivals(context.Background(), "C", 0); err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	if busData.IngestionStatus().ActiveTopics == 0 {
+		t.Fatal("Expected the vehicles serving the stop to be subscribed to")
+	}
+	waitFor(t, 2*time.Second, "the watched stop to expire", func() bool {
+		return busData.IngestionStatus().ActiveTopics == 0
+	})
+
+	// And every vehicle once the service stops
+	if _, err := service.Arrivals(context.Background(), "C", 0); err != nil {
+		t.Fatalf("Arrivals returned error: %v", err)
+	}
+	cancel()
+	waitFor(t, 2*time.Second, "the watcher to be closed", func() bool {
+		return busData.IngestionStatus().ActiveTopics == 0
+	})
+	if _, err := service.Arrivals(context.Background(), "C", 0); err != nil || busData.IngestionStatus().ActiveTopics != 0 {
+		t.Errorf("Expected no vehicles subscribed to once stopped, got %d topics (%v)", busData.IngestionStatus().ActiveTopics, err)
+	}
+}
+
+func TestSegmentRecorder(t *testing.T) {
+	storage := memory.NewStorage()
+	recorder := services.NewSegmentRecorder(storage, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder.Start(ctx)
+	observe := func(tripID, nextStop string) {
+		recorder.Observe(models.BusData{VehicleID: "1", RouteID: "R1", TripID: tripID, NextStop: nextStop})
+	}
+
+	observe("T1", "A")
+	observe("T1", "B") // Passed A
+	time.Sleep(20 * time.Millisecond)
+	observe("T1", "C") // Passed B
+	observe("T1", "C")
+	observe("T2", "D") // A new trip starts over
+	observe("T2", "A")
+
+	waitFor(t, 2*time.Second, "the segment time to be stored", func() bool { return len(storage.SegmentTimes()) > 0 })
+	time.Sleep(20 * time.Millisecond)
+	segments := storage.SegmentTimes()
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, got %+v", segments)
+	}
+	segment := segments[0]
+	if segment.FromStop != "A" || segment.ToStop != "B" || segment.RouteID != "R1" || segment.VehicleID != "1" ||
+		segment.Seconds < 0.02 || segment.Seconds > 1 {
+		t.Errorf("Expected A to B in about 20 ms, got %+v", segment)
+	}
+}
+
+func TestGeohashPositionInvertsSplitGeohash(t *testing.T) {
+	head, first, second, third := geo.SplitGeohash(60.18745, 25.00712)
+	lat, lon, ok := geo.GeohashPosition(head, first, second, third)
+	if !ok || lat != 60.1875 || lon != 25.0075 {
+		t.Errorf("Expected the cell center 60.1875, 25.0075, got %v, %v, %v", lat, lon, ok)
+	}
+	if lat, lon, ok := geo.GeohashPosition("60;24"); !ok || lat != 60.5 || lon != 24.5 {
+		t.Errorf("Expected the center of the degree cell, got %v, %v, %v", lat, lon, ok)
+	}
+	if _, _, ok := geo.GeohashPosition("0"); ok {
+		t.Error("Expected an invalid head to be rejected")
+	}
+}
+
+// writeCurrentArrivalsGTFS writes a feed whose trip T1 reaches C in a few minutes, in UTC so the
+// stop times are independent of the local time zone, and returns its path
+func writeCurrentArrivalsGTFS(t *testing.T) string {
+	now := time.Now().UTC()
+	start := now.Hour()*3600 + now.Minute()*60 + now.Second() - 270
+	if start < 0 {
+		// Late trips of the previous service day run past midnight
+		start += 24 * 3600
+	}
+	return writeGTFS(t, arrivalsGTFS("UTC", tripStopTimes("T1", start)))
+}
+
+// publishVehicle publishes a position of vehicle 1 on trip T1 halfway from B to C
+func publishVehicle(t *testing.T, h *testharness.Harness) {
+	h.PublishBusData(t, models.BusData{VehicleID: "1", RouteID: "R1", NextStop: "C", Latitude: 60.185, Longitude: 24.940})
+}
+
+type arrivalsBody struct {
+	StopID   string           `json:"stop_id"`
+	Arrivals []models.Arrival `json:"arrivals"`
+	Pending  bool             `json:"pending"`
+}
+
+func TestArrivalsAPI(t *testing.T) {
+	path := writeCurrentArrivalsGTFS(t)
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+
+	// The first request subscribes to the vehicles serving the stop, whose arrivals are pending
+	// until the vehicles report their positions
+	if body := getJSON[arrivalsBody](t, h.URL("/api/v1/stops/C/arrivals"), http.StatusAccepted); body.StopID != "C" || !body.Pending || body.Arrivals == nil || len(body.Arrivals) != 0 {
+		t.Fatalf("Expected pending arrivals before any vehicle is known, got %+v", body)
+	}
+	var body arrivalsBody
+	waitFor(t, 5*time.Second, "the arrival of vehicle 1", func() bool {
+		publishVehicle(t, h)
+		var status int
+		body, status = fetchJSON[arrivalsBody](t, h.URL("/api/v1/stops/C/arrivals?limit=5"))
+		return status == http.StatusOK && len(body.Arrivals) > 0 && !body.Pending
+	})
+	arrival := body.Arrivals[0]
+	// The position is the center of the geohash cell, close to halfway from B to C
+	if arrival.VehicleID != "1" || arrival.TripID != "T1" || arrival.StopsAway != 0 || arrival.InSeconds < 70 || arrival.InSeconds > 100 {
+		t.Errorf("Expected vehicle 1 in about 90 seconds, got %+v", arrival)
+	}
+
+	getJSON[arrivalsBody](t, h.URL("/api/v1/stops/nope/arrivals"), http.StatusNotFound)
+	getJSON[arrivalsBody](t, h.URL("/api/v1/stops/C/arrivals?limit=0"), http.StatusBadRequest)
+}
+
+func TestArrivalsAPIWithoutGTFS(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	getJSON[arrivalsBody](t, h.URL("/api/v1/stops/C/arrivals"), http.StatusServiceUnavailable)
+}
+
+type wsArrivals struct {
+	Type     string           `json:"type"`
+	ID       string           `json:"id"`
+	Error    string           `json:"error"`
+	Stop     string           `json:"stop"`
+	Arrivals []models.Arrival `json:"arrivals"`
+}
+
+func TestWebSocketArrivals(t *testing.T) {
+	path := writeCurrentArrivalsGTFS(t)
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+	c, _, err := websocket.DefaultDialer.Dial(h.WebSocketURL("/ws/bus-updates"), nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer c.Close()
+	read := func() wsArrivals {
+		t.Helper()
+		var message wsArrivals
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := c.ReadJSON(&message); err != nil {
+			t.Fatalf("ReadJSON returned error: %v", err)
+		}
+		return message
+	}
+
+	if err := c.WriteJSON(map[string]string{"type": "subscribe", "id": "x", "arrivals": "nope"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(); message.Type != "error" || message.ID != "x" {
+		t.Errorf("Expected an error for an unknown stop, got %+v", message)
+	}
+
+	if err := c.WriteJSON(map[string]string{"type": "subscribe", "id": "c", "arrivals": "C"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(); message.Type != "ack" || message.ID != "c" {
+		t.Fatalf("Expected an ack, got %+v", message)
+	}
+	if message := read(); message.Type != "arrivals" || message.Stop != "C" || len(message.Arrivals) != 0 {
+		t.Fatalf("Expected the empty arrivals of the stop, got %+v", message)
+	}
+
+	// Updates of the vehicles serving the stop send new arrivals
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			publishVehicle(t, h)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	message := read()
+	for len(message.Arrivals) == 0 && message.Type == "arrivals" {
+		message = read()
+	}
+	close(done)
+	if message.Type != "arrivals" || message.ID != "c" || len(message.Arrivals) != 1 || message.Arrivals[0].VehicleID != "1" {
+		t.Fatalf("Expected the arrival of vehicle 1, got %+v", message)
+	}
+
+	if err := c.WriteJSON(map[string]string{"type": "unsubscribe", "id": "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := read(); message.Type != "ack" || message.ID != "c" {
+		t.Errorf("Expected the unsubscribe to be acknowledged, got %+v", message)
+	}
+}
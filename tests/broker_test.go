@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// busTopic is a vehicle position topic of the Digitransit feed for the vehicle
+func busTopic(vehicleID string) string {
+	return "/gtfsrt/vp/HSL/HSL/HSL/bus/550/1/Itis/trip-1/1234/08:00/" + vehicleID + "/60;24/1/2/3/550/00b9e4"
+}
+
+// waitFor polls condition until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// getJSON gets the URL, expecting the status, and decodes the body of a successful response
+func getJSON[T any](t *testing.T, url string, status int) T {
+	t.Helper()
+	body, got := fetchJSON[T](t, url)
+	if got != status {
+		t.Fatalf("Expected status %d for %s, got %d", status, url, got)
+	}
+	return body
+}
+
+// fetchJSON gets the URL and returns the response status and its decoded body if successful
+func fetchJSON[T any](t *testing.T, url string) (T, int) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s returned error: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var body T
+	if resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Error decoding %s: %v", url, err)
+		}
+	}
+	return body, resp.StatusCode
+}
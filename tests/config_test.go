@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"errors"
+	"finbus/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv unsets the configuration environment variables for the duration of the test, so
+// an environment set up by godotenv does not affect it
+func clearConfigEnv(t *testing.T) {
+	for _, key := range []string{"FINBUS_CONFIG", "HTTP_PORT", "INFLUXDB_URL", "INFLUXDB_TOKEN", "INFLUXDB_ORG", "INFLUXDB_BUCKET", "MQTT_BROKER", "LOG_LEVEL", "LOG_FORMAT", "MQTT_CLIENT_ID", "MQTT_CLEAN_SESSION", "MQTT_PASSWORD"} {
+		t.Setenv(key, "")
+		_ = os.Unsetenv(key)
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "finbus.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+http:
+  port: "9000"
+influxdb:
+  token: file-token
+  bucket: file-bucket
+mqtt:
+  broker: tcp://file-broker:1883
+websocket:
+  ping_interval: 10s
+  pong_wait: 25s
+`)
+	clearConfigEnv(t)
+	t.Setenv("INFLUXDB_BUCKET", "env-bucket")
+	t.Setenv("MQTT_BROKER", "tcp://env-broker:1883")
+	t.Setenv("HEADWAY_ROUTES", "2550, 2551,")
+
+	cfg, err := config.Load([]string{"-config", path, "-mqtt-broker", "tcp://flag-broker:1883"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+
+	if cfg.HTTP.Port != "9000" || cfg.InfluxDB.Token != "file-token" {
+		t.Errorf("Expected file values, got port %s and token %s", cfg.HTTP.Port, string(cfg.InfluxDB.Token))
+	}
+	if cfg.InfluxDB.Bucket != "env-bucket" {
+		t.Errorf("Expected the environment to override the file, got bucket %s", cfg.InfluxDB.Bucket)
+	}
+	if cfg.MQTT.Broker != "tcp://flag-broker:1883" {
+		t.Errorf("Expected the flag to override the environment, got broker %s", cfg.MQTT.Broker)
+	}
+	if cfg.WebSocket.PingInterval != 10*time.Second || cfg.WebSocket.WriteTimeout != 10*time.Second {
+		t.Errorf("Expected file durations with defaults for the rest, got %+v", cfg.WebSocket)
+	}
+	if strings.Join(cfg.Headway.Routes, "|") != "2550|2551" {
+		t.Errorf("Expected the comma-separated routes, got %q", cfg.Headway.Routes)
+	}
+	if cfg.InfluxDB.Org != "abax" {
+		t.Errorf("Expected default org, got %s", cfg.InfluxDB.Org)
+	}
+}
+
+func TestConfigValidationListsAllProblems(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("WS_PING_INTERVAL", "soon")
+
+	_, err := config.Load([]string{"-http-port", "http", "-gtfsrt-url", "ftp://feeds", "-log-level", "loud", "-mqtt-clean-session", "false", "-replay-speed", "-2",
+		"-headway-gap-threshold", "1m", "-geofence-dwell-time", "-1m",
+		"-alert-webhook-url", "ftp://hooks"})
+
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{"WS_PING_INTERVAL", "http.port", "influxdb.token", "gtfsrt.url", "log.level", "mqtt.client_id", "replay.speed", "headway.gap_threshold", "geofence.dwell_time", "alert.webhook.url"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a problem with %s in:\n%v", expected, err)
+		}
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("INFLUXDB_TOKEN", "super-secret-token")
+	t.Setenv("MQTT_PASSWORD", "super-secret-password")
+	t.Setenv("ALERT_WEBHOOK_SECRET", "super-secret-hook")
+
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if strings.Contains(cfg.String(), "super-secret") || !strings.Contains(cfg.String(), "[REDACTED]") {
+		t.Errorf("Expected the secrets to be redacted in:\n%s", cfg)
+	}
+	if string(cfg.InfluxDB.Token) != "super-secret-token" {
+		t.Error("Expected the token value to be kept")
+	}
+}
+
+func TestConfigAlertRules(t *testing.T) {
+	path := writeConfigFile(t, `
+influxdb:
+  token: token
+alert:
+  rules:
+    - name: stationary
+      type: vehicle_stationary
+      for: 10m
+    - name: stationary
+      type: route_without_vehicles
+    - type: feed_silent
+      for: -1m
+    - name: night
+      type: route_without_vehicles
+      routes: ["550"]
+      service_hours: 05:00
+      timezone: Europe/Nowhere
+    - name: unknown
+      type: vehicle_missing
+`)
+	clearConfigEnv(t)
+
+	_, err := config.Load([]string{"-config", path})
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{`alert.rules[1].name: "stationary" is used`, "alert.rules[1].routes", "alert.rules[2].name",
+		"alert.rules[2].for", "alert.rules[3].service_hours", "alert.rules[3].timezone", "alert.rules[4].type"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a problem with %s in:\n%v", expected, err)
+		}
+	}
+	if len(validationErr.Problems) != 7 {
+		t.Errorf("Expected 7 problems, got:\n%v", err)
+	}
+
+	start, end, err := config.ParseServiceHours("05:00-01:30")
+	if err != nil || start != 300 || end != 90 {
+		t.Errorf("Expected service hours from 300 to 90 minutes, got %d to %d with %v", start, end, err)
+	}
+}
@@ -0,0 +1,322 @@
+package tests
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/services"
+	"finbus/internal/simulator"
+	"finbus/internal/testharness"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeDelay stores a position of the vehicle heading to the stop, with the delay if it is not nil
+func storeDelay(t *testing.T, h *testharness.Harness, vehicleID, routeID, directionID, nextStop string, delay *int) {
+	t.Helper()
+	err := h.Storage.WriteToInfluxDB(context.Background(), models.BusData{
+		FeedFormat: "gtfsrt", Type: "vp", FeedID: "HSL", Mode: "bus", RouteID: routeID, DirectionID: directionID,
+		TripID: "trip-" + vehicleID, NextStop: nextStop, VehicleID: vehicleID, Delay: delay,
+	})
+	if err != nil {
+		t.Fatalf("WriteToInfluxDB returned error: %v", err)
+	}
+}
+
+func TestSimulatedDelayIsCaptured(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Simulator.Vehicles = 3
+		cfg.Simulator.Interval = 20 * time.Millisecond
+	}})
+
+	// The simulator in the app reports the schedule deviation of its vehicles as the delay
+	h.WaitForWrites(t, 3)
+	for _, data := range h.Storage.Written() {
+		if data.FeedID != simulator.FeedID || data.Delay == nil {
+			t.Errorf("Expected simulated vehicle %s to have a delay, got %s", data.VehicleID, formatDelay(data.Delay))
+		}
+	}
+}
+
+func TestMQTTPositionsHaveNoDelayWithoutSchedule(t *testing.T) {
+	sim := newTestSimulator(t, 3, simulator.DefaultRoutes())
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
+
+	// Only the topics are parsed, so the dl of the HFP JSON payloads of finbus-sim is not read, and
+	// the recorded GTFS-Realtime positions do not report the delay
+	positions := sim.Step(time.Now(), time.Second)
+	for _, position := range positions {
+		payload, err := position.Payload()
+		if err != nil {
+			t.Fatalf("Payload returned error: %v", err)
+		}
+		h.Publish(t, position.Topic(), payload)
+	}
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(positions)+len(recorded))
+
+	for _, data := range h.Storage.Written() {
+		if data.Delay != nil {
+			t.Errorf("Expected vehicle %s to have no delay without a schedule, got %d", data.VehicleID, *data.Delay)
+		}
+	}
+}
+
+func TestScheduleDelay(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, arrivalsGTFS("Europe/Helsinki", tripStopTimes("T1", 8*3600))))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	helsinki, _ := time.LoadLocation("Europe/Helsinki")
+	now := time.Date(2024, 5, 14, 8, 5, 0, 0, helsinki)
+	enricher := services.NewScheduleEnricher(schedule.NewStaticStore(feed), func() time.Time { return now })
+
+	for _, test := range []struct {
+		description string
+		vehicle     models.BusData
+		delay       *int
+	}{
+		// Scheduled halfway from B to C at 08:04:30
+		{"late", models.BusData{TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940}, intPtr(30)},
+		// Scheduled to leave A at 08:00
+		{"not departed", models.BusData{TripID: "T1", NextStop: "A", Latitude: 60.170, Longitude: 24.940}, intPtr(300)},
+		{"reported", models.BusData{TripID: "T1", NextStop: "C", Latitude: 60.185, Longitude: 24.940, Delay: intPtr(-10)}, intPtr(-10)},
+		{"unknown trip", models.BusData{TripID: "T9", NextStop: "C", Latitude: 60.185, Longitude: 24.940}, nil},
+		{"not on the trip", models.BusData{TripID: "T1", NextStop: "X", Latitude: 60.185, Longitude: 24.940}, nil},
+	} {
+		delay := enricher.Enrich(test.vehicle).Delay
+		if (test.delay == nil) != (delay == nil) || delay != nil && *delay != *test.delay {
+			t.Errorf("Expected delay %s of a %s vehicle, got %s", formatDelay(test.delay), test.description, formatDelay(delay))
+		}
+	}
+
+	// A vehicle waiting for its departure is on time
+	now = time.Date(2024, 5, 14, 7, 58, 0, 0, helsinki)
+	if delay := enricher.Enrich(models.BusData{TripID: "T1", NextStop: "A"}).Delay; delay == nil || *delay != 0 {
+		t.Errorf("Expected a vehicle before its departure to be on time, got %s", formatDelay(delay))
+	}
+}
+
+func TestRecordedPositionsGetScheduleDelay(t *testing.T) {
+	path := writeGTFS(t, testGTFS)
+	feed, err := schedule.Load(path)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+	h.App.Subscriber.ListenToAllTopics()
+
+	before := time.Now()
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
+	after := time.Now()
+
+	// The GTFS-Realtime payloads do not report the delay, so it is taken from the schedule: the
+	// seconds since the vehicle was scheduled between its previous and next stop, or since the
+	// departure from the first stop for vehicles yet to leave it
+	expected := []struct {
+		vehicleID string
+		// from and to bound when the vehicle was scheduled at its position
+		from, to  int
+		departing bool
+	}{
+		{"1362", 8*3600 + 5*60, 8*3600 + 5*60, true},
+		{"1107", 24*3600 + 52*60, 24*3600 + 52*60, true},
+		{"1362", 8*3600 + 5*60, 8*3600 + 7*60, false},
+	}
+	delayAt := func(now time.Time, scheduled int, departing bool) int {
+		delay := now.Sub(feed.ServiceDay(now, scheduled).Add(time.Duration(scheduled) * time.Second))
+		if departing {
+			delay = max(delay, 0)
+		}
+		return int(delay.Round(time.Second).Seconds())
+	}
+	written := h.Storage.Written()
+	for i, want := range expected {
+		data := written[i]
+		low, high := delayAt(after, want.to, want.departing), delayAt(before, want.to, want.departing)
+		for _, delay := range []int{delayAt(before, want.from, want.departing), delayAt(after, want.from, want.departing)} {
+			low, high = min(low, delay), max(high, delay)
+		}
+		if data.VehicleID != want.vehicleID || data.Delay == nil || !data.DelayEstimated || *data.Delay < low-1 || *data.Delay > high+1 {
+			t.Errorf("Expected vehicle %s to be %d to %d seconds late by the schedule, got vehicle %s %s late",
+				want.vehicleID, low, high, data.VehicleID, formatDelay(data.Delay))
+		}
+	}
+	if last := written[len(written)-1]; last.VehicleID != "922" || last.Delay != nil {
+		t.Errorf("Expected no delay for vehicle 922 of a route missing from the feed, got %+v", last)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func formatDelay(delay *int) string {
+	if delay == nil {
+		return "none"
+	}
+	return fmt.Sprint(*delay)
+}
+
+type delaysBody struct {
+	Stats []models.DelayStats `json:"stats"`
+}
+
+func TestDelayStatsAPI(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+
+	storeDelay(t, h, "1", "2550", "1", "1140447", intPtr(30))
+	storeDelay(t, h, "2", "2550", "1", "1140447", intPtr(240))
+	storeDelay(t, h, "3", "2550", "1", "1140449", intPtr(-90))
+	storeDelay(t, h, "4", "2550", "1", "1140449", intPtr(0))
+	storeDelay(t, h, "5", "2550", "2", "1140447", intPtr(60))
+	storeDelay(t, h, "6", "1018", "1", "1130446", intPtr(600))
+	// Positions without a delay are left out
+	storeDelay(t, h, "7", "1018", "1", "1130446", nil)
+
+	routes := getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/routes"), http.StatusOK).Stats
+	expectedRoutes := []models.DelayStats{
+		// Delays -90, 0, 30, 60 and 240, of which -90 is too early and 240 too late
+		{RouteID: "1018", Count: 1, Mean: 600, P50: 600, P90: 600, OnTimePercent: 0},
+		{RouteID: "2550", Count: 5, Mean: 48, P50: 30, P90: 168, OnTimePercent: 60},
+	}
+	if fmt.Sprint(routes) != fmt.Sprint(expectedRoutes) {
+		t.Errorf("Expected route stats %+v, got %+v", expectedRoutes, routes)
+	}
+
+	directions := getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/directions?start=-1h"), http.StatusOK).Stats
+	if len(directions) != 3 || directions[1].RouteID != "2550" || directions[1].DirectionID != "1" || directions[1].Count != 4 ||
+		directions[1].Mean != 45 || directions[2].DirectionID != "2" || directions[2].Mean != 60 {
+		t.Errorf("Unexpected direction stats %+v", directions)
+	}
+
+	stops := getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/stops?route=2550"), http.StatusOK).Stats
+	if len(stops) != 2 || stops[0].StopID != "1140447" || stops[0].Mean != 110 || stops[0].RouteID != "" ||
+		stops[1].StopID != "1140449" || stops[1].Mean != -45 || stops[1].OnTimePercent != 50 {
+		t.Errorf("Unexpected stop stats %+v", stops)
+	}
+
+	if stats := getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/routes?start=2024-05-14T00:00:00Z&end=-1h"), http.StatusOK).Stats; stats == nil || len(stats) != 0 {
+		t.Errorf("Expected an empty list of delays before the last hour, got %+v", stats)
+	}
+	getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/routes?start=yesterday"), http.StatusBadRequest)
+	getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/routes?start=-1h&end=-2h"), http.StatusBadRequest)
+	getJSON[delaysBody](t, h.URL("/api/v1/analytics/delays/vehicles"), http.StatusNotFound)
+}
+
+// delayStatsCSV is the response of InfluxDB to the delay statistics query of two routes
+const delayStatsCSV = `#datatype,string,long,string,double,double,double,double,double
+#group,false,false,false,false,false,false,false,false
+#default,_result,,,,,,,
+,result,table,route_id,count,mean,on_time_percent,p50,p90
+,,0,1018,1,600,0,600,600
+,,0,2550,5,48,60,30,168
+
+`
+
+func TestQueryDelayStatsParsesResult(t *testing.T) {
+	influx := startFakeInfluxDB(t, delayStatsCSV)
+	storage := influx.storage(t)
+	end := time.Now()
+	stats, err := storage.QueryDelayStats(context.Background(), models.DelayQuery{GroupBy: models.DelayByRoute, Start: end.Add(-time.Hour), End: end})
+	if err != nil {
+		t.Fatalf("QueryDelayStats returned error: %v", err)
+	}
+	expected := []models.DelayStats{
+		{RouteID: "1018", Count: 1, Mean: 600, P50: 600, P90: 600, OnTimePercent: 0},
+		{RouteID: "2550", Count: 5, Mean: 48, P50: 30, P90: 168, OnTimePercent: 60},
+	}
+	if fmt.Sprint(stats) != fmt.Sprint(expected) {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+	for _, part := range []string{`from(bucket:"telemetry")`, `group(columns: ["route_id"])`, "r._value >= -60.0 and r._value <= 180.0"} {
+		if !strings.Contains(influx.lastQuery(), part) {
+			t.Errorf("Expected the query to contain %s, got %s", part, influx.lastQuery())
+		}
+	}
+}
+
+// TestQueryDelayStatsInfluxDB runs the delay statistics query in the InfluxDB given by
+// FINBUS_TEST_INFLUXDB_URL, FINBUS_TEST_INFLUXDB_TOKEN, FINBUS_TEST_INFLUXDB_ORG and
+// FINBUS_TEST_INFLUXDB_BUCKET, and is skipped without one
+func TestQueryDelayStatsInfluxDB(t *testing.T) {
+	url := os.Getenv("FINBUS_TEST_INFLUXDB_URL")
+	if url == "" {
+		t.Skip("FINBUS_TEST_INFLUXDB_URL is not set")
+	}
+	storage, err := influxdb.NewBusDataManager(config.InfluxDBConfig{
+		URL:    url,
+		Token:  config.Secret(os.Getenv("FINBUS_TEST_INFLUXDB_TOKEN")),
+		Org:    os.Getenv("FINBUS_TEST_INFLUXDB_ORG"),
+		Bucket: os.Getenv("FINBUS_TEST_INFLUXDB_BUCKET"),
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBusDataManager returned error: %v", err)
+	}
+	defer storage.Close()
+
+	// A route of its own keeps the statistics apart from earlier runs
+	route := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	start := time.Now()
+	for i, delay := range []*int{intPtr(30), intPtr(240), intPtr(-90), intPtr(0), intPtr(60), nil} {
+		direction := "1"
+		if i == 4 {
+			direction = "2"
+		}
+		err := storage.WriteToInfluxDB(context.Background(), models.BusData{
+			FeedFormat: "gtfsrt", Type: "vp", RouteID: route, DirectionID: direction, NextStop: "1140447",
+			VehicleID: fmt.Sprint(i), Delay: delay,
+		})
+		if err != nil {
+			t.Fatalf("WriteToInfluxDB returned error: %v", err)
+		}
+		// Every position is a point of its own
+		time.Sleep(time.Millisecond)
+	}
+	query := models.DelayQuery{RouteID: route, Start: start.Add(-time.Minute), End: time.Now().Add(time.Minute)}
+
+	query.GroupBy = models.DelayByRoute
+	stats, err := storage.QueryDelayStats(context.Background(), query)
+	if err != nil {
+		t.Fatalf("QueryDelayStats returned error: %v", err)
+	}
+	// Delays -90, 0, 30, 60 and 240, of which -90 is too early and 240 too late. The percentiles
+	// are estimated.
+	if len(stats) != 1 || stats[0].RouteID != route || stats[0].Count != 5 || stats[0].Mean != 48 || stats[0].OnTimePercent != 60 ||
+		math.Abs(stats[0].P50-30) > 15 || stats[0].P90 < 60 || stats[0].P90 > 240 {
+		t.Errorf("Unexpected route stats %+v", stats)
+	}
+
+	query.GroupBy = models.DelayByDirection
+	stats, err = storage.QueryDelayStats(context.Background(), query)
+	if err != nil {
+		t.Fatalf("QueryDelayStats returned error: %v", err)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].DirectionID < stats[j].DirectionID })
+	if len(stats) != 2 || stats[0].DirectionID != "1" || stats[0].Count != 4 || stats[0].Mean != 45 ||
+		stats[1].DirectionID != "2" || stats[1].Mean != 60 {
+		t.Errorf("Unexpected direction stats %+v", stats)
+	}
+
+	query.GroupBy = models.DelayByStop
+	stats, err = storage.QueryDelayStats(context.Background(), query)
+	if err != nil {
+		t.Fatalf("QueryDelayStats returned error: %v", err)
+	}
+	if len(stats) != 1 || stats[0].StopID != "1140447" || stats[0].Count != 5 {
+		t.Errorf("Unexpected stop stats %+v", stats)
+	}
+}
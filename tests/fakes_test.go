@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/database/influxdb"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/transport/mqtt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeBusDataManager stores written bus data in memory. Methods that are not overridden panic.
+type fakeBusDataManager struct {
+	influxdb.BusDataManager
+	mu       sync.Mutex
+	written  []models.BusData
+	readyErr error
+	findErr  error
+}
+
+func (f *fakeBusDataManager) WriteToInfluxDB(ctx context.Context, data models.BusData) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, data)
+	return nil
+}
+
+// fakeSubscriber records MQTT topic subscriptions. Methods that are not overridden panic.
+type fakeSubscriber struct {
+	mqtt.BusDataSubscriber
+	mu           sync.Mutex
+	topics       map[string]bool
+	disconnected bool
+	// lostTopics reports no topics acknowledged by the broker, as if their subscriptions failed
+	lostTopics bool
+}
+
+func newFakeSubscriber() *fakeSubscriber {
+	return &fakeSubscriber{topics: make(map[string]bool)}
+}
+
+func (f *fakeSubscriber) SubscribeToTopic(topic string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.topics[topic] = true
+	return nil
+}
+
+func (f *fakeSubscriber) UnsubscribeFromTopic(topic string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.topics, topic)
+	return nil
+}
+
+func (f *fakeSubscriber) subscribed(topic string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.topics[topic]
+}
+
+func (f *fakeBusDataManager) FindBusesNear(ctx context.Context, geohash string) ([]models.BusData, error) {
+	return nil, f.findErr
+}
+
+func (f *fakeBusDataManager) Ready(ctx context.Context) error {
+	return f.readyErr
+}
+
+func (f *fakeSubscriber) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.disconnected
+}
+
+func (f *fakeSubscriber) ConnectionState() mqtt.ConnectionState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := mqtt.ConnectionState{Connected: !f.disconnected, Subscriptions: len(f.topics), Acknowledged: len(f.topics)}
+	if f.lostTopics {
+		state.Acknowledged = 0
+	}
+	return state
+}
+
+// fakeInfluxDB is an InfluxDB server answering every query with an annotated CSV response
+type fakeInfluxDB struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	query  string
+}
+
+func startFakeInfluxDB(t *testing.T, response string) *fakeInfluxDB {
+	f := &fakeInfluxDB{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status": "ready", "started": "2024-05-14T08:00:00Z", "up": "1h"}`))
+		case "/api/v2/query":
+			var query struct {
+				Query string `json:"query"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+				t.Errorf("Error decoding the query: %v", err)
+			}
+			f.mu.Lock()
+			f.query = query.Query
+			f.mu.Unlock()
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			_, _ = w.Write([]byte(response))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// lastQuery returns the Flux query last received
+func (f *fakeInfluxDB) lastQuery() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.query
+}
+
+// storage returns storage using the server with the bucket telemetry
+func (f *fakeInfluxDB) storage(t *testing.T) influxdb.BusDataManager {
+	storage, err := influxdb.NewBusDataManager(config.InfluxDBConfig{URL: f.server.URL, Org: "finbus", Bucket: "telemetry"}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBusDataManager returned error: %v", err)
+	}
+	t.Cleanup(storage.Close)
+	return storage
+}
+
+// fakeArrivalService predicts the same arrivals at every stop. Methods that are not overridden
+// panic.
+type fakeArrivalService struct {
+	services.ArrivalService
+	arrivals []models.Arrival
+}
+
+func (f *fakeArrivalService) Arrivals(ctx context.Context, stopID string, limit int) ([]models.Arrival, error) {
+	return f.arrivals, nil
+}
+
+func (f *fakeArrivalService) Filter(stopID string) (models.BusFilter, error) {
+	return models.BusFilter{}, nil
+}
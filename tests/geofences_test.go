@@ -0,0 +1,455 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"finbus/internal/config"
+	"finbus/internal/database/memory"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/testharness"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRegionContains(t *testing.T) {
+	square := func(minLat, minLon, size float64) []geo.Point {
+		return []geo.Point{{Lat: minLat, Lon: minLon}, {Lat: minLat, Lon: minLon + size},
+			{Lat: minLat + size, Lon: minLon + size}, {Lat: minLat + size, Lon: minLon}}
+	}
+	// A square with a hole in the middle, and a second square to the east
+	polygon := geo.NewPolygon([][]geo.Point{square(60.0, 24.0, 0.1), square(60.04, 24.04, 0.02)}, [][]geo.Point{square(60.0, 25.0, 0.1)})
+	circle := geo.Circle{Center: geo.Point{Lat: 60.2, Lon: 24.9}, Radius: 500}
+
+	tests := []struct {
+		region   geo.Region
+		lat, lon float64
+		inside   bool
+	}{
+		{polygon, 60.01, 24.01, true},
+		{polygon, 60.05, 24.05, false},
+		{polygon, 60.05, 25.05, true},
+		{polygon, 60.05, 24.5, false},
+		{polygon, 60.2, 24.05, false},
+		{circle, 60.2, 24.9, true},
+		{circle, 60.204, 24.9, true},
+		{circle, 60.2, 24.91, false},
+	}
+	for _, test := range tests {
+		if inside := test.region.Contains(test.lat, test.lon); inside != test.inside {
+			t.Errorf("Expected %.3f,%.3f inside %v to be %v", test.lat, test.lon, test.region, test.inside)
+		}
+	}
+	if bounds := circle.Bounds(); !bounds.Contains(60.2044, 24.9) || !bounds.Contains(60.2, 24.909) || bounds.Contains(60.2, 24.91) {
+		t.Errorf("Unexpected circle bounds %+v", bounds)
+	}
+
+	// The whole Earth is tested everywhere instead of being bucketed into cells
+	world := geo.NewPolygon([][]geo.Point{{{Lat: -89, Lon: -179}, {Lat: -89, Lon: 179}, {Lat: 89, Lon: 179}, {Lat: 89, Lon: -179}}})
+	index := geo.NewIndex(map[string]geo.Region{"polygon": polygon, "circle": circle, "world": world}, 0.01)
+	for _, test := range []struct {
+		lat, lon float64
+		ids      []string
+	}{
+		{60.01, 24.01, []string{"polygon", "world"}},
+		{60.2, 24.9, []string{"circle", "world"}},
+		{60.05, 24.05, []string{"world"}},
+	} {
+		ids := index.Containing(test.lat, test.lon)
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Errorf("Expected %.3f,%.3f in %v, got %v", test.lat, test.lon, test.ids, ids)
+		}
+	}
+}
+
+func TestGeohashCells(t *testing.T) {
+	for _, test := range []struct {
+		bounds geo.Bounds
+		heads  []string
+	}{
+		{geo.Bounds{MinLat: 60.19, MinLon: 24.89, MaxLat: 60.21, MaxLon: 24.91}, []string{"60;24"}},
+		{geo.Bounds{MinLat: 59.9, MinLon: 24.5, MaxLat: 61.1, MaxLon: 25.5}, []string{"59;24", "59;25", "60;24", "60;25", "61;24", "61;25"}},
+		// The heads truncate towards zero
+		{geo.Bounds{MinLat: -0.5, MinLon: -1.5, MaxLat: 0.5, MaxLon: 0.5}, []string{"0;-1", "0;0"}},
+		{geo.Bounds{MinLat: math.Inf(1), MinLon: math.Inf(1), MaxLat: math.Inf(-1), MaxLon: math.Inf(-1)}, nil},
+	} {
+		var heads []string
+		for _, cell := range geo.GeohashCells(test.bounds) {
+			heads = append(heads, geo.GeohashHead(cell.Lat, cell.Lon))
+		}
+		sort.Strings(heads)
+		if fmt.Sprint(heads) != fmt.Sprint(test.heads) {
+			t.Errorf("Expected the heads %v of %+v, got %v", test.heads, test.bounds, heads)
+		}
+	}
+}
+
+// depotGeofence is a square geofence around 60.2, 24.9
+func depotGeofence(id string) models.Geofence {
+	return models.Geofence{
+		Type: "Feature",
+		ID:   id,
+		Geometry: models.GeofenceGeometry{Type: "Polygon",
+			Coordinates: json.RawMessage(`[[[24.89, 60.19], [24.91, 60.19], [24.91, 60.21], [24.89, 60.21], [24.89, 60.19]]]`)},
+		Properties: models.GeofenceProperties{Name: "Depot", Kind: "depot"},
+	}
+}
+
+// terminalGeofence is a 300 m circle around 60.17, 24.94
+func terminalGeofence(id string) models.Geofence {
+	return models.Geofence{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   models.GeofenceGeometry{Type: "Point", Coordinates: json.RawMessage(`[24.94, 60.17]`)},
+		Properties: models.GeofenceProperties{Name: "Terminal", Radius: 300},
+	}
+}
+
+func TestGeofenceEvents(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "geofences.json")
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	storage := memory.NewStorage()
+	options := services.GeofenceOptions{File: file, DwellTime: 5 * time.Minute, Now: func() time.Time { return now }}
+	service, err := services.NewGeofenceService(storage, options, slog.Default())
+	if err != nil {
+		t.Fatalf("NewGeofenceService returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.Start(ctx)
+	listener := service.Listen()
+	defer service.CloseListener(listener)
+
+	for _, geofence := range []models.Geofence{depotGeofence("depot"), terminalGeofence("terminal")} {
+		if _, err := service.CreateGeofence(ctx, geofence); err != nil {
+			t.Fatalf("CreateGeofence returned error: %v", err)
+		}
+	}
+
+	observe := func(after time.Duration, vehicleID string, lat, lon float64) []models.GeofenceEvent {
+		now = start.Add(after)
+		service.Observe(models.BusData{VehicleID: vehicleID, RouteID: "550", Latitude: lat, Longitude: lon})
+		var events []models.GeofenceEvent
+		for {
+			select {
+			case event := <-listener.Events:
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+	expectEvents := func(events []models.GeofenceEvent, expected ...string) {
+		t.Helper()
+		var got []string
+		for _, event := range events {
+			got = append(got, fmt.Sprintf("%s %s %s %.0f", event.Type, event.GeofenceID, event.VehicleID, event.Duration))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("Expected events %v, got %v", expected, got)
+		}
+	}
+
+	expectEvents(observe(0, "1", 60.18, 24.9))
+	expectEvents(observe(time.Minute, "1", 60.2, 24.9), "enter depot 1 0")
+	expectEvents(observe(3*time.Minute, "1", 60.201, 24.9))
+	expectEvents(observe(6*time.Minute, "1", 60.202, 24.9), "dwell depot 1 300")
+	expectEvents(observe(9*time.Minute, "1", 60.203, 24.9))
+	// Moving from the depot straight to the terminal
+	expectEvents(observe(10*time.Minute, "1", 60.171, 24.94), "exit depot 1 540", "enter terminal 1 0")
+
+	var events []models.GeofenceEvent
+	waitFor(t, 2*time.Second, "the events to be stored", func() bool {
+		events, err = service.Events(ctx, models.GeofenceEventQuery{Start: start, End: now.Add(time.Second), GeofenceID: "depot"})
+		return err != nil || len(events) == 3
+	})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	expectEvents(events, "exit depot 1 540", "dwell depot 1 300", "enter depot 1 0")
+	if events[0].GeofenceName != "Depot" || events[0].RouteID != "550" || events[0].Latitude != 60.171 {
+		t.Errorf("Unexpected exit event %+v", events[0])
+	}
+
+	// Vehicles outside an updated geofence exit it, while a deleted geofence raises no exit
+	expectEvents(observe(11*time.Minute, "2", 60.2, 24.9), "enter depot 2 0")
+	moved := terminalGeofence("")
+	moved.Geometry.Coordinates = json.RawMessage(`[24.95, 60.17]`)
+	if _, err := service.UpdateGeofence(ctx, "terminal", moved); err != nil {
+		t.Fatalf("UpdateGeofence returned error: %v", err)
+	}
+	if err := service.DeleteGeofence(ctx, "depot"); err != nil {
+		t.Fatalf("DeleteGeofence returned error: %v", err)
+	}
+	expectEvents(observe(12*time.Minute, "1", 60.171, 24.94), "exit terminal 1 120")
+	expectEvents(observe(12*time.Minute, "2", 60.2, 24.9))
+
+	// The geofences are persisted
+	reloaded, err := services.NewGeofenceService(storage, options, slog.Default())
+	if err != nil {
+		t.Fatalf("NewGeofenceService returned error: %v", err)
+	}
+	geofences, _ := reloaded.Geofences(ctx)
+	if len(geofences) != 1 || geofences[0].ID != "terminal" || string(geofences[0].Geometry.Coordinates) != `[24.95,60.17]` ||
+		!geofences[0].Properties.UpdatedAt.Equal(start.Add(11*time.Minute)) {
+		t.Errorf("Expected the updated terminal to be reloaded, got %+v", geofences)
+	}
+
+	if _, err := service.CreateGeofence(ctx, terminalGeofence("terminal")); !errors.Is(err, services.ErrGeofenceExists) {
+		t.Errorf("Expected ErrGeofenceExists, got %v", err)
+	}
+	if _, err := service.Geofence(ctx, "depot"); !errors.Is(err, services.ErrUnknownGeofence) {
+		t.Errorf("Expected ErrUnknownGeofence, got %v", err)
+	}
+	if _, err := service.Events(ctx, models.GeofenceEventQuery{Start: now, End: start}); !errors.Is(err, services.ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+	created, err := service.CreateGeofence(ctx, depotGeofence(""))
+	if err != nil || created.ID == "" {
+		t.Errorf("Expected an ID to be generated, got %+v and %v", created, err)
+	}
+}
+
+// deadlineStorage records whether geofence events are written with a deadline
+type deadlineStorage struct {
+	*memory.Storage
+	deadlines chan bool
+}
+
+func (s *deadlineStorage) WriteGeofenceEvent(ctx context.Context, event models.GeofenceEvent) error {
+	_, ok := ctx.Deadline()
+	s.deadlines <- ok
+	return s.Storage.WriteGeofenceEvent(ctx, event)
+}
+
+func TestGeofenceEventsAreWrittenWithTimeout(t *testing.T) {
+	storage := &deadlineStorage{Storage: memory.NewStorage(), deadlines: make(chan bool, 1)}
+	service, err := services.NewGeofenceService(storage, services.GeofenceOptions{}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewGeofenceService returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.Start(ctx)
+	if _, err := service.CreateGeofence(ctx, depotGeofence("depot")); err != nil {
+		t.Fatalf("CreateGeofence returned error: %v", err)
+	}
+
+	service.Observe(models.BusData{VehicleID: "1", RouteID: "550", Latitude: 60.2, Longitude: 24.9})
+	select {
+	case ok := <-storage.deadlines:
+		if !ok {
+			t.Error("Expected the geofence event to be written with a deadline")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the enter event to be written")
+	}
+}
+
+func TestGeofenceValidation(t *testing.T) {
+	service, err := services.NewGeofenceService(memory.NewStorage(), services.GeofenceOptions{}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewGeofenceService returned error: %v", err)
+	}
+	invalid := map[string]func(*models.Geofence){
+		"type":          func(g *models.Geofence) { g.Type = "FeatureCollection" },
+		"id":            func(g *models.Geofence) { g.ID = "a/b" },
+		"name":          func(g *models.Geofence) { g.Properties.Name = "" },
+		"geometry type": func(g *models.Geofence) { g.Geometry.Type = "LineString" },
+		"coordinates":   func(g *models.Geofence) { g.Geometry.Coordinates = json.RawMessage(`"here"`) },
+		"short ring": func(g *models.Geofence) {
+			g.Geometry.Coordinates = json.RawMessage(`[[[24.9, 60.1], [25.0, 60.1], [24.9, 60.1]]]`)
+		},
+		"out of range": func(g *models.Geofence) {
+			g.Geometry.Coordinates = json.RawMessage(`[[[60.1, 24.9], [60.1, 250], [60.2, 25.0]]]`)
+		},
+		"no rings":        func(g *models.Geofence) { g.Geometry.Coordinates = json.RawMessage(`[]`) },
+		"polygon radius":  func(g *models.Geofence) { g.Properties.Radius = 100 },
+		"negative radius": func(g *models.Geofence) { g.Properties.Radius = -1 },
+		"point radius": func(g *models.Geofence) {
+			g.Geometry = models.GeofenceGeometry{Type: "Point", Coordinates: json.RawMessage(`[24.9, 60.1]`)}
+		},
+	}
+	for name, modify := range invalid {
+		geofence := depotGeofence("depot")
+		modify(&geofence)
+		if _, err := service.CreateGeofence(context.Background(), geofence); !errors.Is(err, services.ErrInvalidGeofence) {
+			t.Errorf("Expected ErrInvalidGeofence for an invalid %s, got %v", name, err)
+		}
+	}
+
+	multi := depotGeofence("multi")
+	multi.Type = ""
+	multi.Geometry = models.GeofenceGeometry{Type: "MultiPolygon",
+		Coordinates: json.RawMessage(`[[[[24.9, 60.1], [25.0, 60.1], [25.0, 60.2]]], [[[26.9, 60.1], [27.0, 60.1], [27.0, 60.2]]]]`)}
+	if created, err := service.CreateGeofence(context.Background(), multi); err != nil || created.Type != "Feature" {
+		t.Errorf("Expected a valid MultiPolygon with an implied type, got %+v and %v", created, err)
+	}
+}
+
+// geofenceRequest sends a request with the JSON body, returning the response status and decoding
+// the body into result if it is not nil
+func geofenceRequest(t *testing.T, method, url string, body any, result any) int {
+	t.Helper()
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(body))
+	default:
+		content, _ := json.Marshal(body)
+		reader = bytes.NewReader(content)
+	}
+	req, _ := http.NewRequest(method, url, reader)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s returned error: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatalf("Error decoding response of %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestGeofenceAPI(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "geofences.json")
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Geofence.File = file
+	}})
+
+	var created models.Geofence
+	if status := geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), depotGeofence("depot"), &created); status != http.StatusCreated ||
+		created.ID != "depot" || created.Properties.UpdatedAt.IsZero() {
+		t.Fatalf("Expected the depot to be created, got %d with %+v", status, created)
+	}
+	if status := geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), depotGeofence("depot"), nil); status != http.StatusConflict {
+		t.Errorf("Expected a conflict creating the depot again, got %d", status)
+	}
+	if status := geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), `{"type": "Feature"`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected a bad request for a malformed body, got %d", status)
+	}
+	if status := geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), terminalGeofence("a b"), nil); status != http.StatusBadRequest {
+		t.Errorf("Expected a bad request for an invalid ID, got %d", status)
+	}
+	geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), terminalGeofence("terminal"), nil)
+
+	var collection models.GeofenceCollection
+	geofenceRequest(t, http.MethodGet, h.URL("/api/v1/geofences"), nil, &collection)
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 || collection.Features[0].ID != "depot" {
+		t.Errorf("Expected the depot and terminal, got %+v", collection)
+	}
+
+	renamed := terminalGeofence("")
+	renamed.Properties.Name = "Main terminal"
+	var updated models.Geofence
+	if status := geofenceRequest(t, http.MethodPut, h.URL("/api/v1/geofences/terminal"), renamed, &updated); status != http.StatusOK ||
+		updated.ID != "terminal" || updated.Properties.Name != "Main terminal" {
+		t.Errorf("Expected the terminal to be renamed, got %d with %+v", status, updated)
+	}
+	if status := geofenceRequest(t, http.MethodPut, h.URL("/api/v1/geofences/nope"), renamed, nil); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown geofence to not be updated, got %d", status)
+	}
+	if status := geofenceRequest(t, http.MethodDelete, h.URL("/api/v1/geofences/terminal"), nil, nil); status != http.StatusNoContent {
+		t.Errorf("Expected the terminal to be deleted, got %d", status)
+	}
+	if status := geofenceRequest(t, http.MethodGet, h.URL("/api/v1/geofences/terminal"), nil, nil); status != http.StatusNotFound {
+		t.Errorf("Expected the deleted terminal to be gone, got %d", status)
+	}
+
+	// The vehicles in the geofences are received without any client subscribing to them
+	h.PublishPosition(t, "1", "550", 60.18, 24.9)
+	h.WaitForWrites(t, 1)
+	h.PublishPosition(t, "1", "550", 60.2, 24.9)
+	var body struct {
+		Events []models.GeofenceEvent `json:"events"`
+	}
+	waitFor(t, 2*time.Second, "the enter event", func() bool {
+		geofenceRequest(t, http.MethodGet, h.URL("/api/v1/geofences/events?geofence=depot&type=enter"), nil, &body)
+		return len(body.Events) > 0
+	})
+	if len(body.Events) != 1 || body.Events[0].VehicleID != "1" || body.Events[0].GeofenceName != "Depot" {
+		t.Errorf("Expected vehicle 1 to enter the depot, got %+v", body.Events)
+	}
+	if status := geofenceRequest(t, http.MethodGet, h.URL("/api/v1/geofences/events?type=left"), nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected a bad request for an unknown type, got %d", status)
+	}
+}
+
+type wsGeofence struct {
+	Type  string                `json:"type"`
+	Event *models.GeofenceEvent `json:"event"`
+}
+
+func TestLiveGeofenceEvents(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "geofences.json")
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Geofence.File = file
+	}})
+	geofenceRequest(t, http.MethodPost, h.URL("/api/v1/geofences"), depotGeofence("depot"), nil)
+
+	c, _, err := websocket.DefaultDialer.Dial(h.WebSocketURL("/ws/bus-updates"), nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer c.Close()
+	readUntil := func(messageType string) wsGeofence {
+		t.Helper()
+		for {
+			var message wsGeofence
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := c.ReadJSON(&message); err != nil {
+				t.Fatalf("ReadJSON returned error waiting for %s: %v", messageType, err)
+			}
+			if message.Type == messageType {
+				return message
+			}
+		}
+	}
+	if err := c.WriteJSON(map[string]any{"type": "configure", "geofences": true}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("ack")
+	if err := c.WriteJSON(map[string]any{"type": "subscribe", "routes": []string{"550"}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("snapshot")
+
+	next := openStream(t, h.URL("/api/v1/stream?vehicle=1&geofences=true"), nil)
+	if snapshot := next(); snapshot.name != "snapshot" {
+		t.Fatalf("Expected a snapshot, got %+v", snapshot)
+	}
+
+	h.PublishPosition(t, "2", "550", 60.2, 24.9)
+	h.PublishPosition(t, "1", "550", 60.2, 24.9)
+	if message := readUntil("geofence"); message.Event == nil || message.Event.Type != models.GeofenceEnter || message.Event.GeofenceID != "depot" {
+		t.Errorf("Expected an enter event, got %+v", message.Event)
+	}
+	for {
+		event := next()
+		if event.name != "geofence" {
+			continue
+		}
+		if event.id != "" || !strings.Contains(event.data, `"enter"`) || !strings.Contains(event.data, `"vehicle_id":"1"`) {
+			t.Errorf("Expected the enter event of vehicle 1 only, got %+v", event)
+		}
+		break
+	}
+}
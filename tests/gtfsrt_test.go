@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"context"
+	"finbus/internal/models"
+	"finbus/internal/transport/gtfsrt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestFeed builds a feed with one vehicle position and a trip update for its trip
+func newTestFeed(t *testing.T) []byte {
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")},
+		Entity: []*gtfs.FeedEntity{
+			{
+				Id: proto.String("v1"),
+				Vehicle: &gtfs.VehiclePosition{
+					Trip: &gtfs.TripDescriptor{
+						TripId:      proto.String("trip1"),
+						RouteId:     proto.String("550"),
+						DirectionId: proto.Uint32(1),
+						StartTime:   proto.String("08:15:00"),
+					},
+					Vehicle:  &gtfs.VehicleDescriptor{Id: proto.String("bus-42")},
+					Position: &gtfs.Position{Latitude: proto.Float32(60.1699), Longitude: proto.Float32(24.9384)},
+				},
+			},
+			{
+				Id: proto.String("t1"),
+				TripUpdate: &gtfs.TripUpdate{
+					Trip: &gtfs.TripDescriptor{TripId: proto.String("trip1")},
+					StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{
+						{StopId: proto.String("1130446"), Arrival: &gtfs.TripUpdate_StopTimeEvent{Delay: proto.Int32(75)}},
+					},
+				},
+			},
+		},
+	}
+	body, err := proto.Marshal(feed)
+	if err != nil {
+		t.Fatalf("Error marshalling feed: %v", err)
+	}
+	return body
+}
+
+func TestGTFSRTPollerUsesETag(t *testing.T) {
+	body := newTestFeed(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	dataChannel := make(chan models.BusMessage, 10)
+	poller, err := gtfsrt.NewPoller(gtfsrt.PollerConfig{URL: server.URL, FeedID: "test", Mode: "bus"}, dataChannel)
+	if err != nil {
+		t.Fatalf("NewPoller returned error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := poller.Poll(context.Background()); err != nil {
+			t.Fatalf("Poll returned error: %v", err)
+		}
+	}
+
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+	if len(dataChannel) != 1 {
+		t.Fatalf("Expected 1 bus after an unchanged second poll, got %d", len(dataChannel))
+	}
+
+	busData := (<-dataChannel).Data
+	if busData.VehicleID != "bus-42" || busData.RouteID != "550" || busData.DirectionID != "1" {
+		t.Errorf("Unexpected vehicle data: %+v", busData)
+	}
+	if busData.NextStop != "1130446" {
+		t.Errorf("Expected NextStop from trip update, got %q", busData.NextStop)
+	}
+	if busData.Delay == nil || *busData.Delay != 75 {
+		t.Errorf("Expected the arrival delay of the trip update, got %s", formatDelay(busData.Delay))
+	}
+	if busData.GeohashHead != "60;24" || busData.GeohashFirstDeg != "19" || busData.GeohashSecondDeg != "63" {
+		t.Errorf("Unexpected geohash %s/%s/%s", busData.GeohashHead, busData.GeohashFirstDeg, busData.GeohashSecondDeg)
+	}
+}
+
+func TestParseFeedTripDelay(t *testing.T) {
+	vehicle := func(tripID string) *gtfs.FeedEntity {
+		return &gtfs.FeedEntity{Id: proto.String("v-" + tripID), Vehicle: &gtfs.VehiclePosition{
+			Trip:     &gtfs.TripDescriptor{TripId: proto.String(tripID)},
+			Vehicle:  &gtfs.VehicleDescriptor{Id: proto.String(tripID)},
+			Position: &gtfs.Position{Latitude: proto.Float32(60.17), Longitude: proto.Float32(24.94)},
+		}}
+	}
+	feed := &gtfs.FeedMessage{Entity: []*gtfs.FeedEntity{
+		vehicle("trip1"), vehicle("trip2"),
+		{Id: proto.String("t1"), TripUpdate: &gtfs.TripUpdate{
+			Trip:  &gtfs.TripDescriptor{TripId: proto.String("trip1")},
+			Delay: proto.Int32(-20),
+			StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{
+				{StopId: proto.String("A"), Departure: &gtfs.TripUpdate_StopTimeEvent{Delay: proto.Int32(40)}},
+			},
+		}},
+		// An update without a trip matches no vehicle, not even one without a trip
+		vehicle(""),
+		{Id: proto.String("t0"), TripUpdate: &gtfs.TripUpdate{
+			Trip:           &gtfs.TripDescriptor{RouteId: proto.String("2550")},
+			Delay:          proto.Int32(300),
+			StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{{StopId: proto.String("B")}},
+		}},
+	}}
+
+	buses := gtfsrt.ParseFeed(feed, "test", "bus")
+	if len(buses) != 3 {
+		t.Fatalf("Expected 2 buses, got %+v", buses)
+	}
+	// The delay of the trip takes precedence over the delay of the next stop
+	if buses[0].Delay == nil || *buses[0].Delay != -20 || buses[0].NextStop != "A" {
+		t.Errorf("Expected trip1 20 seconds early heading to A, got %+v with delay %s", buses[0], formatDelay(buses[0].Delay))
+	}
+	if buses[1].Delay != nil {
+		t.Errorf("Expected no delay for a trip without an update, got %d", *buses[1].Delay)
+	}
+	if buses[2].Delay != nil || buses[2].NextStop != "" {
+		t.Errorf("Expected no delay or next stop for a vehicle without a trip, got %+v with delay %s", buses[2], formatDelay(buses[2].Delay))
+	}
+}
+
+func TestGTFSRTPollerRejectsBadStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	poller, _ := gtfsrt.NewPoller(gtfsrt.PollerConfig{URL: server.URL}, make(chan models.BusMessage, 1))
+	if err := poller.Poll(context.Background()); err == nil {
+		t.Error("Expected an error for a 503 response")
+	}
+}
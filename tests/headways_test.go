@@ -0,0 +1,369 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/config"
+	"finbus/internal/database/memory"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/services"
+	"finbus/internal/testharness"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// headwayGTFS is a feed of one route along a meridian, from 60.170 to 60.200 on shape S1
+func headwayGTFS() map[string]string {
+	return map[string]string{
+		"stops.txt": "stop_id,stop_name,stop_lat,stop_lon\n" +
+			"A,Stop A,60.170,24.940\n" +
+			"D,Stop D,60.200,24.940\n",
+		"routes.txt": "route_id,route_short_name,route_long_name,route_type\n" +
+			"R1,1,A-D,3\n",
+		"trips.txt": "route_id,service_id,trip_id,trip_headsign,shape_id\n" +
+			"R1,Ti,T1,D,S1\n" +
+			"R1,Ti,T2,D,S1\n" +
+			"R1,Ti,T3,D,S1\n",
+		"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" +
+			"S1,60.170,24.940,1\n" +
+			"S1,60.180,24.940,2\n" +
+			"S1,60.190,24.940,3\n" +
+			"S1,60.200,24.940,4\n",
+	}
+}
+
+func TestPathProject(t *testing.T) {
+	path := geo.NewPath([]geo.Point{{Lat: 60.170, Lon: 24.940}, {Lat: 60.180, Lon: 24.940}, {Lat: 60.180, Lon: 24.960}})
+	leg := geo.Distance(60.170, 24.940, 60.180, 24.940)
+	if want := leg + geo.Distance(60.180, 24.940, 60.180, 24.960); math.Abs(path.Length()-want) > 0.001 {
+		t.Errorf("Expected length %.1f, got %.1f", want, path.Length())
+	}
+
+	tests := []struct {
+		lat, lon      float64
+		along, offset float64
+	}{
+		{60.175, 24.940, leg / 2, 0},
+		// East of the first leg, nearest to its middle
+		{60.175, 24.941, leg / 2, geo.Distance(60.175, 24.940, 60.175, 24.941)},
+		// Before the start
+		{60.160, 24.940, 0, geo.Distance(60.160, 24.940, 60.170, 24.940)},
+		// Along the second leg
+		{60.180, 24.950, leg + geo.Distance(60.180, 24.940, 60.180, 24.950), 0},
+	}
+	for _, test := range tests {
+		along, offset, ok := path.Project(test.lat, test.lon)
+		if !ok || math.Abs(along-test.along) > 1 || math.Abs(offset-test.offset) > 1 {
+			t.Errorf("Expected %.5f,%.5f %.1f m along and %.1f m off the path, got %.1f and %.1f",
+				test.lat, test.lon, test.along, test.offset, along, offset)
+		}
+	}
+
+	if _, _, ok := geo.NewPath(nil).Project(60.17, 24.94); ok {
+		t.Error("Expected an empty path to not project")
+	}
+}
+
+func TestHeadwayDetection(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, headwayGTFS()))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	storage := memory.NewStorage()
+	service := services.NewHeadwayService(schedule.NewStaticStore(feed), storage, services.HeadwayOptions{
+		BunchingThreshold: 3 * time.Minute,
+		GapThreshold:      10 * time.Minute,
+		Now:               func() time.Time { return now },
+	}, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.Start(ctx)
+	listener := service.Listen()
+	defer service.CloseListener(listener)
+
+	observe := func(after time.Duration, vehicleID, tripID, directionID string, lat float64) {
+		now = start.Add(after)
+		service.Observe(models.BusData{VehicleID: vehicleID, RouteID: "R1", DirectionID: directionID, TripID: tripID,
+			NextStop: "D", Latitude: lat, Longitude: 24.940})
+	}
+	nextEvent := func() *models.HeadwayEvent {
+		select {
+		case event := <-listener.Events:
+			return &event
+		default:
+			return nil
+		}
+	}
+
+	// Vehicle 2 reaches 60.175 two minutes after vehicle 1
+	observe(0, "1", "T1", "1", 60.175)
+	observe(time.Minute, "1", "T1", "1", 60.180)
+	observe(2*time.Minute, "1", "T1", "1", 60.185)
+	observe(2*time.Minute, "2", "T2", "1", 60.175)
+	event := nextEvent()
+	if event == nil || event.Type != models.HeadwayBunching || event.VehicleID != "2" || event.LeaderID != "1" ||
+		event.Headway != 120 || math.Abs(event.Distance-geo.Distance(60.175, 24.94, 60.185, 24.94)) > 1 ||
+		event.NextStop != "D" || event.Latitude != 60.175 || !event.At.Equal(now) {
+		t.Fatalf("Expected vehicle 2 to be bunched two minutes behind vehicle 1, got %+v", event)
+	}
+
+	// Staying bunched raises no new event, and the leader's progress is interpolated
+	observe(2*time.Minute+10*time.Second, "2", "T2", "1", 60.1755)
+	if event := nextEvent(); event != nil {
+		t.Errorf("Expected no event while staying bunched, got %+v", event)
+	}
+	// Vehicles laying over at the terminal or off the shape are not measured
+	observe(2*time.Minute+10*time.Second, "5", "T3", "1", 60.1701)
+	service.Observe(models.BusData{VehicleID: "6", RouteID: "R1", DirectionID: "1", TripID: "T3", Latitude: 60.176, Longitude: 24.960})
+	if event := nextEvent(); event != nil {
+		t.Errorf("Expected no events of vehicles that are not measured, got %+v", event)
+	}
+
+	headways, err := service.Headways(context.Background(), "R1")
+	if err != nil {
+		t.Fatalf("Headways returned error: %v", err)
+	}
+	if len(headways) != 1 || headways[0].VehicleID != "2" || headways[0].Status != models.HeadwayBunching ||
+		math.Abs(headways[0].Headway-124) > 1 {
+		t.Errorf("Expected the headway of vehicle 2 only, got %+v", headways)
+	}
+
+	// Vehicle 4 falls eleven minutes behind vehicle 3 in the other direction
+	observe(0, "3", "T3", "2", 60.180)
+	observe(8*time.Minute, "3", "T3", "2", 60.190)
+	observe(11*time.Minute, "4", "T3", "2", 60.175)
+	if event := nextEvent(); event == nil || event.Type != models.HeadwayGap || event.VehicleID != "4" ||
+		event.LeaderID != "3" || event.Headway != 660 || event.DirectionID != "2" {
+		t.Errorf("Expected a gap in front of vehicle 4, got %+v", event)
+	}
+
+	var events []models.HeadwayEvent
+	waitFor(t, 2*time.Second, "the events to be stored", func() bool {
+		events, err = service.Events(context.Background(), models.HeadwayEventQuery{Start: start, End: now.Add(time.Second), Type: models.HeadwayGap})
+		return err != nil || len(events) > 0
+	})
+	if err != nil {
+		t.Fatalf("Events returned error: %v", err)
+	}
+	if len(events) != 1 || events[0].VehicleID != "4" {
+		t.Errorf("Expected the stored gap event, got %+v", events)
+	}
+	if _, err := service.Events(context.Background(), models.HeadwayEventQuery{Start: now, End: start}); !errors.Is(err, services.ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+	if _, err := service.Headways(context.Background(), "nope"); !errors.Is(err, services.ErrUnknownRoute) {
+		t.Errorf("Expected ErrUnknownRoute, got %v", err)
+	}
+
+	withoutSchedule := services.NewHeadwayService(nil, storage, services.HeadwayOptions{}, slog.Default())
+	if _, err := withoutSchedule.Headways(context.Background(), "R1"); !errors.Is(err, services.ErrNoSchedule) {
+		t.Errorf("Expected ErrNoSchedule, got %v", err)
+	}
+}
+
+// blockingStorage blocks the writes of events until released
+type blockingStorage struct {
+	*memory.Storage
+	release chan struct{}
+}
+
+func (s *blockingStorage) WriteHeadwayEvent(ctx context.Context, event models.HeadwayEvent) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.Storage.WriteHeadwayEvent(ctx, event)
+}
+
+func TestHeadwayEventsAreStoredAsynchronously(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, headwayGTFS()))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	now := start
+	storage := &blockingStorage{Storage: memory.NewStorage(), release: make(chan struct{})}
+	service := services.NewHeadwayService(schedule.NewStaticStore(feed), storage, services.HeadwayOptions{
+		BunchingThreshold: 3 * time.Minute,
+		Now:               func() time.Time { return now },
+	}, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.Start(ctx)
+	listener := service.Listen()
+	defer service.CloseListener(listener)
+
+	// Vehicle 2 bunches behind vehicle 1 while the storage is stuck
+	observed := make(chan struct{})
+	go func() {
+		defer close(observed)
+		for _, vehicle := range []struct {
+			after    time.Duration
+			id, trip string
+			latitude float64
+		}{{0, "1", "T1", 60.175}, {2 * time.Minute, "1", "T1", 60.185}, {2 * time.Minute, "2", "T2", 60.175}} {
+			now = start.Add(vehicle.after)
+			service.Observe(models.BusData{VehicleID: vehicle.id, RouteID: "R1", DirectionID: "1", TripID: vehicle.trip,
+				NextStop: "D", Latitude: vehicle.latitude, Longitude: 24.940})
+		}
+	}()
+	select {
+	case <-observed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected observing to return while the storage is stuck")
+	}
+	if event := <-listener.Events; event.VehicleID != "2" || event.Type != models.HeadwayBunching {
+		t.Errorf("Expected the bunching event of vehicle 2 to be published, got %+v", event)
+	}
+
+	close(storage.release)
+	waitFor(t, 2*time.Second, "the event to be stored", func() bool {
+		events, _ := storage.QueryHeadwayEvents(context.Background(), models.HeadwayEventQuery{Start: start, End: now.Add(time.Second)})
+		return len(events) == 1
+	})
+}
+
+// publishBunching publishes positions of vehicle 1 on trip T1 passing 60.175, followed right
+// after by vehicle 2 on trip T2
+func publishBunching(t *testing.T, h *testharness.Harness) {
+	h.PublishPosition(t, "1", "R1", 60.175, 24.940)
+	h.WaitForWrites(t, 1)
+	h.PublishPosition(t, "1", "R1", 60.185, 24.940)
+	h.WaitForWrites(t, 2)
+	h.PublishPosition(t, "2", "R1", 60.175, 24.940)
+}
+
+type headwaysBody struct {
+	RouteID  string                `json:"route_id"`
+	Headways []models.Headway      `json:"headways"`
+	Events   []models.HeadwayEvent `json:"events"`
+}
+
+func TestHeadwaysAPI(t *testing.T) {
+	path := writeGTFS(t, headwayGTFS())
+	// The monitored route is received without any client subscribing to it
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+		cfg.Headway.Routes = []string{"R1"}
+	}})
+
+	if body := getJSON[headwaysBody](t, h.URL("/api/v1/routes/R1/headways"), http.StatusOK); body.RouteID != "R1" || body.Headways == nil || len(body.Headways) != 0 {
+		t.Errorf("Expected no headways before any vehicles, got %+v", body)
+	}
+
+	publishBunching(t, h)
+	var body headwaysBody
+	waitFor(t, 2*time.Second, "the headway of vehicle 2", func() bool {
+		body = getJSON[headwaysBody](t, h.URL("/api/v1/routes/R1/headways"), http.StatusOK)
+		return len(body.Headways) > 0
+	})
+	if len(body.Headways) != 1 || body.Headways[0].VehicleID != "2" || body.Headways[0].LeaderID != "1" ||
+		body.Headways[0].Status != models.HeadwayBunching {
+		t.Errorf("Expected vehicle 2 to be bunched behind vehicle 1, got %+v", body.Headways)
+	}
+
+	var events []models.HeadwayEvent
+	waitFor(t, 2*time.Second, "the bunching event to be stored", func() bool {
+		events = getJSON[headwaysBody](t, h.URL("/api/v1/headways/events?route=R1&type=bunching"), http.StatusOK).Events
+		return len(events) > 0
+	})
+	if len(events) != 1 || events[0].VehicleID != "2" || events[0].Type != models.HeadwayBunching {
+		t.Errorf("Expected the bunching event of vehicle 2, got %+v", events)
+	}
+	if events := getJSON[headwaysBody](t, h.URL("/api/v1/headways/events?type=gap"), http.StatusOK).Events; len(events) != 0 {
+		t.Errorf("Expected no gap events, got %+v", events)
+	}
+
+	getJSON[headwaysBody](t, h.URL("/api/v1/routes/nope/headways"), http.StatusNotFound)
+	getJSON[headwaysBody](t, h.URL("/api/v1/headways/events?type=late"), http.StatusBadRequest)
+	getJSON[headwaysBody](t, h.URL("/api/v1/headways/events?limit=0"), http.StatusBadRequest)
+	getJSON[headwaysBody](t, h.URL("/api/v1/headways/events?start=-1h&end=-2h"), http.StatusBadRequest)
+}
+
+func TestHeadwaysAPIWithoutGTFS(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	getJSON[headwaysBody](t, h.URL("/api/v1/routes/R1/headways"), http.StatusServiceUnavailable)
+	getJSON[headwaysBody](t, h.URL("/api/v1/headways/events"), http.StatusOK)
+}
+
+type wsHeadway struct {
+	Type  string               `json:"type"`
+	Event *models.HeadwayEvent `json:"event"`
+}
+
+func TestWebSocketHeadwayEvents(t *testing.T) {
+	path := writeGTFS(t, headwayGTFS())
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+	c, _, err := websocket.DefaultDialer.Dial(h.WebSocketURL("/ws/bus-updates"), nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer c.Close()
+	// readUntil reads messages until one of the type
+	readUntil := func(messageType string) wsHeadway {
+		t.Helper()
+		for {
+			var message wsHeadway
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := c.ReadJSON(&message); err != nil {
+				t.Fatalf("ReadJSON returned error waiting for %s: %v", messageType, err)
+			}
+			if message.Type == messageType {
+				return message
+			}
+		}
+	}
+
+	if err := c.WriteJSON(map[string]any{"type": "configure", "headways": true}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("ack")
+	if err := c.WriteJSON(map[string]any{"type": "subscribe", "id": "r", "routes": []string{"R1"}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("snapshot")
+
+	publishBunching(t, h)
+	message := readUntil("headway")
+	if message.Event == nil || message.Event.Type != models.HeadwayBunching || message.Event.VehicleID != "2" {
+		t.Errorf("Expected the bunching event of vehicle 2, got %+v", message.Event)
+	}
+}
+
+func TestSSEHeadwayEvents(t *testing.T) {
+	path := writeGTFS(t, headwayGTFS())
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+
+	getJSON[headwaysBody](t, h.URL("/api/v1/stream?route=R1&headways=maybe"), http.StatusBadRequest)
+
+	next := openStream(t, h.URL("/api/v1/stream?route=R1&headways=true"), nil)
+	if snapshot := next(); snapshot.name != "snapshot" {
+		t.Fatalf("Expected a snapshot, got %+v", snapshot)
+	}
+	publishBunching(t, h)
+	for {
+		event := next()
+		if event.name != "headway" {
+			continue
+		}
+		if event.id != "" || !strings.Contains(event.data, `"bunching"`) || !strings.Contains(event.data, `"vehicle_id":"2"`) {
+			t.Errorf("Expected the bunching event of vehicle 2 without an ID, got %+v", event)
+		}
+		break
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/transport/rest"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type healthBody struct {
+	Status string                      `json:"status"`
+	Uptime string                      `json:"uptime"`
+	Checks []services.DependencyStatus `json:"checks"`
+}
+
+// startHealthServer starts a server exposing the health endpoints of services backed by the given fakes
+func startHealthServer(t *testing.T, db *fakeBusDataManager, sub *fakeSubscriber, options services.HealthOptions) (*httptest.Server, chan models.BusMessage) {
+	dataChannel := make(chan models.BusMessage)
+	service := services.NewBusDataService(db, dataChannel, sub, services.BusDataOptions{}, slog.Default())
+	handler := rest.NewHealthHandler(services.NewHealthService(db, service, options), slog.Default())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", handler.HandleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", handler.HandleReadyz).Methods("GET")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, dataChannel
+}
+
+func getHealth(t *testing.T, url string) (int, healthBody) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s returned error: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var body healthBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Error decoding health response: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+func findCheck(t *testing.T, body healthBody, name string) services.DependencyStatus {
+	for _, check := range body.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("Check %q missing from %+v", name, body.Checks)
+	return services.DependencyStatus{}
+}
+
+func TestHealthz(t *testing.T) {
+	db := &fakeBusDataManager{readyErr: errors.New("connection refused")}
+	server, _ := startHealthServer(t, db, newFakeSubscriber(), services.HealthOptions{})
+
+	status, body := getHealth(t, server.URL+"/healthz")
+	if status != http.StatusOK || body.Status != "ok" || body.Uptime == "" {
+		t.Errorf("Unexpected liveness response %d %+v", status, body)
+	}
+}
+
+func TestReadyzReady(t *testing.T) {
+	server, _ := startHealthServer(t, &fakeBusDataManager{}, newFakeSubscriber(), services.HealthOptions{MaxIngestionLag: time.Minute})
+
+	status, body := getHealth(t, server.URL+"/readyz")
+	if status != http.StatusOK || body.Status != "ready" {
+		t.Fatalf("Expected ready, got %d %+v", status, body)
+	}
+	for _, name := range []string{"influxdb", "mqtt", "subscriptions", "ingestion"} {
+		if check := findCheck(t, body, name); !check.Healthy {
+			t.Errorf("Expected %s to be healthy, got %+v", name, check)
+		}
+	}
+}
+
+func TestReadyzDependencyDown(t *testing.T) {
+	sub := newFakeSubscriber()
+	sub.disconnected = true
+	db := &fakeBusDataManager{readyErr: errors.New("connection refused")}
+	server, _ := startHealthServer(t, db, sub, services.HealthOptions{})
+
+	status, body := getHealth(t, server.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || body.Status != "not ready" {
+		t.Fatalf("Expected not ready, got %d %+v", status, body)
+	}
+	if check := findCheck(t, body, "influxdb"); check.Healthy || check.Detail != "connection refused" {
+		t.Errorf("Unexpected influxdb check %+v", check)
+	}
+	if check := findCheck(t, body, "mqtt"); check.Healthy {
+		t.Errorf("Unexpected mqtt check %+v", check)
+	}
+}
+
+func TestReadyzIngestionLag(t *testing.T) {
+	server, dataChannel := startHealthServer(t, &fakeBusDataManager{}, newFakeSubscriber(), services.HealthOptions{
+		MaxIngestionLag:     50 * time.Millisecond,
+		ContinuousIngestion: true,
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	status, body := getHealth(t, server.URL+"/readyz")
+	if check := findCheck(t, body, "ingestion"); status != http.StatusServiceUnavailable || check.Healthy {
+		t.Fatalf("Expected lagging ingestion to be unhealthy, got %d %+v", status, check)
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "1", RouteID: "550"}}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ = getHealth(t, server.URL+"/readyz"); status == http.StatusOK {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("Expected ready after a bus update, got %d", status)
+}
+
+func TestReadinessLostSubscriptions(t *testing.T) {
+	sub := newFakeSubscriber()
+	db := &fakeBusDataManager{}
+	service := services.NewBusDataService(db, make(chan models.BusMessage), sub, services.BusDataOptions{}, slog.Default())
+	health := services.NewHealthService(db, service, services.HealthOptions{})
+	subscriptions := func() services.DependencyStatus {
+		_, checks := health.Readiness(context.Background())
+		for _, check := range checks {
+			if check.Name == "subscriptions" {
+				return check
+			}
+		}
+		t.Fatalf("Subscriptions check missing from %+v", checks)
+		return services.DependencyStatus{}
+	}
+
+	if err := service.Subscribe(service.NewSubscriber(), "r550", models.BusFilter{Routes: []string{"550"}}); err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	if check := subscriptions(); !check.Healthy {
+		t.Errorf("Expected registered topics to be healthy, got %+v", check)
+	}
+
+	sub.mu.Lock()
+	sub.lostTopics = true
+	sub.mu.Unlock()
+	if check := subscriptions(); check.Healthy {
+		t.Errorf("Expected topics missing from the broker to be unhealthy, got %+v", check)
+	}
+
+	// Disconnected, the topics are restored on reconnect
+	sub.mu.Lock()
+	sub.disconnected = true
+	sub.mu.Unlock()
+	if check := subscriptions(); !check.Healthy {
+		t.Errorf("Expected the topics to wait for the reconnect, got %+v", check)
+	}
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/logging"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggerSamplesDebugRecords(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(config.LogConfig{Level: "debug", Format: "text", SampleEvery: 10}, &buf)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	for i := 0; i < 25; i++ {
+		logger.Debug("Received MQTT message", "i", i)
+		logger.Info("Subscribed to topic", "i", i)
+	}
+
+	if count := strings.Count(buf.String(), "Received MQTT message"); count != 3 {
+		t.Errorf("Expected 3 of 25 debug records to be logged, got %d", count)
+	}
+	if count := strings.Count(buf.String(), "Subscribed to topic"); count != 25 {
+		t.Errorf("Expected every info record to be logged, got %d", count)
+	}
+}
+
+func TestLoggerJSONFormatAndLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(config.LogConfig{Level: "warn", Format: "json", SampleEvery: 1}, &buf)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	logger.Info("Ignored")
+	logger.Warn("Connection lost", "broker", "tcp://localhost:1883")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "Connection lost" || record["broker"] != "tcp://localhost:1883" {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	if _, err := logging.New(config.LogConfig{Level: "loud", Format: "text"}, &buf); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	handler := logging.Middleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.FromContext(r.Context(), nil).Info("Handling request")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/get-busses", nil)
+	req.Header.Set(logging.RequestIDHeader, "abc123")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if id := recorder.Header().Get(logging.RequestIDHeader); id != "abc123" {
+		t.Errorf("Expected the client's request ID to be echoed, got %q", id)
+	}
+	if !strings.Contains(buf.String(), "request_id=abc123") {
+		t.Errorf("Expected the request ID in the log, got %q", buf.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/get-busses", nil))
+	if id := recorder.Header().Get(logging.RequestIDHeader); len(id) != 16 {
+		t.Errorf("Expected a generated request ID, got %q", id)
+	}
+}
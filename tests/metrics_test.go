@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"finbus/internal/metrics"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := metrics.InstrumentHandler("/api/test", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+	})
+	before := testutil.CollectAndCount(metrics.HTTPRequestDuration)
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/test", nil))
+
+	if count := testutil.CollectAndCount(metrics.HTTPRequestDuration); count != before+1 {
+		t.Errorf("Expected a new series for the route, got %d series after %d", count, before)
+	}
+	expected := `finbus_http_request_duration_seconds_count{method="GET",route="/api/test",status="400"} 1`
+	if body := scrapeMetrics(t); !strings.Contains(body, expected) {
+		t.Errorf("Expected %q in metrics", expected)
+	}
+}
+
+func TestTrackedVehiclesMetric(t *testing.T) {
+	dataChannel := make(chan models.BusMessage)
+	service := services.NewBusDataService(&fakeBusDataManager{}, dataChannel, newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "metrics-1", RouteID: "550"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "metrics-2", RouteID: "550"}}
+	deadline := time.Now().Add(time.Second)
+	for service.IngestionStatus().TrackedVehicles < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if tracked := testutil.ToFloat64(metrics.TrackedVehicles); tracked != 2 {
+		t.Errorf("Expected 2 tracked vehicles, got %v", tracked)
+	}
+}
+
+func TestIngestQueueDepthWhileStalled(t *testing.T) {
+	dataChannel := make(chan models.BusMessage, 10)
+	service := services.NewBusDataService(&fakeBusDataManager{}, dataChannel, newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+	// A closed service no longer consumes the queue, as if it were stalled
+	service.Close()
+
+	for i := 0; i < 3; i++ {
+		dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "stalled", RouteID: "550"}}
+	}
+	expected := `finbus_queue_depth{queue="ingest"} 3`
+	if body := scrapeMetrics(t); !strings.Contains(body, expected) {
+		t.Errorf("Expected %q in metrics", expected)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	body := scrapeMetrics(t)
+	for _, name := range []string{"finbus_tracked_vehicles", "finbus_websocket_sessions_active", "finbus_influxdb_write_errors_total"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Expected %s in metrics", name)
+		}
+	}
+}
+
+// scrapeMetrics returns the metrics exposed by the metrics handler
+func scrapeMetrics(t *testing.T) string {
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET /metrics returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
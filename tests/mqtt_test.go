@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/testharness"
+	"finbus/internal/transport/mqtt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func newTestSubscriber(t *testing.T, cfg config.MQTTConfig) (mqtt.BusDataSubscriber, chan models.BusMessage) {
+	dataChannel := make(chan models.BusMessage, 16)
+	subscriber, err := mqtt.NewBusDataSubscriber(cfg, dataChannel, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBusDataSubscriber returned error: %v", err)
+	}
+	// Starting the subscriber disconnects it when the test ends
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := subscriber.Start(ctx); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	return subscriber, dataChannel
+}
+
+func receiveBus(t *testing.T, dataChannel chan models.BusMessage) models.BusData {
+	t.Helper()
+	select {
+	case message := <-dataChannel:
+		return message.Data
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for bus data")
+		return models.BusData{}
+	}
+}
+
+func TestMQTTSubscriberRestoresSubscriptionsAfterReconnect(t *testing.T) {
+	address := testharness.FreeAddress(t)
+	broker := testharness.StartBroker(t, address, testharness.BrokerOptions{})
+	subscriber, dataChannel := newTestSubscriber(t, config.MQTTConfig{Broker: "tcp://" + address, CleanSession: true})
+
+	if err := subscriber.SubscribeToTopic(busTopic("1")); err != nil {
+		t.Fatalf("SubscribeToTopic returned error: %v", err)
+	}
+	_ = broker.Publish(busTopic("1"), nil, false, 0)
+	if busData := receiveBus(t, dataChannel); busData.VehicleID != "1" {
+		t.Fatalf("Expected vehicle 1, got %+v", busData)
+	}
+
+	broker.Stop()
+	waitFor(t, 5*time.Second, "the connection to be lost", func() bool { return !subscriber.IsConnected() })
+	// Subscriptions made while disconnected are made on reconnect
+	if err := subscriber.SubscribeToTopic(busTopic("2")); err != nil {
+		t.Fatalf("SubscribeToTopic while disconnected returned error: %v", err)
+	}
+
+	broker = testharness.StartBroker(t, address, testharness.BrokerOptions{})
+	waitFor(t, 10*time.Second, "the client to reconnect", func() bool {
+		state := subscriber.ConnectionState()
+		return state.Connected && state.Reconnects == 1
+	})
+	waitFor(t, 5*time.Second, "the subscriptions to be restored", func() bool {
+		return len(broker.Topics.Subscribers(busTopic("1")).Subscriptions) == 1 && len(broker.Topics.Subscribers(busTopic("2")).Subscriptions) == 1
+	})
+
+	_ = broker.Publish(busTopic("1"), nil, false, 0)
+	_ = broker.Publish(busTopic("2"), nil, false, 0)
+	received := map[string]bool{receiveBus(t, dataChannel).VehicleID: true, receiveBus(t, dataChannel).VehicleID: true}
+	if !received["1"] || !received["2"] {
+		t.Errorf("Expected updates of vehicles 1 and 2 after reconnecting, got %v", received)
+	}
+	if state := subscriber.ConnectionState(); state.Subscriptions != 2 || state.Acknowledged != 2 || state.LastError == "" {
+		t.Errorf("Unexpected connection state %+v", state)
+	}
+}
+
+func TestMQTTSubscribersUseUniqueClientIDs(t *testing.T) {
+	address := testharness.FreeAddress(t)
+	broker := testharness.StartBroker(t, address, testharness.BrokerOptions{})
+
+	first, _ := newTestSubscriber(t, config.MQTTConfig{Broker: "tcp://" + address, CleanSession: true})
+	second, _ := newTestSubscriber(t, config.MQTTConfig{Broker: "tcp://" + address, CleanSession: true})
+	configured, _ := newTestSubscriber(t, config.MQTTConfig{Broker: "tcp://" + address, ClientID: "finbus-test"})
+
+	time.Sleep(200 * time.Millisecond)
+	if !first.IsConnected() || !second.IsConnected() || !configured.IsConnected() {
+		t.Errorf("Expected every replica to stay connected, got %v, %v and %v",
+			first.IsConnected(), second.IsConnected(), configured.IsConnected())
+	}
+	if _, ok := broker.Clients.Get("finbus-test"); !ok {
+		t.Error("Expected the configured client ID to be used")
+	}
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/testharness"
+	"finbus/internal/transport/mqtt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+)
+
+// testPKI is a CA with a broker and a client certificate signed by it, written as PEM files
+type testPKI struct {
+	caFile, clientCertFile, clientKeyFile string
+	caPool                                *x509.CertPool
+	serverCert                            tls.Certificate
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "finbus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Error creating %s certificate: %v", name, err)
+		}
+		return der, key
+	}
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+		return path
+	}
+
+	serverDER, serverKey := issue(2, "broker.test", x509.ExtKeyUsageServerAuth)
+	clientDER, clientKey := issue(3, "finbus", x509.ExtKeyUsageClientAuth)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return testPKI{
+		caFile:         writePEM("ca.pem", "CERTIFICATE", caDER),
+		clientCertFile: writePEM("client.pem", "CERTIFICATE", clientDER),
+		clientKeyFile:  writePEM("client-key.pem", "EC PRIVATE KEY", clientKeyDER),
+		caPool:         pool,
+		serverCert:     tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey},
+	}
+}
+
+// startTLSBroker starts a broker requiring a client certificate signed by the test CA and the
+// username finbus with password secret
+func startTLSBroker(t *testing.T, pki testPKI) string {
+	address := testharness.FreeAddress(t)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientCAs:    pki.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	testharness.StartBroker(t, address, testharness.BrokerOptions{
+		TLSConfig: tlsConfig,
+		Hook:      new(auth.Hook),
+		HookConfig: &auth.Options{
+			Ledger: &auth.Ledger{Auth: auth.AuthRules{{Username: "finbus", Password: "secret", Allow: true}}},
+		},
+	})
+	return "ssl://" + address
+}
+
+func writeSecretFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Error writing %s: %v", name, err)
+	}
+	return path
+}
+
+func TestMQTTSubscriberConnectsWithTLSAndCredentialFiles(t *testing.T) {
+	pki := newTestPKI(t)
+	broker := startTLSBroker(t, pki)
+
+	subscriber, _ := newTestSubscriber(t, config.MQTTConfig{
+		Broker:       broker,
+		CleanSession: true,
+		UsernameFile: writeSecretFile(t, "username", "finbus\n"),
+		PasswordFile: writeSecretFile(t, "password", "secret\n"),
+		TLS: config.MQTTTLSConfig{
+			CAFile:     pki.caFile,
+			CertFile:   pki.clientCertFile,
+			KeyFile:    pki.clientKeyFile,
+			ServerName: "broker.test",
+			MinVersion: "1.3",
+		},
+	})
+	if !subscriber.IsConnected() {
+		t.Error("Expected the subscriber to be connected")
+	}
+}
+
+func TestMQTTSubscriberRejectsInvalidTLSOrCredentials(t *testing.T) {
+	pki := newTestPKI(t)
+	broker := startTLSBroker(t, pki)
+	valid := config.MQTTConfig{
+		Broker:       broker,
+		CleanSession: true,
+		Username:     "finbus",
+		Password:     "secret",
+		TLS: config.MQTTTLSConfig{
+			CAFile:     pki.caFile,
+			CertFile:   pki.clientCertFile,
+			KeyFile:    pki.clientKeyFile,
+			ServerName: "broker.test",
+		},
+	}
+
+	tests := map[string]func(cfg *config.MQTTConfig){
+		"untrusted CA":          func(cfg *config.MQTTConfig) { cfg.TLS.CAFile = "" },
+		"wrong server name":     func(cfg *config.MQTTConfig) { cfg.TLS.ServerName = "other.test" },
+		"no client cert":        func(cfg *config.MQTTConfig) { cfg.TLS.CertFile, cfg.TLS.KeyFile = "", "" },
+		"wrong password":        func(cfg *config.MQTTConfig) { cfg.Password = "guess" },
+		"missing CA file":       func(cfg *config.MQTTConfig) { cfg.TLS.CAFile = filepath.Join(t.TempDir(), "missing.pem") },
+		"missing password file": func(cfg *config.MQTTConfig) { cfg.Password, cfg.PasswordFile = "", "/nonexistent/password" },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			modify(&cfg)
+			if _, err := mqtt.NewBusDataSubscriber(cfg, make(chan models.BusMessage), slog.Default()); err == nil {
+				t.Error("Expected NewBusDataSubscriber to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/recording"
+	"finbus/internal/testharness"
+	"finbus/internal/transport/mqtt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRecording records the messages of the fixture to a new gzip recording file
+func writeRecording(t *testing.T, fixture string) (string, []recording.Message) {
+	messages, err := testharness.LoadFixtures(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "traffic.ndjson.gz")
+	writer, err := recording.Create(path)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	for _, message := range messages {
+		if err := writer.Write(message); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	return path, messages
+}
+
+func readRecording(t *testing.T, path string) ([]recording.Message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening recording: %v", err)
+	}
+	defer file.Close()
+	return recording.ReadAll(file)
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	path, messages := writeRecording(t, testharness.HSLVehiclePositions)
+
+	// A second writer appends to the recording
+	writer, err := recording.Create(path)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	extra := recording.Message{Topic: busTopic("7"), Payload: []byte{0, 1, 2}, ReceivedAt: time.Date(2024, 5, 14, 9, 0, 0, 0, time.UTC)}
+	if err := writer.Write(extra); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	// Flushed messages can be read before the recording is closed
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+	_, err = readRecording(t, path)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected an unexpected EOF reading an unclosed recording, got %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	read, err := readRecording(t, path)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if len(read) != len(messages)+1 {
+		t.Fatalf("Expected %d messages, got %d", len(messages)+1, len(read))
+	}
+	for i, message := range messages {
+		if read[i].Topic != message.Topic || string(read[i].Payload) != string(message.Payload) || !read[i].ReceivedAt.Equal(message.ReceivedAt) {
+			t.Errorf("Message %d changed in the recording: %+v", i, read[i])
+		}
+	}
+	if last := read[len(read)-1]; last.Topic != extra.Topic || string(last.Payload) != string(extra.Payload) {
+		t.Errorf("Expected the appended message last, got %+v", last)
+	}
+}
+
+func TestSubscriberRecordsReceivedMessages(t *testing.T) {
+	address := testharness.FreeAddress(t)
+	broker := testharness.StartBroker(t, address, testharness.BrokerOptions{})
+	path := filepath.Join(t.TempDir(), "traffic.ndjson.gz")
+
+	dataChannel := make(chan models.BusMessage, 16)
+	subscriber, err := mqtt.NewBusDataSubscriber(config.MQTTConfig{Broker: "tcp://" + address, CleanSession: true, RecordFile: path}, dataChannel, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBusDataSubscriber returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := subscriber.Start(ctx); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	subscriber.ListenToAllTopics()
+
+	before := time.Now()
+	_ = broker.Publish(busTopic("1"), []byte("payload"), false, 0)
+	// Messages that cannot be parsed are recorded too
+	_ = broker.Publish("/gtfsrt/vp/short", nil, false, 0)
+	receiveBus(t, dataChannel)
+	waitFor(t, 5*time.Second, "the recording to be flushed", func() bool {
+		read, _ := readRecording(t, path)
+		return len(read) == 2
+	})
+
+	// The recording is closed once the subscriber stops
+	cancel()
+	var read []recording.Message
+	waitFor(t, 5*time.Second, "the recording to be closed", func() bool {
+		read, err = readRecording(t, path)
+		return err == nil
+	})
+	if read[0].Topic != busTopic("1") || string(read[0].Payload) != "payload" || read[0].ReceivedAt.Before(before) {
+		t.Errorf("Unexpected recorded message %+v", read[0])
+	}
+	if read[1].Topic != "/gtfsrt/vp/short" {
+		t.Errorf("Expected the unparsable message recorded, got %+v", read[1])
+	}
+}
+
+func startReplay(t *testing.T, cfg config.ReplayConfig) (mqtt.ReplaySource, chan models.BusMessage) {
+	dataChannel := make(chan models.BusMessage, 16)
+	replay, err := mqtt.NewReplaySource(cfg, dataChannel, slog.Default())
+	if err != nil {
+		t.Fatalf("NewReplaySource returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := replay.Start(ctx); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	return replay, dataChannel
+}
+
+func TestReplayAtMaxSpeed(t *testing.T) {
+	path, messages := writeRecording(t, testharness.HSLVehiclePositions)
+	replay, dataChannel := startReplay(t, config.ReplayConfig{File: path, Speed: 0})
+
+	for i, stop := range []string{"1140447", "1130446", "1140449", "4810241"} {
+		if busData := receiveBus(t, dataChannel); busData.NextStop != stop {
+			t.Errorf("Expected message %d of %d heading to %s, got %+v", i, len(messages), stop, busData)
+		}
+	}
+	select {
+	case <-replay.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the replay to finish at the end of the recording")
+	}
+}
+
+func TestReplayKeepsRecordedIntervals(t *testing.T) {
+	path, messages := writeRecording(t, testharness.HSLVehiclePositions)
+	recorded := messages[len(messages)-1].ReceivedAt.Sub(messages[0].ReceivedAt)
+
+	start := time.Now()
+	replay, dataChannel := startReplay(t, config.ReplayConfig{File: path, Speed: 10})
+	for range messages {
+		receiveBus(t, dataChannel)
+	}
+	<-replay.Done()
+	if elapsed := time.Since(start); elapsed < recorded/10 || elapsed > recorded {
+		t.Errorf("Expected the replay to take about %v at 10x speed, took %v", recorded/10, elapsed)
+	}
+}
+
+func TestReplayLoops(t *testing.T) {
+	path, messages := writeRecording(t, testharness.HSLVehiclePositions)
+	replay, dataChannel := startReplay(t, config.ReplayConfig{File: path, Speed: 0, Loop: true})
+
+	for i := 0; i < 3*len(messages); i++ {
+		receiveBus(t, dataChannel)
+	}
+	select {
+	case <-replay.Done():
+		t.Error("Expected a looping replay to keep running")
+	default:
+	}
+}
+
+func TestReplayThroughApp(t *testing.T) {
+	path, messages := writeRecording(t, testharness.HSLVehiclePositions)
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Replay = config.ReplayConfig{File: path, Speed: 0}
+	}})
+
+	h.WaitForWrites(t, len(messages))
+	if written := h.Storage.Written(); written[len(written)-1].VehicleID != "922" {
+		t.Errorf("Expected the replayed vehicle 922 stored last, got %+v", written[len(written)-1])
+	}
+}
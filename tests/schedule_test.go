@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"archive/zip"
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/testharness"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testGTFS is a small feed of the routes in the HSL fixtures
+var testGTFS = map[string]string{
+	"stops.txt": "\ufeffstop_id,stop_code,stop_name,stop_lat,stop_lon,parent_station\n" +
+		"1140447,H4012,Kulosaaren silta,60.18745,25.00712,\n" +
+		"1140449,H4014,Kulosaari,60.18834,25.01021,\n" +
+		"1130446,H3046,Kivihaantie,60.20442,24.89764,\n",
+	"routes.txt": "route_id,agency_id,route_short_name,route_long_name,route_type,route_color\n" +
+		"2550,HSL,550,Itäkeskus(M)-Westendinasema,3,007ac9\n" +
+		"1018,HSL,18,Eira-Kivihaka,3,\n",
+	"trips.txt": "route_id,service_id,trip_id,trip_headsign,direction_id,shape_id\n" +
+		"2550,Ti,2550_20240514_Ti_1_0805,Itäkeskus(M),0,2550_20240101_1\n" +
+		"1018,Ti,1018_20240514_Ti_2_0752,Kivihaka,1,1018_20240101_2\n",
+	"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence,shape_dist_traveled\n" +
+		"2550_20240514_Ti_1_0805,08:07:00,08:07:30,1140449,2,1200.5\n" +
+		"2550_20240514_Ti_1_0805,08:05:00,08:05:00,1140447,1,0\n" +
+		"1018_20240514_Ti_2_0752,24:52:00,24:52:00,1130446,1,0\n",
+	"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence,shape_dist_traveled\n" +
+		"2550_20240101_1,60.18834,25.01021,2,1200.5\n" +
+		"2550_20240101_1,60.18745,25.00712,1,0\n",
+	"translations.txt": "table_name,field_name,language,translation,record_id,record_sub_id,field_value\n" +
+		"stops,stop_name,sv,Brändö bro,1140447,,\n" +
+		"stops,stop_name,sv,Brändö,,,Kulosaari\n" +
+		"routes,route_long_name,sv,Östra centrum-Västerleds station,2550,,\n",
+}
+
+// writeGTFS writes the GTFS files to a new directory
+func writeGTFS(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writeGTFSZip writes the GTFS files to a new zip file
+func writeGTFSZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gtfs.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadGTFS(t *testing.T) {
+	for name, path := range map[string]string{"directory": writeGTFS(t, testGTFS), "zip": writeGTFSZip(t, testGTFS)} {
+		t.Run(name, func(t *testing.T) {
+			feed, err := schedule.Load(path)
+			if err != nil {
+				t.Fatalf("Load returned error: %v", err)
+			}
+			if len(feed.Stops) != 3 || len(feed.Routes) != 2 || len(feed.Trips) != 2 {
+				t.Fatalf("Expected 3 stops, 2 routes and 2 trips, got %d, %d and %d", len(feed.Stops), len(feed.Routes), len(feed.Trips))
+			}
+			if stop := feed.Stops["1140447"]; stop == nil || stop.Name != "Kulosaaren silta" || stop.Lat != 60.18745 {
+				t.Errorf("Expected stop 1140447 despite the byte order mark, got %+v", stop)
+			}
+			if route := feed.Routes["2550"]; route.Color != "007AC9" || route.Type != 3 {
+				t.Errorf("Expected route 2550 to be a bus colored 007AC9, got %+v", route)
+			}
+
+			stopTimes := feed.StopTimes["2550_20240514_Ti_1_0805"]
+			if len(stopTimes) != 2 || stopTimes[0].StopID != "1140447" || stopTimes[1].Departure != 8*3600+7*60+30 {
+				t.Errorf("Expected the stop times ordered by sequence, got %+v", stopTimes)
+			}
+			if arrival := feed.StopTimes["1018_20240514_Ti_2_0752"][0].Arrival; arrival != 24*3600+52*60 {
+				t.Errorf("Expected an arrival past midnight of the service day, got %d", arrival)
+			}
+			if points := feed.Shapes["2550_20240101_1"]; len(points) != 2 || points[0].Sequence != 1 || points[1].Distance != 1200.5 {
+				t.Errorf("Expected the shape points ordered by sequence, got %+v", points)
+			}
+
+			routes := feed.RoutesAtStop("1140449")
+			if len(routes) != 1 || routes[0].ShortName != "550" {
+				t.Errorf("Expected route 550 at stop 1140449, got %+v", routes)
+			}
+			if routes := feed.RoutesAtStop("unknown"); len(routes) != 0 {
+				t.Errorf("Expected no routes at an unknown stop, got %+v", routes)
+			}
+		})
+	}
+}
+
+func TestLoadGTFSOptionalAndInvalidFiles(t *testing.T) {
+	files := map[string]string{}
+	for name, content := range testGTFS {
+		files[name] = content
+	}
+	delete(files, "stop_times.txt")
+	delete(files, "shapes.txt")
+	feed, err := schedule.Load(writeGTFS(t, files))
+	if err != nil {
+		t.Fatalf("Expected stop times and shapes to be optional, got %v", err)
+	}
+	if len(feed.StopTimes) != 0 || len(feed.Shapes) != 0 || len(feed.Stops) != 3 {
+		t.Errorf("Unexpected feed %+v", feed)
+	}
+
+	delete(files, "trips.txt")
+	if _, err := schedule.Load(writeGTFS(t, files)); err == nil {
+		t.Error("Expected an error without trips.txt")
+	}
+
+	files["trips.txt"] = testGTFS["trips.txt"]
+	files["stops.txt"] = "stop_id,stop_name,stop_lat,stop_lon\n1140447,Kulosaaren silta,north,25.00712\n"
+	if _, err := schedule.Load(writeGTFS(t, files)); err == nil {
+		t.Error("Expected an error for an invalid stop latitude")
+	}
+
+	if _, err := schedule.Load(filepath.Join(t.TempDir(), "missing.zip")); err == nil {
+		t.Error("Expected an error for a missing feed")
+	}
+}
+
+func TestScheduleEnrich(t *testing.T) {
+	feed, err := schedule.Load(writeGTFS(t, testGTFS))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	store := schedule.NewStaticStore(feed)
+
+	enriched := store.Enrich(models.BusData{
+		RouteID:  "1018",
+		TripID:   "1018_20240514_Ti_2_0752",
+		NextStop: "1130446",
+		Color:    "FF0000",
+	})
+	if enriched.NextStopName != "Kivihaantie" || enriched.RouteLongName != "Eira-Kivihaka" || enriched.ShapeID != "1018_20240101_2" {
+		t.Errorf("Expected the stop name, route long name and shape, got %+v", enriched)
+	}
+	if enriched.ShortName != "18" || enriched.TripHeadsign != "Kivihaka" {
+		t.Errorf("Expected the missing short name and headsign from the feed, got %+v", enriched)
+	}
+	if enriched.Color != "FF0000" {
+		t.Errorf("Expected the received color to be kept, got %s", enriched.Color)
+	}
+
+	unknown := models.BusData{VehicleID: "1", RouteID: "9999", NextStop: "EOL"}
+	if enriched := store.Enrich(unknown); enriched != unknown {
+		t.Errorf("Expected data of unknown routes and stops unchanged, got %+v", enriched)
+	}
+}
+
+func TestScheduleRefresh(t *testing.T) {
+	dir := writeGTFS(t, testGTFS)
+	store, err := schedule.NewStore(config.GTFSConfig{Path: dir, RefreshInterval: 10 * time.Millisecond}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewStore returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := store.Start(ctx); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	// An invalid update keeps the previous feed
+	stops := filepath.Join(dir, "stops.txt")
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(stops, []byte("stop_name\nbroken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(stops, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := store.Feed().Stops["1140447"].Name; name != "Kulosaaren silta" {
+		t.Fatalf("Expected the previous feed to be kept, got stop %s", name)
+	}
+
+	if err := os.WriteFile(stops, []byte("stop_id,stop_name,stop_lat,stop_lon\n1140447,Kulosaaren silta (renamed),60.18745,25.00712\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(stops, later, later); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "GTFS refresh", func() bool {
+		stop := store.Feed().Stops["1140447"]
+		return stop != nil && stop.Name == "Kulosaaren silta (renamed)"
+	})
+}
+
+func TestGTFSEnrichesLiveVehicles(t *testing.T) {
+	path := writeGTFSZip(t, testGTFS)
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+	h.App.Subscriber.ListenToAllTopics()
+
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
+
+	written := h.Storage.Written()
+	if first := written[0]; first.NextStopName != "Kulosaaren silta" || first.RouteLongName != "Itäkeskus(M)-Westendinasema" || first.ShapeID != "2550_20240101_1" {
+		t.Errorf("Expected vehicle 1362 enriched with the schedule, got %+v", first)
+	}
+	if last := written[len(written)-1]; last.VehicleID != "922" || last.NextStopName != "" || last.RouteLongName != "" {
+		t.Errorf("Expected vehicle 922 of a route missing from the feed unchanged, got %+v", last)
+	}
+}
@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/geo"
+	"finbus/internal/simulator"
+	"finbus/internal/testharness"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSimulator(t *testing.T, vehicles int, routes []simulator.Route) *simulator.Simulator {
+	sim, err := simulator.New(config.SimulatorConfig{Vehicles: vehicles, Speed: 36, Seed: 42}, routes, time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	return sim
+}
+
+func TestSimulatorIsRepeatable(t *testing.T) {
+	a := newTestSimulator(t, 5, simulator.DefaultRoutes())
+	b := newTestSimulator(t, 5, simulator.DefaultRoutes())
+	now := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	for step := 0; step < 10; step++ {
+		now = now.Add(time.Second)
+		pa, pb := a.Step(now, time.Second), b.Step(now, time.Second)
+		for i := range pa {
+			if pa[i].Topic() != pb[i].Topic() || pa[i].Data.Latitude != pb[i].Data.Latitude {
+				t.Fatalf("Expected simulations with the same seed to match, got %s and %s", pa[i].Topic(), pb[i].Topic())
+			}
+		}
+	}
+}
+
+func TestSimulatorDrivesAlongTheRoute(t *testing.T) {
+	// A straight route of about 1.1 km to the north
+	routes := []simulator.Route{{
+		ID:        "9001",
+		ShortName: "1",
+		Headsigns: [2]string{"North", "South"},
+		Points:    []simulator.Point{{Lat: 60.17, Lon: 24.94}, {Lat: 60.18, Lon: 24.94}},
+	}}
+	sim := newTestSimulator(t, 1, routes)
+	now := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	previous := sim.Step(now, 0)[0]
+
+	turned := false
+	for step := 0; step < 200; step++ {
+		now = now.Add(time.Second)
+		position := sim.Step(now, time.Second)[0]
+		moved := math.Abs(position.Data.Latitude-previous.Data.Latitude) * 111_000
+		if !turned && moved > 14 {
+			t.Fatalf("Expected at most 14 m per second at 36 km/h, moved %.1f m", moved)
+		}
+		if position.Data.Longitude != 24.94 || position.Data.Latitude < 60.17 || position.Data.Latitude > 60.18 {
+			t.Fatalf("Expected the vehicle to stay on the route, got %f, %f", position.Data.Latitude, position.Data.Longitude)
+		}
+		if position.Data.DirectionID != previous.Data.DirectionID {
+			turned = true
+			if position.Data.TripID == previous.Data.TripID {
+				t.Errorf("Expected a new trip after turning around, kept %s", position.Data.TripID)
+			}
+		}
+		expectedHeading := 0
+		if position.Data.DirectionID == "2" {
+			expectedHeading = 180
+		}
+		if position.Heading != expectedHeading || position.Data.TripHeadsign != routes[0].Headsigns[position.Heading/180] {
+			t.Fatalf("Expected heading %d, got %d towards %s", expectedHeading, position.Heading, position.Data.TripHeadsign)
+		}
+		previous = position
+	}
+	if !turned {
+		t.Error("Expected the vehicle to turn around at the end of the route within 200 s")
+	}
+}
+
+func TestSimulatedScheduleDeviation(t *testing.T) {
+	sim := newTestSimulator(t, 5, simulator.DefaultRoutes())
+	now := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	first := make(map[string]int)
+	drifted := false
+	for step := 0; step < 120; step++ {
+		now = now.Add(time.Second)
+		for _, position := range sim.Step(now, time.Second) {
+			if position.Data.Delay == nil {
+				t.Fatalf("Expected the schedule deviation of vehicle %s", position.Data.VehicleID)
+			}
+			delay := *position.Data.Delay
+			if delay < -300 || delay > 300 {
+				t.Errorf("Expected vehicle %s within 5 minutes of its schedule, got %d s", position.Data.VehicleID, delay)
+			}
+			payload, err := position.Payload()
+			if err != nil {
+				t.Fatalf("Payload returned error: %v", err)
+			}
+			var message struct {
+				VP struct {
+					Dl int `json:"dl"`
+				} `json:"VP"`
+			}
+			if err := json.Unmarshal(payload, &message); err != nil || message.VP.Dl != -delay {
+				t.Fatalf("Expected dl %d for a delay of %d s, got %s", -delay, delay, payload)
+			}
+			if initial, ok := first[position.Data.VehicleID]; !ok {
+				first[position.Data.VehicleID] = delay
+			} else if initial != delay {
+				drifted = true
+			}
+		}
+	}
+	// Vehicles drive faster or slower than the schedule, so their deviation changes
+	if !drifted {
+		t.Error("Expected the schedule deviation to change as vehicles drive")
+	}
+}
+
+func TestSimulatedPositionsAreWellFormed(t *testing.T) {
+	sim := newTestSimulator(t, 3, simulator.DefaultRoutes())
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
+
+	positions := sim.Step(time.Now(), time.Second)
+	for _, position := range positions {
+		payload, err := position.Payload()
+		if err != nil {
+			t.Fatalf("Payload returned error: %v", err)
+		}
+		var message struct {
+			VP struct {
+				Veh  int     `json:"veh"`
+				Lat  float64 `json:"lat"`
+				Long float64 `json:"long"`
+				Stop string  `json:"stop"`
+			} `json:"VP"`
+		}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatalf("Expected an HFP JSON payload, got %s: %v", payload, err)
+		}
+		if message.VP.Lat != position.Data.Latitude || message.VP.Long != position.Data.Longitude || message.VP.Stop != position.Data.NextStop {
+			t.Errorf("Payload %s does not match the topic %s", payload, position.Topic())
+		}
+		h.Publish(t, position.Topic(), payload)
+	}
+
+	h.WaitForWrites(t, len(positions))
+	for i, busData := range h.Storage.Written() {
+		expected := positions[i].Data
+		head, first, second, third := geo.SplitGeohash(expected.Latitude, expected.Longitude)
+		if busData.VehicleID != expected.VehicleID || busData.NextStop != expected.NextStop || busData.FeedID != simulator.FeedID {
+			t.Errorf("Expected %+v parsed from the topic, got %+v", expected, busData)
+		}
+		if busData.GeohashHead != head || busData.GeohashFirstDeg != first || busData.GeohashSecondDeg != second || busData.GeohashThirdDeg != third {
+			t.Errorf("Expected the geohash levels of %f, %f in %s", expected.Latitude, expected.Longitude, positions[i].Topic())
+		}
+	}
+}
+
+func TestSimulatorFeedsThePipeline(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.Simulator.Vehicles = 4
+		cfg.Simulator.Interval = 20 * time.Millisecond
+	}})
+
+	h.WaitForWrites(t, 8)
+	vehicles := make(map[string]bool)
+	for _, busData := range h.Storage.Written() {
+		vehicles[busData.VehicleID] = true
+		if busData.RouteID != "2550" || busData.Latitude == 0 {
+			t.Errorf("Expected positions on the default route, got %+v", busData)
+		}
+	}
+	if len(vehicles) != 4 {
+		t.Errorf("Expected 4 simulated vehicles, got %v", vehicles)
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir := t.TempDir()
+	shapes := filepath.Join(dir, "shapes.txt")
+	if err := os.WriteFile(shapes, []byte("shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n"+
+		"1018_1,60.17,24.94,2\n1018_1,60.16,24.93,1\n1018_1,60.18,24.92,3\n4615_1,60.17,24.94,1\n4615_1,60.31,24.96,2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := simulator.LoadRoutes(shapes)
+	if err != nil {
+		t.Fatalf("LoadRoutes returned error: %v", err)
+	}
+	if len(routes) != 2 || routes[0].ID != "1018_1" || len(routes[0].Points) != 3 || routes[0].Points[0].Lat != 60.16 {
+		t.Errorf("Expected the shapes ordered by sequence, got %+v", routes)
+	}
+
+	routes, err = simulator.LoadRoutes("../cmd/finbus-sim/routes.example.yaml")
+	if err != nil {
+		t.Fatalf("LoadRoutes returned error: %v", err)
+	}
+	if len(routes) != 2 || routes[0].Headsigns[0] != "Kivihaka" || len(routes[0].Stops) != 3 || routes[1].Points[5].Lat != 60.31722 {
+		t.Errorf("Unexpected routes %+v", routes)
+	}
+
+	invalid := filepath.Join(dir, "routes.yaml")
+	if err := os.WriteFile(invalid, []byte("routes:\n  - id: x\n    points: [[60.1, 24.9]]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simulator.LoadRoutes(invalid); err == nil {
+		t.Error("Expected an error for a route with a single point")
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"bufio"
+	"errors"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/transport/sse"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type sseEvent struct {
+	id, name, data string
+	comment        bool
+}
+
+// startSSEServer starts an SSE server backed by fakes
+func startSSEServer(t *testing.T, options sse.Options) (*httptest.Server, chan models.BusMessage) {
+	return startSSEServerWithStorage(t, &fakeBusDataManager{}, options)
+}
+
+// startSSEServerWithStorage starts an SSE server storing bus data in storage
+func startSSEServerWithStorage(t *testing.T, storage *fakeBusDataManager, options sse.Options) (*httptest.Server, chan models.BusMessage) {
+	dataChannel := make(chan models.BusMessage)
+	service := services.NewBusDataService(storage, dataChannel, newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/stream", sse.NewStreamHandler(service, options, slog.Default()).HandleStream).Methods("GET")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, dataChannel
+}
+
+// openStream opens an event stream and returns a function reading the next event or comment
+func openStream(t *testing.T, url string, header http.Header) func() sseEvent {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d with Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	return func() sseEvent {
+		var event sseEvent
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("Stream closed")
+				}
+				switch {
+				case line == "" && (event.name != "" || event.comment):
+					return event
+				case strings.HasPrefix(line, ":"):
+					event.comment = true
+				case strings.HasPrefix(line, "id: "):
+					event.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					event.name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					event.data = strings.TrimPrefix(line, "data: ")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Timed out waiting for an event")
+			}
+		}
+	}
+}
+
+func TestSSEStreamsMatchingUpdates(t *testing.T) {
+	server, dataChannel := startSSEServer(t, sse.DefaultOptions())
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "20"}}
+
+	next := openStream(t, server.URL+"/api/v1/stream?route=550,551", nil)
+	snapshot := next()
+	if snapshot.name != "snapshot" || snapshot.id != "2" || !strings.Contains(snapshot.data, `"bus-1"`) || strings.Contains(snapshot.data, `"bus-2"`) {
+		t.Fatalf("Unexpected snapshot %+v", snapshot)
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-3", RouteID: "20"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-4", RouteID: "551"}}
+	update := next()
+	if update.name != "update" || update.id != "4" || !strings.Contains(update.data, `"bus-4"`) {
+		t.Errorf("Unexpected update %+v", update)
+	}
+}
+
+func TestSSESendsHeartbeats(t *testing.T) {
+	server, _ := startSSEServer(t, sse.Options{HeartbeatInterval: 20 * time.Millisecond})
+
+	next := openStream(t, server.URL+"/api/v1/stream?vehicle=bus-1", http.Header{"Last-Event-ID": {"7"}})
+	if event := next(); event.name != "snapshot" {
+		t.Fatalf("Expected snapshot, got %+v", event)
+	}
+	if event := next(); !event.comment {
+		t.Errorf("Expected heartbeat comment, got %+v", event)
+	}
+}
+
+func TestSSERejectsInvalidRequests(t *testing.T) {
+	server, _ := startSSEServer(t, sse.DefaultOptions())
+
+	for _, query := range []string{"", "?lat=60.1", "?route=550&last_event_id=abc"} {
+		resp, err := http.Get(server.URL + "/api/v1/stream" + query)
+		if err != nil {
+			t.Fatalf("GET returned error: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestSSEResumesFromLastEventID(t *testing.T) {
+	server, dataChannel := startSSEServer(t, sse.DefaultOptions())
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop1"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "20"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop2"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop3"}}
+
+	next := openStream(t, server.URL+"/api/v1/stream?route=550", http.Header{"Last-Event-ID": {"1"}})
+	for _, expected := range []struct{ id, stop string }{{"3", "stop2"}, {"4", "stop3"}} {
+		event := next()
+		if event.name != "update" || event.id != expected.id || !strings.Contains(event.data, expected.stop) {
+			t.Fatalf("Expected replayed update %s, got %+v", expected.id, event)
+		}
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop4"}}
+	if event := next(); event.name != "update" || event.id != "5" {
+		t.Errorf("Expected live update 5 after the replay, got %+v", event)
+	}
+}
+
+func TestSSEFallsBackToSnapshotWhenGapIsTooLarge(t *testing.T) {
+	server, dataChannel := startSSEServer(t, sse.DefaultOptions())
+
+	// Overflow the replay buffer so the first updates are no longer available
+	for i := 0; i < 10005; i++ {
+		dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550"}}
+	}
+
+	for _, lastID := range []string{"2", "99999"} {
+		next := openStream(t, server.URL+"/api/v1/stream?route=550", http.Header{"Last-Event-ID": {lastID}})
+		if event := next(); event.name != "snapshot" {
+			t.Errorf("Expected snapshot when resuming from %s, got %+v", lastID, event)
+		}
+	}
+}
+
+func TestSSESnapshotError(t *testing.T) {
+	server, _ := startSSEServerWithStorage(t, &fakeBusDataManager{findErr: errors.New("influxdb unavailable")}, sse.DefaultOptions())
+
+	// Without cached vehicles the area snapshot is read from the failing storage
+	resp, err := http.Get(server.URL + "/api/v1/stream?lat=60.17&lon=24.94")
+	if err != nil {
+		t.Fatalf("GET returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading the stream: %v", err)
+	}
+	if !strings.Contains(string(body), "event: error\ndata: {\"error\":\"error loading snapshot\"") {
+		t.Errorf("Expected an error event, got:\n%s", body)
+	}
+	if strings.Contains(string(body), "event: snapshot") {
+		t.Errorf("Expected no snapshot after the error, got:\n%s", body)
+	}
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"finbus/internal/config"
+	"finbus/internal/models"
+	"finbus/internal/schedule"
+	"finbus/internal/testharness"
+	"net/http"
+	"testing"
+)
+
+func loadTestFeed(t *testing.T) *schedule.Feed {
+	t.Helper()
+	feed, err := schedule.Load(writeGTFS(t, testGTFS))
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	return feed
+}
+
+func stopIDs(stops []*schedule.Stop) []string {
+	ids := make([]string, len(stops))
+	for i, stop := range stops {
+		ids[i] = stop.ID
+	}
+	return ids
+}
+
+func TestSearchStops(t *testing.T) {
+	feed := loadTestFeed(t)
+	if names := feed.Stops["1140449"].Names; names["sv"] != "Brändö" {
+		t.Errorf("Expected the Swedish name translated by name, got %v", names)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		// The exact name comes before the name it prefixes
+		{"Kulosaari", []string{"1140449", "1140447"}},
+		{"kulo", []string{"1140449", "1140447"}},
+		{"silta", []string{"1140447"}},
+		// Swedish names, with or without the accents
+		{"Brändö bro", []string{"1140447"}},
+		{"brando", []string{"1140449", "1140447"}},
+		// Stop codes
+		{"H3046", []string{"1130446"}},
+		// Typos
+		{"Kivihantie", []string{"1130446"}},
+		{"kulsaari", []string{"1140449", "1140447"}},
+		{"xyz", []string{}},
+		{"  ", []string{}},
+	}
+	for _, test := range tests {
+		ids := stopIDs(feed.SearchStops(test.query, 10))
+		if len(ids) != len(test.expected) {
+			t.Errorf("Expected %v for %q, got %v", test.expected, test.query, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.expected[i] {
+				t.Errorf("Expected %v for %q, got %v", test.expected, test.query, ids)
+				break
+			}
+		}
+	}
+
+	if stops := feed.SearchStops("kulo", 1); len(stops) != 1 {
+		t.Errorf("Expected the search to be limited to 1 stop, got %d", len(stops))
+	}
+}
+
+func TestStopsNear(t *testing.T) {
+	feed := loadTestFeed(t)
+	near := feed.StopsNear(60.1875, 25.0072, 500, 0)
+	if len(near) != 2 || near[0].Stop.ID != "1140447" || near[1].Stop.ID != "1140449" {
+		t.Fatalf("Expected the 2 Kulosaari stops nearest first, got %+v", near)
+	}
+	if near[0].Distance > 10 || near[1].Distance < 150 || near[1].Distance > 250 {
+		t.Errorf("Unexpected distances %.0f m and %.0f m", near[0].Distance, near[1].Distance)
+	}
+	if near := feed.StopsNear(60.1875, 25.0072, 100, 0); len(near) != 1 {
+		t.Errorf("Expected 1 stop within 100 m, got %+v", near)
+	}
+	if near := feed.StopsNear(60.1875, 25.0072, 50000, 2); len(near) != 2 {
+		t.Errorf("Expected the nearby stops to be limited to 2, got %+v", near)
+	}
+}
+
+func TestStopsAPI(t *testing.T) {
+	path := writeGTFS(t, testGTFS)
+	h := testharness.Start(t, testharness.Options{Configure: func(cfg *config.Config) {
+		cfg.GTFS.Path = path
+	}})
+
+	stops := getJSON[[]models.Stop](t, h.URL("/api/v1/stops?q=brando+bro"), http.StatusOK)
+	if len(stops) != 1 || stops[0].ID != "1140447" || stops[0].Names["sv"] != "Brändö bro" || stops[0].Distance != nil {
+		t.Fatalf("Expected Kulosaaren silta by its Swedish name, got %+v", stops)
+	}
+	if routes := stops[0].Routes; len(routes) != 1 || routes[0].ShortName != "550" || routes[0].LongName != "Itäkeskus(M)-Westendinasema" {
+		t.Errorf("Expected route 550 serving the stop, got %+v", routes)
+	}
+
+	stops = getJSON[[]models.Stop](t, h.URL("/api/v1/stops?lat=60.20442&lon=24.89764&radius=100"), http.StatusOK)
+	if len(stops) != 1 || stops[0].ID != "1130446" || stops[0].Distance == nil || *stops[0].Distance > 1 {
+		t.Fatalf("Expected Kivihaantie at the location, got %+v", stops)
+	}
+	if routes := stops[0].Routes; len(routes) != 1 || routes[0].ID != "1018" {
+		t.Errorf("Expected route 1018 serving the stop, got %+v", routes)
+	}
+
+	if stops := getJSON[[]models.Stop](t, h.URL("/api/v1/stops?lat=60.20442&lon=25.5"), http.StatusOK); len(stops) != 0 {
+		t.Errorf("Expected no stops within the default radius, got %+v", stops)
+	}
+	for _, query := range []string{"", "?lat=60.2", "?lat=north&lon=24.9", "?lat=60.2&lon=24.9&radius=10000", "?q=kulo&limit=0"} {
+		getJSON[[]models.Stop](t, h.URL("/api/v1/stops"+query), http.StatusBadRequest)
+	}
+
+	// Found stops feed the stop-based vehicle query as they are
+	h.App.Subscriber.ListenToAllTopics()
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
+	body, _ := json.Marshal(getJSON[[]models.Stop](t, h.URL("/api/v1/stops?q=kulosaaren"), http.StatusOK))
+	resp, err := http.Post(h.URL("/api/stops/get-busses/"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	var busData models.BusData
+	if err := json.NewDecoder(resp.Body).Decode(&busData); err != nil {
+		t.Fatalf("Error decoding bus data: %v", err)
+	}
+	if busData.VehicleID != "1362" {
+		t.Errorf("Expected vehicle 1362 heading to Kulosaaren silta, got %+v", busData)
+	}
+}
+
+func TestStopsAPIWithoutGTFS(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	getJSON[[]models.Stop](t, h.URL("/api/v1/stops?q=kulo"), http.StatusServiceUnavailable)
+}
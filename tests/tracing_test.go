@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"finbus/internal/config"
+	"finbus/internal/logging"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/tracing"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording spans in memory for the duration of the test
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestTracingFollowsBusDataThroughProcessing(t *testing.T) {
+	exporter := recordSpans(t)
+	dataChannel := make(chan models.BusMessage)
+	services.NewBusDataService(&fakeBusDataManager{}, dataChannel, newFakeSubscriber(), services.BusDataOptions{}, slog.Default())
+
+	ctx, message := tracing.Tracer().Start(context.Background(), "mqtt.message")
+	dataChannel <- models.BusMessage{Ctx: ctx, Data: models.BusData{VehicleID: "traced-1"}}
+	message.End()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if span, ok := findSpan(exporter.GetSpans(), "bus_data.process"); ok {
+			if span.Parent.SpanID() != message.SpanContext().SpanID() {
+				t.Errorf("Expected processing to be a child of the message span, got parent %s", span.Parent.SpanID())
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Expected a bus_data.process span")
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := recordSpans(t)
+	// The none exporter still installs the propagator continuing client traces
+	if _, err := tracing.Setup(context.Background(), config.TracingConfig{Exporter: "none"}); err != nil {
+		t.Fatalf("Setup returned error: %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware)
+	router.HandleFunc("/api/vehicles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed", http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/vehicles/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET returned error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if traceID := resp.Header.Get(tracing.TraceIDHeader); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the client's trace to be continued, got trace ID %q", traceID)
+	}
+	span, ok := findSpan(exporter.GetSpans(), "GET /api/vehicles/{id}")
+	if !ok {
+		t.Fatalf("Expected a span named after the route, got %v", exporter.GetSpans())
+	}
+	if span.Status.Description != http.StatusText(http.StatusInternalServerError) {
+		t.Errorf("Expected the span to record the server error, got status %+v", span.Status)
+	}
+}
+
+func TestLogsIncludeTraceID(t *testing.T) {
+	recordSpans(t)
+	var buf bytes.Buffer
+	logger, _ := logging.New(config.LogConfig{Level: "info", Format: "text", SampleEvery: 1}, &buf)
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "test")
+	defer span.End()
+	logger.ErrorContext(ctx, "Error writing to InfluxDB")
+
+	if expected := "trace_id=" + span.SpanContext().TraceID().String(); !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expected %q in %q", expected, buf.String())
+	}
+}
+
+func TestStdoutTraceExporterWritesFile(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	path := filepath.Join(t.TempDir(), "traces.json")
+
+	shutdown, err := tracing.Setup(context.Background(), config.TracingConfig{Exporter: "stdout", File: path, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Setup returned error: %v", err)
+	}
+	_, span := tracing.Tracer().Start(context.Background(), "influxdb.query")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading trace file: %v", err)
+	}
+	if !strings.Contains(string(data), `"Name":"influxdb.query"`) {
+		t.Errorf("Expected the span in the trace file, got %s", data)
+	}
+}
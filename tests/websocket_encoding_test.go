@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"finbus/internal/models"
+	"finbus/internal/transport/ws"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMessage holds the decoded string fields of a ServerMessage and its nested data message
+type protoMessage struct {
+	fields map[protowire.Number]string
+	data   map[protowire.Number]interface{}
+	seq    uint64
+}
+
+// decodeProtoFields decodes the scalar fields of a message, keeping the last value of repeated ones
+func decodeProtoFields(b []byte) map[protowire.Number]interface{} {
+	fields := map[protowire.Number]interface{}{}
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			fields[number] = protowire.DecodeZigZag(v)
+			b = b[m:]
+		case protowire.Fixed64Type:
+			bits, m := protowire.ConsumeFixed64(b)
+			fields[number] = math.Float64frombits(bits)
+			b = b[m:]
+		default:
+			s, m := protowire.ConsumeString(b)
+			fields[number] = s
+			b = b[m:]
+		}
+	}
+	return fields
+}
+
+// decodeProtoMessage decodes a ServerMessage following api/finbus.proto
+func decodeProtoMessage(t *testing.T, b []byte) protoMessage {
+	message := protoMessage{fields: map[protowire.Number]string{}, data: map[protowire.Number]interface{}{}}
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if number == 8 && typ == protowire.VarintType {
+			seq, m := protowire.ConsumeVarint(b[n:])
+			message.seq = seq
+			b = b[n+m:]
+			continue
+		}
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("Unexpected field %d of type %d", number, typ)
+		}
+		value, m := protowire.ConsumeBytes(b[n:])
+		b = b[n+m:]
+		if number != 5 {
+			message.fields[number] = string(value)
+			continue
+		}
+		message.data = decodeProtoFields(value)
+	}
+	return message
+}
+
+func readProtoMessage(t *testing.T, c *websocket.Conn) protoMessage {
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage returned error: %v", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("Expected a binary message, got type %d", messageType)
+	}
+	return decodeProtoMessage(t, data)
+}
+
+func TestWebSocketProtobufSubprotocol(t *testing.T) {
+	dialer := &websocket.Dialer{Subprotocols: []string{"finbus.v1.proto"}, EnableCompression: true}
+	options := ws.DefaultOptions()
+	options.EnableCompression = true
+	c, dataChannel, _, _ := startWebSocketServerWithDialer(t, options, dialer)
+
+	if c.Subprotocol() != "finbus.v1.proto" {
+		t.Fatalf("Expected the protobuf subprotocol to be negotiated, got %q", c.Subprotocol())
+	}
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "id": "r550", "routes": []string{"550"}})
+	if message := readProtoMessage(t, c); message.fields[1] != "ack" || message.fields[2] != "r550" || message.fields[3] != "subscribe" {
+		t.Fatalf("Expected subscribe ack, got %+v", message)
+	}
+	readProtoMessage(t, c)
+
+	onTime := 0
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", Latitude: 60.17, Delay: &onTime}}
+	message := readProtoMessage(t, c)
+	if message.fields[1] != "update" || message.seq != 1 || message.data[13] != "bus-1" || message.data[7] != "550" || message.data[20] != 60.17 {
+		t.Errorf("Unexpected update %+v", message)
+	}
+	if _, ok := message.data[1]; ok {
+		t.Error("Expected empty fields to be omitted")
+	}
+	if message.data[25] != int64(0) {
+		t.Errorf("Expected a zero delay to be sent as it is set, got %v", message.data[25])
+	}
+}
+
+func TestWebSocketProtobufOmitsZeroTimes(t *testing.T) {
+	predicted := time.Date(2024, 5, 14, 8, 5, 0, 0, time.UTC)
+	options := ws.DefaultOptions()
+	// A vehicle without a scheduled time, as it is not in the static schedule
+	options.Arrivals = &fakeArrivalService{arrivals: []models.Arrival{{StopID: "C", VehicleID: "1", PredictedAt: predicted, InSeconds: 300}}}
+	dialer := &websocket.Dialer{Subprotocols: []string{"finbus.v1.proto"}}
+	c, _, _, _ := startWebSocketServerWithDialer(t, options, dialer)
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "id": "c", "arrivals": "C"})
+	if message := readProtoMessage(t, c); message.fields[1] != "ack" {
+		t.Fatalf("Expected subscribe ack, got %+v", message)
+	}
+	message := readProtoMessage(t, c)
+	if message.fields[1] != "arrivals" {
+		t.Fatalf("Expected the arrivals of the stop, got %+v", message)
+	}
+	arrival := decodeProtoFields([]byte(message.fields[11]))
+	if _, ok := arrival[7]; ok {
+		t.Errorf("Expected the zero scheduled time to be omitted, got %v", arrival[7])
+	}
+	if arrival[8] != predicted.Unix() || arrival[2] != "1" {
+		t.Errorf("Expected vehicle 1 predicted at %d, got %+v", predicted.Unix(), arrival)
+	}
+}
+
+func TestWebSocketDefaultsToJSON(t *testing.T) {
+	c, _, _ := startProtocolServer(t)
+
+	if c.Subprotocol() != "" {
+		t.Errorf("Expected no subprotocol, got %q", c.Subprotocol())
+	}
+	_ = c.WriteJSON(map[string]interface{}{"type": "ping"})
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, _, err := c.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage {
+		t.Errorf("Expected a JSON text message, got type %d and error %v", messageType, err)
+	}
+}
+
+// protoFieldNumbers returns the field numbers of a message in api/finbus.proto by field name
+func protoFieldNumbers(t *testing.T, message string) map[string]protowire.Number {
+	content, err := os.ReadFile(filepath.Join("..", "api", "finbus.proto"))
+	if err != nil {
+		t.Fatalf("Error reading api/finbus.proto: %v", err)
+	}
+	body := regexp.MustCompile(`(?s)message ` + message + ` \{(.*?)\n\}`).FindSubmatch(content)
+	if body == nil {
+		t.Fatalf("No %s message in api/finbus.proto", message)
+	}
+	numbers := make(map[string]protowire.Number)
+	for _, field := range regexp.MustCompile(`(\w+) = (\d+);`).FindAllSubmatch(body[1], -1) {
+		number, _ := strconv.Atoi(string(field[2]))
+		numbers[string(field[1])] = protowire.Number(number)
+	}
+	return numbers
+}
+
+func TestWebSocketProtobufBusDataFields(t *testing.T) {
+	dialer := &websocket.Dialer{Subprotocols: []string{"finbus.v1.proto"}}
+	c, dataChannel, _, _ := startWebSocketServerWithDialer(t, ws.DefaultOptions(), dialer)
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"RouteID"}})
+	readProtoMessage(t, c)
+	readProtoMessage(t, c)
+
+	// Every string field is set to its Go name, so the decoded fields tell which field has which
+	// number
+	delay := 42
+	busData := models.BusData{Latitude: 60.17, Longitude: 24.94, Delay: &delay, DelayEstimated: true}
+	value := reflect.ValueOf(&busData).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() == reflect.String {
+			field.SetString(value.Type().Field(i).Name)
+		}
+	}
+	dataChannel <- models.BusMessage{Data: busData}
+	message := readProtoMessage(t, c)
+
+	numbers := protoFieldNumbers(t, "BusData")
+	// The decoder reads every varint as a sint64, so true decodes as -1
+	expected := map[string]interface{}{"latitude": 60.17, "longitude": 24.94, "delay": int64(42), "delay_estimated": int64(-1)}
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Type().Field(i); field.IsExported() && field.Type.Kind() == reflect.String {
+			expected[snakeCase(field.Name)] = field.Name
+		}
+	}
+	if len(expected) != len(numbers) {
+		t.Errorf("Expected the %d BusData fields in api/finbus.proto, got %v", len(expected), numbers)
+	}
+	for name, value := range expected {
+		number, ok := numbers[name]
+		if !ok {
+			t.Errorf("No %s field in the BusData message of api/finbus.proto", name)
+			continue
+		}
+		if message.data[number] != value {
+			t.Errorf("Expected field %d (%s) to be %v, got %v", number, name, value, message.data[number])
+		}
+	}
+}
+
+// snakeCase converts a Go field name such as GeohashFirstDeg or FeedID to geohash_first_deg or
+// feed_id
+func snakeCase(name string) string {
+	var b strings.Builder
+	previous := ' '
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(previous) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+		previous = r
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"finbus/internal/transport/ws"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketIdleTimeoutClosesSession(t *testing.T) {
+	c, _, _, handler := startWebSocketServer(t, ws.Options{
+		PingInterval: 20 * time.Millisecond,
+		IdleTimeout:  50 * time.Millisecond,
+	})
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}})
+	readWSMessage(t, c)
+	readWSMessage(t, c)
+	_ = c.WriteJSON(map[string]interface{}{"type": "unsubscribe"})
+	readWSMessage(t, c)
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("Expected a normal closure for an idle session, got %v", err)
+	}
+
+	waitForActiveSessions(t, handler, 0)
+	if stats := handler.Stats(); stats.TotalSessions != 1 || stats.MessagesSent != 3 {
+		t.Errorf("Unexpected stats after session closed: %+v", stats)
+	}
+}
+
+func TestWebSocketDeadConnectionIsDetected(t *testing.T) {
+	c, _, _, handler := startWebSocketServer(t, ws.Options{
+		PingInterval: 20 * time.Millisecond,
+		PongWait:     60 * time.Millisecond,
+	})
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}})
+	waitForActiveSessions(t, handler, 1)
+
+	// The client never reads, so pings are never answered and the server must give up
+	waitForActiveSessions(t, handler, 0)
+}
+
+func waitForActiveSessions(t *testing.T, handler ws.WebSocketHandler, expected int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for handler.Stats().ActiveSessions != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active sessions, got %d", expected, handler.Stats().ActiveSessions)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
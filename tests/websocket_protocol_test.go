@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"finbus/internal/config"
+	"finbus/internal/geo"
+	"finbus/internal/models"
+	"finbus/internal/services"
+	"finbus/internal/transport/ws"
+	"fmt"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+type wsMessage struct {
+	Type     string           `json:"type"`
+	ID       string           `json:"id"`
+	Command  string           `json:"command"`
+	Error    string           `json:"error"`
+	Seq      uint64           `json:"seq"`
+	Data     *models.BusData  `json:"data"`
+	Vehicles []models.BusData `json:"vehicles"`
+}
+
+// startProtocolServer starts a WebSocket server backed by fakes and dials it
+func startProtocolServer(t *testing.T) (*websocket.Conn, chan models.BusMessage, *fakeSubscriber) {
+	c, dataChannel, subscriber, _ := startWebSocketServer(t, ws.DefaultOptions())
+	return c, dataChannel, subscriber
+}
+
+// startWebSocketServer starts a WebSocket server with the given options and dials it
+func startWebSocketServer(t *testing.T, options ws.Options) (*websocket.Conn, chan models.BusMessage, *fakeSubscriber, ws.WebSocketHandler) {
+	return startWebSocketServerWithDialer(t, options, websocket.DefaultDialer)
+}
+
+// startWebSocketServerWithDialer starts a WebSocket server and dials it with the given dialer
+func startWebSocketServerWithDialer(t *testing.T, options ws.Options, dialer *websocket.Dialer) (*websocket.Conn, chan models.BusMessage, *fakeSubscriber, ws.WebSocketHandler) {
+	dataChannel := make(chan models.BusMessage)
+	subscriber := newFakeSubscriber()
+	service := services.NewBusDataService(&fakeBusDataManager{}, dataChannel, subscriber, services.BusDataOptions{}, slog.Default())
+	handler := ws.NewWebSocketHandler(service, options, slog.Default())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/bus-updates", handler.HandleBusUpdatesWS)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	c, _, err := dialer.Dial("ws"+server.URL[4:]+"/ws/bus-updates", nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c, dataChannel, subscriber, handler
+}
+
+func readWSMessage(t *testing.T, c *websocket.Conn) wsMessage {
+	var message wsMessage
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.ReadJSON(&message); err != nil {
+		t.Fatalf("ReadJSON returned error: %v", err)
+	}
+	return message
+}
+
+func TestWebSocketProtocolCommands(t *testing.T) {
+	c, dataChannel, subscriber := startProtocolServer(t)
+
+	commands := []map[string]interface{}{
+		{"type": "subscribe", "id": "r550", "routes": []string{"550"}},
+		{"type": "ping", "id": "p1"},
+		{"type": "unsubscribe", "id": "missing"},
+		{"type": "teleport"},
+	}
+	for _, command := range commands {
+		if err := c.WriteJSON(command); err != nil {
+			t.Fatalf("WriteJSON returned error: %v", err)
+		}
+	}
+
+	if message := readWSMessage(t, c); message.Type != "ack" || message.ID != "r550" || message.Command != "subscribe" {
+		t.Errorf("Expected subscribe ack, got %+v", message)
+	}
+	if message := readWSMessage(t, c); message.Type != "snapshot" || message.ID != "r550" {
+		t.Errorf("Expected subscribe snapshot, got %+v", message)
+	}
+	if message := readWSMessage(t, c); message.Type != "pong" || message.ID != "p1" {
+		t.Errorf("Expected pong, got %+v", message)
+	}
+	if message := readWSMessage(t, c); message.Type != "error" || message.Command != "unsubscribe" {
+		t.Errorf("Expected unsubscribe error, got %+v", message)
+	}
+	if message := readWSMessage(t, c); message.Type != "error" || message.Error == "" {
+		t.Errorf("Expected unknown command error, got %+v", message)
+	}
+
+	if !subscriber.subscribed(config.BuildTopic("550", "", "", "")) {
+		t.Error("Expected the route topic to be subscribed")
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "other", RouteID: "20"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550"}}
+	if message := readWSMessage(t, c); message.Type != "update" || message.Data == nil || message.Data.VehicleID != "bus-1" {
+		t.Errorf("Expected update for route 550 only, got %+v", message)
+	}
+}
+
+func TestWebSocketProtocolUpdateLocation(t *testing.T) {
+	c, dataChannel, subscriber := startProtocolServer(t)
+
+	_ = c.WriteJSON(map[string]interface{}{
+		"type": "subscribe", "area": map[string]float64{"latitude": 60.17, "longitude": 24.94},
+	})
+	readWSMessage(t, c)
+	readWSMessage(t, c)
+	_ = c.WriteJSON(map[string]interface{}{"type": "update_location", "latitude": 61.5, "longitude": 23.8})
+	if message := readWSMessage(t, c); message.Type != "ack" {
+		t.Fatalf("Expected update_location ack, got %+v", message)
+	}
+	if message := readWSMessage(t, c); message.Type != "snapshot" {
+		t.Fatalf("Expected snapshot of the new area, got %+v", message)
+	}
+
+	if subscriber.subscribed(config.BuildTopic("", "", "", "60;24")) {
+		t.Error("Expected the old area topic to be released")
+	}
+	if !subscriber.subscribed(config.BuildTopic("", "", "", "61;23")) {
+		t.Error("Expected the new area topic to be subscribed")
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "helsinki", GeohashHead: "60;24"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "tampere", GeohashHead: "61;23"}}
+	if message := readWSMessage(t, c); message.Data == nil || message.Data.VehicleID != "tampere" {
+		t.Errorf("Expected update from the new area, got %+v", message)
+	}
+}
+
+func TestWebSocketSubscribeSendsSnapshot(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "550", GeohashHead: "60;24"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", GeohashHead: "60;24"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", GeohashHead: "60;24", NextStop: "stop2"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-3", RouteID: "20", GeohashHead: "60;24"}}
+	// The data channel is unbuffered, so this send returns once the previous update is processed
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-4", RouteID: "20", GeohashHead: "61;23"}}
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "id": "r550", "routes": []string{"550"}})
+	readWSMessage(t, c)
+	message := readWSMessage(t, c)
+	if message.Type != "snapshot" || message.ID != "r550" {
+		t.Fatalf("Expected snapshot, got %+v", message)
+	}
+	if len(message.Vehicles) != 2 || message.Vehicles[0].VehicleID != "bus-1" || message.Vehicles[1].VehicleID != "bus-2" {
+		t.Fatalf("Expected route 550 vehicles in the snapshot, got %+v", message.Vehicles)
+	}
+	if message.Vehicles[0].NextStop != "stop2" {
+		t.Errorf("Expected the latest state of bus-1, got %+v", message.Vehicles[0])
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "550", NextStop: "stop3"}}
+	if message := readWSMessage(t, c); message.Type != "update" || message.Data.NextStop != "stop3" {
+		t.Errorf("Expected incremental update after the snapshot, got %+v", message)
+	}
+}
+
+func TestWebSocketSnapshotWhilePublishing(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: fmt.Sprint(i)}}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Every subscription is acknowledged and sent its snapshot before any live update, and live
+	// updates follow the snapshot without repeating what it covers
+	var lastSeq uint64
+	for round := 0; round < 20; round++ {
+		id := fmt.Sprintf("r%d", round)
+		_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "id": id, "routes": []string{"550"}})
+		acked := false
+		for {
+			message := readWSMessage(t, c)
+			if message.Type == "ack" && message.ID == id {
+				acked = true
+				continue
+			}
+			if message.Type == "snapshot" && message.ID == id {
+				if !acked {
+					t.Fatalf("Expected the snapshot of %s after its ack", id)
+				}
+				if message.Seq < lastSeq {
+					t.Fatalf("Expected the snapshot of %s after update %d, got %d", id, lastSeq, message.Seq)
+				}
+				lastSeq = message.Seq
+				break
+			}
+			if message.Type != "update" {
+				t.Fatalf("Unexpected message %+v", message)
+			}
+			if acked {
+				t.Fatalf("Expected the snapshot of %s before update %d", id, message.Seq)
+			}
+			if message.Seq <= lastSeq {
+				t.Fatalf("Expected updates after %d, got %d", lastSeq, message.Seq)
+			}
+			lastSeq = message.Seq
+		}
+		for i := 0; i < 5; i++ {
+			message := readWSMessage(t, c)
+			if message.Type != "update" || message.Seq <= lastSeq {
+				t.Fatalf("Expected an update after %d, got %+v", lastSeq, message)
+			}
+			lastSeq = message.Seq
+		}
+	}
+}
+
+func TestWebSocketLegacySnapshotOfManyVehicles(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	// More vehicles than the replies buffer holds, which the initial command must not block on
+	head := geo.GeohashHead(60.1699, 24.9384)
+	const vehicles = 40
+	for i := 0; i < vehicles; i++ {
+		dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: fmt.Sprintf("bus-%02d", i), RouteID: "550", GeohashHead: head}}
+	}
+	// The data channel is unbuffered, so this send returns once the previous updates are processed
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "elsewhere", RouteID: "550", GeohashHead: "61;23"}}
+
+	if err := c.WriteJSON(models.ClientCoords{Latitude: 60.1699, Longitude: 24.9384}); err != nil {
+		t.Fatalf("WriteJSON returned error: %v", err)
+	}
+	for i := 0; i < vehicles; i++ {
+		var busData models.BusData
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := c.ReadJSON(&busData); err != nil {
+			t.Fatalf("ReadJSON returned error after %d vehicles: %v", i, err)
+		}
+		if expected := fmt.Sprintf("bus-%02d", i); busData.VehicleID != expected || busData.GeohashHead != head {
+			t.Fatalf("Expected %s in %s, got %+v", expected, head, busData)
+		}
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-00", RouteID: "550", GeohashHead: head, NextStop: "stop2"}}
+	var busData models.BusData
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.ReadJSON(&busData); err != nil || busData.NextStop != "stop2" {
+		t.Errorf("Expected the live update after the snapshot, got %+v with %v", busData, err)
+	}
+}
@@ -3,41 +3,19 @@ package tests
 import (
 	"bytes"
 	"encoding/json"
-	"finbus/internal/database/influxdb"
 	"finbus/internal/models"
-	"finbus/internal/services"
-	"finbus/internal/transport/mqtt"
-	"finbus/internal/transport/rest"
-	"finbus/internal/transport/ws"
-	"fmt"
-	"github.com/gorilla/mux"
+	"finbus/internal/testharness"
 	"github.com/gorilla/websocket"
 	"io"
-	"log"
 	"net/http"
-	"net/http/httptest"
 	"testing"
 	"time"
 )
 
 func TestWebSocketBusUpdates(t *testing.T) {
-	busChannel := make(chan models.BusData)
-	router := mux.NewRouter()
+	h := testharness.Start(t, testharness.Options{})
 
-	dbManager, err := influxdb.NewBusDataManager()
-	if err != nil {
-		t.Errorf("Error connecting to InfluxDB, start the docker container to run this test: %v", err)
-	}
-	busDataSubscriber, _ := mqtt.NewBusDataSubscriber("mqtts://mqtt.digitransit.fi:8883", busChannel)
-	busDataService := services.NewBusDataService(dbManager, busChannel, busDataSubscriber)
-	webSocketHandler := ws.NewWebSocketHandler(busDataService)
-	router.HandleFunc("/ws/bus-updates", webSocketHandler.HandleBusUpdatesWS)
-	server := httptest.NewServer(router)
-	defer server.Close()
-
-	u := "ws" + server.URL[4:] + "/ws/bus-updates"
-
-	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	c, _, err := websocket.DefaultDialer.Dial(h.WebSocketURL("/ws/bus-updates"), nil)
 	if err != nil {
 		t.Fatalf("Dial returned error: %v", err)
 	}
@@ -54,7 +32,14 @@ func TestWebSocketBusUpdates(t *testing.T) {
 		t.Fatalf("WriteMessage returned error: %v", err)
 	}
 
+	// Publish the recorded buses once the area is subscribed to
+	waitFor(t, 5*time.Second, "area subscription", func() bool {
+		return h.App.Service.IngestionStatus().ActiveTopics == 1
+	})
+	h.PublishFixtures(t, testharness.HSLVehiclePositions)
+
 	// Read response and validate
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
 	_, message, err := c.ReadMessage()
 	if err != nil {
 		t.Fatalf("ReadMessage returned error: %v", err)
@@ -70,37 +55,22 @@ func TestWebSocketBusUpdates(t *testing.T) {
 	if busData.FeedFormat != "gtfsrt" {
 		t.Errorf("Expected FeedFormat to be 'gtfsrt', got %s", busData.FeedFormat)
 	}
-
+	if busData.VehicleID != "1362" || busData.GeohashHead != "60;24" {
+		t.Errorf("Expected vehicle 1362 in 60;24, got %s in %s", busData.VehicleID, busData.GeohashHead)
+	}
 }
 
 func TestHandleGetBusesFromStops(t *testing.T) {
-	busChannel := make(chan models.BusData)
-	router := mux.NewRouter()
-	influxdbClient, err := influxdb.NewBusDataManager()
-	if err != nil {
-		log.Fatalf("Error connecting to InfluxDB: %v", err)
-	}
-	defer influxdbClient.GetClient().Close()
-	fmt.Println("Connected to InfluxDB")
-
-	busDataSubscriber, _ := mqtt.NewBusDataSubscriber("mqtts://mqtt.digitransit.fi:8883", busChannel)
-	busDataService := services.NewBusDataService(influxdbClient, busChannel, busDataSubscriber)
-	busHandler := rest.NewBusHandler(busDataService)
-	router.HandleFunc("/api/stops/get-busses/", busHandler.HandleGetBusesFromStops).Methods("POST")
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
 
-	//Mock data
-	testData := models.BusData{NextStop: "stop1", VehicleID: "Bus123"}
-	busChannel <- testData
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
 
-	time.Sleep(1 * time.Second)
-
-	server := httptest.NewServer(router)
-	defer server.Close()
-
-	stops := []models.BusData{{NextStop: "stop1"}, {NextStop: "stop2"}}
+	stops := []models.BusData{{NextStop: "1140447"}, {NextStop: "stop2"}}
 	stopsJSON, _ := json.Marshal(stops)
 
-	resp, err := http.Post(server.URL+"/api/stops/get-busses/", "application/json", bytes.NewBuffer(stopsJSON))
+	resp, err := http.Post(h.URL("/api/stops/get-busses/"), "application/json", bytes.NewBuffer(stopsJSON))
 	if err != nil {
 		t.Fatalf("Failed to send POST request: %v", err)
 	}
@@ -127,8 +97,98 @@ func TestHandleGetBusesFromStops(t *testing.T) {
 		t.Errorf("Failed to decode response body: %v", err)
 	}
 
-	// Check if the busData has valid data, here you might check something more specific
-	if busData.VehicleID == "" {
-		t.Error("Expected non-empty VehicleID or valid bus data")
+	// The only bus recorded heading to one of the stops
+	if busData.VehicleID != "1362" {
+		t.Errorf("Expected vehicle 1362 heading to stop 1140447, got %q", busData.VehicleID)
+	}
+}
+
+func TestHandleGetBusesFromStopIDs(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
+
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
+
+	for _, body := range []string{`[{"id": "stop2"}, {"id": "1140447"}]`, `[{"stop_id": "1140447"}]`} {
+		resp, err := http.Post(h.URL("/api/stops/get-busses/"), "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("Failed to send POST request: %v", err)
+		}
+		var busData models.BusData
+		err = json.NewDecoder(resp.Body).Decode(&busData)
+		_ = resp.Body.Close()
+		if err != nil || busData.VehicleID != "1362" {
+			t.Errorf("Expected vehicle 1362 heading to the stops %s, got %+v (%v)", body, busData, err)
+		}
+	}
+
+	resp, err := http.Post(h.URL("/api/stops/get-busses/"), "application/json", bytes.NewBufferString(`[{"name": "Kulosaaren silta"}]`))
+	if err != nil {
+		t.Fatalf("Failed to send POST request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a stop without an ID, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestHarnessStoresRecordedPositions(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
+
+	recorded := h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	h.WaitForWrites(t, len(recorded))
+
+	written := h.Storage.Written()
+	for i, busData := range written {
+		if busData.FeedFormat != "gtfsrt" || busData.Mode != "BUS" || busData.Color != "007AC9" {
+			t.Errorf("Unexpected bus data parsed from %s: %+v", recorded[i].Topic, busData)
+		}
+	}
+	if written[0].VehicleID != "1362" || written[0].RouteID != "2550" || written[0].NextStop != "1140447" {
+		t.Errorf("Expected vehicle 1362 of route 2550 heading to 1140447 first, got %+v", written[0])
+	}
+
+	resp, err := http.Get(h.URL("/readyz"))
+	if err != nil {
+		t.Fatalf("Failed to get readiness: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the harness to be ready, got status %d", resp.StatusCode)
+	}
+}
+
+func TestAppCloseStopsSessionsAndIngestion(t *testing.T) {
+	h := testharness.Start(t, testharness.Options{})
+	h.App.Subscriber.ListenToAllTopics()
+
+	c, _, err := websocket.DefaultDialer.Dial(h.WebSocketURL("/ws/bus-updates"), nil)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer c.Close()
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}})
+	if message := readWSMessage(t, c); message.Type != "ack" {
+		t.Fatalf("Expected subscribe ack, got %+v", message)
+	}
+
+	h.App.Close()
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := c.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("Expected the session to be closed going away, got %v", err)
+			}
+			break
+		}
+	}
+
+	written := len(h.Storage.Written())
+	h.PublishFixtures(t, testharness.HSLVehiclePositions)
+	time.Sleep(100 * time.Millisecond)
+	if len(h.Storage.Written()) != written {
+		t.Errorf("Expected no bus updates stored after closing, got %d more", len(h.Storage.Written())-written)
 	}
 }
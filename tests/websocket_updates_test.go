@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"finbus/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsDeltaMessage struct {
+	Type    string                 `json:"type"`
+	Data    *models.BusData        `json:"data"`
+	Changes map[string]interface{} `json:"changes"`
+}
+
+func readWSDelta(t *testing.T, c interface {
+	ReadJSON(v interface{}) error
+	SetReadDeadline(time.Time) error
+}) wsDeltaMessage {
+	var message wsDeltaMessage
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.ReadJSON(&message); err != nil {
+		t.Fatalf("ReadJSON returned error: %v", err)
+	}
+	return message
+}
+
+func TestWebSocketDeltaUpdates(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop1"}}
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "configure", "delta": true})
+	readWSMessage(t, c)
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}})
+	readWSMessage(t, c)
+	if message := readWSMessage(t, c); message.Type != "snapshot" || len(message.Vehicles) != 1 {
+		t.Fatalf("Expected snapshot with bus-1, got %+v", message)
+	}
+
+	// Unchanged updates are skipped, so the next message is the delta for stop2
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop1"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop2"}}
+	message := readWSDelta(t, c)
+	if message.Type != "delta" || len(message.Changes) != 2 || message.Changes["NextStop"] != "stop2" || message.Changes["VehicleID"] != "bus-1" {
+		t.Fatalf("Expected delta with the changed stop, got %+v", message)
+	}
+
+	// Vehicles the client has not seen yet are sent in full
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "550", NextStop: "stop9"}}
+	if message := readWSDelta(t, c); message.Type != "update" || message.Data == nil || message.Data.NextStop != "stop9" {
+		t.Fatalf("Expected full update for a new vehicle, got %+v", message)
+	}
+}
+
+func TestWebSocketThrottledUpdates(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "configure", "max_rate": 5})
+	readWSMessage(t, c)
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}})
+	readWSMessage(t, c)
+	readWSMessage(t, c)
+
+	for _, stop := range []string{"stop1", "stop2", "stop3"} {
+		dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: stop}}
+	}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "550", NextStop: "stop7"}}
+
+	first, second := readWSMessage(t, c), readWSMessage(t, c)
+	if first.Data == nil || first.Data.VehicleID != "bus-1" || first.Data.NextStop != "stop3" {
+		t.Errorf("Expected the coalesced latest state of bus-1, got %+v", first)
+	}
+	if second.Data == nil || second.Data.VehicleID != "bus-2" {
+		t.Errorf("Expected bus-2 after bus-1, got %+v", second)
+	}
+}
+
+func TestWebSocketConfigureRejectsNegativeRate(t *testing.T) {
+	c, _, _ := startProtocolServer(t)
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "configure", "max_rate": -1})
+	if message := readWSMessage(t, c); message.Type != "error" || message.Command != "configure" {
+		t.Errorf("Expected configure error, got %+v", message)
+	}
+}
+
+func TestWebSocketResumeReplaysMissedUpdates(t *testing.T) {
+	c, dataChannel, _ := startProtocolServer(t)
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop1"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-2", RouteID: "20"}}
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop2"}}
+
+	_ = c.WriteJSON(map[string]interface{}{"type": "subscribe", "routes": []string{"550"}, "since": 1})
+	readWSMessage(t, c)
+
+	var message struct {
+		Type string          `json:"type"`
+		Seq  uint64          `json:"seq"`
+		Data *models.BusData `json:"data"`
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.ReadJSON(&message); err != nil {
+		t.Fatalf("ReadJSON returned error: %v", err)
+	}
+	if message.Type != "update" || message.Seq != 3 || message.Data.NextStop != "stop2" {
+		t.Fatalf("Expected replayed update 3, got %+v", message)
+	}
+
+	dataChannel <- models.BusMessage{Data: models.BusData{VehicleID: "bus-1", RouteID: "550", NextStop: "stop3"}}
+	if err := c.ReadJSON(&message); err != nil {
+		t.Fatalf("ReadJSON returned error: %v", err)
+	}
+	if message.Type != "update" || message.Seq != 4 {
+		t.Errorf("Expected live update 4, got %+v", message)
+	}
+}
+
+// busesNearCSV is the response of InfluxDB to the query of buses near 60;24, where line protocol
+// left out the empty route of bus-2 and the missing vehicle of the last position
+const busesNearCSV = `#datatype,string,long,string,string,string,string,string,string
+#group,false,false,true,true,true,true,true,true
+#default,_result,,,,,,,
+,result,table,_measurement,vehicle_id,route_id,geoHash_first,geoHash_second,geoHash_third
+,,0,busTelemetry,bus-1,550,1,2,3
+
+#datatype,string,long,string,string,string,string,string
+#group,false,false,true,true,true,true,true
+#default,_result,,,,,,
+,result,table,_measurement,vehicle_id,geoHash_first,geoHash_second,geoHash_third
+,,1,busTelemetry,bus-2,4,5,6
+
+#datatype,string,long,string,string,string,string
+#group,false,false,true,true,true,true
+#default,_result,,,,,
+,result,table,_measurement,geoHash_first,geoHash_second,geoHash_third
+,,2,busTelemetry,7,8,9
+
+`
+
+func TestFindBusesNearWithMissingTags(t *testing.T) {
+	influx := startFakeInfluxDB(t, busesNearCSV)
+	buses, err := influx.storage(t).FindBusesNear(context.Background(), "60;24")
+	if err != nil {
+		t.Fatalf("FindBusesNear returned error: %v", err)
+	}
+	if len(buses) != 2 || buses[0].VehicleID != "bus-1" || buses[0].RouteID != "550" || buses[0].GeohashThirdDeg != "3" ||
+		buses[1].VehicleID != "bus-2" || buses[1].RouteID != "" || buses[1].GeohashFirstDeg != "4" {
+		t.Errorf("Expected bus-1 on route 550 and bus-2 without a route, got %+v", buses)
+	}
+	if !strings.Contains(influx.lastQuery(), `r.geoHash_head == "60;24"`) {
+		t.Errorf("Expected the query of the geohash head, got %s", influx.lastQuery())
+	}
+}